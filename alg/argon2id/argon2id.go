@@ -0,0 +1,90 @@
+// password hashing with argon2id in the PHC string format
+package argon2id
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrInvalidHash = errors.New("invalid argon2id hash")
+
+type Params struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultParams follows the second recommended option of RFC 9106
+var DefaultParams = Params{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+var encoding = base64.RawStdEncoding
+
+// Hash returns the encoded hash: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func Hash(password string, p Params) (string, error) {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+func decode(encoded string) (*Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	p := new(Params)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	salt, err := encoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	key, err := encoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+// Verify checks the password against the encoded hash using the parameters stored in it
+func Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash returns true if the hash was created with parameters different from p
+func NeedsRehash(encoded string, p Params) bool {
+	hp, _, _, err := decode(encoded)
+	if err != nil {
+		return true
+	}
+	return hp.Memory != p.Memory || hp.Time != p.Time || hp.Threads != p.Threads || hp.KeyLen != p.KeyLen
+}
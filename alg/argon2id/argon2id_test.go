@@ -0,0 +1,28 @@
+package argon2id
+
+import (
+	"testing"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	p := Params{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+	h, err := Hash("correct horse", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Verify("correct horse", h); err != nil || !ok {
+		t.Fatal("password should match", err)
+	}
+	if ok, _ := Verify("wrong horse", h); ok {
+		t.Fatal("wrong password should not match")
+	}
+	if NeedsRehash(h, p) {
+		t.Fatal("hash with same parameters should not need rehash")
+	}
+	if !NeedsRehash(h, DefaultParams) {
+		t.Fatal("hash with other parameters should need rehash")
+	}
+	if _, err := Verify("x", "$argon2i$v=19$m=1024,t=1,p=1$AAAA$AAAA"); err == nil {
+		t.Fatal("non argon2id hash should be rejected")
+	}
+}
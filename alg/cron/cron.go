@@ -0,0 +1,157 @@
+// cron expressions of five fields, minute hour day-of-month month day-of-week, and the times they match.
+// Fields are *, numbers, ranges a-b, steps */n and a-b/n, and lists of them. Day of week 0 and 7 are sunday.
+package cron
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matches further than this are not searched, e.g. of 30 2 *
+const searchYears = 5
+
+var ErrNoMatch = errors.New("the expression matches no time")
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Schedule is a parsed expression, the bits of the values each field matches
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// with either day field *, both must match, otherwise one of them
+	domStar, dowStar bool
+}
+
+// Parse parses an expression of five fields separated by spaces
+func Parse(expr string) (*Schedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, errors.New("expected 5 fields: minute hour day-of-month month day-of-week")
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseField(parts[i], f)
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	s := &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}
+	// 7 is sunday as well
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var r uint64
+	for _, part := range strings.Split(s, ",") {
+		b, err := parseRange(part, f)
+		if err != nil {
+			return 0, err
+		}
+		r |= b
+	}
+	return r, nil
+}
+
+func parseRange(s string, f field) (uint64, error) {
+	invalid := errors.New("invalid " + f.name + ": " + s)
+	rng, step := s, 1
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 {
+			return 0, invalid
+		}
+		rng, step = s[:i], n
+	}
+	from, to := f.min, f.max
+	switch i := strings.IndexByte(rng, '-'); {
+	case rng == "*":
+	case i >= 0:
+		a, err1 := strconv.Atoi(rng[:i])
+		b, err2 := strconv.Atoi(rng[i+1:])
+		if err1 != nil || err2 != nil || a > b {
+			return 0, invalid
+		}
+		from, to = a, b
+	default:
+		a, err := strconv.Atoi(rng)
+		if err != nil {
+			return 0, invalid
+		}
+		// a/n is a to the max by n
+		from = a
+		if step == 1 {
+			to = a
+		}
+	}
+	if from < f.min || to > f.max {
+		return 0, errors.New(f.name + " out of range: " + s)
+	}
+	var r uint64
+	for v := from; v <= to; v += step {
+		r |= 1 << uint(v)
+	}
+	return r, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t the schedule matches, in the location of t
+func (s *Schedule) Next(t time.Time) (time.Time, error) {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + searchYears
+	// the next candidate, which never goes back on a repeated hour at the end of daylight saving time
+	advance := func(next time.Time) time.Time {
+		if !next.After(t) {
+			return t.Add(time.Minute)
+		}
+		return next
+	}
+	for t.Year() <= limit {
+		y, m, d := t.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			t = advance(time.Date(y, m+1, 1, 0, 0, 0, 0, loc))
+		case !s.dayMatches(t):
+			t = advance(time.Date(y, m, d+1, 0, 0, 0, 0, loc))
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = advance(time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc))
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrNoMatch
+}
@@ -0,0 +1,86 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for expr, valid := range map[string]bool{
+		"* * * * *":           true,
+		"*/15 2-4 1,15 * 1-5": true,
+		"0 0 * * 7":           true,
+		"5/10 * * * *":        true,
+		"* * * *":             false,
+		"60 * * * *":          false,
+		"* 24 * * *":          false,
+		"* * 0 * *":           false,
+		"* * * 13 *":          false,
+		"* * * * 8":           false,
+		"*/0 * * * *":         false,
+		"5-1 * * * *":         false,
+		"a * * * *":           false,
+	} {
+		if _, err := Parse(expr); (err == nil) != valid {
+			t.Error(expr, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	from := time.Date(2026, 10, 19, 10, 30, 20, 0, time.UTC) // monday
+	for _, c := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 19, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2026, 10, 20, 10, 30, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, 10, 19, 10, 40, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2026, 10, 19, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * 0", time.Date(2026, 10, 25, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2026, 10, 25, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 1 * 3", time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatal(c.expr, err)
+		}
+		next, err := s.Next(from)
+		if err != nil || !next.Equal(c.next) {
+			t.Error(c.expr, next, err)
+		}
+	}
+}
+
+func TestNextNoMatch(t *testing.T) {
+	s, err := Parse("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Next(time.Now()); err != ErrNoMatch {
+		t.Fatal(err)
+	}
+}
+
+func TestNextDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := Parse("30 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clocks go back from 03:00 to 02:00 on 2026-10-25, 02:30 happens twice
+	from := time.Date(2026, 10, 25, 0, 45, 0, 0, time.UTC) // 02:45 CEST
+	next, err := s.Next(from.In(loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Equal(time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC)) {
+		t.Fatal(next, next.UTC())
+	}
+}
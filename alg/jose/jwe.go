@@ -0,0 +1,166 @@
+package jose
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash"
+)
+
+const (
+	AlgRSAOAEP    = "RSA-OAEP"
+	AlgRSAOAEP256 = "RSA-OAEP-256"
+	AlgECDHES     = "ECDH-ES" // direct key agreement, without key wrapping
+
+	EncA256GCM = "A256GCM"
+)
+
+var ErrWeakKey = errors.New("rsa key shorter than 2048 bits")
+
+// JWEHeader is the protected header of a jwe
+type JWEHeader struct {
+	Alg string      `json:"alg"`
+	Enc string      `json:"enc"`
+	Kid string      `json:"kid,omitempty"`
+	Epk *JSONWebKey `json:"epk,omitempty"`
+}
+
+// KeyAlgorithm returns the key management algorithm to encrypt to the key: its alg, or RSA-OAEP-256
+// and ECDH-ES by key type
+func KeyAlgorithm(k *JSONWebKey) (string, error) {
+	if len(k.Use) > 0 && k.Use != "enc" {
+		return "", ErrUnsupportedKey
+	}
+	switch pub := k.Key.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return "", ErrWeakKey
+		}
+		switch k.Alg {
+		case "":
+			return AlgRSAOAEP256, nil
+		case AlgRSAOAEP, AlgRSAOAEP256:
+			return k.Alg, nil
+		}
+	case *ecdsa.PublicKey:
+		switch k.Alg {
+		case "", AlgECDHES:
+			return AlgECDHES, nil
+		}
+	default:
+		return "", ErrUnsupportedKey
+	}
+	return "", ErrUnsupportedAlgorithm
+}
+
+// concatKDF derives the content encryption key of ECDH-ES, RFC 7518 section 4.6.2
+func concatKDF(z []byte, enc string, apu, apv []byte, keyLen int) []byte {
+	var otherInfo []byte
+	for _, v := range [][]byte{[]byte(enc), apu, apv} { // AlgorithmID, PartyUInfo, PartyVInfo
+		otherInfo = append(otherInfo, lengthPrefixed(v)...)
+	}
+	otherInfo = append(otherInfo, uint32Bytes(uint32(keyLen*8))...) // SuppPubInfo
+
+	var key []byte
+	for counter := uint32(1); len(key) < keyLen; counter++ {
+		h := sha256.New()
+		h.Write(uint32Bytes(counter))
+		h.Write(z)
+		h.Write(otherInfo)
+		key = h.Sum(key)
+	}
+	return key[:keyLen]
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func lengthPrefixed(b []byte) []byte {
+	return append(uint32Bytes(uint32(len(b))), b...)
+}
+
+// ecdhSharedSecret is the x coordinate of the product, of the size of the curve
+func ecdhSharedSecret(pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) ([]byte, error) {
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, ErrUnsupportedKey
+	}
+	x, _ := pub.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	return x.FillBytes(make([]byte, size)), nil
+}
+
+func oaepHash(alg string) hash.Hash {
+	if alg == AlgRSAOAEP {
+		return sha1.New()
+	}
+	return sha256.New()
+}
+
+// EncryptCompact encrypts the payload to the public key with A256GCM, in compact serialization
+func EncryptCompact(payload []byte, k *JSONWebKey) (string, error) {
+	alg, err := KeyAlgorithm(k)
+	if err != nil {
+		return "", err
+	}
+	header := &JWEHeader{Alg: alg, Enc: EncA256GCM, Kid: k.Kid}
+	var cek, encryptedKey []byte
+	switch pub := k.Key.(type) {
+	case *rsa.PublicKey:
+		cek = make([]byte, 32)
+		if _, err := rand.Read(cek); err != nil {
+			return "", err
+		}
+		encryptedKey, err = rsa.EncryptOAEP(oaepHash(alg), rand.Reader, pub, cek, nil)
+		if err != nil {
+			return "", err
+		}
+	case *ecdsa.PublicKey:
+		ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		z, err := ecdhSharedSecret(pub, ephemeral)
+		if err != nil {
+			return "", err
+		}
+		cek = concatKDF(z, EncA256GCM, nil, nil, 32)
+		epk, err := PublicKeyToJWK(&ephemeral.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		header.Epk = epk
+	}
+
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := encodeSegment(hb)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	// the protected header is the additional authenticated data
+	sealed := gcm.Seal(nil, iv, payload, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	return protected + "." + encodeSegment(encryptedKey) + "." + encodeSegment(iv) + "." +
+		encodeSegment(ciphertext) + "." + encodeSegment(tag), nil
+}
@@ -0,0 +1,139 @@
+package jose
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// decrypt is what a client does with the private key
+func decrypt(t *testing.T, token string, priv interface{}) (*JWEHeader, string) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		t.Fatal("malformed jwe")
+	}
+	seg := make([][]byte, 5)
+	for i, p := range parts {
+		b, err := decodeSegment(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg[i] = b
+	}
+	header := new(JWEHeader)
+	if err := json.Unmarshal(seg[0], header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Enc != EncA256GCM {
+		t.Fatal(header.Enc)
+	}
+	var cek []byte
+	var err error
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		cek, err = rsa.DecryptOAEP(oaepHash(header.Alg), nil, k, seg[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		if header.Alg != AlgECDHES || len(seg[1]) != 0 || header.Epk == nil {
+			t.Fatal(header.Alg)
+		}
+		if err := ParseKey(header.Epk); err != nil {
+			t.Fatal(err)
+		}
+		z, err := ecdhSharedSecret(header.Epk.Key.(*ecdsa.PublicKey), k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cek = concatKDF(z, header.Enc, nil, nil, 32)
+	}
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, seg[2], append(seg[3], seg[4]...), []byte(parts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, string(plain)
+}
+
+func jwkOf(t *testing.T, pub interface{}, alg string) *JSONWebKey {
+	k, err := PublicKeyToJWK(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Kid = "k1"
+	k.Alg = alg
+	// round trip through json
+	b, _ := json.Marshal(k)
+	parsed := new(JSONWebKey)
+	if err := json.Unmarshal(b, parsed); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseKey(parsed); err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestEncryptCompact(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	cases := []struct {
+		priv     interface{}
+		key      *JSONWebKey
+		expected string
+	}{
+		{rsaKey, jwkOf(t, &rsaKey.PublicKey, ""), AlgRSAOAEP256},
+		{rsaKey, jwkOf(t, &rsaKey.PublicKey, AlgRSAOAEP), AlgRSAOAEP},
+		{p256, jwkOf(t, &p256.PublicKey, ""), AlgECDHES},
+		{p384, jwkOf(t, &p384.PublicKey, AlgECDHES), AlgECDHES},
+	}
+	payload := `{"address_list":{},"lease_id":"pg/db1/x"}`
+	for _, c := range cases {
+		token, err := EncryptCompact([]byte(payload), c.key)
+		if err != nil {
+			t.Fatal(c.expected, err)
+		}
+		header, plain := decrypt(t, token, c.priv)
+		if header.Alg != c.expected || header.Kid != "k1" || plain != payload {
+			t.Fatal(header.Alg, plain)
+		}
+	}
+}
+
+func TestKeyAlgorithm(t *testing.T) {
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signing := jwkOf(t, &ecKey.PublicKey, "")
+	signing.Use = "sig"
+	cases := map[*JSONWebKey]error{
+		jwkOf(t, &small.PublicKey, ""):               ErrWeakKey,
+		jwkOf(t, &rsaKey.PublicKey, "RSA1_5"):        ErrUnsupportedAlgorithm,
+		jwkOf(t, &ecKey.PublicKey, "ECDH-ES+A256KW"): ErrUnsupportedAlgorithm,
+		signing: ErrUnsupportedKey,
+	}
+	for k, expected := range cases {
+		if _, err := KeyAlgorithm(k); err != expected {
+			t.Error(k.Kty, k.Alg, err)
+		}
+	}
+}
+
+// RFC 7518 appendix C
+func TestConcatKDF(t *testing.T) {
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156,
+		251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	key := concatKDF(z, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	if encodeSegment(key) != "VqqN6vgjbSBcIijNcacQGg" {
+		t.Fatal(encodeSegment(key))
+	}
+}
@@ -0,0 +1,166 @@
+// minimal JOSE support: JWK, JWS verification, JWE encryption
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported jwk")
+
+// JSONWebKey is a public key in jwk format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	Key crypto.PublicKey `json:"-"`
+}
+
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := decodeSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrUnsupportedKey
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func curveByName(crv string) (elliptic.Curve, error) {
+	switch crv {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// ParseKey fills the public key of the jwk
+func ParseKey(k *JSONWebKey) error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return ErrUnsupportedKey
+		}
+		k.Key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		curve, err := curveByName(k.Crv)
+		if err != nil {
+			return err
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("ec point is not on curve")
+		}
+		k.Key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return ErrUnsupportedKey
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return ErrUnsupportedKey
+		}
+		k.Key = ed25519.PublicKey(x)
+	default:
+		return ErrUnsupportedKey
+	}
+	return nil
+}
+
+// ParseJWKS parses a key set. Keys of unsupported types are skipped.
+func ParseJWKS(b []byte) (*JSONWebKeySet, error) {
+	set := new(JSONWebKeySet)
+	if err := json.Unmarshal(b, set); err != nil {
+		return nil, err
+	}
+	var keys []*JSONWebKey
+	for _, k := range set.Keys {
+		if err := ParseKey(k); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key in jwks")
+	}
+	set.Keys = keys
+	return set, nil
+}
+
+// PublicKeyToJWK converts a public key to jwk format
+func PublicKeyToJWK(pub crypto.PublicKey) (*JSONWebKey, error) {
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		return &JSONWebKey{
+			Kty: "RSA",
+			N:   encodeSegment(p.N.Bytes()),
+			E:   encodeSegment(big.NewInt(int64(p.E)).Bytes()),
+			Key: p,
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (p.Curve.Params().BitSize + 7) / 8
+		return &JSONWebKey{
+			Kty: "EC",
+			Crv: p.Curve.Params().Name,
+			X:   encodeSegment(p.X.FillBytes(make([]byte, size))),
+			Y:   encodeSegment(p.Y.FillBytes(make([]byte, size))),
+			Key: p,
+		}, nil
+	case ed25519.PublicKey:
+		return &JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   encodeSegment(p),
+			Key: p,
+		}, nil
+	}
+	return nil, ErrUnsupportedKey
+}
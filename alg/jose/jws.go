@@ -0,0 +1,143 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrMalformed            = errors.New("malformed jws")
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	ErrInvalidSignature     = errors.New("invalid signature")
+)
+
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+func hashOf(alg string) (crypto.Hash, error) {
+	switch alg[len(alg)-3:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+	return 0, ErrUnsupportedAlgorithm
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput, sig []byte) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		if !ed25519.Verify(pub, signingInput, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return ErrUnsupportedAlgorithm
+	}
+	h, err := hashOf(alg)
+	if err != nil {
+		return err
+	}
+	hasher := h.New()
+	hasher.Write(signingInput)
+	digest := hasher.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		return rsa.VerifyPKCS1v15(pub, h, digest, sig)
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		return rsa.VerifyPSS(pub, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	// none and symmetric algorithms are never accepted
+	return ErrUnsupportedAlgorithm
+}
+
+// VerifyCompact verifies a compact serialized jws against the key set and returns its payload
+func VerifyCompact(token string, set *JSONWebKeySet) (*Header, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, ErrMalformed
+	}
+	hb, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	header := new(Header)
+	if err := json.Unmarshal(hb, header); err != nil {
+		return nil, nil, ErrMalformed
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	if len(header.Alg) == 0 {
+		return nil, nil, ErrUnsupportedAlgorithm
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	lastErr := ErrInvalidSignature
+	for _, k := range set.Keys {
+		if len(header.Kid) > 0 && k.Kid != header.Kid {
+			continue
+		}
+		if len(k.Alg) > 0 && k.Alg != header.Alg {
+			continue
+		}
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		err := verifySignature(header.Alg, k.Key, signingInput, sig)
+		if err == nil {
+			return header, payload, nil
+		}
+		if err == ErrUnsupportedAlgorithm {
+			return nil, nil, err
+		}
+		lastErr = ErrInvalidSignature
+	}
+	return nil, nil, lastErr
+}
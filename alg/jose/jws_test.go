@@ -0,0 +1,100 @@
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+)
+
+func sign(t *testing.T, alg, kid string, key crypto.Signer, payload string) string {
+	hb, _ := json.Marshal(Header{Alg: alg, Kid: kid, Typ: "JWT"})
+	input := encodeSegment(hb) + "." + encodeSegment([]byte(payload))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		d := sha256.Sum256([]byte(input))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, d[:])
+	case *ecdsa.PrivateKey:
+		d := sha256.Sum256([]byte(input))
+		r, s, e := ecdsa.Sign(rand.Reader, k, d[:])
+		err = e
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + encodeSegment(sig)
+}
+
+func keySet(t *testing.T, keys map[string]crypto.PublicKey) *JSONWebKeySet {
+	set := new(JSONWebKeySet)
+	for kid, pub := range keys {
+		jwk, err := PublicKeyToJWK(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwk.Kid = kid
+		set.Keys = append(set.Keys, jwk)
+	}
+	// round trip through json
+	b, _ := json.Marshal(set)
+	parsed, err := ParseJWKS(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestVerifyCompact(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	set := keySet(t, map[string]crypto.PublicKey{
+		"rsa": rsaKey.Public(),
+		"ec":  ecKey.Public(),
+		"ed":  edKey.Public(),
+	})
+
+	for _, c := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{
+		{"RS256", "rsa", rsaKey},
+		{"ES256", "ec", ecKey},
+		{"EdDSA", "ed", edKey},
+		{"ES256", "", ecKey},
+	} {
+		token := sign(t, c.alg, c.kid, c.key, `{"sub":"test"}`)
+		_, payload, err := VerifyCompact(token, set)
+		if err != nil {
+			t.Fatal(c.alg, err)
+		}
+		if string(payload) != `{"sub":"test"}` {
+			t.Fatal("unexpected payload:", string(payload))
+		}
+	}
+
+	if _, _, err := VerifyCompact(sign(t, "ES256", "ec", otherKey, `{}`), set); err == nil {
+		t.Fatal("token signed by unknown key should be rejected")
+	}
+	token := sign(t, "ES256", "ec", ecKey, `{"sub":"a"}`)
+	tampered := token[:len(token)-4] + "AAAA"
+	if _, _, err := VerifyCompact(tampered, set); err == nil {
+		t.Fatal("tampered token should be rejected")
+	}
+	none := encodeSegment([]byte(`{"alg":"none"}`)) + "." + encodeSegment([]byte(`{}`)) + "."
+	if _, _, err := VerifyCompact(none, set); err == nil {
+		t.Fatal("alg none should be rejected")
+	}
+}
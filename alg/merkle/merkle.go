@@ -0,0 +1,59 @@
+// keyed merkle tree: every node is an HMAC-SHA256 so the tree cannot be rebuilt without the key
+package merkle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+func DeriveKey(masterKey []byte, purpose string) []byte {
+	m := hmac.New(sha256.New, masterKey)
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+func LeafHash(key []byte, parts ...[]byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte{leafPrefix})
+	for _, p := range parts {
+		// length prefix to keep parts unambiguous
+		l := len(p)
+		m.Write([]byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l)})
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+func nodeHash(key, left, right []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte{nodePrefix})
+	m.Write(left)
+	m.Write(right)
+	return m.Sum(nil)
+}
+
+// Root computes the root of the leaves in the given order.
+// An odd node is promoted to the upper level unchanged.
+func Root(key []byte, leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nodeHash(key, nil, nil)
+	}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, nodeHash(key, level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		level = next
+	}
+	return level[0]
+}
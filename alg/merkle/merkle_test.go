@@ -0,0 +1,39 @@
+package merkle
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	key := DeriveKey([]byte("master"), "test")
+	leaves := [][]byte{
+		LeafHash(key, []byte("ns"), []byte("k1"), []byte("v1")),
+		LeafHash(key, []byte("ns"), []byte("k2"), []byte("v2")),
+		LeafHash(key, []byte("ns"), []byte("k3"), []byte("v3")),
+	}
+	r1 := Root(key, leaves)
+	r2 := Root(key, leaves)
+	if !bytes.Equal(r1, r2) {
+		t.Fatal("root is not stable")
+	}
+
+	changed := append([][]byte{}, leaves...)
+	changed[2] = LeafHash(key, []byte("ns"), []byte("k3"), []byte("v4"))
+	if bytes.Equal(r1, Root(key, changed)) {
+		t.Fatal("root does not change with leaf")
+	}
+	if bytes.Equal(r1, Root(key, leaves[:2])) {
+		t.Fatal("root does not change with removed leaf")
+	}
+	if bytes.Equal(r1, Root(DeriveKey([]byte("other"), "test"), leaves)) {
+		t.Fatal("root does not depend on key")
+	}
+}
+
+func TestLeafHashUnambiguous(t *testing.T) {
+	key := DeriveKey([]byte("master"), "test")
+	if bytes.Equal(LeafHash(key, []byte("ab"), []byte("c")), LeafHash(key, []byte("a"), []byte("bc"))) {
+		t.Fatal("leaf hash is ambiguous")
+	}
+}
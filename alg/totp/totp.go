@@ -0,0 +1,86 @@
+// time-based one-time password, RFC 6238 with HMAC-SHA1, 6 digits and 30 seconds steps
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 // seconds
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random base32 encoded secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	return encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// Step returns the time step of t
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+func code(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	m := hmac.New(sha1.New, key)
+	m.Write(msg)
+	sum := m.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// Code returns the code of the secret at the time step
+func Code(secret string, step int64) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, step), nil
+}
+
+// Validate checks the code against the steps around t allowing skew steps of clock drift.
+// It returns the matched step so callers can reject replays of a used code.
+func Validate(secret, c string, t time.Time, skew int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(c) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for s := now - skew; s <= now+skew; s++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, s)), []byte(c)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// URL returns the otpauth url for authenticator apps
+func URL(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(Period))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
@@ -0,0 +1,50 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// test vectors of RFC 6238 appendix B, sha1, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, c := range []struct {
+		t    int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		r, err := Code(secret, Step(time.Unix(c.t, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != c.code {
+			t.Fatal("unexpected code at", c.t, r)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	prev, _ := Code(secret, Step(now)-1)
+	if s, ok := Validate(secret, prev, now, 1); !ok || s != Step(now)-1 {
+		t.Fatal("code of previous step should be accepted")
+	}
+	old, _ := Code(secret, Step(now)-2)
+	if _, ok := Validate(secret, old, now, 1); ok {
+		t.Fatal("code out of skew should be rejected")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Fatal("short code should be rejected")
+	}
+}
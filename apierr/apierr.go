@@ -0,0 +1,151 @@
+// typed errors of the web api and the response envelope they are written with
+package apierr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type Code string
+
+// stable error codes, clients can switch on them
+const (
+	CodeValidationFailed    Code = "validation_failed"
+	CodeUnauthorized        Code = "unauthorized"
+	CodeForbidden           Code = "forbidden"
+	CodeNotFound            Code = "not_found"
+	CodeConflict            Code = "conflict"
+	CodeLocked              Code = "locked"
+	CodeTooLarge            Code = "too_large"
+	CodeInternal            Code = "internal"
+	CodeUnreachableDatabase Code = "unreachable_database"
+	CodeSealed              Code = "sealed"
+	CodeUnavailable         Code = "unavailable"
+)
+
+var httpStatus = map[Code]int{
+	CodeValidationFailed:    http.StatusBadRequest,
+	CodeUnauthorized:        http.StatusUnauthorized,
+	CodeForbidden:           http.StatusForbidden,
+	CodeNotFound:            http.StatusNotFound,
+	CodeConflict:            http.StatusConflict,
+	CodeLocked:              http.StatusLocked,
+	CodeTooLarge:            http.StatusRequestEntityTooLarge,
+	CodeInternal:            http.StatusInternalServerError,
+	CodeUnreachableDatabase: http.StatusBadGateway,
+	CodeSealed:              http.StatusServiceUnavailable,
+	CodeUnavailable:         http.StatusServiceUnavailable,
+}
+
+// HTTPStatus returns the status code responses with the error code are sent with
+func (c Code) HTTPStatus() int {
+	if s, ok := httpStatus[c]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is an error with a code, a message safe to show to clients and optional details.
+// The cause is only logged, never sent.
+type Error struct {
+	Code    Code
+	Message string
+	Details map[string]interface{}
+	Cause   error
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return string(e.Code) + ": " + e.Message + ": " + e.Cause.Error()
+	}
+	return string(e.Code) + ": " + e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is matches errors with the same code, so errors.Is(err, apierr.New(apierr.CodeNotFound, "")) works
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && (len(t.Message) == 0 || t.Message == e.Message)
+}
+
+// WithDetail returns a copy of the error with one more detail
+func (e *Error) WithDetail(key string, value interface{}) *Error {
+	n := *e
+	n.Details = make(map[string]interface{}, len(e.Details)+1)
+	for k, v := range e.Details {
+		n.Details[k] = v
+	}
+	n.Details[key] = value
+	return &n
+}
+
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func Wrap(code Code, message string, cause error) *Error {
+	return &Error{Code: code, Message: message, Cause: cause}
+}
+
+// From returns the typed error of err, an internal error if it has none
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return Internal(err)
+}
+
+// CodeOf returns the code of err, CodeInternal if it has none
+func CodeOf(err error) Code {
+	return From(err).Code
+}
+
+func Validation(message string) *Error {
+	return New(CodeValidationFailed, message)
+}
+
+// InvalidField is a validation error naming the offending field in details
+func InvalidField(field, message string) *Error {
+	return Validation(message).WithDetail("field", field)
+}
+
+func Unauthorized(message string) *Error {
+	return New(CodeUnauthorized, message)
+}
+
+func Forbidden() *Error {
+	return New(CodeForbidden, "permission denied")
+}
+
+// NotFound is the error of a missing resource of the given kind, e.g. NotFound("instance", "db1")
+func NotFound(kind, name string) *Error {
+	return New(CodeNotFound, kind+" not found").WithDetail(kind, name)
+}
+
+// Conflict is the error of a resource of the given kind which already exists
+func Conflict(kind, name string) *Error {
+	return New(CodeConflict, kind+" already exists").WithDetail(kind, name)
+}
+
+func Internal(cause error) *Error {
+	return Wrap(CodeInternal, "internal error", cause)
+}
+
+// UnreachableDatabase is the error of a managed database which cannot be connected to
+func UnreachableDatabase(address string, cause error) *Error {
+	return Wrap(CodeUnreachableDatabase, fmt.Sprintf("cannot connect to database %s", address), cause).
+		WithDetail("address", address)
+}
+
+func Sealed() *Error {
+	return New(CodeSealed, "nekoq-security is sealed")
+}
+
+func Unavailable(message string) *Error {
+	return New(CodeUnavailable, message)
+}
@@ -0,0 +1,108 @@
+package apierr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	cases := map[Code]int{
+		CodeValidationFailed:    http.StatusBadRequest,
+		CodeForbidden:           http.StatusForbidden,
+		CodeNotFound:            http.StatusNotFound,
+		CodeConflict:            http.StatusConflict,
+		CodeUnreachableDatabase: http.StatusBadGateway,
+		CodeSealed:              http.StatusServiceUnavailable,
+		Code("unknown"):         http.StatusInternalServerError,
+	}
+	for c, s := range cases {
+		if c.HTTPStatus() != s {
+			t.Fatal(c, c.HTTPStatus(), s)
+		}
+	}
+}
+
+func TestFrom(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := fmt.Errorf("rotate: %w", UnreachableDatabase("db1:5432", cause))
+	if CodeOf(err) != CodeUnreachableDatabase {
+		t.Fatal(CodeOf(err))
+	}
+	if !errors.Is(err, cause) {
+		t.Fatal("cause lost")
+	}
+	if !errors.Is(err, New(CodeUnreachableDatabase, "")) {
+		t.Fatal("code not matched")
+	}
+	if CodeOf(cause) != CodeInternal {
+		t.Fatal(CodeOf(cause))
+	}
+}
+
+func TestWithDetail(t *testing.T) {
+	e := InvalidField("password", "password too short")
+	e2 := e.WithDetail("min", 12)
+	if len(e.Details) != 1 || len(e2.Details) != 2 {
+		t.Fatal(e.Details, e2.Details)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.Use(RequestId())
+	g.GET("/internal", func(ctx *gin.Context) {
+		Abort(ctx, errors.New("secret detail"))
+	})
+	g.GET("/sealed", func(ctx *gin.Context) {
+		Abort(ctx, Sealed())
+	})
+	g.GET("/missing", func(ctx *gin.Context) {
+		Abort(ctx, NotFound("instance", "db1"))
+	})
+
+	do := func(path, requestId string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(requestId) > 0 {
+			req.Header.Set(RequestIdHeader, requestId)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		body := make(map[string]interface{})
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return w, body
+	}
+
+	w, body := do("/internal", "")
+	if w.Code != http.StatusInternalServerError || body["code"] != "internal" || body["message"] != "internal error" {
+		t.Fatal(w.Code, body)
+	}
+	if len(w.Header().Get(RequestIdHeader)) == 0 || body["request_id"] != w.Header().Get(RequestIdHeader) {
+		t.Fatal("request id", w.Header(), body)
+	}
+
+	w, body = do("/sealed", "abc-123")
+	if w.Code != http.StatusServiceUnavailable || body["status"] != float64(-1) || w.Header().Get("Retry-After") != "10" {
+		t.Fatal(w.Code, w.Header(), body)
+	}
+	if body["request_id"] != "abc-123" {
+		t.Fatal(body)
+	}
+
+	w, body = do("/missing", "bad id with spaces")
+	details, _ := body["details"].(map[string]interface{})
+	if w.Code != http.StatusNotFound || body["status"] != float64(1) || details["instance"] != "db1" {
+		t.Fatal(w.Code, body)
+	}
+	if body["request_id"] == "bad id with spaces" {
+		t.Fatal("invalid request id kept")
+	}
+}
@@ -0,0 +1,74 @@
+package apierr
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	RequestIdHeader = "X-Request-Id"
+
+	requestIdKey = "nekoq.request_id"
+
+	// seconds a client should wait before retrying a request refused while sealed or unavailable
+	RetryAfterSeconds = 10
+)
+
+// ids given by a proxy in front are kept when they look sane
+var requestIdPattern = regexp.MustCompile("^[A-Za-z0-9._:-]{1,128}$")
+
+// RequestId assigns every request an id, sent back in the X-Request-Id header and in error responses.
+// It has to be the first middleware so the audit log records the same id.
+func RequestId() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(RequestIdHeader)
+		if !requestIdPattern.MatchString(id) {
+			id = uuid.NewV4().String()
+		}
+		ctx.Set(requestIdKey, id)
+		ctx.Header(RequestIdHeader, id)
+		ctx.Next()
+	}
+}
+
+// RequestIdOf returns the id of the request, empty without the RequestId middleware
+func RequestIdOf(ctx *gin.Context) string {
+	return ctx.GetString(requestIdKey)
+}
+
+// Body is the envelope of error responses
+func Body(ctx *gin.Context, e *Error) gin.H {
+	status := 1
+	if e.Code.HTTPStatus() == http.StatusServiceUnavailable {
+		// the request may succeed later, not a client error
+		status = -1
+	}
+	h := gin.H{
+		"status":     status,
+		"code":       e.Code,
+		"message":    e.Message,
+		"request_id": RequestIdOf(ctx),
+	}
+	if len(e.Details) > 0 {
+		h["details"] = e.Details
+	}
+	return h
+}
+
+// Abort writes err in the error envelope with the status of its code and stops the handler chain.
+// Errors without a code are sent as internal errors, without their text.
+func Abort(ctx *gin.Context, err error) {
+	e := From(err)
+	if e.Code == CodeSealed || e.Code == CodeUnavailable {
+		ctx.Header("Retry-After", strconv.Itoa(RetryAfterSeconds))
+	}
+	if e.Cause != nil {
+		// recorded as the error of the audit entry
+		_ = ctx.Error(e)
+	}
+	ctx.AbortWithStatusJSON(e.Code.HTTPStatus(), Body(ctx, e))
+}
@@ -0,0 +1,227 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// polled by load balancers, not audited
+var skipPaths = map[string]bool{
+	"/sys/health":    true,
+	"/sys/ready":     true,
+	"/v1/sys/health": true,
+	"/v1/sys/ready":  true,
+	"/metrics":       true,
+}
+
+var (
+	devices    *broker
+	failClosed bool
+	maxBody    int64
+	keyFn      func() []byte
+)
+
+// Init opens the audit devices. key returns the HMAC key of secrets, nil while locked.
+func Init(ac *config.AuditConfig, key func() []byte) error {
+	if !ac.Enable {
+		return nil
+	}
+	b := &broker{key: key}
+	for i := range ac.Devices {
+		d, err := newDevice(&ac.Devices[i], ac.FailClosed)
+		if err != nil {
+			return err
+		}
+		// continue the chain of the first file
+		if f, ok := d.(*fileDevice); ok && len(b.lastHash) == 0 {
+			h, err := f.lastHash()
+			if err != nil {
+				return err
+			}
+			b.lastHash = h
+		}
+		b.devices = append(b.devices, d)
+	}
+	devices = b
+	failClosed = ac.FailClosed
+	maxBody = int64(ac.MaxBodyKB) * 1024
+	keyFn = key
+	return nil
+}
+
+func write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return devices.write(b)
+}
+
+// bodyWriter keeps a copy of the response body. With hold, nothing is sent before flush.
+type bodyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+	hold bool
+}
+
+func (w *bodyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	if w.hold {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	if w.hold {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *bodyWriter) WriteHeaderNow() {
+	if !w.hold {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *bodyWriter) Flush() {
+	if !w.hold {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *bodyWriter) Written() bool {
+	return w.body.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// flush sends the held response
+func (w *bodyWriter) flush() {
+	if w.body.Len() == 0 {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	if _, err := w.ResponseWriter.Write(w.body.Bytes()); err != nil {
+		logging.Error("audit write response error", logging.Err(err))
+	}
+}
+
+func refuse(ctx *gin.Context, w gin.ResponseWriter) {
+	e := apierr.Unavailable("audit log unavailable")
+	b, err := json.Marshal(apierr.Body(ctx, e))
+	if err != nil {
+		logging.FromContext(ctx).Error("audit marshal refusal error", logging.Err(err))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(apierr.RetryAfterSeconds))
+	w.WriteHeader(e.Code.HTTPStatus())
+	w.Write(b)
+}
+
+// Middleware records the request before it is handled and the response after.
+// In fail-closed mode a request is refused when its entries cannot be recorded,
+// and the response is held back until it is recorded. A request body larger than
+// the cap is recorded truncated and the request is refused.
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if devices == nil || skipPaths[ctx.Request.URL.Path] {
+			ctx.Next()
+			return
+		}
+		start := time.Now()
+		body, err := ioutil.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxBody))
+		// the reader stops with an error once the cap is reached
+		truncated := err != nil && int64(len(body)) == maxBody
+		if err != nil && !truncated {
+			logging.Error("audit read request body error", logging.Err(err))
+		}
+		ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		key := keyFn()
+		req := &Request{
+			Method:     ctx.Request.Method,
+			Path:       ctx.Request.URL.Path,
+			Query:      sanitizeQuery(key, ctx.Request.URL.Query()),
+			RemoteAddr: config.RemoteIP(ctx.Request),
+			Body:       sanitizeBody(key, body),
+			Truncated:  truncated,
+		}
+		id := apierr.RequestIdOf(ctx)
+		if len(id) == 0 {
+			id = uuid.NewV4().String()
+		}
+		err = write(&Entry{
+			Type:      TypeRequest,
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			RequestId: id,
+			Request:   req,
+		})
+		if err != nil {
+			logging.Error("audit request error", logging.Err(err))
+			if failClosed {
+				refuse(ctx, ctx.Writer)
+				ctx.Abort()
+				return
+			}
+		}
+
+		w := &bodyWriter{ResponseWriter: ctx.Writer, hold: failClosed}
+		ctx.Writer = w
+		if truncated {
+			apierr.Abort(ctx, apierr.New(apierr.CodeTooLarge, "request body too large"))
+		} else {
+			ctx.Next()
+		}
+		ctx.Writer = w.ResponseWriter
+
+		// the key is available in the response of the unlock request
+		key = keyFn()
+		e := &Entry{
+			Type:      TypeResponse,
+			Time:      time.Now().UTC().Format(time.RFC3339Nano),
+			RequestId: id,
+			Request:   req,
+			Response: &Response{
+				StatusCode: w.Status(),
+				Body:       sanitizeBody(key, w.body.Bytes()),
+				DurationMs: time.Since(start).Milliseconds(),
+			},
+		}
+		if t := auth.CurrentToken(ctx); t != nil {
+			e.Auth = &Auth{
+				Accessor:    t.Accessor,
+				DisplayName: t.DisplayName,
+				TokenType:   t.Type,
+				PolicyNames: t.PolicyNames,
+			}
+		}
+		if len(ctx.Errors) > 0 {
+			e.Error = ctx.Errors.String()
+		}
+		err = write(e)
+		if err != nil {
+			logging.Error("audit response error", logging.Err(err))
+		}
+		if !w.hold {
+			return
+		}
+		if err != nil {
+			refuse(ctx, w.ResponseWriter)
+			return
+		}
+		w.flush()
+	}
+}
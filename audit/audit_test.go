@@ -0,0 +1,296 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSanitizeBody(t *testing.T) {
+	key := []byte("audit-key")
+	b := sanitizeBody(key, []byte(`{"status":0,"result":{"address_list":{"a":{"port":5432,"user_map":{"u":{"user_name":"u","password":"s3cret"}}}}}}`))
+	if bytes.Contains(b, []byte("s3cret")) {
+		t.Fatal("secret in clear text:", string(b))
+	}
+	if !bytes.Contains(b, []byte(HashValue(key, "s3cret"))) || !bytes.Contains(b, []byte(`"port":5432`)) {
+		t.Fatal("unexpected body:", string(b))
+	}
+	if b := sanitizeBody(nil, []byte(`{"key":"shard"}`)); string(b) != `{"key":"redacted"}` {
+		t.Fatal("unexpected body without key:", string(b))
+	}
+	if b := sanitizeBody(key, []byte("not json")); bytes.Contains(b, []byte("not json")) {
+		t.Fatal("non json body in clear text")
+	}
+}
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	// the first entry is written while locked
+	var key []byte
+
+	open := func() *broker {
+		d, err := openFileDevice(&config.AuditDeviceConfig{Type: config.AuditDeviceFile, Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := d.lastHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &broker{lastHash: h, devices: []device{d}, key: func() []byte { return key }}
+	}
+	b := open()
+	for _, v := range []string{"a", "b"} {
+		if v == "b" {
+			key = []byte("secret key")
+		}
+		e, _ := json.Marshal(&Entry{Type: TypeRequest, RequestId: v, Request: &Request{Path: "/" + v}})
+		if err := b.write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.devices[0].(*fileDevice).f.Close()
+	// continue the chain after reopen
+	b = open()
+	e, _ := json.Marshal(&Entry{Type: TypeRequest, RequestId: "c", Request: &Request{Path: "/c"}})
+	if err := b.write(e); err != nil {
+		t.Fatal(err)
+	}
+	b.devices[0].(*fileDevice).f.Close()
+
+	report, err := VerifyFile(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || report.Entries != 3 || report.Unkeyed != 1 || report.Unchecked != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	// without key only the links are checked
+	report, err = VerifyFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || report.Entries != 3 || report.Unchecked != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	// an edited entry chained again without the key
+	forged := func() []string {
+		var r []string
+		prev := ""
+		for i, l := range lines {
+			rec := new(record)
+			json.Unmarshal([]byte(l), rec)
+			if i == 1 {
+				rec.Entry = json.RawMessage(strings.Replace(string(rec.Entry), `"/b"`, `"/x"`, 1))
+			}
+			b, h, _ := makeRecord(nil, prev, rec.Entry)
+			r = append(r, strings.TrimSpace(string(b)))
+			prev = h
+		}
+		return r
+	}
+	for _, c := range []struct {
+		name  string
+		lines []string
+		line  int
+	}{
+		{"edited", []string{lines[0], strings.Replace(lines[1], `"/b"`, `"/x"`, 1), lines[2]}, 2},
+		{"deleted", []string{lines[0], lines[2]}, 2},
+		{"reordered", []string{lines[1], lines[0], lines[2]}, 2},
+		{"rechained", forged(), 1},
+	} {
+		report, err := Verify(strings.NewReader(strings.Join(c.lines, "\n")), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Valid || report.Line != c.line {
+			t.Fatalf("%s: unexpected report %+v", c.name, report)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	d, err := openFileDevice(&config.AuditDeviceConfig{Type: config.AuditDeviceFile, Path: path, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.maxSize = 1024
+	b := &broker{devices: []device{d}}
+	for i := 0; i < 40; i++ {
+		e, _ := json.Marshal(&Entry{Type: TypeRequest, RequestId: strings.Repeat("x", 100), Request: &Request{Path: "/"}})
+		if err := b.write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.f.Close()
+	if exists(path + ".3") {
+		t.Fatal("rotated files should be limited")
+	}
+	// rotated files continue the chain of each other
+	var prev string
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		report, err := VerifyFile(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Valid || report.Entries == 0 {
+			t.Fatalf("unexpected report of %s: %+v", p, report)
+		}
+		if len(prev) > 0 && report.FirstPrev != prev {
+			t.Fatal("chain broken between rotated files")
+		}
+		prev = report.LastHash
+	}
+	if prev != b.lastHash {
+		t.Fatal("unexpected last hash")
+	}
+}
+
+type failingDevice struct {
+}
+
+func (d failingDevice) name() string {
+	return "failing"
+}
+
+func (d failingDevice) write(line []byte) error {
+	return errQueueFull
+}
+
+func TestBrokerAcceptedByAnyDevice(t *testing.T) {
+	b := &broker{devices: []device{failingDevice{}}}
+	if err := b.write([]byte(`{}`)); err != ErrNoDevice {
+		t.Fatal("entry should be refused without any device accepting it")
+	}
+	if len(b.lastHash) > 0 {
+		t.Fatal("refused entry should not advance the chain")
+	}
+	w := newWebhookDevice(&config.AuditDeviceConfig{URL: "http://127.0.0.1:1", BatchSize: 10, FlushIntervalMs: 1000, QueueSize: 10})
+	b.devices = append(b.devices, w)
+	if err := b.write([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBrokerWaitsForSyncDelivery(t *testing.T) {
+	var status int32 = http.StatusOK
+	var received int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var records []record
+		json.NewDecoder(r.Body).Decode(&records)
+		atomic.AddInt32(&received, int32(len(records)))
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	// the flush interval is never waited for
+	d, err := newDevice(&config.AuditDeviceConfig{Type: config.AuditDeviceWebhook, URL: srv.URL,
+		BatchSize: 10, FlushIntervalMs: 3600 * 1000, QueueSize: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{devices: []device{d}}
+	if err := b.write([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&received) != 1 {
+		t.Fatal("entry accepted before it was delivered")
+	}
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if err := b.write([]byte(`{}`)); err != ErrNoDevice {
+		t.Fatal("undelivered entry should be refused:", err)
+	}
+}
+
+// memoryDevice keeps the entries written to it
+type memoryDevice struct {
+	entries []*Entry
+}
+
+func (d *memoryDevice) name() string {
+	return "memory"
+}
+
+func (d *memoryDevice) write(line []byte) error {
+	rec := new(record)
+	if err := json.Unmarshal(line, rec); err != nil {
+		return err
+	}
+	e := new(Entry)
+	if err := json.Unmarshal(rec.Entry, e); err != nil {
+		return err
+	}
+	d.entries = append(d.entries, e)
+	return nil
+}
+
+func TestMiddlewareBodyCap(t *testing.T) {
+	d := &memoryDevice{}
+	devices, maxBody, keyFn = &broker{devices: []device{d}}, 1024, func() []byte { return []byte("audit-key") }
+	t.Cleanup(func() {
+		devices, maxBody, keyFn = nil, 0, nil
+	})
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(Middleware())
+	e.POST("/echo", func(ctx *gin.Context) {
+		b, _ := ioutil.ReadAll(ctx.Request.Body)
+		ctx.JSON(http.StatusOK, gin.H{"status": 0, "result": len(b)})
+	})
+
+	for _, c := range []struct {
+		size      int
+		code      int
+		truncated bool
+	}{
+		{1024, http.StatusOK, false},
+		{1025, http.StatusRequestEntityTooLarge, true},
+		{1 << 20, http.StatusRequestEntityTooLarge, true},
+	} {
+		d.entries = nil
+		body := `{"password":"` + strings.Repeat("x", c.size-15) + `"}`
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body)))
+		if w.Code != c.code {
+			t.Error(c.size, w.Code, w.Body.String())
+		}
+		if len(d.entries) != 2 {
+			t.Fatal(c.size, "entries:", len(d.entries))
+		}
+		for _, entry := range d.entries {
+			if entry.Request.Truncated != c.truncated || bytes.Contains(entry.Request.Body, []byte("xxx")) {
+				t.Error(c.size, entry.Type, "truncated:", entry.Request.Truncated, "body:", len(entry.Request.Body))
+			}
+		}
+		if entry := d.entries[1]; entry.Response.StatusCode != c.code {
+			t.Error(c.size, "recorded status:", entry.Response.StatusCode)
+		}
+	}
+}
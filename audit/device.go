@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"errors"
+	"sync"
+
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+)
+
+var ErrNoDevice = errors.New("no audit device accepted the entry")
+
+// device receives every record as one json line
+type device interface {
+	name() string
+	write(line []byte) error
+}
+
+// syncDevice delivers records after they are queued in the order of the chain
+type syncDevice interface {
+	device
+	deliver(line []byte) (<-chan error, error)
+}
+
+// newDevice opens the device, in fail-closed mode the records of remote devices count once delivered
+func newDevice(dc *config.AuditDeviceConfig, failClosed bool) (device, error) {
+	switch dc.Type {
+	case config.AuditDeviceFile:
+		return openFileDevice(dc)
+	case config.AuditDeviceSyslog:
+		return openSyslogDevice(dc)
+	case config.AuditDeviceWebhook:
+		if failClosed {
+			return &syncWebhookDevice{newWebhookDevice(dc)}, nil
+		}
+		return newWebhookDevice(dc), nil
+	}
+	return nil, errors.New("unknown audit device type")
+}
+
+// broker chains the entries and sends the records to all devices
+type broker struct {
+	lock     sync.Mutex
+	lastHash string
+	devices  []device
+	key      func() []byte // key of secrets, nil while locked
+}
+
+// write succeeds when at least one device accepted the record, or delivered it for synchronous devices
+func (b *broker) write(entry []byte) error {
+	b.lock.Lock()
+	var key []byte
+	if b.key != nil {
+		key = chainKey(b.key())
+	}
+	line, hash, err := makeRecord(key, b.lastHash, entry)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	accepted := false
+	var pending []syncDevice
+	var results []<-chan error
+	for _, d := range b.devices {
+		if sd, ok := d.(syncDevice); ok {
+			done, err := sd.deliver(line)
+			if err != nil {
+				logging.Error("audit device error", logging.F("device", d.name()), logging.Err(err))
+				continue
+			}
+			pending = append(pending, sd)
+			results = append(results, done)
+			continue
+		}
+		if err := d.write(line); err != nil {
+			logging.Error("audit device error", logging.F("device", d.name()), logging.Err(err))
+			continue
+		}
+		accepted = true
+	}
+	if !accepted && len(pending) == 0 {
+		b.lock.Unlock()
+		return ErrNoDevice
+	}
+	b.lastHash = hash
+	b.lock.Unlock()
+
+	// the deliveries of records are waited for outside of the lock, so they are batched
+	for i, d := range pending {
+		if err := <-results[i]; err != nil {
+			logging.Error("audit device error", logging.F("device", d.name()), logging.Err(err))
+			continue
+		}
+		accepted = true
+	}
+	if !accepted {
+		return ErrNoDevice
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// audit log of every request and response. Secrets are HMAC'd and entries are hash-chained.
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const (
+	TypeRequest  = "request"
+	TypeResponse = "response"
+
+	hmacPrefix = "hmac-sha256:"
+	redacted   = "redacted"
+)
+
+// values of these fields, in json bodies and query strings, never appear in clear text
+var secretFields = map[string]bool{
+	"password":             true,
+	"old_password":         true,
+	"pending_new_password": true,
+	"new_password":         true,
+	"token":                true,
+	"root_token":           true,
+	"secret_id":            true,
+	"secret":               true,
+	"otpauth_url":          true,
+	"totp_code":            true,
+	"jwt":                  true,
+	"key":                  true,
+	"input":                true,
+}
+
+type Entry struct {
+	Type      string    `json:"type"`
+	Time      string    `json:"time"`
+	RequestId string    `json:"request_id"`
+	Auth      *Auth     `json:"auth,omitempty"`
+	Request   *Request  `json:"request"`
+	Response  *Response `json:"response,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Auth struct {
+	Accessor    string   `json:"accessor"`
+	DisplayName string   `json:"display_name"`
+	TokenType   string   `json:"token_type"`
+	PolicyNames []string `json:"policy_names,omitempty"`
+}
+
+type Request struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      map[string][]string `json:"query,omitempty"`
+	RemoteAddr string              `json:"remote_addr"`
+	Body       json.RawMessage     `json:"body,omitempty"`
+	Truncated  bool                `json:"truncated,omitempty"` // the body exceeded the cap, see max_body_kb
+}
+
+type Response struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+}
+
+// record is one line of an audit file. Hash covers the previous hash and the exact bytes of Entry,
+// by an HMAC keyed from the master key once unlocked, so the chain cannot be rewritten without the key.
+type record struct {
+	Hash     string          `json:"hash"`
+	PrevHash string          `json:"prev_hash"`
+	Entry    json.RawMessage `json:"entry"`
+}
+
+// chainKey derives the key of the chain from the key of secrets, nil while locked
+func chainKey(key []byte) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("audit-chain"))
+	return m.Sum(nil)
+}
+
+// chainHash returns the HMAC of the record with the chain key, or a plain hash without key
+// for entries written while locked, which an attacker could recompute.
+func chainHash(key []byte, prevHash string, entry []byte) string {
+	if len(key) == 0 {
+		h := sha256.New()
+		h.Write([]byte(prevHash))
+		h.Write([]byte{'\n'})
+		h.Write(entry)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(prevHash))
+	m.Write([]byte{'\n'})
+	m.Write(entry)
+	return hmacPrefix + hex.EncodeToString(m.Sum(nil))
+}
+
+func isKeyedHash(hash string) bool {
+	return strings.HasPrefix(hash, hmacPrefix)
+}
+
+// makeRecord returns the json line of the entry chained to prevHash by the chain key, and its hash
+func makeRecord(key []byte, prevHash string, entry []byte) ([]byte, string, error) {
+	rec := &record{
+		Hash:     chainHash(key, prevHash, entry),
+		PrevHash: prevHash,
+		Entry:    entry,
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, "", err
+	}
+	return append(b, '\n'), rec.Hash, nil
+}
+
+// HashValue returns the HMAC of a secret as it appears in audit entries, or redacted without key
+func HashValue(key []byte, v string) string {
+	if len(key) == 0 {
+		return redacted
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(v))
+	return hmacPrefix + hex.EncodeToString(m.Sum(nil))
+}
+
+func hashSecrets(key []byte, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			if s, ok := vv.(string); ok && secretFields[k] {
+				t[k] = HashValue(key, s)
+				continue
+			}
+			t[k] = hashSecrets(key, vv)
+		}
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = hashSecrets(key, vv)
+		}
+	}
+	return v
+}
+
+// sanitizeBody HMACs secret fields of a json body. A body which is not json is HMAC'd as a whole.
+func sanitizeBody(key []byte, b []byte) json.RawMessage {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		r, _ := json.Marshal(HashValue(key, string(b)))
+		return r
+	}
+	r, err := json.Marshal(hashSecrets(key, v))
+	if err != nil {
+		r, _ = json.Marshal(HashValue(key, string(b)))
+	}
+	return r
+}
+
+func sanitizeQuery(key []byte, q url.Values) map[string][]string {
+	if len(q) == 0 {
+		return nil
+	}
+	r := make(map[string][]string)
+	for k, vs := range q {
+		for _, v := range vs {
+			if secretFields[k] {
+				v = HashValue(key, v)
+			}
+			r[k] = append(r[k], v)
+		}
+	}
+	return r
+}
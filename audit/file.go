@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"goimport.moetang.info/nekoq-security/config"
+)
+
+const maxLineSize = 64 * 1024 * 1024
+
+// fileDevice appends records to a file, which is rotated to <path>.1, <path>.2, ... when too large
+type fileDevice struct {
+	lock     sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int // 0 keeps all rotated files
+	f        *os.File
+	size     int64
+}
+
+func openFileDevice(dc *config.AuditDeviceConfig) (*fileDevice, error) {
+	d := &fileDevice{
+		path:     dc.Path,
+		maxSize:  int64(dc.MaxSizeMB) * 1024 * 1024,
+		maxFiles: dc.MaxFiles,
+	}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *fileDevice) name() string {
+	return "file:" + d.path
+}
+
+func (d *fileDevice) open() error {
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d.f = f
+	d.size = fi.Size()
+	return nil
+}
+
+func (d *fileDevice) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", d.path, i)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (d *fileDevice) rotate() error {
+	if err := d.f.Close(); err != nil {
+		return err
+	}
+	n := 0
+	for exists(d.rotatedPath(n + 1)) {
+		n++
+	}
+	for ; d.maxFiles > 0 && n >= d.maxFiles; n-- {
+		if err := os.Remove(d.rotatedPath(n)); err != nil {
+			return err
+		}
+	}
+	for i := n; i >= 1; i-- {
+		if err := os.Rename(d.rotatedPath(i), d.rotatedPath(i+1)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(d.path, d.rotatedPath(1)); err != nil {
+		return err
+	}
+	return d.open()
+}
+
+func (d *fileDevice) write(line []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.maxSize > 0 && d.size > 0 && d.size+int64(len(line)) > d.maxSize {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := d.f.Write(line)
+	d.size += int64(n)
+	return err
+}
+
+// lastHash returns the hash of the last record written by the device, to continue the chain after restart
+func (d *fileDevice) lastHash() (string, error) {
+	for _, path := range []string{d.path, d.rotatedPath(1)} {
+		h, err := lastHashOfFile(path)
+		if err != nil || len(h) > 0 {
+			return h, err
+		}
+	}
+	return "", nil
+}
+
+func lastHashOfFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return lastHash(f)
+}
+
+func lastHash(r io.Reader) (string, error) {
+	var last string
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		rec := new(record)
+		if err := json.Unmarshal(s.Bytes(), rec); err != nil {
+			return "", err
+		}
+		last = rec.Hash
+	}
+	return last, s.Err()
+}
+
+// files returns the paths of the rotated files from the oldest, and the current file
+func (d *fileDevice) files() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	n := 0
+	for exists(d.rotatedPath(n + 1)) {
+		n++
+	}
+	var r []string
+	for i := n; i >= 1; i-- {
+		r = append(r, d.rotatedPath(i))
+	}
+	return append(r, d.path)
+}
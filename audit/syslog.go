@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package audit
+
+import (
+	"errors"
+	"log/syslog"
+
+	"goimport.moetang.info/nekoq-security/config"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+type syslogDevice struct {
+	w *syslog.Writer
+}
+
+func openSyslogDevice(dc *config.AuditDeviceConfig) (*syslogDevice, error) {
+	facility, ok := syslogFacilities[dc.Facility]
+	if !ok {
+		return nil, errors.New("unknown syslog facility")
+	}
+	w, err := syslog.Dial(dc.Network, dc.Address, facility|syslog.LOG_INFO, dc.Tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogDevice{w: w}, nil
+}
+
+func (d *syslogDevice) name() string {
+	return "syslog"
+}
+
+func (d *syslogDevice) write(line []byte) error {
+	// the writer reconnects once if the socket was closed
+	return d.w.Info(string(line))
+}
@@ -0,0 +1,25 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package audit
+
+import (
+	"errors"
+
+	"goimport.moetang.info/nekoq-security/config"
+)
+
+type syslogDevice struct {
+}
+
+func openSyslogDevice(dc *config.AuditDeviceConfig) (*syslogDevice, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (d *syslogDevice) name() string {
+	return "syslog"
+}
+
+func (d *syslogDevice) write(line []byte) error {
+	return errors.New("syslog is not supported on this platform")
+}
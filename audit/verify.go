@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+type VerifyReport struct {
+	Valid     bool   `json:"valid"`
+	Entries   int    `json:"entries"`
+	FirstPrev string `json:"first_prev_hash"` // not empty when the file continues an earlier chain
+	LastHash  string `json:"last_hash"`
+	Unkeyed   int    `json:"unkeyed"`             // entries written while locked, chained without key
+	Unchecked int    `json:"unchecked,omitempty"` // keyed entries whose HMAC was not checked for lack of the key
+	Line      int    `json:"line,omitempty"`      // first broken line
+	Reason    string `json:"reason,omitempty"`
+
+	// entries at the end which no keyed entry follows, from the line tailLine
+	tail     int
+	tailLine int
+}
+
+// Verify checks the chain of an audit file end to end with the key of secrets.
+// Edited, inserted or deleted lines break the chain, only truncation at the end is not detectable here.
+// Without key only the links between the entries are checked, which anyone could recompute.
+func Verify(r io.Reader, key []byte) (*VerifyReport, error) {
+	report, err := verify(r, key)
+	if err != nil {
+		return nil, err
+	}
+	report.checkTail(key, "")
+	return report, nil
+}
+
+// checkTail refuses entries chained without key at the end: entries written while locked are covered
+// by the keyed ones after unlock, starting with the response of the unlock, so only a rewrite leaves them
+func (r *VerifyReport) checkTail(key []byte, file string) {
+	if r.Valid && len(key) > 0 && r.tail > 0 {
+		r.fail(r.tailLine, "entries not keyed at the end"+file)
+	}
+}
+
+func verify(r io.Reader, key []byte) (*VerifyReport, error) {
+	key = chainKey(key)
+	report := &VerifyReport{Valid: true}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	line := 0
+	for s.Scan() {
+		line++
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		rec := new(record)
+		if err := json.Unmarshal(s.Bytes(), rec); err != nil {
+			report.fail(line, "malformed record")
+			return report, nil
+		}
+		if report.Entries == 0 {
+			report.FirstPrev = rec.PrevHash
+		} else if rec.PrevHash != report.LastHash {
+			report.fail(line, "previous hash mismatch")
+			return report, nil
+		}
+		check := true
+		k := key
+		switch {
+		case !isKeyedHash(rec.Hash):
+			report.Unkeyed++
+			if report.tail == 0 {
+				report.tailLine = line
+			}
+			report.tail++
+			k = nil
+		case len(key) == 0:
+			report.Unchecked++
+			report.tail = 0
+			check = false
+		default:
+			report.tail = 0
+		}
+		if check && !hmac.Equal([]byte(chainHash(k, rec.PrevHash, rec.Entry)), []byte(rec.Hash)) {
+			report.fail(line, "hash mismatch")
+			return report, nil
+		}
+		report.Entries++
+		report.LastHash = rec.Hash
+	}
+	return report, s.Err()
+}
+
+func (r *VerifyReport) fail(line int, reason string) {
+	r.Valid = false
+	r.Line = line
+	r.Reason = reason
+}
+
+// VerifyFiles checks rotated files given from the oldest to the newest, e.g. audit.log.2,audit.log.1,audit.log
+func VerifyFiles(paths []string, key []byte) (*VerifyReport, error) {
+	total := &VerifyReport{Valid: true}
+	tailFile := ""
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		report, err := verify(f, key)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			total.FirstPrev = report.FirstPrev
+		} else if report.Entries > 0 && report.FirstPrev != total.LastHash {
+			total.fail(1, "previous hash mismatch in "+path)
+			return total, nil
+		}
+		if !report.Valid {
+			total.fail(report.Line, report.Reason+" in "+path)
+			return total, nil
+		}
+		total.Entries += report.Entries
+		total.Unkeyed += report.Unkeyed
+		total.Unchecked += report.Unchecked
+		if report.Entries > 0 {
+			total.LastHash = report.LastHash
+		}
+		if report.tail < report.Entries {
+			total.tail, total.tailLine, tailFile = report.tail, report.tailLine, path
+		} else if report.tail > 0 {
+			if total.tail == 0 {
+				total.tailLine, tailFile = report.tailLine, path
+			}
+			total.tail += report.tail
+		}
+	}
+	total.checkTail(key, " in "+tailFile)
+	return total, nil
+}
+
+func VerifyFile(path string, key []byte) (*VerifyReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Verify(f, key)
+}
+
+var ErrNoFileDevice = errors.New("no audit file device")
+
+// VerifyDevice checks the files of the first file device, the one whose chain the server continues,
+// with the key of the running server
+func VerifyDevice() (*VerifyReport, error) {
+	if devices == nil {
+		return nil, ErrNoFileDevice
+	}
+	for _, d := range devices.devices {
+		if f, ok := d.(*fileDevice); ok {
+			return VerifyFiles(f.files(), keyFn())
+		}
+	}
+	return nil, ErrNoFileDevice
+}
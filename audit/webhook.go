@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+)
+
+var errQueueFull = errors.New("audit webhook queue is full")
+
+// webhookDevice posts records in batches as json arrays. Failed batches are retried with backoff, then dropped.
+type webhookDevice struct {
+	url        string
+	headers    map[string]string
+	batchSize  int
+	interval   time.Duration
+	maxRetries int
+	client     *http.Client
+	queue      chan webhookRecord
+}
+
+// webhookRecord is a queued record, done receives the result of its delivery when not nil
+type webhookRecord struct {
+	line []byte
+	done chan error
+}
+
+// syncWebhookDevice is the webhook device of fail-closed mode, whose records count once delivered
+type syncWebhookDevice struct {
+	*webhookDevice
+}
+
+func newWebhookDevice(dc *config.AuditDeviceConfig) *webhookDevice {
+	d := &webhookDevice{
+		url:        dc.URL,
+		headers:    dc.Headers,
+		batchSize:  dc.BatchSize,
+		interval:   time.Duration(dc.FlushIntervalMs) * time.Millisecond,
+		maxRetries: dc.MaxRetries,
+		client:     &http.Client{Timeout: time.Duration(dc.TimeoutMs) * time.Millisecond},
+		queue:      make(chan webhookRecord, dc.QueueSize),
+	}
+	go d.loop()
+	return d
+}
+
+func (d *webhookDevice) name() string {
+	return "webhook:" + d.url
+}
+
+// write only queues the record, it fails when the queue is full
+func (d *webhookDevice) write(line []byte) error {
+	select {
+	case d.queue <- webhookRecord{line: line}:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// deliver queues the record and returns the channel receiving the result of its delivery
+func (d *syncWebhookDevice) deliver(line []byte) (<-chan error, error) {
+	done := make(chan error, 1)
+	select {
+	case d.queue <- webhookRecord{line: line, done: done}:
+		return done, nil
+	default:
+		return nil, errQueueFull
+	}
+}
+
+func (d *webhookDevice) loop() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	var batch []webhookRecord
+	waiting := false
+	for {
+		select {
+		case r := <-d.queue:
+			batch = append(batch, r)
+			waiting = waiting || r.done != nil
+			// records somebody waits for are sent once nothing else is queued
+			if len(batch) < d.batchSize && (!waiting || len(d.queue) > 0) {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := d.send(batch)
+		for _, r := range batch {
+			if r.done != nil {
+				r.done <- err
+			}
+		}
+		batch = nil
+		waiting = false
+	}
+}
+
+func (d *webhookDevice) send(batch []webhookRecord) error {
+	body := make([]byte, 0, 1024)
+	body = append(body, '[')
+	for i, r := range batch {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, bytes.TrimSpace(r.line)...)
+	}
+	body = append(body, ']')
+
+	backoff := 500 * time.Millisecond
+	for i := 0; ; i++ {
+		err := d.post(body)
+		if err == nil {
+			return nil
+		}
+		if i >= d.maxRetries {
+			logging.Error("audit webhook dropped entries", logging.F("entries", len(batch)), logging.Err(err))
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (d *webhookDevice) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range d.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
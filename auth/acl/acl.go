@@ -0,0 +1,153 @@
+// named ACL policies for operations on provider instances
+package acl
+
+import (
+	"errors"
+	"net/http"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+)
+
+const (
+	moduleName = "acl"
+	namespace  = "sys.policy"
+)
+
+var ErrPolicyNotFound = errors.New("policy not found")
+
+var policyKeyPrefix = []byte("policy.")
+
+var container *config.NekoQSecurityContainer
+
+type aclModuleType struct {
+}
+
+func (a aclModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	return nil
+}
+
+func (a aclModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	g := openapi.NewGroup(scaffold.GetGin(), "policy", "/sys/policies", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "", Legacy: "/sys/policy", Id: "listPolicies",
+		Summary: "list acl policies", Result: openapi.Array(policySchema)},
+		auth.RequireManager(), ListPolicies)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "", Legacy: "/sys/policy", Id: "putPolicy",
+		Summary: "create or replace an acl policy", Body: policySchema},
+		auth.RequireManager(), PutPolicy)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/:name", Legacy: "/sys/policy/:name", Id: "getPolicy",
+		Summary: "read an acl policy", PathParams: policyNameParam, Result: policySchema},
+		auth.RequireManager(), GetPolicy)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/:name", Legacy: "/sys/policy/:name", Id: "deletePolicy",
+		Summary: "delete an acl policy", PathParams: policyNameParam},
+		auth.RequireManager(), DeletePolicy)
+	return nil
+}
+
+var aclModule config.Module = aclModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, aclModule)
+}
+
+func makePolicyKey(name string) []byte {
+	return append(append([]byte{}, policyKeyPrefix...), []byte(name)...)
+}
+
+func decryptPolicy(b []byte) (*Policy, error) {
+	p := new(Policy)
+	if err := container.OpenJSON(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func loadPolicy(name string) (*Policy, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makePolicyKey(name))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrPolicyNotFound
+	}
+	return decryptPolicy(b)
+}
+
+func listPolicies() ([]*Policy, error) {
+	var r []*Policy
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(policyKeyPrefix, func(k, v []byte) error {
+			p, err := decryptPolicy(v)
+			if err != nil {
+				return err
+			}
+			r = append(r, p)
+			return nil
+		})
+	})
+	return r, err
+}
+
+func savePolicy(p *Policy) error {
+	b, err := container.SealJSON(p)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makePolicyKey(p.Name), b)
+	})
+}
+
+func deletePolicy(name string) error {
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Delete(makePolicyKey(name))
+	})
+}
+
+// tokenPolicies loads the named policies of the token. Names without a stored policy are ignored.
+func tokenPolicies(t *auth.Token) ([]*Policy, error) {
+	var r []*Policy
+	for _, name := range t.PolicyNames {
+		p, err := loadPolicy(name)
+		if err == ErrPolicyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, p)
+	}
+	return r, nil
+}
+
+// Authorize checks the request against the token. Root tokens are allowed everything.
+// Otherwise a matching deny rule of the named policies always wins, and the request is allowed
+// by a matching allow rule or by an inline token policy with the equivalent capability.
+func Authorize(t *auth.Token, req *Request) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+	if t.Type == auth.TokenTypeRoot {
+		return true, nil
+	}
+	policies, err := tokenPolicies(t)
+	if err != nil {
+		return false, err
+	}
+	allowed, denied := evaluate(policies, req)
+	if denied {
+		return false, nil
+	}
+	if allowed {
+		return true, nil
+	}
+	return t.Allow(legacyCapabilities[req.Operation], req.Resource), nil
+}
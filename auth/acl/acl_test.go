@@ -0,0 +1,62 @@
+package acl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPutPolicyGrant(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.POST("/policies", auth.RequireManager(), PutPolicy)
+
+	// the admin holds the policy it tries to widen
+	admin, err := auth.CreateToken(&auth.Token{Type: auth.TokenTypeAdmin,
+		Policies:    []auth.Policy{{Path: "pg/prod-*", Capabilities: []string{auth.CapabilityReadCredential, auth.CapabilityListInstance}}},
+		PolicyNames: []string{"readers"}}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := auth.CreateToken(&auth.Token{Type: auth.TokenTypeRoot}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		rules []*Rule
+		code  int
+	}{
+		{"covered", admin, []*Rule{{Effect: EffectAllow, Operations: []string{OperationViewCredential}, Instances: []string{"prod-1"}}}, http.StatusOK},
+		{"narrowed by labels", admin, []*Rule{{Effect: EffectAllow, Operations: []string{OperationList}, Instances: []string{"prod-*"},
+			Labels: map[string][]string{"env": {"prod"}}}}, http.StatusOK},
+		{"deny", admin, []*Rule{{Effect: EffectDeny, Operations: []string{"*"}}}, http.StatusOK},
+		{"any instance", admin, []*Rule{{Effect: EffectAllow, Operations: []string{OperationViewCredential}}}, http.StatusForbidden},
+		{"any operation", admin, []*Rule{{Effect: EffectAllow, Operations: []string{"*"}, Instances: []string{"prod-1"}}}, http.StatusForbidden},
+		{"rotate", admin, []*Rule{{Effect: EffectAllow, Operations: []string{OperationRotate}, Instances: []string{"prod-1"}}}, http.StatusForbidden},
+		{"root", root, []*Rule{{Effect: EffectAllow, Operations: []string{"*"}}}, http.StatusOK},
+	} {
+		b, _ := json.Marshal(&Policy{Name: "readers", Rules: tc.rules})
+		req := httptest.NewRequest(http.MethodPost, "/policies", bytes.NewReader(b))
+		req.Header.Set(auth.TokenHeader, tc.token)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Error(tc.name, w.Code, w.Body.String())
+		}
+	}
+}
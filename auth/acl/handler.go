@@ -0,0 +1,75 @@
+package acl
+
+import (
+	"net/http"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ListPolicies(ctx *gin.Context) {
+	policies, err := listPolicies()
+	if err != nil {
+		logging.FromContext(ctx).Error("listPolicies error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": policies,
+	})
+}
+
+func PutPolicy(ctx *gin.Context) {
+	p := new(Policy)
+	if err := ctx.ShouldBindJSON(p); err != nil || !p.validate() {
+		apierr.Abort(ctx, apierr.InvalidField("policies", "invalid policy"))
+		return
+	}
+	// the policy is checked against the inline policies only, so that a policy held by the token cannot widen itself
+	if err := auth.CheckGrant(auth.CurrentToken(ctx), p.grants(), nil); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	if err := savePolicy(p); err != nil {
+		logging.FromContext(ctx).Error("savePolicy error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func GetPolicy(ctx *gin.Context) {
+	p, err := loadPolicy(ctx.Param("name"))
+	if err == ErrPolicyNotFound {
+		apierr.Abort(ctx, apierr.NotFound("policy", ctx.Param("name")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("loadPolicy error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": p,
+	})
+}
+
+func DeletePolicy(ctx *gin.Context) {
+	if err := deletePolicy(ctx.Param("name")); err != nil {
+		logging.FromContext(ctx).Error("deletePolicy error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
@@ -0,0 +1,152 @@
+package acl
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+)
+
+// operations on provider instances
+const (
+	OperationList           = "list"
+	OperationViewMetadata   = "view-metadata"
+	OperationViewCredential = "view-credential"
+	OperationRotate         = "rotate"
+	OperationCreate         = "create"
+	OperationUpdate         = "update"
+	OperationDelete         = "delete"
+
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// capabilities of inline token policies granting the same operations
+var legacyCapabilities = map[string]string{
+	OperationList:           auth.CapabilityListInstance,
+	OperationViewMetadata:   auth.CapabilityReadInstance,
+	OperationViewCredential: auth.CapabilityReadCredential,
+	OperationRotate:         auth.CapabilityRotateCredential,
+	OperationCreate:         auth.CapabilityManageInstance,
+	OperationUpdate:         auth.CapabilityManageInstance,
+	OperationDelete:         auth.CapabilityManageInstance,
+}
+
+// resource prefix of the instances in inline token policies, the same as in the pg provider
+const instanceResourcePrefix = "pg/"
+
+// Policy is a named set of rules. A request is allowed when an allow rule matches and no deny rule does.
+type Policy struct {
+	Name  string  `json:"name"`
+	Rules []*Rule `json:"rules"`
+}
+
+// Rule matches a request when every non-empty condition matches. '*' can be used in all patterns.
+//   - Instances: globs of instance names
+//   - Labels: every label must exist on the instance with a value matching one of the globs
+//   - AddressRoles: address roles, e.g. replica. Such rules only match operations on a single address.
+type Rule struct {
+	Effect       string              `json:"effect"`
+	Operations   []string            `json:"operations"`
+	Instances    []string            `json:"instances"`
+	Labels       map[string][]string `json:"labels"`
+	AddressRoles []string            `json:"address_roles"`
+}
+
+// Request is an operation on an instance, or on one address of it when AddressRole is set
+type Request struct {
+	Operation   string
+	Resource    string // resource of inline token policies, e.g. pg/<instance name>
+	Instance    string
+	Labels      map[string]string
+	AddressRole string
+}
+
+func (p *Policy) validate() bool {
+	if !auth.ValidatePolicyNames([]string{p.Name}) || len(p.Rules) == 0 {
+		return false
+	}
+	for _, r := range p.Rules {
+		if r == nil || !r.validate() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) validate() bool {
+	if r.Effect != EffectAllow && r.Effect != EffectDeny {
+		return false
+	}
+	if len(r.Operations) == 0 {
+		return false
+	}
+	for _, op := range r.Operations {
+		if _, ok := legacyCapabilities[op]; !ok && op != "*" {
+			return false
+		}
+	}
+	for _, v := range r.Labels {
+		if len(v) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// grants returns inline policies granting at least what the allow rules of the policy grant.
+// Labels and address roles only narrow a rule, so they are left out.
+func (p *Policy) grants() []auth.Policy {
+	var r []auth.Policy
+	for _, rule := range p.Rules {
+		if rule.Effect != EffectAllow {
+			continue
+		}
+		var capabilities []string
+		for op, c := range legacyCapabilities {
+			if auth.MatchAny(rule.Operations, []string{op}) {
+				capabilities = append(capabilities, c)
+			}
+		}
+		instances := rule.Instances
+		if len(instances) == 0 {
+			instances = []string{"*"}
+		}
+		for _, v := range instances {
+			r = append(r, auth.Policy{Path: instanceResourcePrefix + v, Capabilities: capabilities})
+		}
+	}
+	return r
+}
+
+func (r *Rule) match(req *Request) bool {
+	if !auth.MatchAny(r.Operations, []string{req.Operation}) {
+		return false
+	}
+	if len(r.Instances) > 0 && !auth.MatchAny(r.Instances, []string{req.Instance}) {
+		return false
+	}
+	for k, patterns := range r.Labels {
+		v, ok := req.Labels[k]
+		if !ok || !auth.MatchAny(patterns, []string{v}) {
+			return false
+		}
+	}
+	if len(r.AddressRoles) > 0 && (len(req.AddressRole) == 0 || !auth.MatchAny(r.AddressRoles, []string{req.AddressRole})) {
+		return false
+	}
+	return true
+}
+
+// evaluate returns whether the policies allow and whether they deny the request
+func evaluate(policies []*Policy, req *Request) (allowed, denied bool) {
+	for _, p := range policies {
+		for _, r := range p.Rules {
+			if !r.match(req) {
+				continue
+			}
+			if r.Effect == EffectDeny {
+				return false, true
+			}
+			allowed = true
+		}
+	}
+	return allowed, false
+}
@@ -0,0 +1,63 @@
+package acl
+
+import (
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	policies := []*Policy{
+		{
+			Name: "dba",
+			Rules: []*Rule{
+				{Effect: EffectAllow, Operations: []string{OperationList, OperationViewMetadata}, Instances: []string{"*"}},
+				{Effect: EffectAllow, Operations: []string{OperationViewCredential}, Labels: map[string][]string{"env": {"prod"}}, AddressRoles: []string{"replica"}},
+				{Effect: EffectAllow, Operations: []string{"*"}, Instances: []string{"test-*"}},
+			},
+		},
+		{
+			Name: "no-billing",
+			Rules: []*Rule{
+				{Effect: EffectDeny, Operations: []string{"*"}, Labels: map[string][]string{"team": {"billing*"}}},
+			},
+		},
+	}
+	for _, p := range policies {
+		if !p.validate() {
+			t.Fatal("policy should be valid:", p.Name)
+		}
+	}
+	prod := map[string]string{"env": "prod"}
+	for _, c := range []struct {
+		req     Request
+		allowed bool
+	}{
+		{Request{Operation: OperationList, Instance: "prod-1", Labels: prod}, true},
+		{Request{Operation: OperationViewCredential, Instance: "prod-1", Labels: prod, AddressRole: "replica"}, true},
+		{Request{Operation: OperationViewCredential, Instance: "prod-1", Labels: prod, AddressRole: "primary"}, false},
+		{Request{Operation: OperationViewCredential, Instance: "prod-1", Labels: prod}, false},
+		{Request{Operation: OperationViewCredential, Instance: "dev-1", AddressRole: "replica"}, false},
+		{Request{Operation: OperationRotate, Instance: "prod-1", Labels: prod, AddressRole: "replica"}, false},
+		{Request{Operation: OperationDelete, Instance: "test-1"}, true},
+		{Request{Operation: OperationDelete, Instance: "test-1", Labels: map[string]string{"team": "billing-eu"}}, false},
+		{Request{Operation: OperationList, Instance: "prod-2", Labels: map[string]string{"env": "prod", "team": "billing"}}, false},
+	} {
+		allowed, _ := evaluate(policies, &c.req)
+		if allowed != c.allowed {
+			t.Fatalf("unexpected result of %+v: %v", c.req, allowed)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, p := range []*Policy{
+		{Name: "a b", Rules: []*Rule{{Effect: EffectAllow, Operations: []string{OperationList}}}},
+		{Name: "a"},
+		{Name: "a", Rules: []*Rule{{Effect: "maybe", Operations: []string{OperationList}}}},
+		{Name: "a", Rules: []*Rule{{Effect: EffectAllow, Operations: []string{"drop"}}}},
+		{Name: "a", Rules: []*Rule{{Effect: EffectAllow, Operations: []string{OperationList}, Labels: map[string][]string{"env": {}}}}},
+	} {
+		if p.validate() {
+			t.Fatalf("policy should be invalid: %+v", p)
+		}
+	}
+}
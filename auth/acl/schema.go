@@ -0,0 +1,24 @@
+package acl
+
+import (
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+// same as the policy names accepted by auth.ValidatePolicyNames
+const policyNamePattern = "^[A-Za-z0-9_.-]+$"
+
+var (
+	ruleSchema = openapi.Object(map[string]*openapi.Schema{
+		"effect": openapi.String().OneOf(EffectAllow, EffectDeny),
+		"operations": openapi.Array(openapi.String().OneOf("*", OperationList, OperationViewMetadata, OperationViewCredential,
+			OperationRotate, OperationCreate, OperationUpdate, OperationDelete)).NonEmpty(),
+		"instances":     openapi.Array(openapi.String()).Describe("instance name globs, any instance when empty"),
+		"labels":        openapi.Map(openapi.Array(openapi.String()).NonEmpty()),
+		"address_roles": openapi.Array(openapi.String()),
+	}).Require("effect", "operations")
+	policySchema = openapi.Object(map[string]*openapi.Schema{
+		"name":  openapi.String().Match(policyNamePattern),
+		"rules": openapi.Array(ruleSchema).NonEmpty(),
+	}).Require("name", "rules")
+	policyNameParam = map[string]*openapi.Schema{"name": openapi.String().Match(policyNamePattern)}
+)
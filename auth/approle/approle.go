@@ -0,0 +1,290 @@
+package approle
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	moduleName = "approle"
+	namespace  = "sys.auth.approle"
+)
+
+var (
+	ErrRoleNotFound     = errors.New("role not found")
+	ErrInvalidSecretId  = errors.New("invalid secret id")
+	ErrSourceNotAllowed = errors.New("source address not allowed")
+)
+
+var (
+	roleKeyPrefix     = []byte("role.")
+	roleIdKeyPrefix   = []byte("role_id.")
+	secretIdKeyPrefix = []byte("secret_id.")
+)
+
+var container *config.NekoQSecurityContainer
+
+type approleModuleType struct {
+}
+
+func (a approleModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	return nil
+}
+
+func (a approleModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	g := openapi.NewGroup(scaffold.GetGin(), "approle", "/auth/approle", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/login", Legacy: "/sys/auth/approle/login", Id: "approleLogin",
+		Summary: "log in with a role id and a secret id", Public: true, Body: loginSchema, Result: openapi.RefTo("Login")},
+		Login)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/roles", Legacy: "/sys/auth/approle/role", Id: "putApproleRole",
+		Summary: "create or update a role", Body: roleSchema},
+		auth.RequireManager(), PutRole)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/roles/:name", Legacy: "/sys/auth/approle/role/:name", Id: "getApproleRole",
+		Summary: "read a role", PathParams: nameParam, Result: roleSchema},
+		auth.RequireManager(), GetRole)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/roles/:name", Legacy: "/sys/auth/approle/role/:name", Id: "deleteApproleRole",
+		Summary: "delete a role and its secret ids", PathParams: nameParam},
+		auth.RequireManager(), DeleteRole)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/roles/:name/secret-id", Legacy: "/sys/auth/approle/role/:name/secret-id", Id: "generateSecretId",
+		Summary: "generate a secret id of the role", PathParams: nameParam, Result: secretIdSchema},
+		auth.RequireManager(), GenerateSecretId)
+	return nil
+}
+
+var approleModule config.Module = approleModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, approleModule)
+}
+
+// Role defines what a machine logging in with role id and secret id gets
+type Role struct {
+	Name            string        `json:"name"`
+	RoleId          string        `json:"role_id"`
+	Policies        []auth.Policy `json:"policies"`
+	PolicyNames     []string      `json:"policy_names"`
+	TokenTTL        int64         `json:"token_ttl"`     // seconds
+	TokenMaxTTL     int64         `json:"token_max_ttl"` // seconds
+	BoundCIDRs      []string      `json:"bound_cidrs"`
+	SecretIdNumUses int           `json:"secret_id_num_uses"` // 0 for unlimited
+	SecretIdTTL     int64         `json:"secret_id_ttl"`      // seconds, 0 for never expire
+}
+
+func (r *Role) allowSource(ip string) bool {
+	if len(r.BoundCIDRs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, v := range r.BoundCIDRs {
+		_, n, err := net.ParseCIDR(v)
+		if err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type secretId struct {
+	RoleName      string `json:"role_name"`
+	Accessor      string `json:"accessor"`
+	RemainingUses int    `json:"remaining_uses"` // 0 for unlimited
+	ExpireAt      int64  `json:"expire_at"`      // 0 for never
+	CreatedAt     int64  `json:"created_at"`
+}
+
+func makeKey(prefix []byte, parts ...string) []byte {
+	r := append([]byte{}, prefix...)
+	for i, v := range parts {
+		if i > 0 {
+			r = append(r, '.')
+		}
+		r = append(r, []byte(v)...)
+	}
+	return r
+}
+
+func hashSecretId(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func loadRole(name string) (*Role, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makeKey(roleKeyPrefix, name))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrRoleNotFound
+	}
+	r := new(Role)
+	err = container.OpenJSON(b, r)
+	return r, err
+}
+
+func loadRoleById(roleId string) (*Role, error) {
+	var name []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		name = bucket.Get(makeKey(roleIdKeyPrefix, roleId))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(name) == 0 {
+		return nil, ErrRoleNotFound
+	}
+	return loadRole(string(name))
+}
+
+// saveRole creates or updates the role. The role id of an existing role is kept.
+func saveRole(r *Role) error {
+	old, err := loadRole(r.Name)
+	switch err {
+	case nil:
+		r.RoleId = old.RoleId
+	case ErrRoleNotFound:
+		r.RoleId = uuid.NewV4().String()
+	default:
+		return err
+	}
+	b, err := container.SealJSON(r)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		if err := bucket.Put(makeKey(roleKeyPrefix, r.Name), b); err != nil {
+			return err
+		}
+		return bucket.Put(makeKey(roleIdKeyPrefix, r.RoleId), []byte(r.Name))
+	})
+}
+
+// deleteRole removes the role together with all its secret ids
+func deleteRole(r *Role) error {
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		var keys [][]byte
+		err := bucket.ForEachWithPrefix(makeKey(secretIdKeyPrefix, r.Name, ""), func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		if err := bucket.Delete(makeKey(roleIdKeyPrefix, r.RoleId)); err != nil {
+			return err
+		}
+		return bucket.Delete(makeKey(roleKeyPrefix, r.Name))
+	})
+}
+
+func generateSecretId(r *Role) (string, *secretId, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	s := hex.EncodeToString(b)
+	now := time.Now()
+	sid := &secretId{
+		RoleName:      r.Name,
+		Accessor:      uuid.NewV4().String(),
+		RemainingUses: r.SecretIdNumUses,
+		CreatedAt:     now.Unix(),
+	}
+	if r.SecretIdTTL > 0 {
+		sid.ExpireAt = now.Add(time.Duration(r.SecretIdTTL) * time.Second).Unix()
+	}
+	enc, err := container.SealJSON(sid)
+	if err != nil {
+		return "", nil, err
+	}
+	err = container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makeKey(secretIdKeyPrefix, r.Name, hashSecretId(s)), enc)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return s, sid, nil
+}
+
+// consumeSecretId checks the secret id of the role and uses it once
+func consumeSecretId(r *Role, s string) error {
+	key := makeKey(secretIdKeyPrefix, r.Name, hashSecretId(s))
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b := bucket.Get(key)
+		if len(b) == 0 {
+			return ErrInvalidSecretId
+		}
+		sid := new(secretId)
+		if err := container.OpenJSON(b, sid); err != nil {
+			return err
+		}
+		if sid.ExpireAt > 0 && time.Now().Unix() >= sid.ExpireAt {
+			return ErrInvalidSecretId
+		}
+		if sid.RemainingUses == 0 {
+			// unlimited
+			return nil
+		}
+		sid.RemainingUses--
+		if sid.RemainingUses == 0 {
+			return bucket.Delete(key)
+		}
+		enc, err := container.SealJSON(sid)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, enc)
+	})
+}
+
+// login exchanges role id and secret id for a client token
+func login(roleId, s, sourceIp string) (string, *auth.Token, error) {
+	r, err := loadRoleById(roleId)
+	if err != nil {
+		return "", nil, err
+	}
+	if !r.allowSource(sourceIp) {
+		return "", nil, ErrSourceNotAllowed
+	}
+	if err := consumeSecretId(r, s); err != nil {
+		return "", nil, err
+	}
+	t := &auth.Token{
+		Type:        auth.TokenTypeClient,
+		DisplayName: "approle:" + r.Name,
+		Policies:    r.Policies,
+		PolicyNames: r.PolicyNames,
+	}
+	ttl := time.Duration(r.TokenTTL) * time.Second
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	token, err := auth.CreateToken(t, ttl, time.Duration(r.TokenMaxTTL)*time.Second)
+	return token, t, err
+}
@@ -0,0 +1,145 @@
+package approle
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowSource(t *testing.T) {
+	r := &Role{BoundCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":    true,
+		"11.1.2.3":    false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"":            false,
+		"not an ip":   false,
+	} {
+		if r.allowSource(ip) != allowed {
+			t.Error(ip)
+		}
+	}
+	if !(&Role{}).allowSource("203.0.113.5") {
+		t.Fatal("a role without bound cidrs allows any source")
+	}
+}
+
+func openTestConfig(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+}
+
+func postLogin(t *testing.T, e *gin.Engine, remoteAddr, forwardedFor, roleId, secretId string) int {
+	b, _ := json.Marshal(gin.H{"role_id": roleId, "secret_id": secretId})
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(b))
+	req.RemoteAddr = remoteAddr
+	if len(forwardedFor) > 0 {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("X-Real-Ip", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestLogin(t *testing.T) {
+	openTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.POST("/login", Login)
+
+	r := &Role{Name: "ci", BoundCIDRs: []string{"10.0.0.0/8"}, SecretIdNumUses: 2,
+		Policies: []auth.Policy{{Path: "pg/*", Capabilities: []string{"read"}}}}
+	if err := saveRole(r); err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := generateSecretId(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the headers of a client outside of the cidr are not trusted
+	if code := postLogin(t, e, "203.0.113.5:4000", "10.1.2.3", r.RoleId, s); code != http.StatusUnauthorized {
+		t.Fatal("forged source address accepted:", code)
+	}
+	if code := postLogin(t, e, "10.1.2.3:4000", "", r.RoleId, "wrong"); code != http.StatusUnauthorized {
+		t.Fatal("wrong secret id accepted:", code)
+	}
+	if code := postLogin(t, e, "10.1.2.3:4000", "", "unknown", s); code != http.StatusUnauthorized {
+		t.Fatal("unknown role id accepted:", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := postLogin(t, e, "10.1.2.3:4000", "", r.RoleId, s); code != http.StatusOK {
+			t.Fatal("login failed:", code)
+		}
+	}
+	// the secret id is used up
+	if code := postLogin(t, e, "10.1.2.3:4000", "", r.RoleId, s); code != http.StatusUnauthorized {
+		t.Fatal("used up secret id accepted:", code)
+	}
+}
+
+func TestSaveRoleKeepsRoleId(t *testing.T) {
+	openTestConfig(t)
+	r := &Role{Name: "app"}
+	if err := saveRole(r); err != nil {
+		t.Fatal(err)
+	}
+	id := r.RoleId
+	r2 := &Role{Name: "app", TokenTTL: 60}
+	if err := saveRole(r2); err != nil {
+		t.Fatal(err)
+	}
+	if r2.RoleId != id {
+		t.Fatal("role id changed")
+	}
+	if err := deleteRole(r2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRoleById(id); err != ErrRoleNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestPutRoleGrant(t *testing.T) {
+	openTestConfig(t)
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.POST("/roles", auth.RequireManager(), PutRole)
+	admin, err := auth.CreateToken(&auth.Token{Type: auth.TokenTypeAdmin,
+		Policies: []auth.Policy{{Path: "pg/prod-*", Capabilities: []string{auth.CapabilityReadCredential}}}}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policies []auth.Policy
+		code     int
+	}{
+		{[]auth.Policy{{Path: "pg/prod-1", Capabilities: []string{auth.CapabilityReadCredential}}}, http.StatusOK},
+		{[]auth.Policy{{Path: "*", Capabilities: []string{auth.CapabilitySys}}}, http.StatusForbidden},
+		{[]auth.Policy{{Path: "pg/*", Capabilities: []string{auth.CapabilityReadCredential}}}, http.StatusForbidden},
+	} {
+		b, _ := json.Marshal(gin.H{"name": "ci", "policies": tc.policies})
+		req := httptest.NewRequest(http.MethodPost, "/roles", bytes.NewReader(b))
+		req.Header.Set(auth.TokenHeader, admin)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Error(tc.policies, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package approle
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+var roleNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+type loginRequest struct {
+	RoleId   string `json:"role_id"`
+	SecretId string `json:"secret_id"`
+}
+
+func Login(ctx *gin.Context) {
+	req := new(loginRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || len(req.RoleId) == 0 || len(req.SecretId) == 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	token, t, err := login(req.RoleId, req.SecretId, config.RemoteIP(ctx.Request))
+	switch err {
+	case nil:
+	case ErrRoleNotFound, ErrInvalidSecretId, ErrSourceNotAllowed:
+		logging.FromContext(ctx).Warn("approle login failed", logging.Err(err))
+		apierr.Abort(ctx, apierr.Unauthorized("invalid role id or secret id"))
+		return
+	default:
+		logging.FromContext(ctx).Error("approle login error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"token":     token,
+			"accessor":  t.Accessor,
+			"expire_at": t.ExpireAt,
+		},
+	})
+}
+
+func PutRole(ctx *gin.Context) {
+	r := new(Role)
+	if err := ctx.ShouldBindJSON(r); err != nil || !roleNamePattern.MatchString(r.Name) {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	for _, p := range r.Policies {
+		if !auth.ValidatePolicy(p) {
+			apierr.Abort(ctx, apierr.InvalidField("policies", "invalid policy"))
+			return
+		}
+	}
+	if !auth.ValidatePolicyNames(r.PolicyNames) {
+		apierr.Abort(ctx, apierr.InvalidField("policy_names", "invalid policy name"))
+		return
+	}
+	if err := auth.CheckGrant(auth.CurrentToken(ctx), r.Policies, r.PolicyNames); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	for _, v := range r.BoundCIDRs {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			apierr.Abort(ctx, apierr.InvalidField("bound_cidrs", "invalid bound cidr"))
+			return
+		}
+	}
+	if err := saveRole(r); err != nil {
+		logging.FromContext(ctx).Error("saveRole error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"name":    r.Name,
+			"role_id": r.RoleId,
+		},
+	})
+}
+
+// roleFromParam loads the role of the request or writes the error response
+func roleFromParam(ctx *gin.Context) (*Role, bool) {
+	r, err := loadRole(ctx.Param("name"))
+	if err == ErrRoleNotFound {
+		apierr.Abort(ctx, apierr.NotFound("role", ctx.Param("name")))
+		return nil, false
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("loadRole error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return nil, false
+	}
+	return r, true
+}
+
+func GetRole(ctx *gin.Context) {
+	r, ok := roleFromParam(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": r,
+	})
+}
+
+func DeleteRole(ctx *gin.Context) {
+	r, ok := roleFromParam(ctx)
+	if !ok {
+		return
+	}
+	if err := deleteRole(r); err != nil {
+		logging.FromContext(ctx).Error("deleteRole error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func GenerateSecretId(ctx *gin.Context) {
+	r, ok := roleFromParam(ctx)
+	if !ok {
+		return
+	}
+	s, sid, err := generateSecretId(r)
+	if err != nil {
+		logging.FromContext(ctx).Error("generateSecretId error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"secret_id":          s,
+			"secret_id_accessor": sid.Accessor,
+			"remaining_uses":     sid.RemainingUses,
+			"expire_at":          sid.ExpireAt,
+		},
+	})
+}
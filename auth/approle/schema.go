@@ -0,0 +1,30 @@
+package approle
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+var (
+	roleSchema = openapi.Object(map[string]*openapi.Schema{
+		"name":               openapi.String().Match(roleNamePattern.String()),
+		"policies":           openapi.Array(openapi.RefTo("Policy")),
+		"policy_names":       openapi.RefTo("PolicyNames"),
+		"token_ttl":          auth.TTLSchema(),
+		"token_max_ttl":      auth.TTLSchema(),
+		"bound_cidrs":        openapi.Array(openapi.String().Describe("e.g. 10.0.0.0/8")),
+		"secret_id_num_uses": openapi.Integer().Min(0).Describe("0 for unlimited"),
+		"secret_id_ttl":      auth.TTLSchema().Describe("seconds, 0 for never expire"),
+	}).Require("name")
+	loginSchema = openapi.Object(map[string]*openapi.Schema{
+		"role_id":   openapi.String().NonEmpty(),
+		"secret_id": openapi.String().NonEmpty(),
+	}).Require("role_id", "secret_id")
+	secretIdSchema = openapi.Object(map[string]*openapi.Schema{
+		"secret_id":          openapi.String(),
+		"secret_id_accessor": openapi.String(),
+		"remaining_uses":     openapi.Integer(),
+		"expire_at":          openapi.Integer(),
+	})
+	nameParam = map[string]*openapi.Schema{"name": openapi.String().Match(roleNamePattern.String())}
+)
@@ -0,0 +1,429 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	moduleName = "auth"
+	namespace  = "sys.auth"
+
+	TokenHeader = "X-NekoQ-Token"
+
+	tokenContextKey = "nekoq.token"
+)
+
+var container *config.NekoQSecurityContainer
+
+type authModuleType struct {
+}
+
+func (a authModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	return nil
+}
+
+func (a authModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	g := openapi.NewGroup(scaffold.GetGin(), "token", "/auth/token", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/create", Legacy: "/sys/auth/token/create", Id: "createToken",
+		Summary: "create a child token", Body: createTokenSchema, Result: openapi.RefTo("Login")},
+		Authenticated(), CreateTokenHandler)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/lookup-self", Legacy: "/sys/auth/token/lookup-self", Id: "lookupSelf",
+		Summary: "the token of the request", Result: openapi.RefTo("Token")},
+		Authenticated(), LookupSelf)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/renew-self", Legacy: "/sys/auth/token/renew-self", Id: "renewSelf",
+		Summary: "renew the token of the request", Body: renewSelfSchema, BodyOptional: true, Result: tokenResultSchema},
+		Authenticated(), RenewSelf)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/revoke-self", Legacy: "/sys/auth/token/revoke-self", Id: "revokeSelf",
+		Summary: "revoke the token of the request"},
+		Authenticated(), RevokeSelf)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/accessors", Legacy: "/sys/auth/token/accessors", Id: "listTokens",
+		Summary: "tokens managed by the token of the request", Result: openapi.Array(openapi.RefTo("Token"))},
+		Authenticated(), ListTokens)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/renew", Legacy: "/sys/auth/token/renew", Id: "renewToken",
+		Summary: "renew a token by accessor", Body: renewSchema, Result: tokenResultSchema},
+		Authenticated(), RenewByAccessor)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/revoke", Legacy: "/sys/auth/token/revoke", Id: "revokeToken",
+		Summary: "revoke a token by accessor", Body: accessorSchema},
+		Authenticated(), RevokeByAccessor)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/encryption-key-self", Id: "setEncryptionKeySelf",
+		Summary: "encrypt the credential responses of the token to a public key", Body: encryptionKeySchema},
+		Authenticated(), SetEncryptionKeySelf)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/encryption-key-self", Id: "deleteEncryptionKeySelf",
+		Summary: "send the credential responses of the token in clear"},
+		Authenticated(), DeleteEncryptionKeySelf)
+
+	initCertRoutes(openapi.NewGroup(scaffold.GetGin(), "cert", "/auth/cert", config.RequireUnsealed()))
+	return nil
+}
+
+var authModule config.Module = authModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, authModule)
+}
+
+func tokenFromRequest(ctx *gin.Context) string {
+	if t := ctx.GetHeader(TokenHeader); len(t) > 0 {
+		return t
+	}
+	a := ctx.GetHeader("Authorization")
+	if strings.HasPrefix(a, "Bearer ") {
+		return strings.TrimPrefix(a, "Bearer ")
+	}
+	return ""
+}
+
+// Authenticated requires a valid token and keeps it in the context
+func Authenticated() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !authenticate(ctx) {
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Require checks the policies of the token before the handler.
+// resource returns the path of the resource the request acts on, e.g. pg/<instance name>
+func Require(capability string, resource func(ctx *gin.Context) string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !authenticate(ctx) {
+			return
+		}
+		t := CurrentToken(ctx)
+		if !t.Allow(capability, resource(ctx)) {
+			apierr.Abort(ctx, apierr.Forbidden())
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireManager lets only root and admin tokens through to the handler, e.g. of the auth methods
+func RequireManager() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !authenticate(ctx) {
+			return
+		}
+		if !IsManager(CurrentToken(ctx)) {
+			apierr.Abort(ctx, apierr.Forbidden())
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// authenticate keeps the token of the request in the context, or aborts the request
+func authenticate(ctx *gin.Context) bool {
+	t, err := Authenticate(tokenFromRequest(ctx), ctx.Request.TLS)
+	if err != nil {
+		apierr.Abort(ctx, err)
+		return false
+	}
+	ctx.Set(tokenContextKey, t)
+	logging.Annotate(ctx, logging.F("principal", t.DisplayName), logging.F("accessor", t.Accessor))
+	return true
+}
+
+// Authenticate looks up a token, falling back to the verified client certificate of the connection when
+// it is empty. It is shared by every transport, errors are *apierr.Error.
+func Authenticate(token string, state *tls.ConnectionState) (*Token, error) {
+	if !config.IsUnsealed() {
+		return nil, apierr.Sealed()
+	}
+	if len(token) == 0 {
+		t, err := certToken(state)
+		if err != nil {
+			logging.Error("certToken error", logging.Err(err))
+			return nil, apierr.Internal(err)
+		}
+		if t == nil {
+			return nil, apierr.Unauthorized("missing token")
+		}
+		return t, nil
+	}
+	t, err := LookupToken(token)
+	if err == ErrTokenNotFound || err == ErrTokenExpired {
+		return nil, apierr.Unauthorized("invalid token")
+	}
+	if err != nil {
+		logging.Error("LookupToken error", logging.Err(err))
+		return nil, apierr.Internal(err)
+	}
+	return t, nil
+}
+
+// StaticResource is a resource function for routes without parameters
+func StaticResource(path string) func(ctx *gin.Context) string {
+	return func(ctx *gin.Context) string {
+		return path
+	}
+}
+
+func CurrentToken(ctx *gin.Context) *Token {
+	v, ok := ctx.Get(tokenContextKey)
+	if !ok {
+		return nil
+	}
+	return v.(*Token)
+}
+
+type createTokenRequest struct {
+	Type        string   `json:"type"`
+	DisplayName string   `json:"display_name"`
+	Policies    []Policy `json:"policies"`
+	PolicyNames []string `json:"policy_names"`
+	TTL         int64    `json:"ttl"`     // seconds
+	MaxTTL      int64    `json:"max_ttl"` // seconds
+}
+
+func CreateTokenHandler(ctx *gin.Context) {
+	req := new(createTokenRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		logging.FromContext(ctx).Error("bind json error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	if len(req.Type) == 0 {
+		req.Type = TokenTypeClient
+	}
+	for _, p := range req.Policies {
+		if !p.validate() {
+			apierr.Abort(ctx, apierr.InvalidField("policies", "invalid policy"))
+			return
+		}
+	}
+	if !ValidatePolicyNames(req.PolicyNames) {
+		apierr.Abort(ctx, apierr.InvalidField("policy_names", "invalid policy name"))
+		return
+	}
+
+	parent := CurrentToken(ctx)
+	// root creates any token, admin creates client tokens only
+	switch {
+	case parent.Type == TokenTypeRoot:
+	case parent.Type == TokenTypeAdmin && req.Type == TokenTypeClient:
+	default:
+		apierr.Abort(ctx, apierr.Forbidden())
+		return
+	}
+	switch req.Type {
+	case TokenTypeRoot, TokenTypeAdmin, TokenTypeClient:
+	default:
+		apierr.Abort(ctx, apierr.InvalidField("type", "unknown token type"))
+		return
+	}
+	// no token grants more than its parent, except those of root
+	if err := CheckGrant(parent, req.Policies, req.PolicyNames); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+
+	ttl := time.Duration(req.TTL) * time.Second
+	if ttl <= 0 && req.Type != TokenTypeRoot {
+		ttl = defaultTokenTTL
+	}
+	t := &Token{
+		Type:        req.Type,
+		DisplayName: req.DisplayName,
+		Policies:    req.Policies,
+		PolicyNames: req.PolicyNames,
+		Parent:      parent.Accessor,
+	}
+	token, err := CreateToken(t, ttl, time.Duration(req.MaxTTL)*time.Second)
+	if err != nil {
+		logging.FromContext(ctx).Error("CreateToken error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"token":      token,
+			"accessor":   t.Accessor,
+			"expire_at":  t.ExpireAt,
+			"token_type": t.Type,
+		},
+	})
+}
+
+func LookupSelf(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": CurrentToken(ctx),
+	})
+}
+
+type renewRequest struct {
+	Accessor  string `json:"accessor"`
+	Increment int64  `json:"increment"` // seconds
+}
+
+func RenewSelf(ctx *gin.Context) {
+	if !requireStoredToken(ctx) {
+		return
+	}
+	req := new(renewRequest)
+	_ = ctx.ShouldBindJSON(req)
+	t := CurrentToken(ctx)
+	renew(ctx, hashToken(tokenFromRequest(ctx)), t, req.Increment)
+}
+
+func RevokeSelf(ctx *gin.Context) {
+	if !requireStoredToken(ctx) {
+		return
+	}
+	revoke(ctx, hashToken(tokenFromRequest(ctx)), CurrentToken(ctx))
+}
+
+// requireStoredToken rejects requests authenticated without a token, e.g. by client certificate
+func requireStoredToken(ctx *gin.Context) bool {
+	if len(tokenFromRequest(ctx)) == 0 {
+		apierr.Abort(ctx, apierr.Validation("request is not authenticated by token"))
+		return false
+	}
+	return true
+}
+
+func RenewByAccessor(ctx *gin.Context) {
+	req := new(renewRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || len(req.Accessor) == 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	t, hash, ok := lookupManagedToken(ctx, req.Accessor)
+	if !ok {
+		return
+	}
+	renew(ctx, hash, t, req.Increment)
+}
+
+func RevokeByAccessor(ctx *gin.Context) {
+	req := new(renewRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || len(req.Accessor) == 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	t, hash, ok := lookupManagedToken(ctx, req.Accessor)
+	if !ok {
+		return
+	}
+	revoke(ctx, hash, t)
+}
+
+func ListTokens(ctx *gin.Context) {
+	if !canManageTokens(CurrentToken(ctx), nil) {
+		apierr.Abort(ctx, apierr.Forbidden())
+		return
+	}
+	tokens, err := listAccessors()
+	if err != nil {
+		logging.FromContext(ctx).Error("listAccessors error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": tokens,
+	})
+}
+
+// canManageTokens returns true for root tokens, and for admin tokens on client tokens
+func canManageTokens(current, target *Token) bool {
+	switch current.Type {
+	case TokenTypeRoot:
+		return true
+	case TokenTypeAdmin:
+		return target == nil || target.Type == TokenTypeClient
+	}
+	return false
+}
+
+func lookupManagedToken(ctx *gin.Context, accessor string) (*Token, string, bool) {
+	t, hash, err := lookupByAccessor(accessor)
+	if err == ErrTokenNotFound || err == ErrTokenExpired {
+		apierr.Abort(ctx, apierr.NotFound("token", accessor))
+		return nil, "", false
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("lookupByAccessor error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return nil, "", false
+	}
+	if !canManageTokens(CurrentToken(ctx), t) {
+		apierr.Abort(ctx, apierr.Forbidden())
+		return nil, "", false
+	}
+	return t, hash, true
+}
+
+func renew(ctx *gin.Context, hash string, t *Token, increment int64) {
+	err := renewToken(hash, t, time.Duration(increment)*time.Second)
+	if err != nil {
+		logging.FromContext(ctx).Error("renewToken error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"accessor":  t.Accessor,
+			"expire_at": t.ExpireAt,
+		},
+	})
+}
+
+func revoke(ctx *gin.Context, hash string, t *Token) {
+	err := revokeToken(hash, t)
+	if err != nil {
+		logging.FromContext(ctx).Error("revokeToken error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+// CheckGrant returns an error unless t may grant the policies and the named policies, to a token or to
+// the role or user of an auth method. Root grants anything. Other tokens never grant sys, and otherwise
+// only what they are granted themselves.
+func CheckGrant(t *Token, policies []Policy, policyNames []string) error {
+	if t.Type == TokenTypeRoot {
+		return nil
+	}
+	for _, p := range policies {
+		if containsString(p.Capabilities, CapabilitySys) {
+			return apierr.New(apierr.CodeForbidden, "only root grants "+CapabilitySys)
+		}
+		if !p.coveredBy(t.Policies) {
+			return apierr.New(apierr.CodeForbidden, "policy "+p.Path+" is not granted to the current token")
+		}
+	}
+	for _, name := range policyNames {
+		if !containsString(t.PolicyNames, name) {
+			return apierr.New(apierr.CodeForbidden, "policy "+name+" is not granted to the current token")
+		}
+	}
+	return nil
+}
+
+// IsManager returns true for tokens allowed to manage auth methods, i.e. root and admin tokens
+func IsManager(t *Token) bool {
+	return canManageTokens(t, nil)
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreateTokenPolicies(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	gin.SetMode(gin.TestMode)
+
+	create := func(parent *Token, req gin.H) int {
+		e := gin.New()
+		e.POST("/create", func(ctx *gin.Context) {
+			ctx.Set(tokenContextKey, parent)
+		}, CreateTokenHandler)
+		b, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/create", bytes.NewReader(b)))
+		return w.Code
+	}
+
+	admin := &Token{
+		Type:        TokenTypeAdmin,
+		Accessor:    "admin",
+		Policies:    []Policy{{Path: "pg/prod-*", Capabilities: []string{CapabilityReadCredential}}},
+		PolicyNames: []string{"readers"},
+	}
+	for _, tc := range []struct {
+		req  gin.H
+		code int
+	}{
+		{gin.H{"policies": []Policy{{Path: "pg/prod-1", Capabilities: []string{CapabilityReadCredential}}}, "policy_names": []string{"readers"}}, http.StatusOK},
+		{gin.H{"policies": []Policy{{Path: "*", Capabilities: []string{CapabilitySys}}}}, http.StatusForbidden},
+		{gin.H{"policies": []Policy{{Path: "pg/prod-1", Capabilities: []string{CapabilityRotateCredential}}}}, http.StatusForbidden},
+		{gin.H{"policy_names": []string{"admins"}}, http.StatusForbidden},
+		{gin.H{"type": TokenTypeAdmin}, http.StatusForbidden},
+	} {
+		if code := create(admin, tc.req); code != tc.code {
+			t.Error(tc.req, code)
+		}
+	}
+
+	root := &Token{Type: TokenTypeRoot, Accessor: "root"}
+	if code := create(root, gin.H{"policies": []Policy{{Path: "*", Capabilities: []string{CapabilitySys}}}, "policy_names": []string{"admins"}}); code != http.StatusOK {
+		t.Error("root is refused:", code)
+	}
+}
+
+func TestEnsureRootTokenOnce(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var tokens []string
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, generated, err := EnsureRootToken()
+			if err != nil {
+				t.Error(err)
+			}
+			if generated {
+				mu.Lock()
+				tokens = append(tokens, token)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(tokens) != 1 {
+		t.Fatal("root tokens generated:", len(tokens))
+	}
+	if tk, err := LookupToken(tokens[0]); err != nil || tk.Type != TokenTypeRoot {
+		t.Fatal(tk, err)
+	}
+	accessors, err := listAccessors()
+	if err != nil || len(accessors) != 1 {
+		t.Fatal("stored tokens:", len(accessors), err)
+	}
+}
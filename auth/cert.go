@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sort"
+	"strings"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+var certRoleKeyPrefix = []byte("cert.role.")
+
+// CertRole maps verified client certificates to policies.
+// Every non-empty allowed list must match the certificate. '*' can be used as in policy paths.
+type CertRole struct {
+	Name               string   `json:"name"`
+	AllowedCommonNames []string `json:"allowed_common_names"`
+	AllowedDNSSANs     []string `json:"allowed_dns_sans"`
+	AllowedURISANs     []string `json:"allowed_uri_sans"`
+	AllowedEmailSANs   []string `json:"allowed_email_sans"`
+	Policies           []Policy `json:"policies"`
+	PolicyNames        []string `json:"policy_names"`
+}
+
+func (r *CertRole) validate() bool {
+	if len(r.Name) == 0 {
+		return false
+	}
+	if len(r.AllowedCommonNames)+len(r.AllowedDNSSANs)+len(r.AllowedURISANs)+len(r.AllowedEmailSANs) == 0 {
+		return false
+	}
+	for _, p := range r.Policies {
+		if !p.validate() {
+			return false
+		}
+	}
+	return ValidatePolicyNames(r.PolicyNames)
+}
+
+// MatchAny returns true if any value matches any of the patterns, '*' allowed
+func MatchAny(patterns []string, values []string) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if globMatch(p, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *CertRole) match(cert *x509.Certificate) bool {
+	if len(r.AllowedCommonNames) > 0 && !MatchAny(r.AllowedCommonNames, []string{cert.Subject.CommonName}) {
+		return false
+	}
+	if len(r.AllowedDNSSANs) > 0 && !MatchAny(r.AllowedDNSSANs, cert.DNSNames) {
+		return false
+	}
+	if len(r.AllowedURISANs) > 0 {
+		var uris []string
+		for _, u := range cert.URIs {
+			uris = append(uris, u.String())
+		}
+		if !MatchAny(r.AllowedURISANs, uris) {
+			return false
+		}
+	}
+	if len(r.AllowedEmailSANs) > 0 && !MatchAny(r.AllowedEmailSANs, cert.EmailAddresses) {
+		return false
+	}
+	return true
+}
+
+func makeCertRoleKey(name string) []byte {
+	return append(append([]byte{}, certRoleKeyPrefix...), []byte(name)...)
+}
+
+func listCertRoles() ([]*CertRole, error) {
+	var r [][]byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(certRoleKeyPrefix, func(k, v []byte) error {
+			r = append(r, v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []*CertRole
+	for _, v := range r {
+		role := new(CertRole)
+		if err := container.OpenJSON(v, role); err != nil {
+			return nil, err
+		}
+		result = append(result, role)
+	}
+	return result, nil
+}
+
+// certToken builds a non-persistent client token from the verified client certificate
+func certToken(state *tls.ConnectionState) (*Token, error) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cert := state.VerifiedChains[0][0]
+	roles, err := listCertRoles()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var policies []Policy
+	var policyNames []string
+	for _, r := range roles {
+		if r.match(cert) {
+			names = append(names, r.Name)
+			policies = append(policies, r.Policies...)
+			policyNames = append(policyNames, r.PolicyNames...)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return &Token{
+		Accessor:    "cert:" + strings.Join(names, ","),
+		Type:        TokenTypeClient,
+		DisplayName: "cert:" + cert.Subject.CommonName,
+		Policies:    policies,
+		PolicyNames: policyNames,
+	}, nil
+}
+
+func initCertRoutes(g *openapi.Group) {
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/roles", Legacy: "/sys/auth/cert/roles", Id: "listCertRoles",
+		Summary: "list cert roles", Result: openapi.Array(certRoleSchema)},
+		RequireManager(), ListCertRoles)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/roles", Legacy: "/sys/auth/cert/role", Id: "putCertRole",
+		Summary: "create or replace a cert role", Body: certRoleSchema},
+		RequireManager(), PutCertRole)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/roles/:name", Legacy: "/sys/auth/cert/role/:name", Id: "deleteCertRole",
+		Summary: "delete a cert role"},
+		RequireManager(), DeleteCertRole)
+}
+
+func ListCertRoles(ctx *gin.Context) {
+	roles, err := listCertRoles()
+	if err != nil {
+		logging.FromContext(ctx).Error("listCertRoles error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": roles,
+	})
+}
+
+func PutCertRole(ctx *gin.Context) {
+	role := new(CertRole)
+	if err := ctx.ShouldBindJSON(role); err != nil || !role.validate() {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	if err := CheckGrant(CurrentToken(ctx), role.Policies, role.PolicyNames); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	b, err := container.SealJSON(role)
+	if err == nil {
+		err = container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+			return bucket.Put(makeCertRoleKey(role.Name), b)
+		})
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("save cert role error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func DeleteCertRole(ctx *gin.Context) {
+	name := ctx.Param("name")
+	err := container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Delete(makeCertRoleKey(name))
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("delete cert role error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
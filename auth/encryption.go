@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"goimport.moetang.info/nekoq-security/alg/jose"
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EncryptionKeyHeader carries the public key to encrypt the response to, a base64url encoded jwk.
+// It takes precedence over the key of the token.
+const EncryptionKeyHeader = "X-NekoQ-Encryption-Key"
+
+// ParseEncryptionKey parses a public jwk of an RSA key of at least 2048 bits, for RSA-OAEP or RSA-OAEP-256,
+// or of an EC key, for ECDH-ES
+func ParseEncryptionKey(b []byte) (*jose.JSONWebKey, error) {
+	k := new(jose.JSONWebKey)
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, err
+	}
+	if err := jose.ParseKey(k); err != nil {
+		return nil, err
+	}
+	if _, err := jose.KeyAlgorithm(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// EncryptedResponse encrypts the result of the handler to the key of the request or of its token, as a compact jwe.
+// It goes after authentication. Errors are sent as they are.
+func EncryptedResponse() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		k := CurrentToken(ctx).EncryptionKey
+		if h := ctx.GetHeader(EncryptionKeyHeader); len(h) > 0 {
+			b, err := base64.RawURLEncoding.DecodeString(h)
+			if err == nil {
+				k, err = ParseEncryptionKey(b)
+			}
+			if err != nil {
+				apierr.Abort(ctx, apierr.InvalidField(EncryptionKeyHeader, "invalid encryption key: "+err.Error()))
+				return
+			}
+		}
+		if k == nil {
+			ctx.Next()
+			return
+		}
+		r := openapi.Record(ctx)
+		ctx.Next()
+		r.Stop(ctx)
+
+		result, ok := r.Result()
+		if !ok {
+			if err := r.Send(); err != nil {
+				logging.FromContext(ctx).Error("write response error", logging.Err(err))
+			}
+			return
+		}
+		jwe, err := jose.EncryptCompact(result, k)
+		if err != nil {
+			logging.FromContext(ctx).Error("encrypt response error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"status": 0,
+			"result": gin.H{"jwe": jwe},
+		})
+	}
+}
+
+type encryptionKeyRequest struct {
+	JWK json.RawMessage `json:"jwk"`
+}
+
+// SetEncryptionKeySelf registers the public key the credential responses of the token are encrypted to
+func SetEncryptionKeySelf(ctx *gin.Context) {
+	if !requireStoredToken(ctx) {
+		return
+	}
+	req := new(encryptionKeyRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	k, err := ParseEncryptionKey(req.JWK)
+	if err != nil {
+		apierr.Abort(ctx, apierr.InvalidField("jwk", "invalid encryption key: "+err.Error()))
+		return
+	}
+	setEncryptionKeySelf(ctx, k)
+}
+
+// DeleteEncryptionKeySelf sends the credential responses of the token in clear again
+func DeleteEncryptionKeySelf(ctx *gin.Context) {
+	if !requireStoredToken(ctx) {
+		return
+	}
+	setEncryptionKeySelf(ctx, nil)
+}
+
+func setEncryptionKeySelf(ctx *gin.Context, k *jose.JSONWebKey) {
+	t := CurrentToken(ctx)
+	if err := setEncryptionKey(hashToken(tokenFromRequest(ctx)), t, k); err != nil {
+		logging.FromContext(ctx).Error("setEncryptionKey error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
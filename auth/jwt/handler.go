@@ -0,0 +1,167 @@
+package jwt
+
+import (
+	"net/http"
+	"regexp"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+var roleNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+type loginRequest struct {
+	Role string `json:"role"`
+	JWT  string `json:"jwt"`
+}
+
+func Login(ctx *gin.Context) {
+	req := new(loginRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || len(req.Role) == 0 || len(req.JWT) == 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	token, t, err := login(req.Role, req.JWT)
+	switch err {
+	case nil:
+	case ErrRoleNotFound, ErrInvalidJWT:
+		apierr.Abort(ctx, apierr.Unauthorized("invalid role or jwt"))
+		return
+	case ErrNotConfigured:
+		apierr.Abort(ctx, apierr.Validation(err.Error()))
+		return
+	default:
+		logging.FromContext(ctx).Error("jwt login error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"token":     token,
+			"accessor":  t.Accessor,
+			"expire_at": t.ExpireAt,
+		},
+	})
+}
+
+func GetConfig(ctx *gin.Context) {
+	c, err := loadConfig()
+	if err == ErrNotConfigured {
+		apierr.Abort(ctx, apierr.New(apierr.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("loadConfig error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": c,
+	})
+}
+
+func PutConfig(ctx *gin.Context) {
+	c := new(Config)
+	if err := ctx.ShouldBindJSON(c); err != nil || c.Leeway < 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	if _, err := c.keySet(); err != nil {
+		apierr.Abort(ctx, apierr.InvalidField("jwks", "invalid jwks: "+err.Error()))
+		return
+	}
+	if err := save(configKey, c); err != nil {
+		logging.FromContext(ctx).Error("save jwt config error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func PutRole(ctx *gin.Context) {
+	r := new(Role)
+	if err := ctx.ShouldBindJSON(r); err != nil || !roleNamePattern.MatchString(r.Name) {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	// without audience, tokens the issuer minted for any other service would be accepted
+	if len(r.BoundAudiences) == 0 {
+		apierr.Abort(ctx, apierr.InvalidField("bound_audiences", "role requires bound_audiences"))
+		return
+	}
+	for _, p := range r.Policies {
+		if !auth.ValidatePolicy(p) {
+			apierr.Abort(ctx, apierr.InvalidField("policies", "invalid policy"))
+			return
+		}
+	}
+	if !auth.ValidatePolicyNames(r.PolicyNames) {
+		apierr.Abort(ctx, apierr.InvalidField("policy_names", "invalid policy name"))
+		return
+	}
+	if err := auth.CheckGrant(auth.CurrentToken(ctx), r.Policies, r.PolicyNames); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	if err := save(makeRoleKey(r.Name), r); err != nil {
+		logging.FromContext(ctx).Error("save jwt role error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+// roleFromParam loads the role of the request or writes the error response
+func roleFromParam(ctx *gin.Context) (*Role, bool) {
+	r, err := loadRole(ctx.Param("name"))
+	if err == ErrRoleNotFound {
+		apierr.Abort(ctx, apierr.NotFound("role", ctx.Param("name")))
+		return nil, false
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("loadRole error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return nil, false
+	}
+	return r, true
+}
+
+func GetRole(ctx *gin.Context) {
+	r, ok := roleFromParam(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": r,
+	})
+}
+
+func DeleteRole(ctx *gin.Context) {
+	r, ok := roleFromParam(ctx)
+	if !ok {
+		return
+	}
+	err := deleteKey(makeRoleKey(r.Name))
+	if err != nil {
+		logging.FromContext(ctx).Error("delete jwt role error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
@@ -0,0 +1,309 @@
+package jwt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/jose"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+)
+
+const (
+	moduleName = "jwt"
+	namespace  = "sys.auth.jwt"
+
+	defaultLeeway = 60 * time.Second
+)
+
+var (
+	ErrNotConfigured = errors.New("jwt auth is not configured")
+	ErrRoleNotFound  = errors.New("role not found")
+	ErrInvalidJWT    = errors.New("invalid jwt")
+)
+
+var (
+	configKey     = []byte("config")
+	roleKeyPrefix = []byte("role.")
+)
+
+var container *config.NekoQSecurityContainer
+
+type jwtModuleType struct {
+}
+
+func (j jwtModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	return nil
+}
+
+func (j jwtModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	g := openapi.NewGroup(scaffold.GetGin(), "jwt", "/auth/jwt", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/login", Legacy: "/sys/auth/jwt/login", Id: "jwtLogin",
+		Summary: "log in with a jwt of a role", Public: true, Body: loginSchema, Result: openapi.RefTo("Login")},
+		Login)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/config", Legacy: "/sys/auth/jwt/config", Id: "getJwtConfig",
+		Summary: "read the jwks and issuer configuration", Result: configSchema},
+		auth.RequireManager(), GetConfig)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/config", Legacy: "/sys/auth/jwt/config", Id: "putJwtConfig",
+		Summary: "set the jwks and issuer configuration", Body: configSchema},
+		auth.RequireManager(), PutConfig)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/roles", Legacy: "/sys/auth/jwt/role", Id: "putJwtRole",
+		Summary: "create or replace a role", Body: roleSchema},
+		auth.RequireManager(), PutRole)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/roles/:name", Legacy: "/sys/auth/jwt/role/:name", Id: "getJwtRole",
+		Summary: "read a role", PathParams: nameParam, Result: roleSchema},
+		auth.RequireManager(), GetRole)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/roles/:name", Legacy: "/sys/auth/jwt/role/:name", Id: "deleteJwtRole",
+		Summary: "delete a role", PathParams: nameParam},
+		auth.RequireManager(), DeleteRole)
+	return nil
+}
+
+var jwtModule config.Module = jwtModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, jwtModule)
+}
+
+// Config of the jwt auth method. Keys come from JWKS or, if empty, from the jwt.jwks_file of the server config,
+// which only the operator sets.
+type Config struct {
+	JWKS        json.RawMessage `json:"jwks,omitempty"`
+	BoundIssuer string          `json:"bound_issuer"`
+	Leeway      int64           `json:"leeway"` // seconds of clock skew allowed, default 60
+}
+
+func (c *Config) keySet() (*jose.JSONWebKeySet, error) {
+	b := []byte(c.JWKS)
+	if len(b) == 0 {
+		if len(container.JWKSFile) == 0 {
+			return nil, ErrNotConfigured
+		}
+		fb, err := ioutil.ReadFile(container.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		b = fb
+	}
+	return jose.ParseJWKS(b)
+}
+
+// Role maps verified tokens to policies. Every bound claim must match one of its values, '*' allowed.
+// A claim name starting with '/' is a path into nested claims, e.g. /kubernetes.io/namespace
+type Role struct {
+	Name           string              `json:"name"`
+	BoundAudiences []string            `json:"bound_audiences"`
+	BoundSubject   string              `json:"bound_subject"`
+	BoundClaims    map[string][]string `json:"bound_claims"`
+	UserClaim      string              `json:"user_claim"` // used as display name, default sub
+	Policies       []auth.Policy       `json:"policies"`
+	PolicyNames    []string            `json:"policy_names"`
+	TokenTTL       int64               `json:"token_ttl"`     // seconds
+	TokenMaxTTL    int64               `json:"token_max_ttl"` // seconds
+}
+
+func load(key []byte, v interface{}) (bool, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(key)
+		return nil
+	})
+	if err != nil || len(b) == 0 {
+		return false, err
+	}
+	return true, container.OpenJSON(b, v)
+}
+
+func save(key []byte, v interface{}) error {
+	b, err := container.SealJSON(v)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(key, b)
+	})
+}
+
+func deleteKey(key []byte) error {
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Delete(key)
+	})
+}
+
+func makeRoleKey(name string) []byte {
+	return append(append([]byte{}, roleKeyPrefix...), []byte(name)...)
+}
+
+func loadConfig() (*Config, error) {
+	c := new(Config)
+	exist, err := load(configKey, c)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrNotConfigured
+	}
+	return c, nil
+}
+
+func loadRole(name string) (*Role, error) {
+	r := new(Role)
+	exist, err := load(makeRoleKey(name), r)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrRoleNotFound
+	}
+	return r, nil
+}
+
+// claimValue resolves a claim name or a '/' separated path into nested claims
+func claimValue(claims map[string]interface{}, name string) (interface{}, bool) {
+	if !strings.HasPrefix(name, "/") {
+		v, ok := claims[name]
+		return v, ok
+	}
+	var cur interface{} = claims
+	for _, p := range strings.Split(name[1:], "/") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[p]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func claimStrings(v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var r []string
+		for _, i := range c {
+			r = append(r, claimStrings(i)...)
+		}
+		return r
+	case nil:
+		return nil
+	default:
+		// numbers and booleans
+		return []string{fmt.Sprint(c)}
+	}
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	v, ok := claims[name].(float64)
+	return int64(v), ok
+}
+
+// validateClaims checks issuer, expiry, audience, subject and bound claims
+func validateClaims(c *Config, r *Role, claims map[string]interface{}, now time.Time) error {
+	leeway := defaultLeeway
+	if c.Leeway > 0 {
+		leeway = time.Duration(c.Leeway) * time.Second
+	}
+	if len(c.BoundIssuer) > 0 && claims["iss"] != c.BoundIssuer {
+		return errors.New("issuer mismatch")
+	}
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.Add(-leeway).Unix() >= exp {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(leeway).Unix() < nbf {
+		return errors.New("token not valid yet")
+	}
+	// roles saved before bound_audiences was required accept no login until one is set
+	if len(r.BoundAudiences) == 0 {
+		return errors.New("role has no bound_audiences")
+	}
+	if !auth.MatchAny(r.BoundAudiences, claimStrings(claims["aud"])) {
+		return errors.New("audience mismatch")
+	}
+	if len(r.BoundSubject) > 0 && claims["sub"] != r.BoundSubject {
+		return errors.New("subject mismatch")
+	}
+	for name, allowed := range r.BoundClaims {
+		v, ok := claimValue(claims, name)
+		if !ok || !auth.MatchAny(allowed, claimStrings(v)) {
+			return fmt.Errorf("claim %s mismatch", name)
+		}
+	}
+	return nil
+}
+
+// login verifies the jwt for the role and issues a client token
+func login(roleName, token string) (string, *auth.Token, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := loadRole(roleName)
+	if err != nil {
+		return "", nil, err
+	}
+	set, err := c.keySet()
+	if err != nil {
+		return "", nil, err
+	}
+	_, payload, err := jose.VerifyCompact(token, set)
+	if err != nil {
+		logging.Warn("jwt login rejected", logging.Err(err))
+		return "", nil, ErrInvalidJWT
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		logging.Warn("jwt login rejected", logging.Err(err))
+		return "", nil, ErrInvalidJWT
+	}
+	if err := validateClaims(c, r, claims, time.Now()); err != nil {
+		logging.Warn("jwt login rejected", logging.Err(err))
+		return "", nil, ErrInvalidJWT
+	}
+
+	userClaim := r.UserClaim
+	if len(userClaim) == 0 {
+		userClaim = "sub"
+	}
+	user := ""
+	if v, ok := claimValue(claims, userClaim); ok {
+		user = strings.Join(claimStrings(v), ",")
+	}
+	t := &auth.Token{
+		Type:        auth.TokenTypeClient,
+		DisplayName: "jwt:" + r.Name + ":" + user,
+		Policies:    r.Policies,
+		PolicyNames: r.PolicyNames,
+	}
+	ttl := time.Duration(r.TokenTTL) * time.Second
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	// never outlive the identity token
+	maxTTL := time.Duration(r.TokenMaxTTL) * time.Second
+	if exp, ok := numericClaim(claims, "exp"); ok {
+		remain := time.Until(time.Unix(exp, 0))
+		if remain > 0 && (maxTTL <= 0 || remain < maxTTL) {
+			maxTTL = remain
+		}
+	}
+	issued, err := auth.CreateToken(t, ttl, maxTTL)
+	return issued, t, err
+}
@@ -0,0 +1,63 @@
+package jwt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestValidateClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &Config{BoundIssuer: "https://issuer"}
+	r := &Role{
+		Name:           "deploy",
+		BoundAudiences: []string{"nekoq"},
+		BoundClaims: map[string][]string{
+			"repository":               {"org/*"},
+			"/kubernetes.io/namespace": {"prod"},
+		},
+	}
+	parse := func(s string) map[string]interface{} {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	valid := `{"iss":"https://issuer","aud":["other","nekoq"],"exp":1700000100,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`
+	if err := validateClaims(c, r, parse(valid), now); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`{"iss":"https://other","aud":"nekoq","exp":1700000100,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`,
+		`{"iss":"https://issuer","aud":"nekoq","exp":1699999000,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`,
+		`{"iss":"https://issuer","aud":"nekoq","repository":"org/app","kubernetes.io":{"namespace":"prod"}}`,
+		`{"iss":"https://issuer","aud":"nekoq","exp":1700000100,"nbf":1700001000,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`,
+		`{"iss":"https://issuer","aud":"other","exp":1700000100,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`,
+		`{"iss":"https://issuer","aud":"nekoq","exp":1700000100,"repository":"evil/app","kubernetes.io":{"namespace":"prod"}}`,
+		`{"iss":"https://issuer","aud":"nekoq","exp":1700000100,"repository":"org/app","kubernetes.io":{"namespace":"dev"}}`,
+		`{"iss":"https://issuer","aud":"nekoq","exp":1700000100,"repository":"org/app"}`,
+	} {
+		if err := validateClaims(c, r, parse(s), now); err == nil {
+			t.Fatal("claims should be rejected:", s)
+		}
+	}
+	// a role without audience accepts no token until one is set
+	legacy := &Role{Name: "legacy", BoundSubject: "ci"}
+	for _, s := range []string{
+		`{"iss":"https://issuer","aud":"other","sub":"ci","exp":1700000100}`,
+		`{"iss":"https://issuer","sub":"ci","exp":1700000100}`,
+	} {
+		if err := validateClaims(c, legacy, parse(s), now); err == nil {
+			t.Fatal("token accepted by a role without bound_audiences:", s)
+		}
+	}
+	if err := validateClaims(c, r, parse(`{"iss":"https://issuer","exp":1700000100,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`), now); err == nil {
+		t.Fatal("token without audience accepted")
+	}
+	// within leeway
+	late := `{"iss":"https://issuer","aud":"nekoq","exp":1699999990,"repository":"org/app","kubernetes.io":{"namespace":"prod"}}`
+	if err := validateClaims(c, r, parse(late), now); err != nil {
+		t.Fatal(err)
+	}
+}
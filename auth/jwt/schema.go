@@ -0,0 +1,30 @@
+package jwt
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+var (
+	configSchema = openapi.Object(map[string]*openapi.Schema{
+		"jwks":         openapi.Object(nil).Describe("json web key set, the jwt.jwks_file of the server config when empty"),
+		"bound_issuer": openapi.String(),
+		"leeway":       openapi.Integer().Min(0).Describe("seconds of clock skew allowed, default 60"),
+	})
+	roleSchema = openapi.Object(map[string]*openapi.Schema{
+		"name":            openapi.String().Match(roleNamePattern.String()),
+		"bound_audiences": openapi.Array(openapi.String()).Describe("required, the aud claim must match one of them"),
+		"bound_subject":   openapi.String(),
+		"bound_claims":    openapi.Map(openapi.Array(openapi.String())).Describe("claim names starting with / address nested claims"),
+		"user_claim":      openapi.String(),
+		"policies":        openapi.Array(openapi.RefTo("Policy")),
+		"policy_names":    openapi.RefTo("PolicyNames"),
+		"token_ttl":       auth.TTLSchema(),
+		"token_max_ttl":   auth.TTLSchema(),
+	}).Require("name", "bound_audiences")
+	loginSchema = openapi.Object(map[string]*openapi.Schema{
+		"role": openapi.String().NonEmpty(),
+		"jwt":  openapi.String().NonEmpty(),
+	}).Require("role", "jwt")
+	nameParam = map[string]*openapi.Schema{"name": openapi.String().Match(roleNamePattern.String())}
+)
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	CapabilityListInstance     = "list-instance"
+	CapabilityReadInstance     = "read-instance"
+	CapabilityManageInstance   = "manage-instance"
+	CapabilityReadCredential   = "read-credential"
+	CapabilityRotateCredential = "rotate-credential"
+	CapabilitySys              = "sys"
+)
+
+var allCapabilities = map[string]bool{
+	CapabilityListInstance:     true,
+	CapabilityReadInstance:     true,
+	CapabilityManageInstance:   true,
+	CapabilityReadCredential:   true,
+	CapabilityRotateCredential: true,
+	CapabilitySys:              true,
+}
+
+// Policy grants capabilities on the resources matching Path.
+// In Path, '*' matches any sequence of characters, e.g. pg/prod-*
+type Policy struct {
+	Path         string   `json:"path"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (p Policy) validate() bool {
+	if len(p.Path) == 0 || len(p.Capabilities) == 0 {
+		return false
+	}
+	for _, v := range p.Capabilities {
+		if !allCapabilities[v] {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidatePolicy(p Policy) bool {
+	return p.validate()
+}
+
+var policyNamePattern = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// ValidatePolicyNames checks names referring to named ACL policies
+func ValidatePolicyNames(names []string) bool {
+	for _, v := range names {
+		if !policyNamePattern.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Policy) allow(capability, resource string) bool {
+	if !globMatch(p.Path, resource) {
+		return false
+	}
+	for _, v := range p.Capabilities {
+		if v == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredBy returns true when the policies grant every capability of p on every resource p matches.
+// The path of p is matched literally: its '*' can only be matched by a '*' of theirs, which matches anything.
+func (p Policy) coveredBy(policies []Policy) bool {
+	for _, c := range p.Capabilities {
+		covered := false
+		for _, v := range policies {
+			if v.allow(c, p.Path) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		idx := strings.Index(s, p)
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(p):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package auth
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "pg/prod-1", true},
+		{"pg/prod-*", "pg/prod-1", true},
+		{"pg/prod-*", "pg/test-1", false},
+		{"pg/*-main", "pg/prod-main", true},
+		{"pg/*-main", "pg/prod-main-2", false},
+		{"pg/a*b*c", "pg/aXXbYYc", true},
+		{"pg/inst", "pg/inst", true},
+		{"pg/inst", "pg/inst2", false},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Error("unexpected result:", c.pattern, c.s)
+		}
+	}
+}
+
+func TestTokenAllow(t *testing.T) {
+	tk := &Token{
+		Type: TokenTypeClient,
+		Policies: []Policy{
+			{Path: "pg/prod-*", Capabilities: []string{CapabilityReadCredential}},
+			{Path: "*", Capabilities: []string{CapabilityListInstance}},
+		},
+	}
+	if !tk.Allow(CapabilityReadCredential, "pg/prod-1") {
+		t.Error("read-credential on pg/prod-1 should be allowed")
+	}
+	if tk.Allow(CapabilityRotateCredential, "pg/prod-1") {
+		t.Error("rotate-credential on pg/prod-1 should be denied")
+	}
+	if tk.Allow(CapabilityReadCredential, "pg/test-1") {
+		t.Error("read-credential on pg/test-1 should be denied")
+	}
+	if !tk.Allow(CapabilityListInstance, "pg/") {
+		t.Error("list-instance should be allowed")
+	}
+	root := &Token{Type: TokenTypeRoot}
+	if !root.Allow(CapabilitySys, "sys/verify") {
+		t.Error("root should be allowed")
+	}
+}
+
+func TestPolicyCoveredBy(t *testing.T) {
+	parent := []Policy{
+		{Path: "pg/prod-*", Capabilities: []string{CapabilityReadCredential, CapabilityReadInstance}},
+		{Path: "pg/test-1", Capabilities: []string{CapabilityRotateCredential}},
+	}
+	cases := []struct {
+		p       Policy
+		covered bool
+	}{
+		{Policy{Path: "pg/prod-1", Capabilities: []string{CapabilityReadCredential}}, true},
+		{Policy{Path: "pg/prod-*", Capabilities: []string{CapabilityReadCredential, CapabilityReadInstance}}, true},
+		{Policy{Path: "pg/prod-a*", Capabilities: []string{CapabilityReadInstance}}, true},
+		{Policy{Path: "pg/prod-1", Capabilities: []string{CapabilityRotateCredential}}, false},
+		{Policy{Path: "pg/*", Capabilities: []string{CapabilityReadCredential}}, false},
+		{Policy{Path: "*", Capabilities: []string{CapabilitySys}}, false},
+		{Policy{Path: "pg/test-*", Capabilities: []string{CapabilityRotateCredential}}, false},
+		{Policy{Path: "pg/test-1", Capabilities: []string{CapabilityRotateCredential}}, true},
+	}
+	for _, c := range cases {
+		if c.p.coveredBy(parent) != c.covered {
+			t.Error("unexpected result:", c.p)
+		}
+	}
+}
+
+func TestCheckGrant(t *testing.T) {
+	admin := &Token{
+		Type:        TokenTypeAdmin,
+		Policies:    []Policy{{Path: "*", Capabilities: []string{CapabilitySys, CapabilityReadCredential}}},
+		PolicyNames: []string{"readers"},
+	}
+	cases := []struct {
+		policies []Policy
+		names    []string
+		granted  bool
+	}{
+		{[]Policy{{Path: "pg/prod-1", Capabilities: []string{CapabilityReadCredential}}}, []string{"readers"}, true},
+		{[]Policy{{Path: "*", Capabilities: []string{CapabilitySys}}}, nil, false},
+		{[]Policy{{Path: "pg/prod-1", Capabilities: []string{CapabilityRotateCredential}}}, nil, false},
+		{nil, []string{"admins"}, false},
+	}
+	for _, c := range cases {
+		if (CheckGrant(admin, c.policies, c.names) == nil) != c.granted {
+			t.Error("unexpected result:", c.policies, c.names)
+		}
+	}
+	root := &Token{Type: TokenTypeRoot}
+	if err := CheckGrant(root, []Policy{{Path: "*", Capabilities: []string{CapabilitySys}}}, []string{"admins"}); err != nil {
+		t.Error("root is refused:", err)
+	}
+}
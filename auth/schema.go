@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"sort"
+
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+// schemas shared by the auth methods, referred to by openapi.RefTo
+func init() {
+	var capabilities []string
+	for k := range allCapabilities {
+		capabilities = append(capabilities, k)
+	}
+	sort.Strings(capabilities)
+	openapi.RegisterSchema("Policy", openapi.Object(map[string]*openapi.Schema{
+		"path":         openapi.String().NonEmpty().Describe("resource glob, e.g. pg/prod-*"),
+		"capabilities": openapi.Array(openapi.String().OneOf(capabilities...)).NonEmpty(),
+	}).Require("path", "capabilities"))
+	openapi.RegisterSchema("PolicyNames", openapi.Array(openapi.String().Match(policyNamePattern.String())).
+		Describe("named acl policies"))
+	openapi.RegisterSchema("Token", openapi.Object(map[string]*openapi.Schema{
+		"accessor":       openapi.String(),
+		"type":           openapi.String().OneOf(TokenTypeRoot, TokenTypeAdmin, TokenTypeClient),
+		"display_name":   openapi.String(),
+		"policies":       openapi.Array(openapi.RefTo("Policy")),
+		"policy_names":   openapi.RefTo("PolicyNames"),
+		"created_at":     openapi.Integer(),
+		"expire_at":      openapi.Integer(),
+		"max_expire_at":  openapi.Integer(),
+		"parent":         openapi.String(),
+		"encryption_key": openapi.Object(nil).Describe("public jwk credential responses are encrypted to"),
+	}))
+	openapi.RegisterSchema("Login", openapi.Object(map[string]*openapi.Schema{
+		"token":     openapi.String(),
+		"accessor":  openapi.String(),
+		"expire_at": openapi.Integer(),
+	}))
+}
+
+// TTLSchema is a duration in seconds, 0 for the default
+func TTLSchema() *openapi.Schema {
+	return openapi.Integer().Min(0).Describe("seconds")
+}
+
+var (
+	createTokenSchema = openapi.Object(map[string]*openapi.Schema{
+		"type":         openapi.String().OneOf(TokenTypeRoot, TokenTypeAdmin, TokenTypeClient),
+		"display_name": openapi.String(),
+		"policies":     openapi.Array(openapi.RefTo("Policy")),
+		"policy_names": openapi.RefTo("PolicyNames"),
+		"ttl":          TTLSchema(),
+		"max_ttl":      TTLSchema(),
+	})
+	encryptionKeySchema = openapi.Object(map[string]*openapi.Schema{
+		"jwk": openapi.Object(nil).Describe("public jwk, RSA for RSA-OAEP or RSA-OAEP-256, EC for ECDH-ES"),
+	}).Require("jwk")
+	renewSelfSchema = openapi.Object(map[string]*openapi.Schema{
+		"increment": TTLSchema(),
+	})
+	renewSchema = openapi.Object(map[string]*openapi.Schema{
+		"accessor":  openapi.String().NonEmpty(),
+		"increment": TTLSchema(),
+	}).Require("accessor")
+	accessorSchema = openapi.Object(map[string]*openapi.Schema{
+		"accessor": openapi.String().NonEmpty(),
+	}).Require("accessor")
+	certRoleSchema = openapi.Object(map[string]*openapi.Schema{
+		"name":                 openapi.String().NonEmpty(),
+		"allowed_common_names": openapi.Array(openapi.String()),
+		"allowed_dns_sans":     openapi.Array(openapi.String()),
+		"allowed_uri_sans":     openapi.Array(openapi.String()),
+		"allowed_email_sans":   openapi.Array(openapi.String()),
+		"policies":             openapi.Array(openapi.RefTo("Policy")),
+		"policy_names":         openapi.RefTo("PolicyNames"),
+	}).Require("name")
+	tokenResultSchema = openapi.Object(map[string]*openapi.Schema{
+		"accessor":  openapi.String(),
+		"expire_at": openapi.Integer(),
+	})
+)
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/jose"
+	"goimport.moetang.info/nekoq-security/config"
+)
+
+const (
+	TokenTypeRoot   = "root"
+	TokenTypeAdmin  = "admin"
+	TokenTypeClient = "client"
+
+	tokenPrefix = "nqs."
+
+	defaultTokenTTL = 24 * time.Hour
+)
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
+var (
+	tokenKeyPrefix    = []byte("token.")
+	accessorKeyPrefix = []byte("accessor.")
+	rootGeneratedKey  = []byte("root_token_generated")
+)
+
+// Token is stored hashed. Only the accessor can be used to refer to a token without knowing it.
+type Token struct {
+	Accessor    string   `json:"accessor"`
+	Type        string   `json:"type"`
+	DisplayName string   `json:"display_name"`
+	Policies    []Policy `json:"policies"`
+	PolicyNames []string `json:"policy_names,omitempty"` // named ACL policies
+	CreatedAt   int64    `json:"created_at"`
+	ExpireAt    int64    `json:"expire_at"` // 0 for never
+	MaxExpireAt int64    `json:"max_expire_at"`
+	Parent      string   `json:"parent"` // accessor of the creator
+	// public key credential responses are encrypted to, see EncryptedResponse
+	EncryptionKey *jose.JSONWebKey `json:"encryption_key,omitempty"`
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return t.ExpireAt > 0 && now.Unix() >= t.ExpireAt
+}
+
+// Allow checks whether the token has capability on resource
+func (t *Token) Allow(capability, resource string) bool {
+	if t.Type == TokenTypeRoot {
+		return true
+	}
+	for _, p := range t.Policies {
+		if p.allow(capability, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func makeTokenKey(hash string) []byte {
+	return append(append([]byte{}, tokenKeyPrefix...), []byte(hash)...)
+}
+
+func makeAccessorKey(accessor string) []byte {
+	return append(append([]byte{}, accessorKeyPrefix...), []byte(accessor)...)
+}
+
+func marshallAndEncToken(t *Token) ([]byte, error) {
+	return container.SealJSON(t)
+}
+
+func decAndUnmarshallToken(b []byte) (*Token, error) {
+	t := new(Token)
+	if err := container.OpenJSON(b, t); err != nil {
+		return nil, err
+	}
+	if t.EncryptionKey != nil {
+		if err := jose.ParseKey(t.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// CreateToken stores a new token and returns the token string which is never stored in plaintext.
+// ttl and maxTTL of 0 means the token never expires.
+func CreateToken(t *Token, ttl, maxTTL time.Duration) (string, error) {
+	token, hash, b, err := newToken(t, ttl, maxTTL)
+	if err != nil {
+		return "", err
+	}
+	err = container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return putToken(bucket, hash, t.Accessor, b)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newToken generates the token and the accessor of t, and returns the token, its hash and the sealed record
+func newToken(t *Token, ttl, maxTTL time.Duration) (string, string, []byte, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", "", nil, err
+	}
+	token = tokenPrefix + token
+	accessor, err := randomString(16)
+	if err != nil {
+		return "", "", nil, err
+	}
+	now := time.Now()
+	t.Accessor = accessor
+	t.CreatedAt = now.Unix()
+	if ttl > 0 {
+		t.ExpireAt = now.Add(ttl).Unix()
+	}
+	if maxTTL > 0 {
+		t.MaxExpireAt = now.Add(maxTTL).Unix()
+		if t.ExpireAt == 0 || t.ExpireAt > t.MaxExpireAt {
+			t.ExpireAt = t.MaxExpireAt
+		}
+	}
+
+	b, err := marshallAndEncToken(t)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return token, hashToken(token), b, nil
+}
+
+func putToken(bucket *config.Bucket, hash, accessor string, b []byte) error {
+	if err := bucket.Put(makeTokenKey(hash), b); err != nil {
+		return err
+	}
+	return bucket.Put(makeAccessorKey(accessor), []byte(hash))
+}
+
+// LookupToken returns a valid token
+func LookupToken(token string) (*Token, error) {
+	t, _, err := lookupByHash(hashToken(token))
+	return t, err
+}
+
+func lookupByHash(hash string) (*Token, string, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makeTokenKey(hash))
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(b) == 0 {
+		return nil, "", ErrTokenNotFound
+	}
+	t, err := decAndUnmarshallToken(b)
+	if err != nil {
+		return nil, "", err
+	}
+	if t.expired(time.Now()) {
+		return nil, "", ErrTokenExpired
+	}
+	return t, hash, nil
+}
+
+func lookupByAccessor(accessor string) (*Token, string, error) {
+	var hash []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		hash = bucket.Get(makeAccessorKey(accessor))
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(hash) == 0 {
+		return nil, "", ErrTokenNotFound
+	}
+	return lookupByHash(string(hash))
+}
+
+// renewToken extends the token ttl by increment, capped by its max ttl
+func renewToken(hash string, t *Token, increment time.Duration) error {
+	if t.ExpireAt == 0 {
+		return nil
+	}
+	if increment <= 0 {
+		increment = defaultTokenTTL
+	}
+	t.ExpireAt = time.Now().Add(increment).Unix()
+	if t.MaxExpireAt > 0 && t.ExpireAt > t.MaxExpireAt {
+		t.ExpireAt = t.MaxExpireAt
+	}
+	b, err := marshallAndEncToken(t)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makeTokenKey(hash), b)
+	})
+}
+
+func setEncryptionKey(hash string, t *Token, k *jose.JSONWebKey) error {
+	t.EncryptionKey = k
+	b, err := marshallAndEncToken(t)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makeTokenKey(hash), b)
+	})
+}
+
+func revokeToken(hash string, t *Token) error {
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		if err := bucket.Delete(makeTokenKey(hash)); err != nil {
+			return err
+		}
+		return bucket.Delete(makeAccessorKey(t.Accessor))
+	})
+}
+
+func listAccessors() ([]*Token, error) {
+	var r [][]byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(tokenKeyPrefix, func(k, v []byte) error {
+			r = append(r, v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []*Token
+	for _, v := range r {
+		t, err := decAndUnmarshallToken(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// EnsureRootToken generates the initial root token if none has been generated yet.
+// The returned token must be handed to the operator since it cannot be recovered.
+func EnsureRootToken() (string, bool, error) {
+	if container == nil {
+		return "", false, errors.New("auth module is not initialized")
+	}
+	t := &Token{Type: TokenTypeRoot, DisplayName: "root"}
+	token, hash, b, err := newToken(t, 0, 0)
+	if err != nil {
+		return "", false, err
+	}
+	// checked and marked in the transaction creating the token, so that concurrent unlocks create one root token
+	generated := false
+	err = container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		if len(bucket.Get(rootGeneratedKey)) > 0 {
+			return nil
+		}
+		generated = true
+		if err := putToken(bucket, hash, t.Accessor, b); err != nil {
+			return err
+		}
+		return bucket.Put(rootGeneratedKey, []byte("1"))
+	})
+	if err != nil || !generated {
+		return "", false, err
+	}
+	return token, true, nil
+}
@@ -0,0 +1,271 @@
+package userpass
+
+import (
+	"net/http"
+	"regexp"
+
+	"goimport.moetang.info/nekoq-security/alg/totp"
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+var usernamePattern = regexp.MustCompile("^[A-Za-z0-9_.@-]+$")
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TOTPCode string `json:"totp_code"`
+}
+
+type changePasswordRequest struct {
+	loginRequest
+	NewPassword string `json:"new_password"`
+}
+
+type putUserRequest struct {
+	Username    string        `json:"username"`
+	Password    string        `json:"password"`
+	Policies    []auth.Policy `json:"policies"`
+	PolicyNames []string      `json:"policy_names"`
+	TokenTTL    int64         `json:"token_ttl"`
+	TokenMaxTTL int64         `json:"token_max_ttl"`
+}
+
+// userView is the user without its secrets
+type userView struct {
+	Username       string        `json:"username"`
+	Policies       []auth.Policy `json:"policies"`
+	PolicyNames    []string      `json:"policy_names"`
+	TokenTTL       int64         `json:"token_ttl"`
+	TokenMaxTTL    int64         `json:"token_max_ttl"`
+	TOTPEnabled    bool          `json:"totp_enabled"`
+	FailedAttempts int           `json:"failed_attempts"`
+	LockedUntil    int64         `json:"locked_until"`
+	CreatedAt      int64         `json:"created_at"`
+	LastLoginAt    int64         `json:"last_login_at"`
+}
+
+func toView(u *User) *userView {
+	return &userView{
+		Username:       u.Username,
+		Policies:       u.Policies,
+		PolicyNames:    u.PolicyNames,
+		TokenTTL:       u.TokenTTL,
+		TokenMaxTTL:    u.TokenMaxTTL,
+		TOTPEnabled:    len(u.TOTPSecret) > 0,
+		FailedAttempts: u.FailedAttempts,
+		LockedUntil:    u.LockedUntil,
+		CreatedAt:      u.CreatedAt,
+		LastLoginAt:    u.LastLoginAt,
+	}
+}
+
+// writeAuthError writes the response of a failed authentication
+func writeAuthError(ctx *gin.Context, username string, err error) {
+	switch err {
+	case ErrInvalidCredentials:
+		logging.FromContext(ctx).Warn("userpass authentication failed", logging.F("username", username))
+		apierr.Abort(ctx, apierr.Unauthorized(err.Error()))
+	case ErrUserLocked:
+		logging.FromContext(ctx).Warn("userpass authentication of locked user", logging.F("username", username))
+		apierr.Abort(ctx, apierr.New(apierr.CodeLocked, err.Error()))
+	default:
+		logging.FromContext(ctx).Error("userpass authentication error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+	}
+}
+
+func Login(ctx *gin.Context) {
+	req := new(loginRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || len(req.Username) == 0 || len(req.Password) == 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	token, t, err := login(req.Username, req.Password, req.TOTPCode)
+	if err != nil {
+		writeAuthError(ctx, req.Username, err)
+		return
+	}
+	logging.FromContext(ctx).Info("userpass login", logging.F("username", req.Username))
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"token":     token,
+			"accessor":  t.Accessor,
+			"expire_at": t.ExpireAt,
+		},
+	})
+}
+
+func ChangePassword(ctx *gin.Context) {
+	req := new(changePasswordRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || len(req.Username) == 0 || len(req.Password) == 0 {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		apierr.Abort(ctx, apierr.InvalidField("new_password", "password too short"))
+		return
+	}
+	if err := changePassword(req.Username, req.Password, req.TOTPCode, req.NewPassword); err != nil {
+		writeAuthError(ctx, req.Username, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func ListUsers(ctx *gin.Context) {
+	users, err := listUsers()
+	if err != nil {
+		logging.FromContext(ctx).Error("listUsers error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	result := make([]*userView, 0, len(users))
+	for _, u := range users {
+		result = append(result, toView(u))
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": result,
+	})
+}
+
+func PutUser(ctx *gin.Context) {
+	req := new(putUserRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil || !usernamePattern.MatchString(req.Username) {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	if len(req.Password) > 0 && len(req.Password) < minPasswordLength {
+		apierr.Abort(ctx, apierr.InvalidField("password", "password too short"))
+		return
+	}
+	for _, p := range req.Policies {
+		if !auth.ValidatePolicy(p) {
+			apierr.Abort(ctx, apierr.InvalidField("policies", "invalid policy"))
+			return
+		}
+	}
+	if !auth.ValidatePolicyNames(req.PolicyNames) {
+		apierr.Abort(ctx, apierr.InvalidField("policy_names", "invalid policy name"))
+		return
+	}
+	if err := auth.CheckGrant(auth.CurrentToken(ctx), req.Policies, req.PolicyNames); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	u := &User{
+		Username:    req.Username,
+		Policies:    req.Policies,
+		PolicyNames: req.PolicyNames,
+		TokenTTL:    req.TokenTTL,
+		TokenMaxTTL: req.TokenMaxTTL,
+	}
+	err := saveUser(u, req.Password)
+	if err == ErrInvalidCredentials {
+		apierr.Abort(ctx, apierr.InvalidField("password", "password is required for new user"))
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("saveUser error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": toView(u),
+	})
+}
+
+// writeUserError writes the response of a failed user lookup or update
+func writeUserError(ctx *gin.Context, err error) {
+	if err == ErrUserNotFound {
+		apierr.Abort(ctx, apierr.NotFound("user", ctx.Param("name")))
+		return
+	}
+	logging.FromContext(ctx).Error("userpass user error", logging.Err(err))
+	apierr.Abort(ctx, apierr.Internal(err))
+}
+
+func GetUser(ctx *gin.Context) {
+	u, err := loadUser(ctx.Param("name"))
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": toView(u),
+	})
+}
+
+func DeleteUser(ctx *gin.Context) {
+	if _, err := loadUser(ctx.Param("name")); err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+	if err := deleteUser(ctx.Param("name")); err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func UnlockUser(ctx *gin.Context) {
+	_, err := updateUser(ctx.Param("name"), func(u *User) error {
+		u.FailedAttempts = 0
+		u.LockedUntil = 0
+		return nil
+	})
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+// EnableTOTP generates a new totp secret. The secret is only returned here.
+func EnableTOTP(ctx *gin.Context) {
+	name := ctx.Param("name")
+	secret, err := enableTOTP(name)
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"secret":      secret,
+			"otpauth_url": totp.URL(totpIssuer, name, secret),
+		},
+	})
+}
+
+func DisableTOTP(ctx *gin.Context) {
+	_, err := updateUser(ctx.Param("name"), func(u *User) error {
+		u.TOTPSecret = ""
+		u.LastTOTPStep = 0
+		return nil
+	})
+	if err != nil {
+		writeUserError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
@@ -0,0 +1,45 @@
+package userpass
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+var (
+	loginSchema = openapi.Object(map[string]*openapi.Schema{
+		"username":  openapi.String().NonEmpty(),
+		"password":  openapi.String().NonEmpty(),
+		"totp_code": openapi.String(),
+	}).Require("username", "password")
+	changePasswordSchema = openapi.Object(map[string]*openapi.Schema{
+		"username":     openapi.String().NonEmpty(),
+		"password":     openapi.String().NonEmpty(),
+		"totp_code":    openapi.String(),
+		"new_password": openapi.String().Len(minPasswordLength, 0),
+	}).Require("username", "password", "new_password")
+	userSchema = openapi.Object(map[string]*openapi.Schema{
+		"username":      openapi.String().Match(usernamePattern.String()),
+		"password":      openapi.String().Len(minPasswordLength, 0).Describe("required for new users"),
+		"policies":      openapi.Array(openapi.RefTo("Policy")),
+		"policy_names":  openapi.RefTo("PolicyNames"),
+		"token_ttl":     auth.TTLSchema(),
+		"token_max_ttl": auth.TTLSchema(),
+	}).Require("username")
+	userViewSchema = openapi.Object(map[string]*openapi.Schema{
+		"username":        openapi.String(),
+		"policies":        openapi.Array(openapi.RefTo("Policy")),
+		"policy_names":    openapi.RefTo("PolicyNames"),
+		"token_ttl":       openapi.Integer(),
+		"token_max_ttl":   openapi.Integer(),
+		"totp_enabled":    openapi.Boolean(),
+		"failed_attempts": openapi.Integer(),
+		"locked_until":    openapi.Integer(),
+		"created_at":      openapi.Integer(),
+		"last_login_at":   openapi.Integer(),
+	})
+	totpSchema = openapi.Object(map[string]*openapi.Schema{
+		"secret":      openapi.String(),
+		"otpauth_url": openapi.String(),
+	})
+	nameParam = map[string]*openapi.Schema{"name": openapi.String().Match(usernamePattern.String())}
+)
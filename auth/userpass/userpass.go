@@ -0,0 +1,330 @@
+package userpass
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/argon2id"
+	"goimport.moetang.info/nekoq-security/alg/totp"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+)
+
+const (
+	moduleName = "userpass"
+	namespace  = "sys.auth.userpass"
+
+	minPasswordLength = 12
+	maxFailedAttempts = 5
+	lockoutDuration   = 15 * time.Minute
+	totpSkew          = 1
+	totpIssuer        = "nekoq-security"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidCredentials = errors.New("invalid username, password or totp code")
+	ErrUserLocked         = errors.New("user is locked")
+)
+
+var userKeyPrefix = []byte("user.")
+
+// verified against unknown users so that response time does not reveal which users exist
+var dummyHash string
+
+var container *config.NekoQSecurityContainer
+
+type userpassModuleType struct {
+}
+
+func (u userpassModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	h, err := argon2id.Hash("nekoq-security.dummy", argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+	dummyHash = h
+	return nil
+}
+
+func (u userpassModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	g := openapi.NewGroup(scaffold.GetGin(), "userpass", "/auth/userpass", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/login", Legacy: "/sys/auth/userpass/login", Id: "userpassLogin",
+		Summary: "log in with username, password and totp code", Public: true, Body: loginSchema, Result: openapi.RefTo("Login")},
+		Login)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/password", Legacy: "/sys/auth/userpass/password", Id: "changePassword",
+		Summary: "change the password of a user", Public: true, Body: changePasswordSchema},
+		ChangePassword)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/users", Legacy: "/sys/auth/userpass/users", Id: "listUsers",
+		Summary: "list users", Result: openapi.Array(userViewSchema)},
+		auth.RequireManager(), ListUsers)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/users", Legacy: "/sys/auth/userpass/user", Id: "putUser",
+		Summary: "create or update a user", Body: userSchema},
+		auth.RequireManager(), PutUser)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/users/:name", Legacy: "/sys/auth/userpass/user/:name", Id: "getUser",
+		Summary: "read a user", PathParams: nameParam, Result: userViewSchema},
+		auth.RequireManager(), GetUser)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/users/:name", Legacy: "/sys/auth/userpass/user/:name", Id: "deleteUser",
+		Summary: "delete a user", PathParams: nameParam},
+		auth.RequireManager(), DeleteUser)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/users/:name/unlock", Legacy: "/sys/auth/userpass/user/:name/unlock", Id: "unlockUser",
+		Summary: "unlock a user locked by failed logins", PathParams: nameParam},
+		auth.RequireManager(), UnlockUser)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/users/:name/totp", Legacy: "/sys/auth/userpass/user/:name/totp", Id: "enableTotp",
+		Summary: "enable totp, the secret is only returned once", PathParams: nameParam, Result: totpSchema},
+		auth.RequireManager(), EnableTOTP)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/users/:name/totp", Legacy: "/sys/auth/userpass/user/:name/totp", Id: "disableTotp",
+		Summary: "disable totp", PathParams: nameParam},
+		auth.RequireManager(), DisableTOTP)
+	return nil
+}
+
+var userpassModule config.Module = userpassModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, userpassModule)
+}
+
+// User is an operator logging in with username, password and optionally a totp code
+type User struct {
+	Username       string        `json:"username"`
+	PasswordHash   string        `json:"password_hash"`
+	Policies       []auth.Policy `json:"policies"`
+	PolicyNames    []string      `json:"policy_names"`
+	TokenTTL       int64         `json:"token_ttl"`     // seconds
+	TokenMaxTTL    int64         `json:"token_max_ttl"` // seconds
+	TOTPSecret     string        `json:"totp_secret,omitempty"`
+	LastTOTPStep   int64         `json:"last_totp_step"`
+	FailedAttempts int           `json:"failed_attempts"`
+	LockedUntil    int64         `json:"locked_until"`
+	CreatedAt      int64         `json:"created_at"`
+	LastLoginAt    int64         `json:"last_login_at"`
+}
+
+func (u *User) locked(now time.Time) bool {
+	return u.LockedUntil > now.Unix()
+}
+
+func makeUserKey(name string) []byte {
+	return append(append([]byte{}, userKeyPrefix...), []byte(name)...)
+}
+
+func getUser(bucket *config.Bucket, name string) (*User, error) {
+	b := bucket.Get(makeUserKey(name))
+	if len(b) == 0 {
+		return nil, ErrUserNotFound
+	}
+	u := new(User)
+	if err := container.OpenJSON(b, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func putUser(bucket *config.Bucket, u *User) error {
+	b, err := container.SealJSON(u)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(makeUserKey(u.Username), b)
+}
+
+func loadUser(name string) (*User, error) {
+	var u *User
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		var err error
+		u, err = getUser(bucket, name)
+		return err
+	})
+	return u, err
+}
+
+// updateUser reads, modifies and writes the user within one transaction
+func updateUser(name string, fn func(u *User) error) (*User, error) {
+	var u *User
+	err := container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		var err error
+		u, err = getUser(bucket, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+		return putUser(bucket, u)
+	})
+	return u, err
+}
+
+func listUsers() ([]*User, error) {
+	var r []*User
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(userKeyPrefix, func(k, v []byte) error {
+			u := new(User)
+			if err := container.OpenJSON(v, u); err != nil {
+				return err
+			}
+			r = append(r, u)
+			return nil
+		})
+	})
+	return r, err
+}
+
+// saveUser creates or updates the user. Password is rehashed when given, totp and lockout state are kept.
+func saveUser(u *User, password string) error {
+	var hash string
+	if len(password) > 0 {
+		h, err := argon2id.Hash(password, argon2id.DefaultParams)
+		if err != nil {
+			return err
+		}
+		hash = h
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		old, err := getUser(bucket, u.Username)
+		switch err {
+		case nil:
+			u.PasswordHash = old.PasswordHash
+			u.TOTPSecret = old.TOTPSecret
+			u.LastTOTPStep = old.LastTOTPStep
+			u.FailedAttempts = old.FailedAttempts
+			u.LockedUntil = old.LockedUntil
+			u.CreatedAt = old.CreatedAt
+			u.LastLoginAt = old.LastLoginAt
+		case ErrUserNotFound:
+			if len(hash) == 0 {
+				return ErrInvalidCredentials
+			}
+			u.CreatedAt = time.Now().Unix()
+		default:
+			return err
+		}
+		if len(hash) > 0 {
+			u.PasswordHash = hash
+		}
+		return putUser(bucket, u)
+	})
+}
+
+func deleteUser(name string) error {
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.Delete(makeUserKey(name))
+	})
+}
+
+// authenticate checks password and totp code and maintains the lockout state
+func authenticate(name, password, code string) (*User, error) {
+	now := time.Now()
+	u, err := loadUser(name)
+	if err == ErrUserNotFound {
+		argon2id.Verify(password, dummyHash)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.locked(now) {
+		return nil, ErrUserLocked
+	}
+	ok, err := argon2id.Verify(password, u.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	var step int64
+	if ok && len(u.TOTPSecret) > 0 {
+		step, ok = totp.Validate(u.TOTPSecret, code, now, totpSkew)
+		// a code can only be used once
+		ok = ok && step > u.LastTOTPStep
+	}
+
+	var failed bool
+	u, err = updateUser(name, func(u *User) error {
+		if u.locked(now) {
+			failed = true
+			return nil
+		}
+		if !ok {
+			failed = true
+			u.FailedAttempts++
+			if u.FailedAttempts >= maxFailedAttempts {
+				u.FailedAttempts = 0
+				u.LockedUntil = now.Add(lockoutDuration).Unix()
+			}
+			return nil
+		}
+		u.FailedAttempts = 0
+		u.LockedUntil = 0
+		u.LastLoginAt = now.Unix()
+		if step > 0 {
+			u.LastTOTPStep = step
+		}
+		if argon2id.NeedsRehash(u.PasswordHash, argon2id.DefaultParams) {
+			h, err := argon2id.Hash(password, argon2id.DefaultParams)
+			if err != nil {
+				return err
+			}
+			u.PasswordHash = h
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if failed {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// login issues a session token bound to the policies of the user
+func login(name, password, code string) (string, *auth.Token, error) {
+	u, err := authenticate(name, password, code)
+	if err != nil {
+		return "", nil, err
+	}
+	t := &auth.Token{
+		Type:        auth.TokenTypeClient,
+		DisplayName: "userpass:" + u.Username,
+		Policies:    u.Policies,
+		PolicyNames: u.PolicyNames,
+	}
+	ttl := time.Duration(u.TokenTTL) * time.Second
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	token, err := auth.CreateToken(t, ttl, time.Duration(u.TokenMaxTTL)*time.Second)
+	return token, t, err
+}
+
+func changePassword(name, password, code, newPassword string) error {
+	if _, err := authenticate(name, password, code); err != nil {
+		return err
+	}
+	h, err := argon2id.Hash(newPassword, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+	_, err = updateUser(name, func(u *User) error {
+		u.PasswordHash = h
+		return nil
+	})
+	return err
+}
+
+func enableTOTP(name string) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = updateUser(name, func(u *User) error {
+		u.TOTPSecret = secret
+		u.LastTOTPStep = 0
+		return nil
+	})
+	return secret, err
+}
@@ -0,0 +1,259 @@
+package userpass
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/argon2id"
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testPassword = "correct horse battery"
+
+func openTestConfig(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+}
+
+// testEngine serves the routes of the module without the unseal check, which the tests do themselves
+func testEngine() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.POST("/login", Login)
+	e.POST("/password", ChangePassword)
+	e.GET("/users", auth.RequireManager(), ListUsers)
+	e.POST("/users", auth.RequireManager(), PutUser)
+	e.GET("/users/:name", auth.RequireManager(), GetUser)
+	e.DELETE("/users/:name", auth.RequireManager(), DeleteUser)
+	return e
+}
+
+func serve(e *gin.Engine, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	if len(token) > 0 {
+		req.Header.Set(auth.TokenHeader, token)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w
+}
+
+func createToken(t *testing.T, tokenType string) string {
+	token, err := auth.CreateToken(&auth.Token{Type: tokenType,
+		Policies:    []auth.Policy{{Path: "pg/*", Capabilities: []string{auth.CapabilityReadCredential}}},
+		PolicyNames: []string{"readers"}}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPasswordHash(t *testing.T) {
+	openTestConfig(t)
+	if err := saveUser(&User{Username: "alice"}, ""); err != ErrInvalidCredentials {
+		t.Fatal("new user without password:", err)
+	}
+	if err := saveUser(&User{Username: "alice", TokenTTL: 60}, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	u, err := loadUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := u.PasswordHash
+	if !strings.HasPrefix(hash, "$argon2id$") || strings.Contains(hash, testPassword) {
+		t.Fatal("password not hashed:", hash)
+	}
+	if ok, err := argon2id.Verify(testPassword, hash); err != nil || !ok {
+		t.Fatal("hash does not verify", err)
+	}
+	if argon2id.NeedsRehash(hash, argon2id.DefaultParams) {
+		t.Fatal("hash of other params")
+	}
+
+	// updates without password keep the hash, a new password gets a new salt
+	if err := saveUser(&User{Username: "alice", TokenTTL: 120}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = loadUser("alice"); err != nil || u.PasswordHash != hash || u.TokenTTL != 120 {
+		t.Fatal(u, err)
+	}
+	if err := saveUser(&User{Username: "alice"}, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if u, err = loadUser("alice"); err != nil || u.PasswordHash == hash {
+		t.Fatal("password not rehashed", err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	openTestConfig(t)
+	e := testEngine()
+	policies := []auth.Policy{{Path: "pg/db1", Capabilities: []string{auth.CapabilityReadCredential}}}
+	if err := saveUser(&User{Username: "alice", Policies: policies, TokenTTL: 600}, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(e, http.MethodPost, "/login", "", gin.H{"username": "alice", "password": testPassword})
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	r := new(struct {
+		Result struct {
+			Token    string `json:"token"`
+			ExpireAt int64  `json:"expire_at"`
+		} `json:"result"`
+	})
+	if err := json.Unmarshal(w.Body.Bytes(), r); err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.LookupToken(r.Result.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != auth.TokenTypeClient || token.DisplayName != "userpass:alice" || !token.Allow(auth.CapabilityReadCredential, "pg/db1") {
+		t.Fatal(token)
+	}
+	if d := r.Result.ExpireAt - time.Now().Unix(); d < 590 || d > 600 {
+		t.Fatal("token ttl", d)
+	}
+	if u, err := loadUser("alice"); err != nil || u.LastLoginAt == 0 {
+		t.Fatal("last login not recorded", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		body gin.H
+		code int
+	}{
+		{"wrong password", gin.H{"username": "alice", "password": "wrong password"}, http.StatusUnauthorized},
+		{"unknown user", gin.H{"username": "bob", "password": testPassword}, http.StatusUnauthorized},
+		{"missing password", gin.H{"username": "alice"}, http.StatusBadRequest},
+		{"missing username", gin.H{"password": testPassword}, http.StatusBadRequest},
+	} {
+		if w := serve(e, http.MethodPost, "/login", "", tc.body); w.Code != tc.code {
+			t.Error(tc.name, w.Code, w.Body.String())
+		}
+	}
+
+	// failed attempts lock the user, even with the right password
+	for i := 1; i < maxFailedAttempts; i++ {
+		serve(e, http.MethodPost, "/login", "", gin.H{"username": "alice", "password": "wrong password"})
+	}
+	if w := serve(e, http.MethodPost, "/login", "", gin.H{"username": "alice", "password": testPassword}); w.Code != apierr.CodeLocked.HTTPStatus() {
+		t.Fatal("user not locked:", w.Code)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	openTestConfig(t)
+	e := testEngine()
+	if err := saveUser(&User{Username: "alice"}, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	newPassword := "a new long password"
+	for _, tc := range []struct {
+		name string
+		body gin.H
+		code int
+	}{
+		{"too short", gin.H{"username": "alice", "password": testPassword, "new_password": "short"}, http.StatusBadRequest},
+		{"wrong password", gin.H{"username": "alice", "password": "wrong password", "new_password": newPassword}, http.StatusUnauthorized},
+		{"changed", gin.H{"username": "alice", "password": testPassword, "new_password": newPassword}, http.StatusOK},
+	} {
+		if w := serve(e, http.MethodPost, "/password", "", tc.body); w.Code != tc.code {
+			t.Error(tc.name, w.Code, w.Body.String())
+		}
+	}
+	if w := serve(e, http.MethodPost, "/login", "", gin.H{"username": "alice", "password": testPassword}); w.Code != http.StatusUnauthorized {
+		t.Error("old password accepted:", w.Code)
+	}
+	if w := serve(e, http.MethodPost, "/login", "", gin.H{"username": "alice", "password": newPassword}); w.Code != http.StatusOK {
+		t.Error("new password refused:", w.Code)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	openTestConfig(t)
+	e := testEngine()
+	admin := createToken(t, auth.TokenTypeAdmin)
+	client := createToken(t, auth.TokenTypeClient)
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		body  gin.H
+		code  int
+	}{
+		{"no token", "", gin.H{"username": "alice", "password": testPassword}, http.StatusUnauthorized},
+		{"not a manager", client, gin.H{"username": "alice", "password": testPassword}, http.StatusForbidden},
+		{"invalid username", admin, gin.H{"username": "alice/bob", "password": testPassword}, http.StatusBadRequest},
+		{"short password", admin, gin.H{"username": "alice", "password": "short"}, http.StatusBadRequest},
+		{"no password", admin, gin.H{"username": "alice"}, http.StatusBadRequest},
+		{"invalid policy", admin, gin.H{"username": "alice", "password": testPassword,
+			"policies": []auth.Policy{{Path: "pg/*", Capabilities: []string{"fly"}}}}, http.StatusBadRequest},
+		{"invalid policy name", admin, gin.H{"username": "alice", "password": testPassword, "policy_names": []string{"a b"}}, http.StatusBadRequest},
+		{"sys granted by admin", admin, gin.H{"username": "alice", "password": testPassword,
+			"policies": []auth.Policy{{Path: "*", Capabilities: []string{auth.CapabilitySys}}}}, http.StatusForbidden},
+		{"wider than admin", admin, gin.H{"username": "alice", "password": testPassword,
+			"policies": []auth.Policy{{Path: "pg/*", Capabilities: []string{auth.CapabilityRotateCredential}}}}, http.StatusForbidden},
+		{"policy name not held by admin", admin, gin.H{"username": "alice", "password": testPassword, "policy_names": []string{"admins"}}, http.StatusForbidden},
+		{"created", admin, gin.H{"username": "alice", "password": testPassword, "token_ttl": 600}, http.StatusOK},
+		{"updated without password", admin, gin.H{"username": "alice", "policy_names": []string{"readers"}}, http.StatusOK},
+	} {
+		if w := serve(e, http.MethodPost, "/users", tc.token, tc.body); w.Code != tc.code {
+			t.Error(tc.name, w.Code, w.Body.String())
+		}
+	}
+
+	w := serve(e, http.MethodGet, "/users/alice", admin, nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "password") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	r := new(struct {
+		Result userView `json:"result"`
+	})
+	if err := json.Unmarshal(w.Body.Bytes(), r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Result.Username != "alice" || len(r.Result.PolicyNames) != 1 || r.Result.PolicyNames[0] != "readers" || r.Result.CreatedAt == 0 {
+		t.Fatal(r.Result)
+	}
+	if w := serve(e, http.MethodGet, "/users", admin, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"username":"alice"`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := serve(e, http.MethodGet, "/users", client, nil); w.Code != http.StatusForbidden {
+		t.Fatal("users listed by client:", w.Code)
+	}
+
+	if w := serve(e, http.MethodDelete, "/users/alice", client, nil); w.Code != http.StatusForbidden {
+		t.Fatal("user deleted by client:", w.Code)
+	}
+	if w := serve(e, http.MethodDelete, "/users/alice", admin, nil); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := serve(e, http.MethodGet, "/users/alice", admin, nil); w.Code != http.StatusNotFound {
+		t.Fatal("deleted user found:", w.Code)
+	}
+	if w := serve(e, http.MethodDelete, "/users/alice", admin, nil); w.Code != http.StatusNotFound {
+		t.Fatal("deleted user deleted again:", w.Code)
+	}
+}
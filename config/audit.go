@@ -0,0 +1,125 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+
+	"goimport.moetang.info/nekoq-security/alg/merkle"
+)
+
+const auditPurpose = "nekoq-security.audit"
+
+const (
+	AuditDeviceFile    = "file"
+	AuditDeviceSyslog  = "syslog"
+	AuditDeviceWebhook = "webhook"
+
+	defaultAuditMaxBodyKB = 1024
+)
+
+type AuditConfig struct {
+	Enable     bool                `toml:"enable"`
+	File       string              `toml:"file"`        // shortcut for a single file device without rotation
+	FailClosed bool                `toml:"fail_closed"` // refuse requests when no device accepts the entry
+	MaxBodyKB  int                 `toml:"max_body_kb"` // larger request bodies are refused, default 1024
+	Devices    []AuditDeviceConfig `toml:"devices"`
+}
+
+type AuditDeviceConfig struct {
+	Type string `toml:"type"` // file, syslog or webhook
+
+	// file
+	Path      string `toml:"path"`
+	MaxSizeMB int    `toml:"max_size_mb"` // rotate when exceeded, 0 for never
+	MaxFiles  int    `toml:"max_files"`   // rotated files to keep
+
+	// syslog, empty network and address for the local syslog socket
+	Network  string `toml:"network"`
+	Address  string `toml:"address"`
+	Tag      string `toml:"tag"`
+	Facility string `toml:"facility"` // e.g. auth, authpriv, local0
+
+	// webhook, entries are posted as json arrays
+	URL             string            `toml:"url"`
+	Headers         map[string]string `toml:"headers"`
+	BatchSize       int               `toml:"batch_size"`
+	FlushIntervalMs int               `toml:"flush_interval_ms"`
+	MaxRetries      int               `toml:"max_retries"`
+	TimeoutMs       int               `toml:"timeout_ms"`
+	QueueSize       int               `toml:"queue_size"`
+}
+
+func (ac *AuditConfig) validate() error {
+	if !ac.Enable {
+		return nil
+	}
+	if len(ac.File) > 0 {
+		ac.Devices = append(ac.Devices, AuditDeviceConfig{Type: AuditDeviceFile, Path: ac.File})
+		ac.File = ""
+	}
+	if len(ac.Devices) == 0 {
+		return errors.New("audit requires at least one device")
+	}
+	if ac.MaxBodyKB < 0 {
+		return errors.New("audit max_body_kb is negative")
+	}
+	if ac.MaxBodyKB == 0 {
+		ac.MaxBodyKB = defaultAuditMaxBodyKB
+	}
+	for i := range ac.Devices {
+		if err := ac.Devices[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dc *AuditDeviceConfig) validate() error {
+	switch dc.Type {
+	case AuditDeviceFile:
+		if len(dc.Path) == 0 {
+			return errors.New("audit file device requires path")
+		}
+		if dc.MaxSizeMB < 0 || dc.MaxFiles < 0 {
+			return errors.New("audit file device max_size_mb and max_files must not be negative")
+		}
+	case AuditDeviceSyslog:
+		if len(dc.Tag) == 0 {
+			dc.Tag = "nekoq-security"
+		}
+		if len(dc.Facility) == 0 {
+			dc.Facility = "auth"
+		}
+	case AuditDeviceWebhook:
+		u, err := url.Parse(dc.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("audit webhook device requires an http(s) url")
+		}
+		if dc.BatchSize <= 0 {
+			dc.BatchSize = 100
+		}
+		if dc.FlushIntervalMs <= 0 {
+			dc.FlushIntervalMs = 1000
+		}
+		if dc.MaxRetries < 0 {
+			return errors.New("audit webhook device max_retries must not be negative")
+		}
+		if dc.TimeoutMs <= 0 {
+			dc.TimeoutMs = 5000
+		}
+		if dc.QueueSize <= 0 {
+			dc.QueueSize = 10000
+		}
+	default:
+		return errors.New("unknown audit device type")
+	}
+	return nil
+}
+
+// AuditKey returns the key to HMAC secrets in audit entries, or nil before unlock
+func (c *NekoQSecurityConfig) AuditKey() []byte {
+	if !c.container.MasterUnlock {
+		return nil
+	}
+	return merkle.DeriveKey(c.container.MasterKey, auditPurpose)
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bytes"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+// Op is a single mutation made on a bucket within DoTxWithinBucket.
+// Ops are what gets replicated in cluster mode.
+type Op struct {
+	Bucket string `json:"bucket"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// Bucket wraps a bbolt bucket and records every mutation made through it.
+// When key hashing is enabled, records are stored under keyed hashes and
+// real keys are kept in an encrypted index.
+type Bucket struct {
+	name string
+	b    *bbolt.Bucket
+	ops  []Op
+
+	keys       *keyCodec
+	index      map[string][]byte
+	indexDirty bool
+}
+
+func newBucket(name string, b *bbolt.Bucket) *Bucket {
+	return &Bucket{
+		name: name,
+		b:    b,
+	}
+}
+
+func (b *Bucket) storageKey(key []byte) []byte {
+	if b.keys == nil {
+		return key
+	}
+	return b.keys.storageKey(b.name, key)
+}
+
+func (b *Bucket) loadIndex() error {
+	if b.index != nil {
+		return nil
+	}
+	index, err := b.keys.decodeIndex(b.b.Get(keyIndexKey))
+	if err != nil {
+		return err
+	}
+	b.index = index
+	return nil
+}
+
+// flush writes the index back if it was changed
+func (b *Bucket) flush() error {
+	if !b.indexDirty {
+		return nil
+	}
+	enc, err := b.keys.encodeIndex(b.index)
+	if err != nil {
+		return err
+	}
+	b.indexDirty = false
+	return b.putRaw(keyIndexKey, enc)
+}
+
+func (b *Bucket) Get(key []byte) []byte {
+	return b.b.Get(b.storageKey(key))
+}
+
+func (b *Bucket) Put(key, value []byte) error {
+	sk := b.storageKey(key)
+	if err := b.putRaw(sk, value); err != nil {
+		return err
+	}
+	if b.keys != nil {
+		if err := b.loadIndex(); err != nil {
+			return err
+		}
+		b.index[string(key)] = sk
+		b.indexDirty = true
+	}
+	return nil
+}
+
+func (b *Bucket) Delete(key []byte) error {
+	if err := b.deleteRaw(b.storageKey(key)); err != nil {
+		return err
+	}
+	if b.keys != nil {
+		if err := b.loadIndex(); err != nil {
+			return err
+		}
+		delete(b.index, string(key))
+		b.indexDirty = true
+	}
+	return nil
+}
+
+func (b *Bucket) putRaw(key, value []byte) error {
+	err := b.b.Put(key, value)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, Op{
+		Bucket: b.name,
+		Key:    append([]byte{}, key...),
+		Value:  append([]byte{}, value...),
+	})
+	return nil
+}
+
+func (b *Bucket) deleteRaw(key []byte) error {
+	err := b.b.Delete(key)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, Op{
+		Bucket: b.name,
+		Key:    append([]byte{}, key...),
+		Delete: true,
+	})
+	return nil
+}
+
+// ForEachWithPrefix iterates all keys starting with prefix in order.
+// Key and value are copied and remain valid after the transaction.
+func (b *Bucket) ForEachWithPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	if b.keys != nil {
+		return b.forEachIndexedWithPrefix(prefix, fn)
+	}
+	cursor := b.b.Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		if err := fn(append([]byte{}, k...), append([]byte{}, v...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) forEachIndexedWithPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	if err := b.loadIndex(); err != nil {
+		return err
+	}
+	var keys []string
+	for k := range b.index {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := b.b.Get(b.index[k])
+		if v == nil {
+			continue
+		}
+		if err := fn([]byte(k), append([]byte{}, v...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyOps(tx *bbolt.Tx, ops []Op) error {
+	for _, op := range ops {
+		b, err := tx.CreateBucketIfNotExists([]byte(op.Bucket))
+		if err != nil {
+			return err
+		}
+		if op.Delete {
+			err = b.Delete(op.Key)
+		} else {
+			err = b.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.etcd.io/bbolt"
+)
+
+var ErrNotLeader = errors.New("current node is not the leader")
+
+var errRollback = errors.New("rollback for replication")
+
+const (
+	ForwardModeProxy    = "forward"
+	ForwardModeRedirect = "redirect"
+
+	raftApplyTimeout = 10 * time.Second
+)
+
+type ClusterConfig struct {
+	Enable      bool             `toml:"enable"`
+	NodeId      string           `toml:"node_id"`
+	RaftBind    string           `toml:"raft_bind"`
+	RaftDir     string           `toml:"raft_dir"`
+	ApiAddress  string           `toml:"api_address"`
+	Bootstrap   bool             `toml:"bootstrap"`
+	ForwardMode string           `toml:"forward_mode"` // forward or redirect
+	TLS         ClusterTLSConfig `toml:"tls"`
+	Peers       []struct {
+		NodeId      string `toml:"node_id"`
+		RaftAddress string `toml:"raft_address"`
+		ApiAddress  string `toml:"api_address"`
+	} `toml:"peers"`
+}
+
+func (cc *ClusterConfig) validate() error {
+	if !cc.Enable {
+		return nil
+	}
+	if len(cc.NodeId) == 0 {
+		return errors.New("no node_id for cluster")
+	}
+	if len(cc.RaftBind) == 0 {
+		return errors.New("no raft_bind for cluster")
+	}
+	if len(cc.RaftDir) == 0 {
+		return errors.New("no raft_dir for cluster")
+	}
+	switch cc.ForwardMode {
+	case "":
+		cc.ForwardMode = ForwardModeProxy
+	case ForwardModeProxy, ForwardModeRedirect:
+	default:
+		return errors.New("unknown cluster forward_mode")
+	}
+	if err := cc.TLS.validate(); err != nil {
+		return err
+	}
+	// the raft log carries encrypted values only, but also the keys and the cluster membership
+	if !cc.TLS.Enable && !isLoopback(cc.RaftBind) {
+		return errors.New("cluster raft_bind outside of loopback requires cluster tls")
+	}
+	found := false
+	for _, p := range cc.Peers {
+		if len(p.NodeId) == 0 || len(p.RaftAddress) == 0 || len(p.ApiAddress) == 0 {
+			return errors.New("cluster peer requires node_id, raft_address and api_address")
+		}
+		if p.NodeId == cc.NodeId {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("current node is not in cluster peers")
+	}
+	return nil
+}
+
+// ClusterTLSConfig secures the connections between the nodes. Every node presents its certificate
+// and only accepts peers with a certificate issued by ca_file, which also has to issue the api
+// certificates of the nodes when tls is enabled on the api.
+type ClusterTLSConfig struct {
+	Enable   bool   `toml:"enable"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	CAFile   string `toml:"ca_file"`
+}
+
+func (tc *ClusterTLSConfig) validate() error {
+	if !tc.Enable {
+		return nil
+	}
+	if len(tc.CertFile) == 0 || len(tc.KeyFile) == 0 || len(tc.CAFile) == 0 {
+		return errors.New("cluster tls requires cert_file, key_file and ca_file")
+	}
+	return nil
+}
+
+// load returns the config of both ends of the connections between the nodes, or nil if tls is not enabled
+func (tc *ClusterTLSConfig) load() (*tls.Config, error) {
+	if !tc.Enable {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(tc.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificate found in cluster ca_file")
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tlsStreamLayer carries the raft traffic between the nodes over mutual tls
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	config    *tls.Config
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), l.config)
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+type ClusterStatus struct {
+	NodeId        string `json:"node_id"`
+	State         string `json:"state"`
+	Leader        string `json:"leader"`
+	LeaderAddress string `json:"leader_api_address"`
+}
+
+// clusterNode replicates every storage mutation through raft.
+// Only the leader accepts writes. The raft log carries encrypted values only,
+// so each node still needs to be unlocked separately.
+type clusterNode struct {
+	config *ClusterConfig
+	raft   *raft.Raft
+	tls    *tls.Config
+
+	writeLock sync.Mutex
+}
+
+func startClusterNode(cc *ClusterConfig, db *bbolt.DB) (*clusterNode, error) {
+	err := os.MkdirAll(cc.RaftDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := cc.TLS.load()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cc.NodeId)
+
+	addr, err := net.ResolveTCPAddr("tcp", cc.RaftBind)
+	if err != nil {
+		return nil, err
+	}
+	var transport *raft.NetworkTransport
+	if tlsConfig != nil {
+		l, err := tls.Listen("tcp", cc.RaftBind, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		transport = raft.NewNetworkTransport(&tlsStreamLayer{Listener: l, advertise: addr, config: tlsConfig}, 3, 10*time.Second, os.Stderr)
+	} else {
+		transport, err = raft.NewTCPTransport(cc.RaftBind, addr, 3, 10*time.Second, os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cc.RaftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cc.RaftDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(rc, &storageFsm{db: db}, store, store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.Bootstrap {
+		exist, err := raft.HasExistingState(store, store, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			servers := make([]raft.Server, 0, len(cc.Peers))
+			for _, p := range cc.Peers {
+				servers = append(servers, raft.Server{
+					ID:      raft.ServerID(p.NodeId),
+					Address: raft.ServerAddress(p.RaftAddress),
+				})
+			}
+			err = r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &clusterNode{
+		config: cc,
+		raft:   r,
+		tls:    tlsConfig,
+	}, nil
+}
+
+func (n *clusterNode) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// LeaderApiAddress returns the http api address of the current leader, or empty if unknown
+func (n *clusterNode) LeaderApiAddress() string {
+	leader := string(n.raft.Leader())
+	for _, p := range n.config.Peers {
+		if p.RaftAddress == leader {
+			return p.ApiAddress
+		}
+	}
+	return ""
+}
+
+func (n *clusterNode) status() ClusterStatus {
+	return ClusterStatus{
+		NodeId:        n.config.NodeId,
+		State:         n.raft.State().String(),
+		Leader:        string(n.raft.Leader()),
+		LeaderAddress: n.LeaderApiAddress(),
+	}
+}
+
+func (n *clusterNode) apply(ops []Op) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	f := n.raft.Apply(b, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if resp, ok := f.Response().(error); ok && resp != nil {
+		return resp
+	}
+	return nil
+}
+
+// doTx runs fn in a transaction which is always rolled back.
+// The changes returned by fn are then replicated and applied by the fsm on every node.
+func (n *clusterNode) doTx(db *bbolt.DB, fn func(tx *bbolt.Tx) ([]Op, error)) error {
+	n.writeLock.Lock()
+	defer n.writeLock.Unlock()
+
+	var ops []Op
+	err := db.Update(func(tx *bbolt.Tx) error {
+		r, err := fn(tx)
+		if err != nil {
+			return err
+		}
+		ops = r
+		return errRollback
+	})
+	if err != errRollback {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return n.apply(ops)
+}
+
+type storageFsm struct {
+	db *bbolt.DB
+}
+
+func (f *storageFsm) Apply(l *raft.Log) interface{} {
+	var ops []Op
+	if err := json.Unmarshal(l.Data, &ops); err != nil {
+		return err
+	}
+	return f.db.Update(func(tx *bbolt.Tx) error {
+		return applyOps(tx, ops)
+	})
+}
+
+func (f *storageFsm) Snapshot() (raft.FSMSnapshot, error) {
+	data := make(map[string]map[string][]byte)
+	err := f.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			m := make(map[string][]byte)
+			data[string(name)] = m
+			return b.ForEach(func(k, v []byte) error {
+				m[string(k)] = append([]byte{}, v...)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &storageSnapshot{data: data}, nil
+}
+
+func (f *storageFsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	data := make(map[string]map[string][]byte)
+	if err := json.NewDecoder(rc).Decode(&data); err != nil {
+		return err
+	}
+	return f.db.Update(func(tx *bbolt.Tx) error {
+		var names [][]byte
+		err := tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, append([]byte{}, name...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		for name, m := range data {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range m {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+type storageSnapshot struct {
+	data map[string]map[string][]byte
+}
+
+func (s *storageSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := json.NewEncoder(sink).Encode(s.data)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *storageSnapshot) Release() {
+}
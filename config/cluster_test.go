@@ -0,0 +1,209 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startTestCluster(t *testing.T, size int) []*NekoQSecurityConfig {
+	nodes, err := OpenTestCluster(t.TempDir(), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	})
+	return nodes
+}
+
+func waitLeader(t *testing.T, nodes []*NekoQSecurityConfig) (*NekoQSecurityConfig, []*NekoQSecurityConfig) {
+	leader, followers, err := WaitLeader(nodes, 20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leader, followers
+}
+
+func TestClusterReplication(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	leader, followers := waitLeader(t, nodes)
+
+	err := leader.container.applyOps([]Op{{Bucket: "test", Key: []byte("k0"), Value: []byte("v0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = leader.container.DoTxWithinBucket("test", func(bucket *Bucket) error {
+		if string(bucket.Get([]byte("k0"))) != "v0" {
+			t.Error("k0 is not written")
+		}
+		return bucket.Put([]byte("k1"), []byte("v1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range followers {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var v []byte
+			_ = f.container.DoTxWithinBucket("test", func(bucket *Bucket) error {
+				v = bucket.Get([]byte("k1"))
+				return nil
+			})
+			if string(v) == "v1" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("value is not replicated to", f.NekoQSecurity.Cluster.NodeId)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		err := f.container.DoTxWithinBucket("test", func(bucket *Bucket) error {
+			return bucket.Put([]byte("k2"), []byte("v2"))
+		})
+		if err != ErrNotLeader {
+			t.Fatal("follower should reject writes, got:", err)
+		}
+		if f.LeaderApiAddress() != leader.NekoQSecurity.Cluster.ApiAddress {
+			t.Fatal("unexpected leader api address:", f.LeaderApiAddress())
+		}
+	}
+}
+
+// writeTestCerts writes a ca and a certificate of the nodes issued by it, valid for 127.0.0.1
+func writeTestCerts(t *testing.T, dir string) ClusterTLSConfig {
+	writePem := func(name, kind string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, node, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ClusterTLSConfig{
+		Enable:   true,
+		CertFile: writePem("node.crt", "CERTIFICATE", der),
+		KeyFile:  writePem("node.key", "EC PRIVATE KEY", keyDer),
+		CAFile:   writePem("ca.crt", "CERTIFICATE", caDer),
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	dir := t.TempDir()
+	nodes, err := openTestCluster(dir, 3, writeTestCerts(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	})
+	leader, followers := waitLeader(t, nodes)
+
+	if err := leader.container.applyOps([]Op{{Bucket: "test", Key: []byte("k1"), Value: []byte("v1")}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range followers {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+			var v []byte
+			_ = f.container.ViewWithinBucket("test", func(bucket *Bucket) error {
+				v = bucket.Get([]byte("k1"))
+				return nil
+			})
+			if string(v) == "v1" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("value is not replicated to", f.NekoQSecurity.Cluster.NodeId)
+			}
+		}
+	}
+
+	// a peer without a certificate of the cluster ca is refused
+	config := leader.ClusterTLSConfig()
+	config.Certificates = nil
+	conn, err := tls.Dial("tcp", leader.NekoQSecurity.Cluster.RaftBind, config)
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("connection without certificate accepted")
+		}
+	}
+}
+
+func TestClusterRaftBind(t *testing.T) {
+	for bind, valid := range map[string]bool{
+		"127.0.0.1:7002": true,
+		"localhost:7002": true,
+		"[::1]:7002":     true,
+		"0.0.0.0:7002":   false,
+		"10.0.0.1:7002":  false,
+	} {
+		cc := &ClusterConfig{Enable: true, NodeId: "node1", RaftBind: bind, RaftDir: "raft"}
+		cc.Peers = append(cc.Peers, struct {
+			NodeId      string `toml:"node_id"`
+			RaftAddress string `toml:"raft_address"`
+			ApiAddress  string `toml:"api_address"`
+		}{"node1", bind, "http://127.0.0.1:6002"})
+		if err := cc.validate(); (err == nil) != valid {
+			t.Error(bind, err)
+		}
+		cc.TLS = ClusterTLSConfig{Enable: true, CertFile: "node.crt", KeyFile: "node.key", CAFile: "ca.crt"}
+		if err := cc.validate(); err != nil {
+			t.Error("with tls:", bind, err)
+		}
+	}
+}
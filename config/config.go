@@ -3,13 +3,17 @@ package config
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
-	"log"
 	"time"
 
 	"goimport.moetang.info/nekoq-security/alg/aesutils"
+	"goimport.moetang.info/nekoq-security/alg/merkle"
 	"goimport.moetang.info/nekoq-security/alg/shamir"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+	"goimport.moetang.info/nekoq-security/tracing"
 
 	scaffold "github.com/moetang/webapp-scaffold"
 
@@ -39,25 +43,53 @@ type Module interface {
 }
 
 type NekoQSecurityConfig struct {
+	Global struct {
+		Debug bool `toml:"debug"` // debug level logging
+	} `toml:"global"`
+	Gin struct {
+		Listen string `toml:"listen"`
+	} `toml:"gin"`
 	NekoQSecurity struct {
 		MasterKey struct {
 			Type string `toml:"type"`
 		} `toml:"masterkey"`
 		Storage struct {
-			Path string `toml:"path"`
+			Path     string `toml:"path"`
+			HashKeys bool   `toml:"hash_keys"` // store keys as keyed hashes derived from the master key
 		} `toml:"storage"`
+		Cluster ClusterConfig  `toml:"cluster"`
+		TLS     TLSConfig      `toml:"tls"`
+		Audit   AuditConfig    `toml:"audit"`
+		GRPC    GRPCConfig     `toml:"grpc"`
+		Metrics MetricsConfig  `toml:"metrics"`
+		Tracing tracing.Config `toml:"tracing"`
+		JWT     struct {
+			// jwks of the jwt auth method when its config has none, read at every login so that it can be rotated
+			JWKSFile string `toml:"jwks_file"`
+		} `toml:"jwt"`
+		// addresses or cidrs of the reverse proxies in front of the server, whose X-Forwarded-For is honoured
+		TrustedProxies []string `toml:"trusted_proxies"`
 	} `toml:"nekoq-security"`
 
 	container *NekoQSecurityContainer
+	tls       *tlsReloader
 }
 
 type NekoQSecurityContainer struct {
-	db *bbolt.DB
+	db      *bbolt.DB
+	cluster *clusterNode
 
 	MasterUnlock bool
 
 	ShamirShards []string
 	MasterKey    []byte
+
+	JWKSFile string // set by the operator only, see the jwt config
+
+	integrityKey     []byte
+	rebuildIntegrity bool // accept the current records at the next unlock
+	hashKeys         bool
+	keyCodec         *keyCodec
 }
 
 func (c *NekoQSecurityConfig) Validate() error {
@@ -69,7 +101,22 @@ func (c *NekoQSecurityConfig) Validate() error {
 	if len(c.NekoQSecurity.Storage.Path) == 0 {
 		return errors.New("no path for storage")
 	}
-	return nil
+	if err := c.NekoQSecurity.TLS.validate(); err != nil {
+		return err
+	}
+	if err := c.NekoQSecurity.Audit.validate(); err != nil {
+		return err
+	}
+	if err := c.NekoQSecurity.GRPC.validate(); err != nil {
+		return err
+	}
+	if err := c.NekoQSecurity.Tracing.Validate(); err != nil {
+		return err
+	}
+	if _, err := parseTrustedProxies(c.NekoQSecurity.TrustedProxies); err != nil {
+		return err
+	}
+	return c.NekoQSecurity.Cluster.validate()
 }
 
 func (c *NekoQSecurityConfig) Init() error {
@@ -82,10 +129,94 @@ func (c *NekoQSecurityConfig) Init() error {
 		return err
 	}
 	c.container.db = db
+	activeContainer = c.container
+	proxies, err := parseTrustedProxies(c.NekoQSecurity.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if c.NekoQSecurity.Cluster.Enable {
+		proxies = append(proxies, peerNets(&c.NekoQSecurity.Cluster)...)
+	}
+	trustedProxies = proxies
+	c.container.hashKeys = c.NekoQSecurity.Storage.HashKeys
+	c.container.JWKSFile = c.NekoQSecurity.JWT.JWKSFile
+
+	if c.NekoQSecurity.Cluster.Enable {
+		n, err := startClusterNode(&c.NekoQSecurity.Cluster, db)
+		if err != nil {
+			return err
+		}
+		c.container.cluster = n
+	}
+
+	if c.NekoQSecurity.TLS.Enable {
+		r, err := newTLSReloader(&c.NekoQSecurity.TLS)
+		if err != nil {
+			return err
+		}
+		c.tls = r
+	}
 
 	return nil
 }
 
+// ServerTLSConfig returns the tls config of the listener, or nil if tls is not enabled
+func (c *NekoQSecurityConfig) ServerTLSConfig() *tls.Config {
+	if c.tls == nil {
+		return nil
+	}
+	return c.tls.tlsConfig()
+}
+
+// ClusterTLSConfig returns the tls config of the connections between the nodes, or nil if cluster tls is not enabled
+func (c *NekoQSecurityConfig) ClusterTLSConfig() *tls.Config {
+	if c.container.cluster == nil || c.container.cluster.tls == nil {
+		return nil
+	}
+	return c.container.cluster.tls.Clone()
+}
+
+func (c *NekoQSecurityConfig) IsClusterEnabled() bool {
+	return c.container.cluster != nil
+}
+
+// IsLeader returns true when the node accepts writes, which is always the case in non-cluster mode
+func (c *NekoQSecurityConfig) IsLeader() bool {
+	return c.container.IsLeader()
+}
+
+// IsLeader returns true when the node accepts writes, which is always the case in non-cluster mode
+func (c *NekoQSecurityContainer) IsLeader() bool {
+	if c.cluster == nil {
+		return true
+	}
+	return c.cluster.IsLeader()
+}
+
+func (c *NekoQSecurityConfig) LeaderApiAddress() string {
+	if c.container.cluster == nil {
+		return ""
+	}
+	return c.container.cluster.LeaderApiAddress()
+}
+
+// RebuildIntegrity lets the next unlock rebuild the integrity tree from the current records
+// when it is missing or does not match them, instead of refusing to unlock
+func (c *NekoQSecurityConfig) RebuildIntegrity() {
+	c.container.rebuildIntegrity = true
+}
+
+func (c *NekoQSecurityConfig) VerifyIntegrity() (*IntegrityReport, error) {
+	return c.container.VerifyIntegrity()
+}
+
+func (c *NekoQSecurityConfig) ClusterStatus() (ClusterStatus, bool) {
+	if c.container.cluster == nil {
+		return ClusterStatus{}, false
+	}
+	return c.container.cluster.status(), true
+}
+
 func (c *NekoQSecurityConfig) IsMasterUnlock() bool {
 	return c.container.MasterUnlock
 }
@@ -94,76 +225,107 @@ func (c *NekoQSecurityConfig) FeedShamirKey(key string) bool {
 	if c.IsMasterUnlock() {
 		return true
 	}
+	result := c.feedShamirKey(key)
+	metrics.UnsealAttempts.WithLabelValues(result).Inc()
+	return result == metrics.UnsealUnlocked
+}
+
+// feedShamirKey returns the result of the attempt, see metrics.UnsealAttempts
+func (c *NekoQSecurityConfig) feedShamirKey(key string) string {
 	if len(c.container.ShamirShards) >= MaxShares {
-		return false
+		return metrics.UnsealRejected
 	}
 
 	c.container.ShamirShards = append(c.container.ShamirShards, key)
 	if len(c.container.ShamirShards) < MinShares {
-		return false
+		return metrics.UnsealPending
 	}
 
 	m, err := shamir.CombineShamirString(c.container.ShamirShards)
 	if err != nil {
-		log.Println("[ERROR] combine shamir key error.", err)
-		return false
+		logging.Error("combine shamir key error", logging.Err(err))
+		return metrics.UnsealFailed
 	}
 
-	err = c.container.db.Update(func(tx *bbolt.Tx) error {
+	var v []byte
+	err = c.container.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte("global"))
-		if b == nil {
-			bucket, err := tx.CreateBucket([]byte("global"))
-			if err != nil {
-				return err
-			}
-			b = bucket
-		}
-		v := b.Get([]byte("nekoq-security.init"))
-		if len(v) == 0 {
-			// need to init
-			rb := make([]byte, 8)
-			_, err := rand.Read(rb)
-			if err != nil {
-				return err
-			}
-
-			rb = append([]byte(hex.EncodeToString(rb)), []byte("_nekoq-security")...)
-
-			enc, err := aesutils.Encrypt(rb, m)
-			if err != nil {
-				return err
-			}
-			err = b.Put([]byte("nekoq-security.init"), enc)
-			if err != nil {
-				return err
-			}
-		} else {
-			// check master key
-			dec, err := aesutils.Decrypt(v, m)
-			if err != nil {
-				return err
-			}
-			if !bytes.HasSuffix(dec, []byte("_nekoq-security")) {
-				return errors.New("masterkey cannot decrypt init value")
-			}
+		if b != nil {
+			v = append([]byte{}, b.Get([]byte("nekoq-security.init"))...)
 		}
 		return nil
 	})
 	if err != nil {
-		log.Println("[ERROR] FeedShamirKey error.", err)
-		return false
+		logging.Error("FeedShamirKey error", logging.Err(err))
+		return metrics.UnsealFailed
+	}
+	if len(v) == 0 {
+		// need to init
+		err = initMasterKeyCheck(c.container, m)
+	} else {
+		// check master key
+		err = checkMasterKey(v, m)
+	}
+	if err != nil {
+		logging.Error("FeedShamirKey error", logging.Err(err))
+		return metrics.UnsealFailed
 	}
 
 	err = initAllBuckets(c.container, c.container.db)
 	if err != nil {
-		log.Println("[ERROR] FeedShamirKey initAllBuckets error.", err)
-		return false
+		logging.Error("FeedShamirKey initAllBuckets error", logging.Err(err))
+		return metrics.UnsealFailed
+	}
+	integrityKey := merkle.DeriveKey(m, integrityPurpose)
+	err = initIntegrity(c.container, m, integrityKey, len(v) == 0)
+	if err != nil {
+		logging.Error("FeedShamirKey initIntegrity error", logging.Err(err))
+		return metrics.UnsealFailed
+	}
+	c.container.integrityKey = integrityKey
+	codec := newKeyCodec(m)
+	err = migrateStorageKeys(c.container, codec, c.container.hashKeys)
+	if err != nil {
+		c.container.integrityKey = nil
+		logging.Error("FeedShamirKey migrateStorageKeys error", logging.Err(err))
+		return metrics.UnsealFailed
+	}
+	if c.container.hashKeys {
+		c.container.keyCodec = codec
 	}
 	// decrypt success and init masterkey
 	c.container.MasterUnlock = true
 	c.container.MasterKey = m
 
-	return true
+	return metrics.UnsealUnlocked
+}
+
+func initMasterKeyCheck(container *NekoQSecurityContainer, m []byte) error {
+	rb := make([]byte, 8)
+	_, err := rand.Read(rb)
+	if err != nil {
+		return err
+	}
+
+	rb = append([]byte(hex.EncodeToString(rb)), []byte("_nekoq-security")...)
+
+	enc, err := aesutils.Encrypt(rb, m)
+	if err != nil {
+		return err
+	}
+	// in cluster mode, only the leader is able to init the master key
+	return container.applyOps([]Op{{Bucket: "global", Key: []byte("nekoq-security.init"), Value: enc}})
+}
+
+func checkMasterKey(v, m []byte) error {
+	dec, err := aesutils.Decrypt(v, m)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(dec, []byte("_nekoq-security")) {
+		return errors.New("masterkey cannot decrypt init value")
+	}
+	return nil
 }
 
 func initAllBuckets(container *NekoQSecurityContainer, db *bbolt.DB) error {
@@ -180,10 +342,6 @@ func initAllBuckets(container *NekoQSecurityContainer, db *bbolt.DB) error {
 			if err != nil {
 				return err
 			}
-			err = v.Module.InitWebScaffold(webscaffold)
-			if err != nil {
-				return err
-			}
 		}
 		return nil
 	})
@@ -2,10 +2,16 @@ package config
 
 import (
 	"container/list"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 
+	"goimport.moetang.info/nekoq-security/alg/aesutils"
+	"goimport.moetang.info/nekoq-security/tracing"
+
 	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (c *NekoQSecurityContainer) ListAllProviderBuckets() ([]string, error) {
@@ -32,13 +38,113 @@ func (c *NekoQSecurityContainer) ListAllProviderBuckets() ([]string, error) {
 	return r, nil
 }
 
-func (c *NekoQSecurityContainer) DoTxWithinBucket(bucket string, fn func(*bbolt.Bucket) error) error {
-	err := c.db.Update(func(tx *bbolt.Tx) error {
+func (c *NekoQSecurityContainer) DoTxWithinBucket(bucket string, fn func(*Bucket) error) error {
+	return c.DoTxWithinBucketContext(context.Background(), bucket, fn)
+}
+
+// DoTxWithinBucketContext is DoTxWithinBucket traced as a child of the span of ctx
+func (c *NekoQSecurityContainer) DoTxWithinBucketContext(ctx context.Context, bucket string, fn func(*Bucket) error) (err error) {
+	_, span := tracing.Start(ctx, "storage.tx", attribute.String("storage.bucket", bucket), attribute.Bool("storage.cluster", c.cluster != nil))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	if c.cluster != nil {
+		return c.cluster.doTx(c.db, func(tx *bbolt.Tx) ([]Op, error) {
+			ops, err := c.runTx(tx, bucket, fn)
+			span.SetAttributes(attribute.Int("storage.ops", len(ops)))
+			return ops, err
+		})
+	}
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		ops, err := c.runTx(tx, bucket, fn)
+		span.SetAttributes(attribute.Int("storage.ops", len(ops)))
+		return err
+	})
+}
+
+// runTx runs fn and maintains the integrity tree for the changes made by fn.
+// It returns all the changes made in the transaction.
+func (c *NekoQSecurityContainer) runTx(tx *bbolt.Tx, bucket string, fn func(*Bucket) error) ([]Op, error) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, errors.New(fmt.Sprint("no bucket:", bucket, " found"))
+	}
+	wb := newBucket(bucket, b)
+	wb.keys = c.keyCodec
+	if err := fn(wb); err != nil {
+		return nil, err
+	}
+	if err := wb.flush(); err != nil {
+		return nil, err
+	}
+	ops := wb.ops
+	if len(ops) > 0 && len(c.integrityKey) > 0 {
+		iops, err := updateIntegrity(tx, c.integrityKey, ops)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, iops...)
+	}
+	return ops, nil
+}
+
+// applyOps writes ops directly in non-cluster mode or replicates them through raft in cluster mode
+func (c *NekoQSecurityContainer) applyOps(ops []Op) error {
+	if c.cluster != nil {
+		return c.cluster.apply(ops)
+	}
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return applyOps(tx, ops)
+	})
+}
+
+// ViewWithinBucket runs fn in a read-only transaction on the local storage, which is not replicated
+// and never blocks on the cluster. Mutations made by fn fail.
+func (c *NekoQSecurityContainer) ViewWithinBucket(bucket string, fn func(*Bucket) error) error {
+	return c.ViewWithinBucketContext(context.Background(), bucket, fn)
+}
+
+// ViewWithinBucketContext is ViewWithinBucket with a span in the trace of ctx
+func (c *NekoQSecurityContainer) ViewWithinBucketContext(ctx context.Context, bucket string, fn func(*Bucket) error) (err error) {
+	_, span := tracing.Start(ctx, "storage.view", attribute.String("storage.bucket", bucket))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	return c.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b == nil {
 			return errors.New(fmt.Sprint("no bucket:", bucket, " found"))
 		}
-		return fn(b)
+		wb := newBucket(bucket, b)
+		wb.keys = c.keyCodec
+		return fn(wb)
+	})
+}
+
+// SealJSON marshals v and encrypts it with the master key, the form of the records of the modules
+func (c *NekoQSecurityContainer) SealJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return aesutils.Encrypt(b, c.MasterKey)
+}
+
+// OpenJSON decrypts a record sealed by SealJSON into v
+func (c *NekoQSecurityContainer) OpenJSON(b []byte, v interface{}) error {
+	dec, err := aesutils.Decrypt(b, c.MasterKey)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dec, v)
+}
+
+// StorageStats returns the transaction stats of the storage and its size in bytes
+func (c *NekoQSecurityConfig) StorageStats() (bbolt.Stats, int64, error) {
+	var size int64
+	err := c.container.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
 	})
-	return err
+	return c.container.db.Stats(), size, err
 }
@@ -0,0 +1,18 @@
+package config
+
+import "errors"
+
+type GRPCConfig struct {
+	Enable bool   `toml:"enable"`
+	Listen string `toml:"listen"` // uses the tls settings of the http listener
+}
+
+func (gc *GRPCConfig) validate() error {
+	if !gc.Enable {
+		return nil
+	}
+	if len(gc.Listen) == 0 {
+		return errors.New("grpc requires listen")
+	}
+	return nil
+}
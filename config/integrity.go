@@ -0,0 +1,366 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"goimport.moetang.info/nekoq-security/alg/aesutils"
+	"goimport.moetang.info/nekoq-security/alg/merkle"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	integrityBucket  = "sys.integrity"
+	integrityPurpose = "nekoq-security.integrity"
+	integrityMarker  = "nekoq-security.integrity"
+)
+
+var (
+	integrityLeafPrefix = []byte("leaf.")
+	integrityRootKey    = []byte("root")
+	// in the global bucket, sealed with the master key once the tree is built
+	integrityMarkerKey = []byte("nekoq-security.integrity")
+)
+
+type IntegrityRecord struct {
+	Namespace  string `json:"namespace"`
+	Key        string `json:"key"`
+	StorageKey string `json:"storage_key,omitempty"` // set when key hashing is enabled
+}
+
+type IntegrityReport struct {
+	Verified  bool              `json:"verified"`
+	RootValid bool              `json:"root_valid"`
+	Added     []IntegrityRecord `json:"added"`
+	Removed   []IntegrityRecord `json:"removed"`
+	Modified  []IntegrityRecord `json:"modified"`
+}
+
+func isModuleNamespace(bucket string) bool {
+	for _, v := range moduleNamespace {
+		if v.Namespace == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+func integrityLeafKey(namespace string, key []byte) []byte {
+	r := append(append([]byte{}, integrityLeafPrefix...), []byte(namespace)...)
+	r = append(r, 0)
+	return append(r, key...)
+}
+
+func parseIntegrityLeafKey(k []byte) IntegrityRecord {
+	k = k[len(integrityLeafPrefix):]
+	idx := bytes.IndexByte(k, 0)
+	if idx < 0 {
+		return IntegrityRecord{Key: string(k)}
+	}
+	return IntegrityRecord{Namespace: string(k[:idx]), Key: string(k[idx+1:])}
+}
+
+// updateIntegrity updates the leaves of the records changed by ops and the root of the tree
+func updateIntegrity(tx *bbolt.Tx, key []byte, ops []Op) ([]Op, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(integrityBucket))
+	if err != nil {
+		return nil, err
+	}
+	ib := newBucket(integrityBucket, b)
+	changed := false
+	for _, op := range ops {
+		if !isModuleNamespace(op.Bucket) {
+			continue
+		}
+		changed = true
+		lk := integrityLeafKey(op.Bucket, op.Key)
+		if op.Delete {
+			err = ib.Delete(lk)
+		} else {
+			err = ib.Put(lk, merkle.LeafHash(key, []byte(op.Bucket), op.Key, op.Value))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	var leaves [][]byte
+	err = ib.ForEachWithPrefix(integrityLeafPrefix, func(k, v []byte) error {
+		leaves = append(leaves, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ib.Put(integrityRootKey, merkle.Root(key, leaves))
+	if err != nil {
+		return nil, err
+	}
+	return ib.ops, nil
+}
+
+func verifyIntegrity(tx *bbolt.Tx, key []byte) (*IntegrityReport, error) {
+	report := new(IntegrityReport)
+	ib := tx.Bucket([]byte(integrityBucket))
+	if ib == nil {
+		return nil, errors.New("integrity tree not found")
+	}
+
+	stored := make(map[string][]byte)
+	var leaves [][]byte
+	cursor := ib.Cursor()
+	for k, v := cursor.Seek(integrityLeafPrefix); k != nil && bytes.HasPrefix(k, integrityLeafPrefix); k, v = cursor.Next() {
+		stored[string(k)] = append([]byte{}, v...)
+		leaves = append(leaves, v)
+	}
+	report.RootValid = bytes.Equal(merkle.Root(key, leaves), ib.Get(integrityRootKey))
+
+	for _, v := range moduleNamespace {
+		b := tx.Bucket([]byte(v.Namespace))
+		if b == nil {
+			continue
+		}
+		err := b.ForEach(func(k, val []byte) error {
+			lk := string(integrityLeafKey(v.Namespace, k))
+			leaf, ok := stored[lk]
+			if !ok {
+				report.Added = append(report.Added, IntegrityRecord{Namespace: v.Namespace, Key: string(k)})
+				return nil
+			}
+			delete(stored, lk)
+			if !bytes.Equal(leaf, merkle.LeafHash(key, []byte(v.Namespace), k, val)) {
+				report.Modified = append(report.Modified, IntegrityRecord{Namespace: v.Namespace, Key: string(k)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	removed := make([]string, 0, len(stored))
+	for k := range stored {
+		removed = append(removed, k)
+	}
+	sort.Strings(removed)
+	for _, k := range removed {
+		report.Removed = append(report.Removed, parseIntegrityLeafKey([]byte(k)))
+	}
+
+	report.Verified = report.RootValid && len(report.Added) == 0 && len(report.Removed) == 0 && len(report.Modified) == 0
+	return report, nil
+}
+
+func buildIntegrityOps(tx *bbolt.Tx, key []byte) ([]Op, error) {
+	var ops []Op
+	for _, v := range moduleNamespace {
+		b := tx.Bucket([]byte(v.Namespace))
+		if b == nil {
+			continue
+		}
+		err := b.ForEach(func(k, val []byte) error {
+			ops = append(ops, Op{Bucket: v.Namespace, Key: append([]byte{}, k...), Value: append([]byte{}, val...)})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// VerifyIntegrity checks every record of all namespaces against the integrity tree
+func (c *NekoQSecurityContainer) VerifyIntegrity() (*IntegrityReport, error) {
+	if !c.MasterUnlock {
+		return nil, errors.New("nekoq-security is not unlocked")
+	}
+	var report *IntegrityReport
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		r, err := verifyIntegrity(tx, c.integrityKey)
+		if err != nil {
+			return err
+		}
+		report = r
+		if c.keyCodec != nil {
+			resolveIntegrityKeys(tx, c.keyCodec, report)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// resolveIntegrityKeys maps hashed storage keys in the report back to real keys where the index knows them
+func resolveIntegrityKeys(tx *bbolt.Tx, codec *keyCodec, report *IntegrityReport) {
+	realKeys := make(map[string]map[string]string)
+	resolve := func(records []IntegrityRecord) {
+		for i, v := range records {
+			m, ok := realKeys[v.Namespace]
+			if !ok {
+				m = make(map[string]string)
+				if b := tx.Bucket([]byte(v.Namespace)); b != nil {
+					// a broken index is already reported as a modified record
+					index, _ := codec.decodeIndex(b.Get(keyIndexKey))
+					for k, sk := range index {
+						m[string(sk)] = k
+					}
+				}
+				realKeys[v.Namespace] = m
+			}
+			if k, ok := m[v.Key]; ok {
+				records[i].StorageKey = v.Key
+				records[i].Key = k
+			}
+		}
+	}
+	resolve(report.Added)
+	resolve(report.Removed)
+	resolve(report.Modified)
+}
+
+var ErrIntegrity = errors.New("integrity verification failed, unlock with -rebuild-integrity to accept the current records")
+
+// sealIntegrityMarker returns the marker that the tree of the store was built by the holder of the master key
+func sealIntegrityMarker(m []byte) ([]byte, error) {
+	return aesutils.Encrypt([]byte(integrityMarker), m)
+}
+
+func checkIntegrityMarker(v, m []byte) error {
+	dec, err := aesutils.Decrypt(v, m)
+	if err != nil {
+		return err
+	}
+	if string(dec) != integrityMarker {
+		return errors.New("masterkey cannot decrypt integrity marker")
+	}
+	return nil
+}
+
+// initIntegrity verifies the store at unlock, and refuses it when the tree is missing or does not match the records,
+// so tampering cannot be laundered by deleting the tree. The tree is built for a new store, whose master key check
+// was just written, or on the explicit rebuild of the operator.
+func initIntegrity(c *NekoQSecurityContainer, m, key []byte, fresh bool) error {
+	var marker []byte
+	var report *IntegrityReport
+	records := 0
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte("global")); b != nil {
+			marker = append([]byte{}, b.Get(integrityMarkerKey)...)
+		}
+		if tx.Bucket([]byte(integrityBucket)) == nil {
+			ops, err := buildIntegrityOps(tx, key)
+			records = len(ops)
+			return err
+		}
+		r, err := verifyIntegrity(tx, key)
+		report = r
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(marker) > 0 {
+		if err := checkIntegrityMarker(marker, m); err != nil {
+			return err
+		}
+	}
+
+	if report != nil {
+		logIntegrityReport(report)
+		if !report.Verified && !c.rebuildIntegrity {
+			return ErrIntegrity
+		}
+		// the tree of a store from before the marker is verified, the leader marks it
+		if report.Verified && (len(marker) > 0 || (c.cluster != nil && !c.cluster.IsLeader())) {
+			return nil
+		}
+	} else {
+		if !c.rebuildIntegrity && !(fresh && records == 0) {
+			logging.Error("integrity verification failed: integrity tree not found")
+			return ErrIntegrity
+		}
+	}
+
+	if c.cluster != nil && !c.cluster.IsLeader() {
+		return errors.New("integrity tree is built by the leader")
+	}
+	if report == nil || !report.Verified {
+		logging.Warn("building integrity tree from current records")
+		if err := rebuildIntegrity(c, key); err != nil {
+			return err
+		}
+	}
+	v, err := sealIntegrityMarker(m)
+	if err != nil {
+		return err
+	}
+	if err := c.applyOps([]Op{{Bucket: "global", Key: integrityMarkerKey, Value: v}}); err != nil {
+		return err
+	}
+	c.rebuildIntegrity = false
+	return nil
+}
+
+// rebuildIntegrity replaces the tree with one of the current records
+func rebuildIntegrity(c *NekoQSecurityContainer, key []byte) error {
+	var ops []Op
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		data, err := buildIntegrityOps(tx, key)
+		ops = data
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var treeOps []Op
+	err = c.db.Update(func(tx *bbolt.Tx) error {
+		if ib := tx.Bucket([]byte(integrityBucket)); ib != nil {
+			err := ib.ForEach(func(k, v []byte) error {
+				treeOps = append(treeOps, Op{Bucket: integrityBucket, Key: append([]byte{}, k...), Delete: true})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket([]byte(integrityBucket)); err != nil {
+				return err
+			}
+		}
+		r, err := updateIntegrity(tx, key, ops)
+		if err != nil {
+			return err
+		}
+		treeOps = append(treeOps, r...)
+		return errRollback
+	})
+	if err != errRollback {
+		return err
+	}
+	if len(ops) == 0 {
+		// no record at all, only the root of an empty tree
+		treeOps = append(treeOps, Op{Bucket: integrityBucket, Key: integrityRootKey, Value: merkle.Root(key, nil)})
+	}
+	return c.applyOps(treeOps)
+}
+
+func logIntegrityReport(report *IntegrityReport) {
+	if report.Verified {
+		logging.Info("integrity verification passed")
+		return
+	}
+	if !report.RootValid {
+		logging.Error("integrity verification failed: integrity tree root mismatch")
+	}
+	for _, v := range report.Added {
+		logging.Error("integrity verification failed: record added", logging.F("namespace", v.Namespace), logging.F("storage_key", v.Key))
+	}
+	for _, v := range report.Removed {
+		logging.Error("integrity verification failed: record removed", logging.F("namespace", v.Namespace), logging.F("storage_key", v.Key))
+	}
+	for _, v := range report.Modified {
+		logging.Error("integrity verification failed: record modified", logging.F("namespace", v.Namespace), logging.F("storage_key", v.Key))
+	}
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	"goimport.moetang.info/nekoq-security/alg/merkle"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+	"go.etcd.io/bbolt"
+)
+
+type testModule struct {
+}
+
+func (t testModule) SetupConfig(container *NekoQSecurityContainer) error {
+	return nil
+}
+
+func (t testModule) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	return nil
+}
+
+func TestIntegrity(t *testing.T) {
+	RegisterModuleNamespace("integrity-test", "test.integrity", testModule{})
+	defer delete(moduleNamespace, "integrity-test")
+
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := &NekoQSecurityContainer{db: db, MasterUnlock: true}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("test.integrity"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := []byte("0123456789abcdef0123456789abcdef")
+	key := merkle.DeriveKey(master, integrityPurpose)
+	if err := initIntegrity(c, master, key, true); err != nil {
+		t.Fatal(err)
+	}
+	c.integrityKey = key
+
+	err = c.DoTxWithinBucket("test.integrity", func(bucket *Bucket) error {
+		for _, k := range []string{"k1", "k2", "k3"} {
+			if err := bucket.Put([]byte(k), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return bucket.Delete([]byte("k3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified {
+		t.Fatal("store should be verified:", report)
+	}
+
+	// tamper outside of the service
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("test.integrity"))
+		if err := b.Put([]byte("k1"), []byte("changed")); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte("k2")); err != nil {
+			return err
+		}
+		return b.Put([]byte("k4"), []byte("v"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = c.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Verified || !report.RootValid {
+		t.Fatal("unexpected report:", report)
+	}
+	if len(report.Modified) != 1 || report.Modified[0].Key != "k1" {
+		t.Fatal("k1 should be reported as modified:", report.Modified)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].Key != "k2" || report.Removed[0].Namespace != "test.integrity" {
+		t.Fatal("k2 should be reported as removed:", report.Removed)
+	}
+	if len(report.Added) != 1 || report.Added[0].Key != "k4" {
+		t.Fatal("k4 should be reported as added:", report.Added)
+	}
+
+	// the unlock is refused, also when the tree is removed to hide the tampering
+	if err := initIntegrity(c, master, key, false); err != ErrIntegrity {
+		t.Fatal("tampered store unlocked:", err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte(integrityBucket))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initIntegrity(c, master, key, false); err != ErrIntegrity {
+		t.Fatal("store without tree unlocked:", err)
+	}
+	// until the operator accepts the current records
+	c.rebuildIntegrity = true
+	if err := initIntegrity(c, master, key, false); err != nil {
+		t.Fatal(err)
+	}
+	report, err = c.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || c.rebuildIntegrity {
+		t.Fatal("tree is not rebuilt:", report)
+	}
+	if err := initIntegrity(c, master, key, false); err != nil {
+		t.Fatal(err)
+	}
+}
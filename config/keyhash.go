@@ -0,0 +1,144 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"goimport.moetang.info/nekoq-security/alg/aesutils"
+	"goimport.moetang.info/nekoq-security/alg/merkle"
+	"goimport.moetang.info/nekoq-security/logging"
+)
+
+const keyHashPurpose = "nekoq-security.keyhash"
+
+// the encrypted index mapping real keys to hashed storage keys, stored within each namespace
+var keyIndexKey = []byte("nekoq-security.keyindex")
+
+type keyIndexEntry struct {
+	Key        []byte `json:"key"`
+	StorageKey []byte `json:"storage_key"`
+}
+
+// keyCodec hides real keys by storing records under keyed hashes derived from the master key
+type keyCodec struct {
+	hashKey []byte
+	encKey  []byte
+}
+
+func newKeyCodec(masterKey []byte) *keyCodec {
+	return &keyCodec{
+		hashKey: merkle.DeriveKey(masterKey, keyHashPurpose),
+		encKey:  masterKey,
+	}
+}
+
+func (k *keyCodec) storageKey(namespace string, key []byte) []byte {
+	m := hmac.New(sha256.New, k.hashKey)
+	m.Write([]byte(namespace))
+	m.Write([]byte{0})
+	m.Write(key)
+	return []byte(hex.EncodeToString(m.Sum(nil)))
+}
+
+func (k *keyCodec) decodeIndex(b []byte) (map[string][]byte, error) {
+	index := make(map[string][]byte)
+	if len(b) == 0 {
+		return index, nil
+	}
+	dec, err := aesutils.Decrypt(b, k.encKey)
+	if err != nil {
+		return nil, err
+	}
+	var entries []keyIndexEntry
+	if err := json.Unmarshal(dec, &entries); err != nil {
+		return nil, err
+	}
+	for _, v := range entries {
+		index[string(v.Key)] = v.StorageKey
+	}
+	return index, nil
+}
+
+func (k *keyCodec) encodeIndex(index map[string][]byte) ([]byte, error) {
+	entries := make([]keyIndexEntry, 0, len(index))
+	for key, sk := range index {
+		entries = append(entries, keyIndexEntry{Key: []byte(key), StorageKey: sk})
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return aesutils.Encrypt(b, k.encKey)
+}
+
+// migrateStorageKeys rewrites the records of all namespaces to match the hash_keys option
+func migrateStorageKeys(c *NekoQSecurityContainer, codec *keyCodec, hashKeys bool) error {
+	if c.cluster != nil && !c.cluster.IsLeader() {
+		return nil
+	}
+	for _, v := range moduleNamespace {
+		namespace := v.Namespace
+		err := c.DoTxWithinBucket(namespace, func(bucket *Bucket) error {
+			// the bucket is in raw mode here: keys are the stored ones
+			index, err := codec.decodeIndex(bucket.Get(keyIndexKey))
+			if err != nil {
+				return err
+			}
+			stored := make(map[string]string)
+			for k, sk := range index {
+				stored[string(sk)] = k
+			}
+
+			type record struct {
+				key, value []byte
+			}
+			var records []record
+			err = bucket.ForEachWithPrefix(nil, func(k, val []byte) error {
+				if string(k) == string(keyIndexKey) {
+					return nil
+				}
+				_, isHashed := stored[string(k)]
+				if isHashed != hashKeys {
+					records = append(records, record{key: k, value: val})
+				}
+				return nil
+			})
+			if err != nil || len(records) == 0 {
+				return err
+			}
+
+			logging.Info("migrate storage keys", logging.F("namespace", namespace), logging.F("hash_keys", hashKeys), logging.F("records", len(records)))
+			for _, r := range records {
+				if err := bucket.Delete(r.key); err != nil {
+					return err
+				}
+				if hashKeys {
+					sk := codec.storageKey(namespace, r.key)
+					index[string(r.key)] = sk
+					err = bucket.Put(sk, r.value)
+				} else {
+					realKey := stored[string(r.key)]
+					delete(index, realKey)
+					err = bucket.Put([]byte(realKey), r.value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if len(index) == 0 {
+				return bucket.Delete(keyIndexKey)
+			}
+			b, err := codec.encodeIndex(index)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(keyIndexKey, b)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
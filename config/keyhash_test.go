@@ -0,0 +1,98 @@
+package config
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestHashedStorageKeys(t *testing.T) {
+	RegisterModuleNamespace("keyhash-test", "test.keyhash", testModule{})
+	defer delete(moduleNamespace, "keyhash-test")
+
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("test.keyhash"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &NekoQSecurityContainer{db: db, MasterUnlock: true}
+	codec := newKeyCodec(bytes.Repeat([]byte{1}, 32))
+
+	// plaintext records written before the option is enabled
+	err = c.DoTxWithinBucket("test.keyhash", func(bucket *Bucket) error {
+		return bucket.Put([]byte("pg.instance.a"), []byte("va"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateStorageKeys(c, codec, true); err != nil {
+		t.Fatal(err)
+	}
+	c.keyCodec = codec
+
+	err = c.DoTxWithinBucket("test.keyhash", func(bucket *Bucket) error {
+		if err := bucket.Put([]byte("pg.instance.b"), []byte("vb")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("other.c"), []byte("vc"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("test.keyhash")).ForEach(func(k, v []byte) error {
+			if bytes.Contains(k, []byte("pg.instance")) || bytes.Contains(k, []byte("other")) {
+				t.Error("plaintext key found in storage:", string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = c.DoTxWithinBucket("test.keyhash", func(bucket *Bucket) error {
+		if string(bucket.Get([]byte("pg.instance.a"))) != "va" {
+			t.Error("migrated record not found")
+		}
+		return bucket.ForEachWithPrefix([]byte("pg.instance."), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "pg.instance.a" || keys[1] != "pg.instance.b" {
+		t.Fatal("unexpected prefix listing:", keys)
+	}
+
+	// switch the option off again
+	c.keyCodec = nil
+	if err := migrateStorageKeys(c, codec, false); err != nil {
+		t.Fatal(err)
+	}
+	err = c.DoTxWithinBucket("test.keyhash", func(bucket *Bucket) error {
+		if string(bucket.Get([]byte("other.c"))) != "vc" {
+			t.Error("record is not migrated back")
+		}
+		if bucket.Get(keyIndexKey) != nil {
+			t.Error("index should be removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
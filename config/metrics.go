@@ -0,0 +1,7 @@
+package config
+
+type MetricsConfig struct {
+	// plain http listener serving /metrics without token, also while sealed, for the network of the monitoring.
+	// The /metrics of the api requires a token.
+	Listen string `toml:"listen"`
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxies of the running server whose X-Forwarded-For is honoured, the cluster peers included
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(v []string) ([]*net.IPNet, error) {
+	var r []*net.IPNet
+	for _, s := range v {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				r = append(r, hostNet(ip))
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy: " + s)
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// peerNets returns the addresses of the api of the peers which are ip literals, requests forwarded by
+// them carry the address of the client in X-Forwarded-For
+func peerNets(cc *ClusterConfig) []*net.IPNet {
+	var r []*net.IPNet
+	for _, p := range cc.Peers {
+		u, err := url.Parse(p.ApiAddress)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			r = append(r, hostNet(ip))
+		}
+	}
+	return r
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP returns the address of the client of the request: the peer address of the connection, or
+// when the peer is a trusted proxy, the last address of X-Forwarded-For which is not one. Unlike the
+// ClientIP of gin, headers sent by anyone else are ignored, so they cannot pass an address check.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+	chain := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(chain) - 1; i >= 0; i-- {
+		v := net.ParseIP(strings.TrimSpace(chain[i]))
+		if v == nil {
+			break
+		}
+		ip = v
+		if !isTrustedProxy(v) {
+			break
+		}
+	}
+	return ip.String()
+}
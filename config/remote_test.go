@@ -0,0 +1,42 @@
+package config
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	defer func() {
+		trustedProxies = nil
+	}()
+	for _, c := range []struct {
+		remoteAddr, forwardedFor, ip string
+	}{
+		{"203.0.113.5:4000", "", "203.0.113.5"},
+		// forged by an untrusted peer
+		{"203.0.113.5:4000", "10.1.1.1", "203.0.113.5"},
+		{"10.0.0.2:4000", "", "10.0.0.2"},
+		{"10.0.0.2:4000", "198.51.100.7", "198.51.100.7"},
+		// the client prepends whatever it wants, the last untrusted address is taken
+		{"10.0.0.2:4000", "10.9.9.9, 198.51.100.7, 192.0.2.1", "198.51.100.7"},
+		{"10.0.0.2:4000", "garbage, 198.51.100.7", "198.51.100.7"},
+		{"[2001:db8::1]:4000", "10.1.1.1", "2001:db8::1"},
+	} {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: http.Header{}}
+		if len(c.forwardedFor) > 0 {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if ip := RemoteIP(r); ip != c.ip {
+			t.Error(c.remoteAddr, c.forwardedFor, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+}
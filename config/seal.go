@@ -0,0 +1,68 @@
+package config
+
+import (
+	"goimport.moetang.info/nekoq-security/apierr"
+
+	"github.com/gin-gonic/gin"
+	"go.etcd.io/bbolt"
+)
+
+// container of the running server, for the shared sealed middleware
+var activeContainer *NekoQSecurityContainer
+
+// IsUnsealed returns true once the master key is unlocked
+func IsUnsealed() bool {
+	return activeContainer != nil && activeContainer.MasterUnlock
+}
+
+// AbortSealed refuses the request with 503 and Retry-After
+func AbortSealed(ctx *gin.Context) {
+	apierr.Abort(ctx, apierr.Sealed())
+}
+
+// RequireUnsealed is the middleware shared by all modules. While sealed the handler is never called.
+func RequireUnsealed() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !IsUnsealed() {
+			AbortSealed(ctx)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// InitModuleRoutes registers the routes of all modules. They are served from the start and refuse
+// requests until unsealed, so it must be called after the global middlewares are set.
+func (c *NekoQSecurityConfig) InitModuleRoutes() error {
+	for _, v := range moduleNamespace {
+		if err := v.Module.InitWebScaffold(webscaffold); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsInitialized returns true when a master key has been set up for the storage
+func (c *NekoQSecurityConfig) IsInitialized() (bool, error) {
+	initialized := false
+	err := c.container.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte("global"))
+		initialized = b != nil && len(b.Get([]byte("nekoq-security.init"))) > 0
+		return nil
+	})
+	return initialized, err
+}
+
+// reads which write, e.g. credential reads issuing a lease, by route pattern
+var leaderReads = make(map[string]bool)
+
+// RegisterLeaderRead makes GET requests of the route forwarded to the leader in cluster mode, like writes
+func RegisterLeaderRead(routes ...string) {
+	for _, v := range routes {
+		leaderReads[v] = true
+	}
+}
+
+func IsLeaderRead(route string) bool {
+	return leaderReads[route]
+}
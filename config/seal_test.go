@@ -0,0 +1,82 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireUnsealed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	called := false
+	e := gin.New()
+	e.GET("/v1/pg/instances", RequireUnsealed(), func(ctx *gin.Context) {
+		called = true
+		ctx.JSON(http.StatusOK, gin.H{"status": 0})
+	})
+	request := func() *httptest.ResponseRecorder {
+		called = false
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/pg/instances", nil))
+		return w
+	}
+
+	dir := t.TempDir()
+	c, err := OpenTestStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		open   func() error
+		status int
+	}{
+		{"uninitialized", func() error { return nil }, http.StatusServiceUnavailable},
+		{"unsealed", func() error {
+			c.Close()
+			c, err = OpenTestConfig(dir)
+			return err
+		}, http.StatusOK},
+		// a restart seals the storage again
+		{"sealed", func() error {
+			c.Close()
+			c, err = OpenTestStorage(dir)
+			return err
+		}, http.StatusServiceUnavailable},
+	} {
+		if err := tc.open(); err != nil {
+			t.Fatal(tc.name, err)
+		}
+		w := request()
+		if w.Code != tc.status {
+			t.Error(tc.name, w.Code)
+			continue
+		}
+		if tc.status == http.StatusOK {
+			if !called || len(w.Header().Get("Retry-After")) > 0 {
+				t.Error(tc.name, "not served")
+			}
+			continue
+		}
+		if called {
+			t.Error(tc.name, "handler called while sealed")
+		}
+		if w.Header().Get("Retry-After") != strconv.Itoa(apierr.RetryAfterSeconds) {
+			t.Error(tc.name, "retry after:", w.Header().Get("Retry-After"))
+		}
+		body := new(struct {
+			Status int         `json:"status"`
+			Code   apierr.Code `json:"code"`
+		})
+		if err := json.Unmarshal(w.Body.Bytes(), body); err != nil || body.Code != apierr.CodeSealed || body.Status != -1 {
+			t.Error(tc.name, w.Body.String())
+		}
+	}
+	c.Close()
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/shamir"
+)
+
+// OpenTestStorage opens the standalone storage in dir, which is sealed like after a start of the server
+func OpenTestStorage(dir string) (*NekoQSecurityConfig, error) {
+	c := new(NekoQSecurityConfig)
+	c.NekoQSecurity.MasterKey.Type = "shamir"
+	c.NekoQSecurity.Storage.Path = filepath.Join(dir, "test.db")
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.Init(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// OpenTestConfig opens a standalone storage in dir and unseals it with a new master key, which sets up
+// the registered modules like an unseal of the server. It is for the tests of the modules.
+func OpenTestConfig(dir string) (*NekoQSecurityConfig, error) {
+	c, err := OpenTestStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := shamir.InitShamirKeys(MaxShares, MinShares)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, v := range shards[:MinShares] {
+		c.FeedShamirKey(v)
+	}
+	if !c.IsMasterUnlock() {
+		c.Close()
+		return nil, errors.New("unseal of the test storage failed")
+	}
+	return c, nil
+}
+
+// Close stops the cluster node and closes the storage
+func (c *NekoQSecurityConfig) Close() error {
+	if activeContainer == c.container {
+		activeContainer = nil
+	}
+	if c.container.cluster != nil {
+		if err := c.container.cluster.raft.Shutdown().Error(); err != nil {
+			return err
+		}
+	}
+	return c.container.db.Close()
+}
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// OpenTestCluster starts the raft nodes of a cluster of size in dir, which are sealed. The api addresses of the
+// peers are free local ports, for the tests serving the api of the nodes.
+func OpenTestCluster(dir string, size int) ([]*NekoQSecurityConfig, error) {
+	return openTestCluster(dir, size, ClusterTLSConfig{})
+}
+
+func openTestCluster(dir string, size int, tc ClusterTLSConfig) ([]*NekoQSecurityConfig, error) {
+	var peers []struct {
+		NodeId      string `toml:"node_id"`
+		RaftAddress string `toml:"raft_address"`
+		ApiAddress  string `toml:"api_address"`
+	}
+	for i := 0; i < size; i++ {
+		raftAddress, err := freeAddress()
+		if err != nil {
+			return nil, err
+		}
+		apiAddress, err := freeAddress()
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, struct {
+			NodeId      string `toml:"node_id"`
+			RaftAddress string `toml:"raft_address"`
+			ApiAddress  string `toml:"api_address"`
+		}{
+			NodeId:      fmt.Sprint("node", i),
+			RaftAddress: raftAddress,
+			ApiAddress:  "http://" + apiAddress,
+		})
+	}
+
+	var nodes []*NekoQSecurityConfig
+	for i := 0; i < size; i++ {
+		c := new(NekoQSecurityConfig)
+		c.NekoQSecurity.MasterKey.Type = "shamir"
+		c.NekoQSecurity.Storage.Path = filepath.Join(dir, fmt.Sprint("node", i, ".db"))
+		c.NekoQSecurity.Cluster.Enable = true
+		c.NekoQSecurity.Cluster.NodeId = peers[i].NodeId
+		c.NekoQSecurity.Cluster.RaftBind = peers[i].RaftAddress
+		c.NekoQSecurity.Cluster.RaftDir = filepath.Join(dir, fmt.Sprint("raft", i))
+		c.NekoQSecurity.Cluster.ApiAddress = peers[i].ApiAddress
+		c.NekoQSecurity.Cluster.Bootstrap = i == 0
+		c.NekoQSecurity.Cluster.Peers = peers
+		c.NekoQSecurity.Cluster.TLS = tc
+		err := c.Validate()
+		if err == nil {
+			err = c.Init()
+		}
+		if err != nil {
+			for _, n := range nodes {
+				n.Close()
+			}
+			return nil, err
+		}
+		nodes = append(nodes, c)
+	}
+	return nodes, nil
+}
+
+// WaitLeader waits for the election of a leader among the nodes, and returns it and the followers
+func WaitLeader(nodes []*NekoQSecurityConfig, timeout time.Duration) (*NekoQSecurityConfig, []*NekoQSecurityConfig, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for i, c := range nodes {
+			if c.IsLeader() {
+				var followers []*NekoQSecurityConfig
+				followers = append(followers, nodes[:i]...)
+				followers = append(followers, nodes[i+1:]...)
+				return c, followers, nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, nil, errors.New("no leader elected")
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"goimport.moetang.info/nekoq-security/logging"
+)
+
+const (
+	ClientAuthNone          = "none"
+	ClientAuthVerifyIfGiven = "verify_if_given"
+	ClientAuthRequire       = "require"
+)
+
+type TLSConfig struct {
+	Enable       bool   `toml:"enable"`
+	CertFile     string `toml:"cert_file"`
+	KeyFile      string `toml:"key_file"`
+	ClientCAFile string `toml:"client_ca_file"`
+	ClientAuth   string `toml:"client_auth"` // none, verify_if_given or require
+}
+
+func (tc *TLSConfig) validate() error {
+	if !tc.Enable {
+		return nil
+	}
+	if len(tc.CertFile) == 0 || len(tc.KeyFile) == 0 {
+		return errors.New("tls requires cert_file and key_file")
+	}
+	switch tc.ClientAuth {
+	case "":
+		tc.ClientAuth = ClientAuthNone
+	case ClientAuthNone:
+	case ClientAuthVerifyIfGiven, ClientAuthRequire:
+		if len(tc.ClientCAFile) == 0 {
+			return errors.New("tls client_auth requires client_ca_file")
+		}
+	default:
+		return errors.New("unknown tls client_auth")
+	}
+	return nil
+}
+
+// tlsReloader keeps the certificate and the client CAs, which are reloaded on SIGHUP
+type tlsReloader struct {
+	config *TLSConfig
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newTLSReloader(tc *TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{config: tc}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := r.load(); err != nil {
+				logging.Error("reload tls certificate error", logging.Err(err))
+			} else {
+				logging.Info("tls certificate reloaded")
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if len(r.config.ClientCAFile) > 0 {
+		b, err := ioutil.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return errors.New("no certificate found in client_ca_file")
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	return nil
+}
+
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch r.config.ClientAuth {
+	case ClientAuthVerifyIfGiven:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
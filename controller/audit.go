@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"net/http"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/audit"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+type auditHashRequest struct {
+	Input string `json:"input"`
+}
+
+var (
+	auditHashSchema = openapi.Object(map[string]*openapi.Schema{
+		"input": openapi.String(),
+	}).Require("input")
+	auditHashResultSchema = openapi.Object(map[string]*openapi.Schema{
+		"hash": openapi.String(),
+	})
+	auditVerifyResultSchema = openapi.Object(map[string]*openapi.Schema{
+		"valid":           openapi.Boolean(),
+		"entries":         openapi.Integer(),
+		"first_prev_hash": openapi.String(),
+		"last_hash":       openapi.String(),
+		"unkeyed":         openapi.Integer(),
+		"line":            openapi.Integer(),
+		"reason":          openapi.String(),
+	})
+)
+
+func initAudit(e *gin.Engine, c *config.NekoQSecurityConfig) {
+	g := openapi.NewGroup(e, "sys", "/sys")
+	// hash a value the way audit entries do, to look for a known secret in the audit log
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/audit-hash", Legacy: "/sys/audit-hash", Id: "auditHash",
+		Summary: "hmac of a value as written to the audit log", Body: auditHashSchema, Result: auditHashResultSchema},
+		auth.Require(auth.CapabilitySys, auth.StaticResource("sys/audit-hash")), func(ctx *gin.Context) {
+			req := new(auditHashRequest)
+			if err := ctx.ShouldBindJSON(req); err != nil {
+				apierr.Abort(ctx, apierr.Validation("parameter error"))
+				return
+			}
+			ctx.JSON(http.StatusOK, gin.H{
+				"status": 0,
+				"result": gin.H{
+					"hash": audit.HashValue(c.AuditKey(), req.Input),
+				},
+			})
+		})
+	// check the chain of the audit file with the key, which the offline -audit-verify has not
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/audit-verify", Legacy: "/sys/audit-verify", Id: "auditVerify",
+		Summary: "verify the hmac chain of the audit file", Result: auditVerifyResultSchema},
+		auth.Require(auth.CapabilitySys, auth.StaticResource("sys/audit-verify")), func(ctx *gin.Context) {
+			report, err := audit.VerifyDevice()
+			if err == audit.ErrNoFileDevice {
+				apierr.Abort(ctx, apierr.NotFound("audit device", "file"))
+				return
+			}
+			if err != nil {
+				apierr.Abort(ctx, err)
+				return
+			}
+			ctx.JSON(http.StatusOK, gin.H{
+				"status": 0,
+				"result": report,
+			})
+		})
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+	"goimport.moetang.info/nekoq-security/tracing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// local paths are always served by the current node: the unlock is required on every node and
+// the health, readiness and raft state are of the node. Everything else is written on the leader.
+var clusterLocalPaths = map[string]bool{
+	"/v1/sys/unseal":         true,
+	"/v1/sys/unseal/reset":   true,
+	"/v1/sys/health":         true,
+	"/sys/health":            true,
+	"/v1/sys/ready":          true,
+	"/sys/ready":             true,
+	"/v1/sys/cluster/status": true,
+	"/sys/cluster/status":    true,
+}
+
+// the deprecated unlock
+const clusterLocalPathPrefix = "/masterkey/"
+
+func clusterForward(c *config.NekoQSecurityConfig) gin.HandlerFunc {
+	// the leader is reached with the certificate of the node, and its api certificate is checked against the cluster ca
+	transport := http.DefaultTransport
+	if tlsConfig := c.ClusterTLSConfig(); tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	}
+	return func(ctx *gin.Context) {
+		if !c.IsClusterEnabled() || c.IsLeader() {
+			ctx.Next()
+			return
+		}
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if !config.IsLeaderRead(ctx.FullPath()) {
+				ctx.Next()
+				return
+			}
+		}
+		if clusterLocalPaths[ctx.Request.URL.Path] || strings.HasPrefix(ctx.Request.URL.Path, clusterLocalPathPrefix) {
+			ctx.Next()
+			return
+		}
+
+		leader := c.LeaderApiAddress()
+		if len(leader) == 0 {
+			apierr.Abort(ctx, apierr.Unavailable("no cluster leader"))
+			return
+		}
+		u, err := url.Parse(leader)
+		if err != nil {
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+
+		logging.FromContext(ctx).Debug("forward request to leader", logging.F("leader", leader), logging.F("mode", c.NekoQSecurity.Cluster.ForwardMode))
+
+		// a proxied request would reach the leader without the client certificate, so the client has to present it there
+		clientCert := ctx.Request.TLS != nil && len(ctx.Request.TLS.PeerCertificates) > 0
+		if c.NekoQSecurity.Cluster.ForwardMode == config.ForwardModeRedirect || clientCert {
+			target := *u
+			target.Path = ctx.Request.URL.Path
+			target.RawQuery = ctx.Request.URL.RawQuery
+			ctx.Redirect(http.StatusTemporaryRedirect, target.String())
+			ctx.Abort()
+			return
+		}
+
+		// the leader continues the trace of the request
+		tracing.Inject(ctx.Request.Context(), ctx.Request.Header)
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.Transport = transport
+		proxy.ServeHTTP(ctx.Writer, ctx.Request)
+		ctx.Abort()
+	}
+}
+
+func initCluster(e *gin.Engine, c *config.NekoQSecurityConfig) {
+	g := openapi.NewGroup(e, "sys", "/sys")
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/cluster/status", Legacy: "/sys/cluster/status", Id: "clusterStatus",
+		Summary: "raft state and peers of the node", Public: true, Result: openapi.Object(nil)}, func(ctx *gin.Context) {
+		s, ok := c.ClusterStatus()
+		if !ok {
+			apierr.Abort(ctx, apierr.New(apierr.CodeNotFound, "cluster mode is not enabled"))
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status": 0,
+			"result": s,
+		})
+	})
+}
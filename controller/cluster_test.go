@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveTestNode serves the forwarding of the node on its api address, with handlers answering the id of the node
+func serveTestNode(t *testing.T, c *config.NekoQSecurityConfig) {
+	e := gin.New()
+	e.Use(clusterForward(c))
+	node := func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"status": 0, "result": c.NekoQSecurity.Cluster.NodeId})
+	}
+	e.POST("/v1/auth/userpass/login", node)
+	e.POST("/v1/auth/token/create", node)
+	e.POST("/v1/sys/policies", node)
+	e.POST("/v1/sys/unseal", node)
+	e.GET("/v1/sys/health", node)
+	e.GET("/v1/sys/cluster/status", node)
+
+	u, err := url.Parse(c.NekoQSecurity.Cluster.ApiAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: e}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+}
+
+func servedBy(t *testing.T, method, address, path string) string {
+	req, _ := http.NewRequest(method, address+path, strings.NewReader(`{"username":"alice","password":"secret"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(path, resp.StatusCode)
+	}
+	r := new(struct {
+		Result string `json:"result"`
+	})
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		t.Fatal(err)
+	}
+	return r.Result
+}
+
+func TestClusterForward(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodes, err := config.OpenTestCluster(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	})
+	leader, followers, err := config.WaitLeader(nodes, 20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the followers know the leader once they received its heartbeat
+	for _, f := range followers {
+		for deadline := time.Now().Add(10 * time.Second); len(f.LeaderApiAddress()) == 0; time.Sleep(100 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("no leader known by", f.NekoQSecurity.Cluster.NodeId)
+			}
+		}
+	}
+	for _, c := range nodes {
+		serveTestNode(t, c)
+	}
+
+	leaderId := leader.NekoQSecurity.Cluster.NodeId
+	for _, f := range followers {
+		address, id := f.NekoQSecurity.Cluster.ApiAddress, f.NekoQSecurity.Cluster.NodeId
+		// logins and the other writes of auth and sys are written by the leader
+		for _, path := range []string{"/v1/auth/userpass/login", "/v1/auth/token/create", "/v1/sys/policies"} {
+			if node := servedBy(t, http.MethodPost, address, path); node != leaderId {
+				t.Error(path, "served by", node)
+			}
+		}
+		// the unlock, health and raft state are of the node
+		if node := servedBy(t, http.MethodPost, address, "/v1/sys/unseal"); node != id {
+			t.Error("unseal served by", node)
+		}
+		for _, path := range []string{"/v1/sys/health", "/v1/sys/cluster/status"} {
+			if node := servedBy(t, http.MethodGet, address, path); node != id {
+				t.Error(path, "served by", node)
+			}
+		}
+
+		// the client certificate cannot be proxied, the client is sent to the leader
+		e := gin.New()
+		e.Use(clusterForward(f))
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/token/create", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != leader.NekoQSecurity.Cluster.ApiAddress+"/v1/auth/token/create" {
+			t.Error("request with a client certificate:", w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+type healthStatus struct {
+	Initialized    bool   `json:"initialized"`
+	Sealed         bool   `json:"sealed"`
+	Standby        bool   `json:"standby"`
+	ClusterEnabled bool   `json:"cluster_enabled"`
+	LeaderAddress  string `json:"leader_address,omitempty"`
+	ServerTimeUTC  int64  `json:"server_time_utc"`
+}
+
+var healthSchema = openapi.Object(map[string]*openapi.Schema{
+	"initialized":     openapi.Boolean(),
+	"sealed":          openapi.Boolean(),
+	"standby":         openapi.Boolean(),
+	"cluster_enabled": openapi.Boolean(),
+	"leader_address":  openapi.String(),
+	"server_time_utc": openapi.Integer(),
+})
+
+func currentHealth(c *config.NekoQSecurityConfig) (*healthStatus, error) {
+	initialized, err := c.IsInitialized()
+	if err != nil {
+		return nil, err
+	}
+	h := &healthStatus{
+		Initialized:    initialized,
+		Sealed:         !c.IsMasterUnlock(),
+		ClusterEnabled: c.IsClusterEnabled(),
+		ServerTimeUTC:  time.Now().Unix(),
+	}
+	if h.ClusterEnabled {
+		h.Standby = !c.IsLeader()
+		h.LeaderAddress = c.LeaderApiAddress()
+	}
+	return h, nil
+}
+
+// initHealth registers the endpoints for load balancers. Both need no token and work while sealed.
+//   - /sys/health: 200 active, 429 unsealed standby (200 with ?standbyok=true), 503 sealed, 501 not initialized
+//   - /sys/ready: 200 when unsealed and able to serve requests, otherwise 503
+func initHealth(e *gin.Engine, c *config.NekoQSecurityConfig) {
+	g := openapi.NewGroup(e, "sys", "/sys")
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/health", Legacy: "/sys/health", Id: "health",
+		Summary: "200 active, 429 unsealed standby, 503 sealed, 501 not initialized", Public: true,
+		Query:  []*openapi.Parameter{{Name: "standbyok", Description: "200 on an unsealed standby", Schema: openapi.Boolean()}},
+		Result: healthSchema}, func(ctx *gin.Context) {
+		h, err := currentHealth(c)
+		if err != nil {
+			logging.Error("health error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		code := http.StatusOK
+		switch {
+		case !h.Initialized:
+			code = http.StatusNotImplemented
+		case h.Sealed:
+			code = http.StatusServiceUnavailable
+		case h.Standby && ctx.Query("standbyok") != "true":
+			code = http.StatusTooManyRequests
+		}
+		ctx.JSON(code, gin.H{
+			"status": 0,
+			"result": h,
+		})
+	})
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/ready", Legacy: "/sys/ready", Id: "ready",
+		Summary: "200 when the node can serve requests, otherwise 503", Public: true, Result: healthSchema}, func(ctx *gin.Context) {
+		h, err := currentHealth(c)
+		if err != nil {
+			logging.Error("health error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		// a standby serves reads and forwards writes as long as there is a leader
+		if h.Sealed || (h.Standby && len(h.LeaderAddress) == 0) {
+			ctx.Header("Retry-After", strconv.Itoa(apierr.RetryAfterSeconds))
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": 1,
+				"result": h,
+			})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"status": 0,
+			"result": h,
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/shamir"
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+type healthCase struct {
+	name  string
+	path  string
+	code  int
+	retry bool
+}
+
+func checkHealth(t *testing.T, c *config.NekoQSecurityConfig, cases []healthCase) {
+	e := gin.New()
+	initHealth(e, c)
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.code {
+			t.Error(tc.name, tc.path, w.Code, w.Body.String())
+		}
+		if retry := w.Header().Get("Retry-After"); tc.retry != (retry == strconv.Itoa(apierr.RetryAfterSeconds)) {
+			t.Error(tc.name, tc.path, "retry after:", retry)
+		}
+	}
+}
+
+func TestHealthStandalone(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	c, err := config.OpenTestStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHealth(t, c, []healthCase{
+		{"uninitialized", "/v1/sys/health", http.StatusNotImplemented, false},
+		{"uninitialized", "/v1/sys/ready", http.StatusServiceUnavailable, true},
+	})
+	c.Close()
+
+	if c, err = config.OpenTestConfig(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkHealth(t, c, []healthCase{
+		{"unsealed", "/v1/sys/health", http.StatusOK, false},
+		{"unsealed", "/sys/health", http.StatusOK, false},
+		{"unsealed", "/v1/sys/ready", http.StatusOK, false},
+	})
+	c.Close()
+
+	if c, err = config.OpenTestStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	checkHealth(t, c, []healthCase{
+		{"sealed", "/v1/sys/health", http.StatusServiceUnavailable, false},
+		{"sealed", "/v1/sys/health?standbyok=true", http.StatusServiceUnavailable, false},
+		{"sealed", "/v1/sys/ready", http.StatusServiceUnavailable, true},
+	})
+}
+
+func TestHealthCluster(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodes, err := config.OpenTestCluster(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, c := range nodes {
+			c.Close()
+		}
+	})
+	leader, followers, err := config.WaitLeader(nodes, 20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards, err := shamir.InitShamirKeys(config.MaxShares, config.MinShares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the leader initializes the storage, followers unseal once the key check is replicated
+	unseal := func(c *config.NekoQSecurityConfig) {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+			if initialized, err := c.IsInitialized(); err == nil && (initialized || c.IsLeader()) {
+				for _, v := range shards[:config.MinShares] {
+					c.FeedShamirKey(v)
+				}
+				if c.IsMasterUnlock() {
+					return
+				}
+				c.ResetMasterKeyWhileUnlocking()
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("unseal failed on", c.NekoQSecurity.Cluster.NodeId)
+			}
+		}
+	}
+	unseal(leader)
+	checkHealth(t, leader, []healthCase{
+		{"leader", "/v1/sys/health", http.StatusOK, false},
+		{"leader", "/v1/sys/ready", http.StatusOK, false},
+	})
+	checkHealth(t, followers[0], []healthCase{
+		{"sealed standby", "/v1/sys/health?standbyok=true", http.StatusServiceUnavailable, false},
+		{"sealed standby", "/v1/sys/ready", http.StatusServiceUnavailable, true},
+	})
+
+	for _, f := range followers {
+		unseal(f)
+		for deadline := time.Now().Add(10 * time.Second); len(f.LeaderApiAddress()) == 0; time.Sleep(100 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("no leader known by", f.NekoQSecurity.Cluster.NodeId)
+			}
+		}
+		checkHealth(t, f, []healthCase{
+			{"standby", "/v1/sys/health", http.StatusTooManyRequests, false},
+			{"standby", "/v1/sys/health?standbyok=true", http.StatusOK, false},
+			{"standby", "/v1/sys/ready", http.StatusOK, false},
+		})
+	}
+}
@@ -3,7 +3,14 @@ package controller
 import (
 	"net/http"
 
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/audit"
+	"goimport.moetang.info/nekoq-security/auth"
 	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+	"goimport.moetang.info/nekoq-security/openapi"
+	"goimport.moetang.info/nekoq-security/tracing"
 
 	scaffold "github.com/moetang/webapp-scaffold"
 
@@ -11,24 +18,55 @@ import (
 )
 
 func Init(scaffold *scaffold.WebappScaffold, c *config.NekoQSecurityConfig) {
-	// init master key
-	scaffold.GetGin().GET("/masterkey/unlock", func(ctx *gin.Context) {
-		key := ctx.Query("key")
+	// request ids first, the audit log and error responses carry them
+	scaffold.GetGin().Use(apierr.RequestId())
+	scaffold.GetGin().Use(tracing.Middleware())
+	scaffold.GetGin().Use(logging.Middleware())
+	scaffold.GetGin().Use(metrics.Middleware())
+	// audit before forwarding, so followers record forwarded requests too
+	scaffold.GetGin().Use(audit.Middleware())
+	initAudit(scaffold.GetGin(), c)
+	initHealth(scaffold.GetGin(), c)
+	initMetrics(scaffold.GetGin(), c)
+	// forward writes to leader in cluster mode
+	scaffold.GetGin().Use(clusterForward(c))
+	initCluster(scaffold.GetGin(), c)
+	initIntegrity(scaffold.GetGin(), c)
 
+	initUnseal(scaffold.GetGin(), c)
+	openapi.ServeDocument(scaffold.GetGin())
+}
+
+type unsealRequest struct {
+	Key string `json:"key"`
+}
+
+var unsealSchema = openapi.Object(map[string]*openapi.Schema{
+	"key": openapi.String().NonEmpty().Describe("one key shard"),
+}).Require("key")
+
+func initUnseal(e *gin.Engine, c *config.NekoQSecurityConfig) {
+	unseal := func(ctx *gin.Context, key string) {
 		if len(key) == 0 {
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"status":  1,
-				"message": "key is empty",
-			})
+			apierr.Abort(ctx, apierr.InvalidField("key", "key is empty"))
 			return
 		}
 
 		b := c.FeedShamirKey(key)
 		if b {
-			ctx.JSON(http.StatusOK, gin.H{
+			r := gin.H{
 				"status":  0,
 				"message": "nekoq-security is unlocked",
-			})
+			}
+			// the initial root token is only returned once
+			token, generated, err := auth.EnsureRootToken()
+			if err != nil {
+				logging.Error("EnsureRootToken error", logging.Err(err))
+			}
+			if generated {
+				r["root_token"] = token
+			}
+			ctx.JSON(http.StatusOK, r)
 			return
 		} else {
 			ctx.JSON(http.StatusOK, gin.H{
@@ -37,8 +75,8 @@ func Init(scaffold *scaffold.WebappScaffold, c *config.NekoQSecurityConfig) {
 			})
 			return
 		}
-	})
-	scaffold.GetGin().GET("/masterkey/reset_init", func(ctx *gin.Context) {
+	}
+	reset := func(ctx *gin.Context) {
 		if c.IsMasterUnlock() {
 			ctx.JSON(http.StatusOK, gin.H{
 				"status":  0,
@@ -52,5 +90,30 @@ func Init(scaffold *scaffold.WebappScaffold, c *config.NekoQSecurityConfig) {
 			"status":  0,
 			"message": "done",
 		})
+	}
+
+	g := openapi.NewGroup(e, "sys", "/sys")
+	unsealOp := &openapi.Operation{Method: http.MethodPost, Path: "/unseal", Id: "unseal",
+		Summary: "feed one key shard of the master key, status is 1 while more shards are needed. " +
+			"The unlock which initializes the store returns the root_token.", Public: true, Body: unsealSchema}
+	g.Handle(unsealOp, func(ctx *gin.Context) {
+		req := new(unsealRequest)
+		if err := ctx.ShouldBindJSON(req); err != nil {
+			apierr.Abort(ctx, apierr.Validation("parameter error"))
+			return
+		}
+		unseal(ctx, req.Key)
+	})
+	resetOp := &openapi.Operation{Method: http.MethodPost, Path: "/unseal/reset", Id: "resetUnseal",
+		Summary: "drop the key shards fed so far", Public: true}
+	g.Handle(resetOp, reset)
+
+	// the legacy routes are GETs, the key shard in the query string
+	e.GET("/masterkey/unlock", openapi.Deprecated("/v1/sys/unseal"), func(ctx *gin.Context) {
+		unseal(ctx, ctx.Query("key"))
 	})
+	openapi.DescribeDeprecated(http.MethodGet, "/masterkey/unlock", &openapi.Operation{Id: unsealOp.Id,
+		Summary: unsealOp.Summary, Public: true, Query: []*openapi.Parameter{{Name: "key", Required: true, Schema: openapi.String()}}})
+	e.GET("/masterkey/reset_init", openapi.Deprecated("/v1/sys/unseal/reset"), reset)
+	openapi.DescribeDeprecated(http.MethodGet, "/masterkey/reset_init", resetOp)
 }
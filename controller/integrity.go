@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"net/http"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+func initIntegrity(e *gin.Engine, c *config.NekoQSecurityConfig) {
+	g := openapi.NewGroup(e, "sys", "/sys")
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/verify", Legacy: "/sys/verify", Id: "verifyIntegrity",
+		Summary: "verify the merkle tree of all module records", Result: openapi.Object(nil)},
+		auth.Require(auth.CapabilitySys, auth.StaticResource("sys/verify")), func(ctx *gin.Context) {
+			if !c.IsMasterUnlock() {
+				apierr.Abort(ctx, apierr.Sealed())
+				return
+			}
+			report, err := c.VerifyIntegrity()
+			if err != nil {
+				logging.Error("VerifyIntegrity error", logging.Err(err))
+				apierr.Abort(ctx, apierr.Internal(err))
+				return
+			}
+			if !report.Verified {
+				apierr.Abort(ctx, apierr.New(apierr.CodeConflict, "integrity verification failed").WithDetail("report", report))
+				return
+			}
+			ctx.JSON(http.StatusOK, gin.H{
+				"status": 0,
+				"result": report,
+			})
+		})
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// storageCollector reads the bbolt stats on every scrape
+type storageCollector struct {
+	c *config.NekoQSecurityConfig
+
+	size         *prometheus.Desc
+	readTx       *prometheus.Desc
+	openReadTx   *prometheus.Desc
+	freePages    *prometheus.Desc
+	pendingPages *prometheus.Desc
+	pageWrites   *prometheus.Desc
+	writeSeconds *prometheus.Desc
+}
+
+func newStorageCollector(c *config.NekoQSecurityConfig) *storageCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "bbolt", name), help, nil, nil)
+	}
+	return &storageCollector{
+		c:            c,
+		size:         desc("size_bytes", "Size of the storage file."),
+		readTx:       desc("read_tx_total", "Read transactions started."),
+		openReadTx:   desc("open_read_tx", "Read transactions currently open."),
+		freePages:    desc("free_pages", "Free pages of the storage file."),
+		pendingPages: desc("pending_pages", "Pages freed by transactions still in use."),
+		pageWrites:   desc("page_writes_total", "Pages written by write transactions."),
+		writeSeconds: desc("write_seconds_total", "Time spent writing pages."),
+	}
+}
+
+func (s *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.size
+	ch <- s.readTx
+	ch <- s.openReadTx
+	ch <- s.freePages
+	ch <- s.pendingPages
+	ch <- s.pageWrites
+	ch <- s.writeSeconds
+}
+
+func (s *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, size, err := s.c.StorageStats()
+	if err != nil {
+		logging.Error("StorageStats error", logging.Err(err))
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(s.size, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(s.readTx, prometheus.CounterValue, float64(stats.TxN))
+	ch <- prometheus.MustNewConstMetric(s.openReadTx, prometheus.GaugeValue, float64(stats.OpenTxN))
+	ch <- prometheus.MustNewConstMetric(s.freePages, prometheus.GaugeValue, float64(stats.FreePageN))
+	ch <- prometheus.MustNewConstMetric(s.pendingPages, prometheus.GaugeValue, float64(stats.PendingPageN))
+	ch <- prometheus.MustNewConstMetric(s.pageWrites, prometheus.CounterValue, float64(stats.TxStats.Write))
+	ch <- prometheus.MustNewConstMetric(s.writeSeconds, prometheus.CounterValue, stats.TxStats.WriteTime.Seconds())
+}
+
+// initMetrics serves /metrics with the state of the node to tokens with sys on sys/metrics. Scrapes without token,
+// also while sealed, are served by metrics.listen only.
+func initMetrics(e *gin.Engine, c *config.NekoQSecurityConfig) {
+	metrics.Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "sealed",
+			Help:      "1 while the master key is locked.",
+		}, func() float64 {
+			return boolValue(!c.IsMasterUnlock())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "initialized",
+			Help:      "1 once a master key is set up for the storage.",
+		}, func() float64 {
+			initialized, err := c.IsInitialized()
+			if err != nil {
+				logging.Error("IsInitialized error", logging.Err(err))
+			}
+			return boolValue(initialized)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "cluster_leader",
+			Help:      "1 when the node accepts writes, always in non-cluster mode.",
+		}, func() float64 {
+			return boolValue(c.IsLeader())
+		}),
+		newStorageCollector(c),
+	)
+	metrics.Serve(e, auth.Require(auth.CapabilitySys, auth.StaticResource("sys/metrics")))
+}
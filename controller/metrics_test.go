@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMetricsRequireToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e := gin.New()
+	initMetrics(e, c)
+
+	scrape := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		return w
+	}
+	if w := scrape(""); w.Code != http.StatusUnauthorized {
+		t.Fatal("metrics served without token:", w.Code)
+	}
+	client, err := auth.CreateToken(&auth.Token{Type: auth.TokenTypeClient,
+		Policies: []auth.Policy{{Path: "pg/*", Capabilities: []string{auth.CapabilityReadCredential}}}}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := scrape(client); w.Code != http.StatusForbidden {
+		t.Fatal("metrics served without sys:", w.Code)
+	}
+	monitoring, err := auth.CreateToken(&auth.Token{Type: auth.TokenTypeClient,
+		Policies: []auth.Policy{{Path: "sys/metrics", Capabilities: []string{auth.CapabilitySys}}}}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := scrape(monitoring); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "nekoq_sealed 0") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
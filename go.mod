@@ -4,9 +4,19 @@ go 1.16
 
 require (
 	github.com/gin-gonic/gin v1.6.3
-	github.com/jackc/pgtype v1.6.2
+	github.com/hashicorp/raft v1.3.1
+	github.com/hashicorp/raft-boltdb/v2 v2.0.0-20210421194847-a7e34179d62c
 	github.com/jackc/pgx/v4 v4.10.1
 	github.com/moetang/webapp-scaffold v0.0.0-20210222140042-ffce1147e84d
+	github.com/pelletier/go-toml v1.8.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/satori/go.uuid v1.2.0
 	go.etcd.io/bbolt v1.3.5
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.3.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	google.golang.org/grpc v1.43.0
 )
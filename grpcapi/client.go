@@ -0,0 +1,89 @@
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// Client calls the api over a connection, authenticated by the token of the context, see WithToken
+type Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{cc: cc}
+}
+
+func (c *Client) call(ctx context.Context, method string, req interface{}, opts ...grpc.CallOption) (*Reply, error) {
+	reply := new(Reply)
+	err := c.cc.Invoke(ctx, "/"+ServiceName+"/"+method, req, reply, append(opts, grpc.ForceCodec(jsonCodec{}))...)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *Client) SealStatus(ctx context.Context) (*Reply, error) {
+	return c.call(ctx, "SealStatus", &Empty{})
+}
+
+func (c *Client) Unseal(ctx context.Context, key string) (*Reply, error) {
+	return c.call(ctx, "Unseal", &UnsealRequest{Key: key})
+}
+
+func (c *Client) ListInstances(ctx context.Context) (*Reply, error) {
+	return c.call(ctx, "ListInstances", &Empty{})
+}
+
+func (c *Client) GetInstance(ctx context.Context, id string) (*Reply, error) {
+	return c.call(ctx, "GetInstance", &InstanceRequest{Id: id})
+}
+
+func (c *Client) CreateInstance(ctx context.Context, instance []byte) (*Reply, error) {
+	return c.call(ctx, "CreateInstance", &InstanceRequest{Instance: instance})
+}
+
+func (c *Client) UpdateInstance(ctx context.Context, id string, instance []byte) (*Reply, error) {
+	return c.call(ctx, "UpdateInstance", &InstanceRequest{Id: id, Instance: instance})
+}
+
+func (c *Client) DeleteInstance(ctx context.Context, id string) (*Reply, error) {
+	return c.call(ctx, "DeleteInstance", &InstanceRequest{Id: id})
+}
+
+func (c *Client) GetCredentials(ctx context.Context, id string) (*Reply, error) {
+	return c.call(ctx, "GetCredentials", &InstanceRequest{Id: id})
+}
+
+func (c *Client) RotateCredentials(ctx context.Context, id string) (*Reply, error) {
+	return c.call(ctx, "RotateCredentials", &InstanceRequest{Id: id})
+}
+
+// CredentialWatch receives the events of WatchCredentials until the context is done
+type CredentialWatch struct {
+	stream grpc.ClientStream
+}
+
+func (w *CredentialWatch) Recv() (*CredentialEvent, error) {
+	e := new(CredentialEvent)
+	if err := w.stream.RecvMsg(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// WatchCredentials watches the given instances, or all visible ones when none is given
+func (c *Client) WatchCredentials(ctx context.Context, instances ...string) (*CredentialWatch, error) {
+	stream, err := c.cc.NewStream(ctx, &ServiceDesc.Streams[0], "/"+ServiceName+"/WatchCredentials", grpc.ForceCodec(jsonCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&WatchRequest{Instances: instances}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &CredentialWatch{stream: stream}, nil
+}
@@ -0,0 +1,27 @@
+// gRPC api served next to the http server. Messages are json, described by the go types of this package.
+package grpcapi
+
+import (
+	"encoding/json"
+)
+
+// Codec is the content subtype of the api, clients send application/grpc+json
+const Codec = "json"
+
+// jsonCodec encodes messages with encoding/json, so the api needs no generated protobuf code
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return Codec
+}
@@ -0,0 +1,163 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// metadata keys, the same as the http headers
+	TokenMetadata     = "x-nekoq-token"
+	RequestIdMetadata = "x-request-id"
+	// code of the http api, in the trailer of failed calls
+	ErrorCodeMetadata = "x-nekoq-error-code"
+	// api address of the leader, in the trailer of watches refused by followers
+	LeaderMetadata = "x-nekoq-leader"
+)
+
+// WithToken returns the outgoing context of a call authenticated by token
+func WithToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, TokenMetadata, token)
+}
+
+// statusCodes maps the codes of the http api to grpc ones
+var statusCodes = map[apierr.Code]codes.Code{
+	apierr.CodeValidationFailed:    codes.InvalidArgument,
+	apierr.CodeUnauthorized:        codes.Unauthenticated,
+	apierr.CodeForbidden:           codes.PermissionDenied,
+	apierr.CodeNotFound:            codes.NotFound,
+	apierr.CodeConflict:            codes.AlreadyExists,
+	apierr.CodeLocked:              codes.FailedPrecondition,
+	apierr.CodeInternal:            codes.Internal,
+	apierr.CodeUnreachableDatabase: codes.Unavailable,
+	apierr.CodeSealed:              codes.Unavailable,
+	apierr.CodeUnavailable:         codes.Unavailable,
+}
+
+func statusError(ctx context.Context, code apierr.Code, message string) error {
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(ErrorCodeMetadata, string(code)))
+	c, ok := statusCodes[code]
+	if !ok {
+		c = codes.Unknown
+	}
+	return status.Error(c, message)
+}
+
+// responseRecorder keeps the response of the in-process request
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+// Flush and CloseNotify are expected by gin when the request is forwarded to the cluster leader
+func (r *responseRecorder) Flush() {
+}
+
+func (r *responseRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+type envelope struct {
+	Status    int             `json:"status"`
+	Code      apierr.Code     `json:"code"`
+	Message   string          `json:"message"`
+	RequestId string          `json:"request_id"`
+	Result    json.RawMessage `json:"result"`
+	RootToken string          `json:"root_token"`
+}
+
+// dispatch serves the call by the http route, so it goes through the same audit, sealed state,
+// authentication, validation and policy checks as http requests
+func (s *Server) dispatch(ctx context.Context, method, path string, body interface{}) (*Reply, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	req, err := http.NewRequest(method, path, bytes.NewReader(b))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(TokenMetadata); len(v) > 0 {
+		req.Header.Set(auth.TokenHeader, v[0])
+	}
+	if v := md.Get("authorization"); len(v) > 0 {
+		req.Header.Set("Authorization", v[0])
+	}
+	if v := md.Get(RequestIdMetadata); len(v) > 0 {
+		req.Header.Set(apierr.RequestIdHeader, v[0])
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &info.State
+		}
+	}
+
+	w := &responseRecorder{header: make(http.Header)}
+	s.handler.ServeHTTP(w, req)
+
+	if id := w.header.Get(apierr.RequestIdHeader); len(id) > 0 {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIdMetadata, id))
+	}
+	if w.code >= 300 && w.code < 400 {
+		// redirect forward mode of the cluster
+		return nil, status.Error(codes.Unavailable, "not the leader, write to "+w.header.Get("Location"))
+	}
+	e := new(envelope)
+	if err := json.Unmarshal(w.body.Bytes(), e); err != nil {
+		return nil, status.Error(codes.Internal, "unexpected response, http status "+strconv.Itoa(w.code))
+	}
+	if len(e.Code) > 0 {
+		return nil, statusError(ctx, e.Code, e.Message)
+	}
+	return &Reply{Status: e.Status, Message: e.Message, Result: e.Result, RootToken: e.RootToken}, nil
+}
+
+func tokenOf(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(TokenMetadata); len(v) > 0 {
+		return v[0]
+	}
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		return strings.TrimPrefix(v[0], "Bearer ")
+	}
+	return ""
+}
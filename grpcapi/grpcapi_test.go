@@ -0,0 +1,146 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func testClient(t *testing.T, e *gin.Engine, leader Leadership) *Client {
+	l := bufconn.Listen(1 << 20)
+	s := NewGRPCServer(e, nil, leader)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewClient(conn)
+}
+
+func TestDispatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(apierr.RequestId())
+	e.GET("/v1/pg/instances/:id", func(ctx *gin.Context) {
+		if ctx.GetHeader("X-NekoQ-Token") != "t1" {
+			apierr.Abort(ctx, apierr.Unauthorized("missing token"))
+			return
+		}
+		if ctx.Param("id") != "db1" {
+			apierr.Abort(ctx, apierr.NotFound("instance", ctx.Param("id")))
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"status": 0, "result": gin.H{"instance_name": "db1"}})
+	})
+	e.PUT("/v1/pg/instances/:id", func(ctx *gin.Context) {
+		b, _ := ctx.GetRawData()
+		ctx.JSON(http.StatusOK, gin.H{"status": 0, "result": string(b)})
+	})
+	c := testClient(t, e, nil)
+
+	var header, trailer metadata.MD
+	ctx := metadata.AppendToOutgoingContext(WithToken(context.Background(), "t1"), RequestIdMetadata, "req-1")
+	r, err := c.GetInstance(ctx, "db1")
+	if err != nil || string(r.Result) != `{"instance_name":"db1"}` {
+		t.Fatal(r, err)
+	}
+
+	_, err = c.call(ctx, "GetInstance", &InstanceRequest{Id: "db2"}, grpc.Header(&header), grpc.Trailer(&trailer))
+	if status.Code(err) != codes.NotFound {
+		t.Fatal(err)
+	}
+	if v := header.Get(RequestIdMetadata); len(v) != 1 || v[0] != "req-1" {
+		t.Fatal(header)
+	}
+	if v := trailer.Get(ErrorCodeMetadata); len(v) != 1 || v[0] != string(apierr.CodeNotFound) {
+		t.Fatal(trailer)
+	}
+
+	if _, err := c.GetInstance(context.Background(), "db1"); status.Code(err) != codes.Unauthenticated {
+		t.Fatal(err)
+	}
+	if _, err := c.UpdateInstance(ctx, "db1", nil); status.Code(err) != codes.InvalidArgument {
+		t.Fatal(err)
+	}
+	r, err = c.UpdateInstance(ctx, "db1", []byte(`{"description":"d"}`))
+	if err != nil || string(r.Result) != `"{\"description\":\"d\"}"` {
+		t.Fatal(r, err)
+	}
+	if _, err := c.ListInstances(ctx); status.Code(err) != codes.Internal {
+		t.Fatal(err)
+	}
+}
+
+type testLeadership struct {
+	leader int32
+}
+
+func (l *testLeadership) IsLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+func (l *testLeadership) LeaderApiAddress() string {
+	return "http://127.0.0.1:6102"
+}
+
+func TestWatchOnLeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	token, err := auth.CreateToken(&auth.Token{Type: auth.TokenTypeClient,
+		Policies: []auth.Policy{{Path: "pg/*", Capabilities: []string{auth.CapabilityReadCredential}}}}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leadershipCheckInterval = 10 * time.Millisecond
+	leadership := new(testLeadership)
+	client := testClient(t, gin.New(), leadership)
+	ctx, cancel := context.WithTimeout(WithToken(context.Background(), token), 5*time.Second)
+	defer cancel()
+
+	// followers have no event and send the watch to the leader
+	w, err := client.WatchCredentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatal(err)
+	}
+	if v := w.stream.Trailer().Get(LeaderMetadata); len(v) != 1 || v[0] != "http://127.0.0.1:6102" {
+		t.Fatal(w.stream.Trailer())
+	}
+
+	// the watch of the leader ends with its leadership
+	atomic.StoreInt32(&leadership.leader, 1)
+	w, err = client.WatchCredentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() {
+		atomic.StoreInt32(&leadership.leader, 0)
+	})
+	if _, err := w.Recv(); status.Code(err) != codes.Unavailable || status.Convert(err).Message() != "leadership lost, watch again" {
+		t.Fatal(err)
+	}
+}
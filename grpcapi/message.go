@@ -0,0 +1,34 @@
+package grpcapi
+
+import (
+	"encoding/json"
+
+	"goimport.moetang.info/nekoq-security/provider/pg"
+)
+
+type Empty struct{}
+
+type UnsealRequest struct {
+	Key string `json:"key"`
+}
+
+// InstanceRequest names an instance by Id. Instance is the json body of create and update, as in the http api.
+type InstanceRequest struct {
+	Id       string          `json:"id,omitempty"`
+	Instance json.RawMessage `json:"instance,omitempty"`
+}
+
+// WatchRequest filters the events by instance name, all visible instances when empty
+type WatchRequest struct {
+	Instances []string `json:"instances,omitempty"`
+}
+
+// Reply is the envelope of the http response, errors are sent as grpc status instead
+type Reply struct {
+	Status    int             `json:"status"`
+	Message   string          `json:"message,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	RootToken string          `json:"root_token,omitempty"`
+}
+
+type CredentialEvent = pg.CredentialEvent
@@ -0,0 +1,280 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/provider/pg"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const ServiceName = "nekoq.security.v1.NekoQSecurity"
+
+// leadershipCheckInterval is how often a watch checks that the node is still the leader
+var leadershipCheckInterval = time.Second
+
+// Leadership tells which node is the leader. Credential events are published in the process
+// making the change, so only the leader has them.
+type Leadership interface {
+	IsLeader() bool
+	LeaderApiAddress() string
+}
+
+// Server serves the grpc api by the routes of the http handler
+type Server struct {
+	handler http.Handler
+	leader  Leadership
+}
+
+// NewServer returns the server of the handler, the node being always the leader when leader is nil
+func NewServer(handler http.Handler, leader Leadership) *Server {
+	return &Server{handler: handler, leader: leader}
+}
+
+func (s *Server) isLeader() bool {
+	return s.leader == nil || s.leader.IsLeader()
+}
+
+func (s *Server) SealStatus(ctx context.Context, req *Empty) (*Reply, error) {
+	// status 0 with the health as result whatever the state, as for the http api
+	return s.dispatch(ctx, http.MethodGet, "/v1/sys/health?standbyok=true", nil)
+}
+
+func (s *Server) Unseal(ctx context.Context, req *UnsealRequest) (*Reply, error) {
+	return s.dispatch(ctx, http.MethodPost, "/v1/sys/unseal", req)
+}
+
+func (s *Server) ListInstances(ctx context.Context, req *Empty) (*Reply, error) {
+	return s.dispatch(ctx, http.MethodGet, "/v1/pg/instances", nil)
+}
+
+func (s *Server) GetInstance(ctx context.Context, req *InstanceRequest) (*Reply, error) {
+	return s.dispatch(ctx, http.MethodGet, instancePath(req.Id), nil)
+}
+
+func (s *Server) CreateInstance(ctx context.Context, req *InstanceRequest) (*Reply, error) {
+	if len(req.Instance) == 0 {
+		return nil, statusError(ctx, apierr.CodeValidationFailed, "instance is required")
+	}
+	return s.dispatch(ctx, http.MethodPost, "/v1/pg/instances", req.Instance)
+}
+
+func (s *Server) UpdateInstance(ctx context.Context, req *InstanceRequest) (*Reply, error) {
+	if len(req.Instance) == 0 {
+		return nil, statusError(ctx, apierr.CodeValidationFailed, "instance is required")
+	}
+	return s.dispatch(ctx, http.MethodPut, instancePath(req.Id), req.Instance)
+}
+
+func (s *Server) DeleteInstance(ctx context.Context, req *InstanceRequest) (*Reply, error) {
+	return s.dispatch(ctx, http.MethodDelete, instancePath(req.Id), nil)
+}
+
+func (s *Server) GetCredentials(ctx context.Context, req *InstanceRequest) (*Reply, error) {
+	return s.dispatch(ctx, http.MethodGet, instancePath(req.Id)+"/credentials", nil)
+}
+
+func (s *Server) RotateCredentials(ctx context.Context, req *InstanceRequest) (*Reply, error) {
+	return s.dispatch(ctx, http.MethodPost, instancePath(req.Id)+"/credentials/rotate", nil)
+}
+
+func instancePath(id string) string {
+	return "/v1/pg/instances/" + url.PathEscape(id)
+}
+
+// WatchCredentials streams the credential events of the instances the token can read the metadata of.
+// The token is checked again before every event, so revoked or expired tokens end the stream.
+// Events are only known by the leader: followers refuse the watch with the api address of the leader
+// in the trailer, and the stream ends when the node loses the leadership.
+func (s *Server) WatchCredentials(req *WatchRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	if !s.isLeader() {
+		leader := s.leader.LeaderApiAddress()
+		if len(leader) == 0 {
+			return statusError(ctx, apierr.CodeUnavailable, "no cluster leader, watch again")
+		}
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(LeaderMetadata, leader))
+		return statusError(ctx, apierr.CodeUnavailable, "not the cluster leader, watch on "+leader)
+	}
+	token := tokenOf(ctx)
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	t, err := auth.Authenticate(token, state)
+	if err != nil {
+		e := apierr.From(err)
+		return statusError(ctx, e.Code, e.Message)
+	}
+	filter := make(map[string]bool)
+	for _, v := range req.Instances {
+		filter[v] = true
+	}
+
+	ch, cancel := pg.Subscribe()
+	defer cancel()
+	ticker := time.NewTicker(leadershipCheckInterval)
+	defer ticker.Stop()
+	logging.Info("credential watch started", logging.F("principal", t.DisplayName), logging.F("accessor", t.Accessor))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if !s.isLeader() {
+				return status.Error(codes.Unavailable, "leadership lost, watch again")
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "watch falls behind, watch again")
+			}
+			if len(filter) > 0 && !filter[e.Instance] {
+				continue
+			}
+			if t, err = auth.Authenticate(token, state); err != nil {
+				e := apierr.From(err)
+				return statusError(ctx, e.Code, e.Message)
+			}
+			visible, err := e.VisibleTo(t)
+			if err != nil {
+				logging.Error("authorize error", logging.Err(err))
+				return status.Error(codes.Internal, "internal error")
+			}
+			if !visible {
+				continue
+			}
+			if err := stream.SendMsg(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// unary describes a method whose request is built by newRequest
+func unary(name string, newRequest func() interface{}, call func(s *Server, ctx context.Context, req interface{}) (*Reply, error)) grpc.MethodDesc {
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + ServiceName + "/" + name}
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			s := srv.(*Server)
+			if interceptor == nil {
+				return call(s, ctx, req)
+			}
+			info := *info
+			info.Server = srv
+			return interceptor(ctx, req, &info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(s, ctx, req)
+			})
+		},
+	}
+}
+
+func empty() interface{} {
+	return new(Empty)
+}
+
+func instanceRequest() interface{} {
+	return new(InstanceRequest)
+}
+
+// ServiceDesc is written by hand in place of generated code, the messages are the types of this package
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unary("SealStatus", empty, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.SealStatus(ctx, req.(*Empty))
+		}),
+		unary("Unseal", func() interface{} { return new(UnsealRequest) }, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.Unseal(ctx, req.(*UnsealRequest))
+		}),
+		unary("ListInstances", empty, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.ListInstances(ctx, req.(*Empty))
+		}),
+		unary("GetInstance", instanceRequest, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.GetInstance(ctx, req.(*InstanceRequest))
+		}),
+		unary("CreateInstance", instanceRequest, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.CreateInstance(ctx, req.(*InstanceRequest))
+		}),
+		unary("UpdateInstance", instanceRequest, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.UpdateInstance(ctx, req.(*InstanceRequest))
+		}),
+		unary("DeleteInstance", instanceRequest, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.DeleteInstance(ctx, req.(*InstanceRequest))
+		}),
+		unary("GetCredentials", instanceRequest, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.GetCredentials(ctx, req.(*InstanceRequest))
+		}),
+		unary("RotateCredentials", instanceRequest, func(s *Server, ctx context.Context, req interface{}) (*Reply, error) {
+			return s.RotateCredentials(ctx, req.(*InstanceRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "WatchCredentials", ServerStreams: true, Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := new(WatchRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(*Server).WatchCredentials(req, stream)
+		}},
+	},
+}
+
+// NewGRPCServer returns a grpc server with the api registered, using the tls config when not nil
+func NewGRPCServer(handler http.Handler, tlsConfig *tls.Config, leader Leadership) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(jsonCodec{})}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(withH2(tlsConfig))))
+	}
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&ServiceDesc, NewServer(handler, leader))
+	return s
+}
+
+// withH2 keeps the h2 protocol negotiated by grpc in the per-client configs of the reloadable tls config
+func withH2(c *tls.Config) *tls.Config {
+	c = c.Clone()
+	getConfigForClient := c.GetConfigForClient
+	if getConfigForClient != nil {
+		c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cc, err := getConfigForClient(hello)
+			if err != nil || cc == nil {
+				return cc, err
+			}
+			cc.NextProtos = []string{"h2"}
+			return cc, nil
+		}
+	}
+	return c
+}
+
+// Serve listens on the grpc listen address until the listener fails
+func Serve(c *config.NekoQSecurityConfig, handler http.Handler) error {
+	l, err := net.Listen("tcp", c.NekoQSecurity.GRPC.Listen)
+	if err != nil {
+		return err
+	}
+	logging.Info("grpc api listening", logging.F("address", l.Addr()))
+	return NewGRPCServer(handler, c.ServerTLSConfig(), c).Serve(l)
+}
@@ -0,0 +1,172 @@
+package lease
+
+import (
+	"net/http"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+func initRoutes(e *gin.Engine) {
+	g := openapi.NewGroup(e, "lease", "/leases", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "", Id: "listLeases",
+		Summary: "leases of the token, or every lease for root and admin tokens", Query: listQuery, Result: openapi.Array(openapi.RefTo("Lease"))},
+		auth.Authenticated(), ListLeases)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/renew", Id: "renewLease",
+		Summary: "extend a lease, capped by its max ttl", Body: renewSchema, Result: leaseResultSchema},
+		auth.Authenticated(), RenewLease)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/revoke", Id: "revokeLease",
+		Summary: "end a lease now", Body: revokeSchema},
+		auth.Authenticated(), RevokeLease)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/revoke-prefix", Id: "revokeLeasePrefix",
+		Summary: "end every lease whose id starts with the prefix, for root and admin tokens", Body: revokePrefixSchema,
+		Result: openapi.Object(map[string]*openapi.Schema{"revoked": openapi.Integer()})},
+		auth.Authenticated(), RevokePrefixHandler)
+}
+
+// CanManage returns true for the token the lease was issued to, and for root and admin tokens
+func CanManage(t *auth.Token, l *Lease) bool {
+	if auth.IsManager(t) {
+		return true
+	}
+	return len(t.Accessor) > 0 && t.Accessor == l.Accessor
+}
+
+func ListLeases(ctx *gin.Context) {
+	leases, err := List(ctx.Query("prefix"))
+	if err != nil {
+		logging.FromContext(ctx).Error("list leases error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	t := auth.CurrentToken(ctx)
+	result := []*Lease{}
+	for _, l := range leases {
+		if CanManage(t, l) {
+			result = append(result, l)
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": result,
+	})
+}
+
+type leaseRequest struct {
+	LeaseId   string `json:"lease_id"`
+	Increment int64  `json:"increment"` // seconds
+	Prefix    string `json:"prefix"`
+	Force     bool   `json:"force"` // delete without running the expiry handler
+}
+
+// lookupManaged writes the error response and returns nil unless the token can manage the lease
+func lookupManaged(ctx *gin.Context, id string) *Lease {
+	l, err := Lookup(id)
+	if err == ErrLeaseNotFound {
+		apierr.Abort(ctx, apierr.NotFound("lease", id))
+		return nil
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("lookup lease error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return nil
+	}
+	// leases of other tokens are not disclosed
+	if !CanManage(auth.CurrentToken(ctx), l) {
+		apierr.Abort(ctx, apierr.NotFound("lease", id))
+		return nil
+	}
+	logging.Annotate(ctx, logging.F("lease_id", id))
+	return l
+}
+
+func RenewLease(ctx *gin.Context) {
+	req := new(leaseRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	l := lookupManaged(ctx, req.LeaseId)
+	if l == nil {
+		return
+	}
+	err := Renew(ctx.Request.Context(), l, time.Duration(req.Increment)*time.Second)
+	switch err {
+	case nil:
+	case ErrLeaseEnded:
+		apierr.Abort(ctx, apierr.NotFound("lease", req.LeaseId))
+		return
+	case ErrNotRenewable:
+		apierr.Abort(ctx, apierr.Validation(err.Error()))
+		return
+	default:
+		logging.FromContext(ctx).Error("renew lease error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{
+			"lease_id":       l.Id,
+			"lease_duration": l.Duration(time.Now()),
+			"expire_at":      l.ExpireAt,
+		},
+	})
+}
+
+func RevokeLease(ctx *gin.Context) {
+	req := new(leaseRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	l := lookupManaged(ctx, req.LeaseId)
+	if l == nil {
+		return
+	}
+	if err := Revoke(ctx.Request.Context(), l); err != nil {
+		logging.FromContext(ctx).Error("revoke lease error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	logging.FromContext(ctx).Info("lease revoked")
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+func RevokePrefixHandler(ctx *gin.Context) {
+	if !auth.IsManager(auth.CurrentToken(ctx)) {
+		apierr.Abort(ctx, apierr.Forbidden())
+		return
+	}
+	req := new(leaseRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	var n int
+	var err error
+	if req.Force {
+		n, err = Forget(ctx.Request.Context(), req.Prefix)
+	} else {
+		n, err = RevokePrefix(ctx.Request.Context(), req.Prefix)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("revoke leases error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	logging.FromContext(ctx).Info("leases revoked", logging.F("prefix", req.Prefix), logging.F("force", req.Force), logging.F("revoked", n))
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{"revoked": n},
+	})
+}
@@ -0,0 +1,317 @@
+// Leases of the credentials handed out by providers, renewed or revoked by clients and ended by the expiry manager
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	moduleName = "lease"
+	namespace  = "sys.lease"
+
+	DefaultTTL    = time.Hour
+	DefaultMaxTTL = 24 * time.Hour
+)
+
+var (
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrLeaseEnded    = errors.New("lease ended")
+	ErrNotRenewable  = errors.New("lease is not renewable")
+)
+
+var (
+	leaseKeyPrefix = []byte("lease.")
+	// expiry.<due unix seconds, zero padded>.<lease id>, so the manager reads the due leases in order and stops
+	// at the first one which is not
+	expiryKeyPrefix = []byte("expiry.")
+	// set once the expiry index covers the leases stored before it
+	expiryIndexedKey = []byte("expiry_indexed")
+)
+
+var container *config.NekoQSecurityContainer
+
+type leaseModuleType struct {
+}
+
+func (l leaseModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	startManager.Do(func() {
+		go manage()
+	})
+	return nil
+}
+
+func (l leaseModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	initRoutes(scaffold.GetGin())
+	return nil
+}
+
+var leaseModule config.Module = leaseModuleType{}
+
+var startManager sync.Once
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, leaseModule)
+}
+
+// Lease is the time a client may use a credential. The id starts with the kind of the credential, e.g. pg/db1/...
+type Lease struct {
+	Id          string            `json:"lease_id"`
+	Data        map[string]string `json:"data,omitempty"` // for the expiry handler, never secret
+	Accessor    string            `json:"accessor"`       // of the token the credential was issued to
+	Renewable   bool              `json:"renewable"`
+	IssuedAt    int64             `json:"issued_at"`
+	ExpireAt    int64             `json:"expire_at"`
+	MaxExpireAt int64             `json:"max_expire_at"`
+	RevokedAt   int64             `json:"revoked_at,omitempty"` // revoked, waiting for the expiry handler
+	LastError   string            `json:"last_error,omitempty"` // of the expiry handler, which is retried
+}
+
+// Duration is the ttl left in seconds
+func (l *Lease) Duration(now time.Time) int64 {
+	if d := l.ExpireAt - now.Unix(); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Ended returns true once expired or revoked
+func (l *Lease) Ended(now time.Time) bool {
+	return l.RevokedAt > 0 || now.Unix() >= l.ExpireAt
+}
+
+// due is when the manager ends the lease: its revocation or its expiry
+func (l *Lease) due() int64 {
+	if l.RevokedAt > 0 {
+		return l.RevokedAt
+	}
+	return l.ExpireAt
+}
+
+// Kind is the first segment of the id, which selects the expiry handler
+func (l *Lease) Kind() string {
+	return strings.SplitN(l.Id, "/", 2)[0]
+}
+
+func makeLeaseKey(id string) []byte {
+	return append(append([]byte{}, leaseKeyPrefix...), []byte(id)...)
+}
+
+func makeExpiryKey(due int64, id string) []byte {
+	return []byte(fmt.Sprintf("%s%020d.%s", expiryKeyPrefix, due, id))
+}
+
+func marshallAndEncLease(l *Lease) ([]byte, error) {
+	return container.SealJSON(l)
+}
+
+func decAndUnmarshallLease(b []byte) (*Lease, error) {
+	l := new(Lease)
+	if err := container.OpenJSON(b, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// save writes l and moves its entry of the expiry index from due, the one before the change, 0 for a new lease
+func save(ctx context.Context, l *Lease, due int64) error {
+	b, err := marshallAndEncLease(l)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return put(bucket, l, b, due)
+	})
+}
+
+func put(bucket *config.Bucket, l *Lease, b []byte, due int64) error {
+	if due > 0 && due != l.due() {
+		if err := bucket.Delete(makeExpiryKey(due, l.Id)); err != nil {
+			return err
+		}
+	}
+	if err := bucket.Put(makeLeaseKey(l.Id), b); err != nil {
+		return err
+	}
+	return bucket.Put(makeExpiryKey(l.due(), l.Id), []byte(l.Id))
+}
+
+// Issue stores l with a new id under prefix, e.g. pg/db1/. ttl and maxTTL of 0 are the defaults.
+func Issue(ctx context.Context, prefix string, l *Lease, ttl, maxTTL time.Duration) error {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	now := time.Now()
+	l.Id = prefix + uuid.NewV4().String()
+	l.IssuedAt = now.Unix()
+	l.ExpireAt = now.Add(ttl).Unix()
+	l.MaxExpireAt = now.Add(maxTTL).Unix()
+	return save(ctx, l, 0)
+}
+
+// Lookup returns the lease, ended or not
+func Lookup(id string) (*Lease, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makeLeaseKey(id))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrLeaseNotFound
+	}
+	return decAndUnmarshallLease(b)
+}
+
+// List returns the leases whose id starts with prefix, ended ones included
+func List(prefix string) ([]*Lease, error) {
+	var r [][]byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(makeLeaseKey(prefix), func(k, v []byte) error {
+			r = append(r, v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []*Lease
+	for _, v := range r {
+		l, err := decAndUnmarshallLease(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// Renew extends the lease by increment, capped by its max ttl
+func Renew(ctx context.Context, l *Lease, increment time.Duration) error {
+	now := time.Now()
+	if l.Ended(now) {
+		return ErrLeaseEnded
+	}
+	if !l.Renewable {
+		return ErrNotRenewable
+	}
+	if increment <= 0 {
+		increment = DefaultTTL
+	}
+	due := l.due()
+	l.ExpireAt = now.Add(increment).Unix()
+	if l.ExpireAt > l.MaxExpireAt {
+		l.ExpireAt = l.MaxExpireAt
+	}
+	return save(ctx, l, due)
+}
+
+// Revoke ends the lease now. The expiry handler is run by the manager.
+func Revoke(ctx context.Context, l *Lease) error {
+	if l.RevokedAt > 0 {
+		return nil
+	}
+	due := l.due()
+	l.RevokedAt = time.Now().Unix()
+	if err := save(ctx, l, due); err != nil {
+		return err
+	}
+	wake()
+	return nil
+}
+
+// RevokePrefix ends every lease whose id starts with prefix, and returns how many were revoked
+func RevokePrefix(ctx context.Context, prefix string) (int, error) {
+	leases, err := List(prefix)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	revoked := 0
+	var encoded [][]byte
+	var changed []*Lease
+	var dues []int64
+	for _, l := range leases {
+		if l.RevokedAt > 0 {
+			continue
+		}
+		dues = append(dues, l.due())
+		l.RevokedAt = now
+		b, err := marshallAndEncLease(l)
+		if err != nil {
+			return 0, err
+		}
+		encoded = append(encoded, b)
+		changed = append(changed, l)
+		revoked++
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		for i, l := range changed {
+			if err := put(bucket, l, encoded[i], dues[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	wake()
+	return revoked, nil
+}
+
+// Forget deletes the leases under prefix without running the expiry handler, e.g. when it cannot succeed any more.
+// It returns how many were deleted.
+func Forget(ctx context.Context, prefix string) (int, error) {
+	deleted := 0
+	err := container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		var keys [][]byte
+		err := bucket.ForEachWithPrefix(makeLeaseKey(prefix), func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		deleted = len(keys)
+		// the entries of the expiry index hold the ids, no lease is decrypted
+		err = bucket.ForEachWithPrefix(expiryKeyPrefix, func(k, v []byte) error {
+			if strings.HasPrefix(string(v), prefix) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
@@ -0,0 +1,346 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+)
+
+func openTestConfig(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+}
+
+func TestLease(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := &Lease{Id: "pg/db1/0f8fad5b-d9cb-469f-a165-70867728950e", Accessor: "a1", ExpireAt: 1060}
+	if l.Kind() != "pg" {
+		t.Fatal(l.Kind())
+	}
+	if l.Ended(now) || l.Duration(now) != 60 {
+		t.Fatal(l.Duration(now))
+	}
+	if !l.Ended(now.Add(time.Minute)) || l.Duration(now.Add(2*time.Minute)) != 0 {
+		t.Fatal("expired lease")
+	}
+	l.RevokedAt = now.Unix()
+	if !l.Ended(now) {
+		t.Fatal("revoked lease")
+	}
+}
+
+func TestCanManage(t *testing.T) {
+	l := &Lease{Id: "pg/db1/x", Accessor: "a1"}
+	cases := []struct {
+		token    *auth.Token
+		expected bool
+	}{
+		{&auth.Token{Type: auth.TokenTypeClient, Accessor: "a1"}, true},
+		{&auth.Token{Type: auth.TokenTypeClient, Accessor: "a2"}, false},
+		{&auth.Token{Type: auth.TokenTypeClient}, false},
+		{&auth.Token{Type: auth.TokenTypeAdmin, Accessor: "a3"}, true},
+		{&auth.Token{Type: auth.TokenTypeRoot}, true},
+	}
+	for _, c := range cases {
+		if CanManage(c.token, l) != c.expected {
+			t.Error(c.token.Type, c.token.Accessor)
+		}
+	}
+	// cert tokens are not stored and have no accessor
+	if CanManage(&auth.Token{Type: auth.TokenTypeClient}, &Lease{}) {
+		t.Fatal("lease without accessor")
+	}
+}
+
+func TestIssue(t *testing.T) {
+	openTestConfig(t)
+	ctx := context.Background()
+
+	l := &Lease{Accessor: "a1", Renewable: true, Data: map[string]string{"username": "u1"}}
+	if err := Issue(ctx, "issue/db1/", l, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Id) <= len("issue/db1/") || l.Id[:len("issue/db1/")] != "issue/db1/" {
+		t.Fatal(l.Id)
+	}
+	if l.ExpireAt-l.IssuedAt != int64(DefaultTTL/time.Second) || l.MaxExpireAt-l.IssuedAt != int64(DefaultMaxTTL/time.Second) {
+		t.Fatal("default ttl", l.ExpireAt-l.IssuedAt, l.MaxExpireAt-l.IssuedAt)
+	}
+	stored, err := Lookup(l.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Accessor != "a1" || stored.Data["username"] != "u1" || stored.ExpireAt != l.ExpireAt {
+		t.Fatal(stored)
+	}
+
+	// the ttl is capped by the max ttl
+	capped := new(Lease)
+	if err := Issue(ctx, "issue/db1/", capped, time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if capped.ExpireAt != capped.MaxExpireAt || capped.ExpireAt-capped.IssuedAt != 60 {
+		t.Fatal(capped)
+	}
+	if leases, err := List("issue/db1/"); err != nil || len(leases) != 2 {
+		t.Fatal(leases, err)
+	}
+	if _, err := Lookup("issue/db2/x"); err != ErrLeaseNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	openTestConfig(t)
+	ctx := context.Background()
+
+	l := &Lease{Renewable: true}
+	if err := Issue(ctx, "renew/db1/", l, time.Minute, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := Renew(ctx, l, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if d := l.ExpireAt - time.Now().Unix(); d < 299 || d > 300 {
+		t.Fatal("renewed by", d)
+	}
+	// renewals never go beyond the max ttl
+	if err := Renew(ctx, l, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if l.ExpireAt != l.MaxExpireAt {
+		t.Fatal("max ttl exceeded", l.ExpireAt, l.MaxExpireAt)
+	}
+	if stored, err := Lookup(l.Id); err != nil || stored.ExpireAt != l.MaxExpireAt {
+		t.Fatal(stored, err)
+	}
+
+	fixed := new(Lease)
+	if err := Issue(ctx, "renew/db1/", fixed, time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := Renew(ctx, fixed, time.Minute); err != ErrNotRenewable {
+		t.Fatal(err)
+	}
+	ended := &Lease{Renewable: true, ExpireAt: time.Now().Add(-time.Second).Unix()}
+	if err := Renew(ctx, ended, time.Minute); err != ErrLeaseEnded {
+		t.Fatal(err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	openTestConfig(t)
+	ctx := context.Background()
+	// the handler fails, so the revoked leases are kept for the checks
+	RegisterExpiry("revoke", func(ctx context.Context, l *Lease) error {
+		return errors.New("database unreachable")
+	})
+
+	l := new(Lease)
+	if err := Issue(ctx, "revoke/db1/", l, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := Revoke(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := Lookup(l.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RevokedAt == 0 || !stored.Ended(time.Now()) {
+		t.Fatal("lease not revoked", stored)
+	}
+
+	for _, prefix := range []string{"revoke/db2/", "revoke/db2/", "revoke/db3/"} {
+		if err := Issue(ctx, prefix, new(Lease), time.Hour, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := RevokePrefix(ctx, "revoke/db2/"); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	// revoked leases are not counted again
+	if n, err := RevokePrefix(ctx, "revoke/db2/"); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	leases, err := List("revoke/db3/")
+	if err != nil || len(leases) != 1 {
+		t.Fatal(leases, err)
+	}
+	if leases[0].RevokedAt != 0 {
+		t.Fatal("lease of another prefix revoked")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	openTestConfig(t)
+	ctx := context.Background()
+	ended := make(chan string, 16)
+	var failing int32 = 1
+	RegisterExpiry("expiry", func(ctx context.Context, l *Lease) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("database unreachable")
+		}
+		ended <- l.Id
+		return nil
+	})
+	waitLease := func(id string, done func(l *Lease, err error) bool) {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if done(Lookup(id)) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("lease not handled", id)
+			}
+		}
+	}
+	deleted := func(l *Lease, err error) bool {
+		return err == ErrLeaseNotFound
+	}
+
+	// a revocation wakes the manager, the error of the handler is kept on the lease
+	revoked := new(Lease)
+	if err := Issue(ctx, "expiry/db1/", revoked, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := Revoke(ctx, revoked); err != nil {
+		t.Fatal(err)
+	}
+	waitLease(revoked.Id, func(l *Lease, err error) bool {
+		return err == nil && l.LastError == "database unreachable"
+	})
+	// and the handler is retried until it succeeds
+	atomic.StoreInt32(&failing, 0)
+	wake()
+	if id := <-ended; id != revoked.Id {
+		t.Fatal(id)
+	}
+	waitLease(revoked.Id, deleted)
+
+	// expired leases are ended by the scan, the others are kept
+	expired := new(Lease)
+	if err := Issue(ctx, "expiry/db1/", expired, time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	active := new(Lease)
+	if err := Issue(ctx, "expiry/db1/", active, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := expire(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// handlers may run again for the lease ended before, which is allowed
+	for id := <-ended; id != expired.Id; id = <-ended {
+		if id != revoked.Id {
+			t.Fatal(id)
+		}
+	}
+	waitLease(expired.Id, deleted)
+	if _, err := Lookup(active.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiryIndex(t *testing.T) {
+	openTestConfig(t)
+	ctx := context.Background()
+	// the handler fails until the scan below, so the revoked lease is kept for the checks
+	var failing int32 = 1
+	RegisterExpiry("index", func(ctx context.Context, l *Lease) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("database unreachable")
+		}
+		return nil
+	})
+	entries := func() []string {
+		var r []string
+		err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+			return bucket.ForEachWithPrefix(expiryKeyPrefix, func(k, v []byte) error {
+				r = append(r, string(k))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	l := &Lease{Renewable: true}
+	if err := Issue(ctx, "index/db1/", l, time.Minute, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if e := entries(); len(e) != 1 || e[0] != string(makeExpiryKey(l.ExpireAt, l.Id)) {
+		t.Fatal(e)
+	}
+	// renewals and revocations move the entry
+	if err := Renew(ctx, l, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if e := entries(); len(e) != 1 || e[0] != string(makeExpiryKey(l.ExpireAt, l.Id)) {
+		t.Fatal(e)
+	}
+	if err := Revoke(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if stored, err := Lookup(l.Id); err == nil && stored.LastError != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lease not handled", l.Id)
+		}
+	}
+	if e := entries(); len(e) != 1 || e[0] != string(makeExpiryKey(l.RevokedAt, l.Id)) {
+		t.Fatal(e)
+	}
+	atomic.StoreInt32(&failing, 0)
+
+	// leases stored before the index are added by the first scan
+	old := &Lease{Id: "index/db1/old", ExpireAt: time.Now().Add(-time.Second).Unix()}
+	b, err := marshallAndEncLease(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		if err := bucket.Put(makeLeaseKey(old.Id), b); err != nil {
+			return err
+		}
+		return bucket.Delete(expiryIndexedKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{l.Id, old.Id} {
+		if _, err := Lookup(id); err != ErrLeaseNotFound {
+			t.Fatal(id, err)
+		}
+	}
+	if e := entries(); len(e) != 0 {
+		t.Fatal(e)
+	}
+
+	// Forget drops the entries with the leases
+	if err := Issue(ctx, "index/db2/", new(Lease), time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Forget(ctx, "index/db2/"); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if e := entries(); len(e) != 0 {
+		t.Fatal(e)
+	}
+}
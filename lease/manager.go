@@ -0,0 +1,184 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// interval of the scans for ended leases, revocations wake the manager earlier
+const scanInterval = 10 * time.Second
+
+// ExpiryFunc ends the use of the credential of an ended lease, e.g. by rotating or dropping it.
+// It is retried until it succeeds and may run more than once for a lease, after a restart.
+type ExpiryFunc func(ctx context.Context, l *Lease) error
+
+var (
+	handlerLock sync.RWMutex
+	handlers    = make(map[string]ExpiryFunc)
+)
+
+// RegisterExpiry sets the handler of the leases of kind, the first segment of their ids
+func RegisterExpiry(kind string, fn ExpiryFunc) {
+	handlerLock.Lock()
+	handlers[kind] = fn
+	handlerLock.Unlock()
+}
+
+func handlerOf(kind string) ExpiryFunc {
+	handlerLock.RLock()
+	defer handlerLock.RUnlock()
+	return handlers[kind]
+}
+
+var wakeup = make(chan struct{}, 1)
+
+func wake() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// manage ends the leases from the storage, so leases ended while the server was down or sealed
+// are handled after unseal. Only the leader runs handlers.
+func manage() {
+	ticker := time.NewTicker(scanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wakeup:
+		}
+		if !config.IsUnsealed() || !container.IsLeader() {
+			continue
+		}
+		if err := expire(time.Now()); err != nil {
+			logging.Error("expire leases error", logging.Err(err))
+		}
+	}
+}
+
+// errScanDone stops the scan of the expiry index at the first lease which is not due
+var errScanDone = errors.New("scan done")
+
+// expire runs the handlers of the ended leases in order of revocation or expiry, deleting a lease once its handler
+// succeeded. Only the due entries of the expiry index are read, and only their leases decrypted.
+func expire(now time.Time) error {
+	if err := indexExpiry(); err != nil {
+		return err
+	}
+	last := makeExpiryKey(now.Unix()+1, "")
+	var keys [][]byte
+	var ids []string
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(expiryKeyPrefix, func(k, v []byte) error {
+			if bytes.Compare(k, last) >= 0 {
+				return errScanDone
+			}
+			keys = append(keys, append([]byte{}, k...))
+			ids = append(ids, string(v))
+			return nil
+		})
+	})
+	if err != nil && err != errScanDone {
+		return err
+	}
+	var stale [][]byte
+	for i, id := range ids {
+		l, err := Lookup(id)
+		if err != nil && err != ErrLeaseNotFound {
+			return err
+		}
+		// deleted or changed since the entry was written
+		if err == ErrLeaseNotFound || !bytes.Equal(keys[i], makeExpiryKey(l.due(), l.Id)) {
+			stale = append(stale, keys[i])
+			continue
+		}
+		if l.Ended(now) {
+			end(l)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// indexExpiry adds the leases stored without an entry of the expiry index, once
+func indexExpiry() error {
+	var indexed bool
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		indexed = len(bucket.Get(expiryIndexedKey)) > 0
+		return nil
+	})
+	if err != nil || indexed {
+		return err
+	}
+	leases, err := List("")
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucket(namespace, func(bucket *config.Bucket) error {
+		for _, l := range leases {
+			if err := bucket.Put(makeExpiryKey(l.due(), l.Id), []byte(l.Id)); err != nil {
+				return err
+			}
+		}
+		return bucket.Put(expiryIndexedKey, []byte{1})
+	})
+}
+
+func end(l *Lease) {
+	ctx, span := tracing.Start(context.Background(), "lease.expire", attribute.String("lease.id", l.Id))
+	err := End(logging.WithContext(ctx, logging.F("lease_id", l.Id)), l)
+	tracing.End(span, err)
+}
+
+// End runs the expiry handler of the lease now and deletes the lease once it succeeded.
+// When it fails the lease is revoked, and the handler retried by the manager.
+func End(ctx context.Context, l *Lease) error {
+	var err error
+	if fn := handlerOf(l.Kind()); fn != nil {
+		err = fn(ctx, l)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("lease expiry handler error", logging.Err(err))
+		due := l.due()
+		if l.RevokedAt == 0 {
+			l.RevokedAt = time.Now().Unix()
+		}
+		l.LastError = err.Error()
+		if err := save(ctx, l, due); err != nil {
+			logging.FromContext(ctx).Error("save lease error", logging.Err(err))
+		}
+		return err
+	}
+	err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		if err := bucket.Delete(makeExpiryKey(l.due(), l.Id)); err != nil {
+			return err
+		}
+		return bucket.Delete(makeLeaseKey(l.Id))
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("delete lease error", logging.Err(err))
+		return err
+	}
+	logging.FromContext(ctx).Info("lease ended")
+	return nil
+}
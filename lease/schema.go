@@ -0,0 +1,40 @@
+package lease
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+func init() {
+	openapi.RegisterSchema("Lease", openapi.Object(map[string]*openapi.Schema{
+		"lease_id":      openapi.String(),
+		"data":          openapi.Map(openapi.String()),
+		"accessor":      openapi.String().Describe("of the token the credential was issued to"),
+		"renewable":     openapi.Boolean(),
+		"issued_at":     openapi.Integer(),
+		"expire_at":     openapi.Integer(),
+		"max_expire_at": openapi.Integer(),
+		"revoked_at":    openapi.Integer(),
+		"last_error":    openapi.String().Describe("of the expiry handler, which is retried"),
+	}))
+}
+
+var (
+	listQuery   = []*openapi.Parameter{{Name: "prefix", Description: "of the lease ids, e.g. pg/db1/", Schema: openapi.String()}}
+	renewSchema = openapi.Object(map[string]*openapi.Schema{
+		"lease_id":  openapi.String().NonEmpty(),
+		"increment": auth.TTLSchema(),
+	}).Require("lease_id")
+	revokeSchema = openapi.Object(map[string]*openapi.Schema{
+		"lease_id": openapi.String().NonEmpty(),
+	}).Require("lease_id")
+	revokePrefixSchema = openapi.Object(map[string]*openapi.Schema{
+		"prefix": openapi.String().NonEmpty(),
+		"force":  openapi.Boolean().Describe("delete the leases without ending their credentials, e.g. of an unreachable database"),
+	}).Require("prefix")
+	leaseResultSchema = openapi.Object(map[string]*openapi.Schema{
+		"lease_id":       openapi.String(),
+		"lease_duration": openapi.Integer().Describe("seconds left"),
+		"expire_at":      openapi.Integer(),
+	})
+)
@@ -0,0 +1,185 @@
+// Structured leveled logging in json lines, with secrets redacted from every value
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Err(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+var (
+	lock  sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = LevelInfo
+)
+
+// Init sets the verbosity from global.debug, and sends the standard logger of dependencies through redaction
+func Init(debug bool) {
+	lock.Lock()
+	if debug {
+		level = LevelDebug
+	} else {
+		level = LevelInfo
+	}
+	lock.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+}
+
+// SetOutput replaces stderr, for tests
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	out = w
+	lock.Unlock()
+}
+
+// Logger carries fields added to every entry
+type Logger struct {
+	fields []Field
+}
+
+var root = &Logger{}
+
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{fields: append(append([]Field{}, l.fields...), fields...)}
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(lv Level, msg string, fields []Field) {
+	lock.Lock()
+	defer lock.Unlock()
+	if lv < level {
+		return
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"time":`)
+	writeValue(buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(buf, lv.String())
+	buf.WriteString(`,"msg":`)
+	writeValue(buf, RedactString(msg))
+	for _, fl := range [][]Field{l.fields, fields} {
+		for _, f := range fl {
+			buf.WriteByte(',')
+			writeValue(buf, f.Key)
+			buf.WriteByte(':')
+			if isSecretField(f.Key) {
+				writeValue(buf, redacted)
+			} else {
+				writeValue(buf, Redact(f.Value))
+			}
+		}
+	}
+	buf.WriteString("}\n")
+	_, _ = out.Write(buf.Bytes())
+}
+
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(err.Error())
+	}
+	buf.Write(b)
+}
+
+func Debug(msg string, fields ...Field) { root.log(LevelDebug, msg, fields) }
+func Info(msg string, fields ...Field)  { root.log(LevelInfo, msg, fields) }
+func Warn(msg string, fields ...Field)  { root.log(LevelWarn, msg, fields) }
+func Error(msg string, fields ...Field) { root.log(LevelError, msg, fields) }
+
+// With returns a logger adding fields to every entry
+func With(fields ...Field) *Logger {
+	return root.With(fields...)
+}
+
+type contextKey struct{}
+
+// WithContext returns a context whose logger adds fields
+func WithContext(ctx context.Context, fields ...Field) context.Context {
+	return context.WithValue(ctx, contextKey{}, FromContext(ctx).With(fields...))
+}
+
+// FromContext returns the logger of the request of ctx, *gin.Context included
+func FromContext(ctx context.Context) *Logger {
+	if gc, ok := ctx.(*gin.Context); ok {
+		ctx = gc.Request.Context()
+	}
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return root
+}
+
+// Annotate adds fields to the logger of the request, e.g. the principal once authenticated
+func Annotate(ctx *gin.Context, fields ...Field) {
+	ctx.Request = ctx.Request.WithContext(WithContext(ctx.Request.Context(), fields...))
+}
+
+// Middleware scopes the logger of the request by request id, and trace id when traced
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		fields := []Field{F("request_id", apierr.RequestIdOf(ctx))}
+		if sc := trace.SpanContextFromContext(ctx.Request.Context()); sc.IsValid() {
+			fields = append(fields, F("trace_id", sc.TraceID().String()))
+		}
+		Annotate(ctx, fields...)
+		ctx.Next()
+	}
+}
+
+// stdWriter logs the lines of the standard logger at info level
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	root.log(LevelInfo, string(bytes.TrimRight(p, "\n")), nil)
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactString(t *testing.T) {
+	shard := "AAEBqYdoH5+kqjXoECkL7/6NC1bddhzVKM3DOyZXiNBxJZVF9UreYri/6NSnBjV/deKVHEu56dkANWvx/Jm2utqvcxU="
+	cases := map[string]string{
+		"failed to connect to `host=db user=app password=s3cret database=app`": "failed to connect to `host=db user=app password=redacted database=app`",
+		"password='s3 cret' host=db":                            "password=redacted host=db",
+		"cannot parse `postgres://app:s3cret@db:5432/app`":      "cannot parse `postgres://app:redacted@db:5432/app`",
+		`{"user_name":"app","password":"s3\"cret","port":5432}`: `{"user_name":"app","password":"redacted","port":5432}`,
+		"Authorization: Bearer abc.def":                         "Authorization: Bearer redacted",
+		"feed shard " + shard:                                   "feed shard redacted",
+		"request 553d19da-6650-4aaa-823a-b376f059e9e5 of key 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": "request 553d19da-6650-4aaa-823a-b376f059e9e5 of key 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	}
+	for in, expected := range cases {
+		if out := RedactString(in); out != expected {
+			t.Error(in, "=>", out)
+		}
+	}
+}
+
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var r []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatal(line, err)
+		}
+		r = append(r, m)
+	}
+	buf.Reset()
+	return r
+}
+
+func TestLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	Init(false)
+
+	Debug("hidden")
+	With(F("instance", "db1")).Error("connect error", Err(errors.New("password=s3cret")), F("root_token", "abc"),
+		F("inst", map[string]interface{}{"password": "s3cret", "port": 5432}))
+	e := entries(t, buf)
+	if len(e) != 1 {
+		t.Fatal(e)
+	}
+	if e[0]["level"] != "error" || e[0]["msg"] != "connect error" || e[0]["instance"] != "db1" ||
+		e[0]["error"] != "password=redacted" || e[0]["root_token"] != "redacted" {
+		t.Fatal(e[0])
+	}
+	if inst := e[0]["inst"].(map[string]interface{}); inst["password"] != "redacted" || inst["port"] != float64(5432) {
+		t.Fatal(inst)
+	}
+
+	Init(true)
+	Debug("shown")
+	if e := entries(t, buf); len(e) != 1 || e[0]["level"] != "debug" {
+		t.Fatal(e)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+	Init(false)
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(apierr.RequestId(), Middleware())
+	e.GET("/v1/pg/instances/:id", func(ctx *gin.Context) {
+		Annotate(ctx, F("instance", ctx.Param("id")))
+		FromContext(ctx).Info("instance read")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/v1/pg/instances/db1", nil)
+	req.Header.Set("X-Request-Id", "r-1")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	l := entries(t, buf)
+	if len(l) != 1 || l[0]["request_id"] != "r-1" || l[0]["instance"] != "db1" {
+		t.Fatal(l)
+	}
+}
@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redacted = "redacted"
+
+// values of these fields never appear in clear text, in fields and in json values
+var secretFields = map[string]bool{
+	"password":             true,
+	"old_password":         true,
+	"pending_new_password": true,
+	"new_password":         true,
+	"token":                true,
+	"root_token":           true,
+	"secret_id":            true,
+	"secret":               true,
+	"otpauth_url":          true,
+	"totp_code":            true,
+	"jwt":                  true,
+	"key":                  true,
+	"shard":                true,
+	"shards":               true,
+	"master_key":           true,
+	"dsn":                  true,
+	"connection_string":    true,
+}
+
+func isSecretField(key string) bool {
+	k := strings.ToLower(key)
+	return secretFields[k] || strings.Contains(k, "password") || strings.Contains(k, "secret")
+}
+
+type rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var rules = []rule{
+	// keyword/value connection strings: host=db user=u password=s3cret
+	{regexp.MustCompile(`(?i)\b(password|passwd|pwd)(\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s'"]+)`), "${1}${2}" + redacted},
+	// user info of urls: postgres://u:s3cret@db:5432/app
+	{regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://[^:/@\s]*:)[^@\s]+@`), "${1}" + redacted + "@"},
+	// json values of secret fields: {"password":"s3cret"}
+	{regexp.MustCompile(`(?i)("(?:[a-z_]*password|token|root_token|secret_id|secret|jwt|key|shard|otpauth_url|totp_code)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + redacted + `"`},
+	// http authorization
+	{regexp.MustCompile(`(?i)\b(bearer\s+)[^\s"]+`), "${1}" + redacted},
+}
+
+// long base64 runs mixing cases and digits, i.e. key shards and tokens. hex digests and uuids are kept.
+var opaquePattern = regexp.MustCompile(`[A-Za-z0-9+/_-]{32,}={0,2}`)
+
+func isOpaque(s string) bool {
+	var upper, lower, digit bool
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+	}
+	return upper && lower && digit
+}
+
+// RedactString scrubs passwords, key shards and tokens from s
+func RedactString(s string) string {
+	for _, r := range rules {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return opaquePattern.ReplaceAllStringFunc(s, func(m string) string {
+		if isOpaque(m) {
+			return redacted
+		}
+		return m
+	})
+}
+
+// Redact returns v as it is logged: errors and strings scrubbed, other values as scrubbed json
+func Redact(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return RedactString(vv)
+	case error:
+		return RedactString(vv.Error())
+	case fmt.Stringer:
+		return RedactString(vv.String())
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return vv
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return RedactString(fmt.Sprint(v))
+	}
+	return json.RawMessage(RedactString(string(b)))
+}
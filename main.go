@@ -1,24 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"strings"
 
 	"goimport.moetang.info/nekoq-security/alg/shamir"
+	"goimport.moetang.info/nekoq-security/audit"
 	"goimport.moetang.info/nekoq-security/config"
 	"goimport.moetang.info/nekoq-security/controller"
+	"goimport.moetang.info/nekoq-security/grpcapi"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+	"goimport.moetang.info/nekoq-security/tracing"
 
 	scaffold "github.com/moetang/webapp-scaffold"
 )
 
 var preKeyShards []string
+var configFile string
+var rebuildIntegrity bool
 
-func init() {
+// parseFlags runs the commands of the flags, or keeps the settings of the server
+func parseFlags() {
 	b := flag.Bool("genmaster", false, "generate shamir keys")
 	premaster := flag.String("preinitmaster", "", "pre-init master key shards. INSECURE")
+	auditVerify := flag.String("audit-verify", "", "verify the hash chain of audit files, rotated files from the oldest separated by comma")
+	flag.BoolVar(&rebuildIntegrity, "rebuild-integrity", false, "accept the current records when the integrity tree is missing or does not match them at unlock")
+	flag.StringVar(&configFile, "config", "nekoq-security.toml", "config file")
 
 	flag.Parse()
 
@@ -31,19 +43,34 @@ func init() {
 		os.Exit(0)
 	}
 
+	if auditVerify != nil && len(*auditVerify) > 0 {
+		report, err := audit.VerifyFiles(strings.Split(*auditVerify, ","), nil)
+		if err != nil {
+			fmt.Println("verify audit file error:", err)
+			os.Exit(2)
+		}
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+		if !report.Valid {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if premaster != nil && len(*premaster) > 0 {
 		preKeyShards = strings.Split(*premaster, ",")
 	}
 }
 
 func main() {
-	webscaf, err := scaffold.NewFromConfigFile("nekoq-security.toml")
+	parseFlags()
+	webscaf, err := scaffold.NewFromConfigFile(configFile)
 	if err != nil {
 		panic(err)
 	}
 	config.InitWebScaffold(webscaf)
 	c := new(config.NekoQSecurityConfig)
-	err = scaffold.ReadCustomConfig("nekoq-security.toml", c)
+	err = scaffold.ReadCustomConfig(configFile, c)
 	if err != nil {
 		panic(err)
 	}
@@ -51,12 +78,28 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	logging.Init(c.Global.Debug)
+	err = tracing.Init(&c.NekoQSecurity.Tracing)
+	if err != nil {
+		panic(err)
+	}
 	err = c.Init()
 	if err != nil {
 		panic(err)
 	}
+	if rebuildIntegrity {
+		c.RebuildIntegrity()
+	}
+	err = audit.Init(&c.NekoQSecurity.Audit, c.AuditKey)
+	if err != nil {
+		panic(err)
+	}
 
 	controller.Init(webscaf, c)
+	err = c.InitModuleRoutes()
+	if err != nil {
+		panic(err)
+	}
 
 	// self-init based on pre-init key shards
 	if len(preKeyShards) > 0 {
@@ -71,13 +114,48 @@ func main() {
 			}
 			if !init {
 				panic("didn't init nekoq-security")
-			} else {
-				log.Println("[INFO] self-init nekoq-security done.")
 			}
+			// the root token is not generated here, where it could only end up in the output of the process
+			logging.Info("self-init nekoq-security done, the root token is returned by the next unseal call")
 		}()
 	}
 
-	err = webscaf.SyncStart()
+	if listen := c.NekoQSecurity.Metrics.Listen; len(listen) > 0 {
+		go func() {
+			if err := metrics.ListenAndServe(listen); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if c.NekoQSecurity.GRPC.Enable {
+		// calls are served by the routes of the http server
+		go func() {
+			if err := grpcapi.Serve(c, webscaf.GetGin()); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if tlsConfig := c.ServerTLSConfig(); tlsConfig != nil {
+		// the scaffold only serves plain http
+		listen := c.Gin.Listen
+		if len(listen) == 0 {
+			listen = ":6001"
+		}
+		err = webscaf.PreInitDb()
+		if err != nil {
+			panic(err)
+		}
+		server := &http.Server{
+			Addr:      listen,
+			Handler:   webscaf.GetGin(),
+			TLSConfig: tlsConfig,
+		}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = webscaf.SyncStart()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/shamir"
+	"goimport.moetang.info/nekoq-security/config"
+)
+
+// the test binary runs a node of the cluster test when the variable holds the config file
+const testNodeEnv = "NEKOQ_SECURITY_TEST_NODE"
+
+func TestMain(m *testing.M) {
+	if configFile := os.Getenv(testNodeEnv); len(configFile) > 0 {
+		os.Args = []string{os.Args[0], "-config", configFile}
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+const testNodeConfig = `[global]
+debug = false
+
+[gin]
+release_mode = true
+listen = "%s"
+
+[nekoq-security]
+masterkey.type = "shamir"
+storage.path = "nekoq-security.db"
+
+[nekoq-security.cluster]
+enable = true
+node_id = "%s"
+raft_bind = "%s"
+raft_dir = "raft"
+api_address = "http://%s"
+bootstrap = %t
+forward_mode = "forward"
+%s`
+
+const testPeerConfig = `
+[[nekoq-security.cluster.peers]]
+node_id = "%s"
+raft_address = "%s"
+api_address = "http://%s"
+`
+
+type testNode struct {
+	id      string
+	api     string
+	raft    string
+	address string
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startNodes runs each node in a process of its own, in its own directory
+func startNodes(t *testing.T, size int) []*testNode {
+	var nodes []*testNode
+	peers := ""
+	for i := 0; i < size; i++ {
+		n := &testNode{id: fmt.Sprint("node", i), api: freeAddress(t), raft: freeAddress(t)}
+		n.address = "http://" + n.api
+		nodes = append(nodes, n)
+		peers += fmt.Sprintf(testPeerConfig, n.id, n.raft, n.api)
+	}
+	for i, n := range nodes {
+		dir := filepath.Join(t.TempDir(), n.id)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		configFile := filepath.Join(dir, "nekoq-security.toml")
+		err := os.WriteFile(configFile, []byte(fmt.Sprintf(testNodeConfig, n.api, n.id, n.raft, n.api, i == 0, peers)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.Create(filepath.Join(dir, "out.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0])
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), testNodeEnv+"="+configFile)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+			out.Close()
+			if t.Failed() {
+				b, _ := os.ReadFile(out.Name())
+				t.Log(string(b))
+			}
+		})
+	}
+	return nodes
+}
+
+type testResponse struct {
+	Status    int             `json:"status"`
+	Message   string          `json:"message"`
+	RootToken string          `json:"root_token"`
+	Result    json.RawMessage `json:"result"`
+}
+
+func call(t *testing.T, method, url, token string, body interface{}) (int, *testResponse) {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-NekoQ-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	r := new(testResponse)
+	_ = json.NewDecoder(resp.Body).Decode(r)
+	return resp.StatusCode, r
+}
+
+// waitFor retries fn until it returns true
+func waitFor(t *testing.T, what string, fn func() bool) {
+	for deadline := time.Now().Add(30 * time.Second); !fn(); time.Sleep(200 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+	}
+}
+
+func health(t *testing.T, n *testNode) (int, bool) {
+	code, r := call(t, http.MethodGet, n.address+"/v1/sys/health", "", nil)
+	if r == nil {
+		return 0, false
+	}
+	h := new(struct {
+		Standby bool `json:"standby"`
+	})
+	_ = json.Unmarshal(r.Result, h)
+	return code, h.Standby
+}
+
+// unseal feeds the shards and returns the response of the last one
+func unseal(t *testing.T, n *testNode, shards []string) *testResponse {
+	var r *testResponse
+	for _, v := range shards {
+		var code int
+		if code, r = call(t, http.MethodPost, n.address+"/v1/sys/unseal", "", map[string]string{"key": v}); code != http.StatusOK {
+			t.Fatal("unseal", n.id, code)
+		}
+	}
+	return r
+}
+
+// TestClusterProcesses runs a cluster of three node processes, unseals them and writes through the followers
+func TestClusterProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts node processes")
+	}
+	nodes := startNodes(t, 3)
+
+	var leader *testNode
+	var followers []*testNode
+	waitFor(t, "leader", func() bool {
+		leader, followers = nil, nil
+		for _, n := range nodes {
+			code, standby := health(t, n)
+			if code == 0 {
+				return false
+			}
+			if standby {
+				followers = append(followers, n)
+			} else {
+				leader = n
+			}
+		}
+		return leader != nil
+	})
+
+	shards, err := shamir.InitShamirKeys(config.MaxShares, config.MinShares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := unseal(t, leader, shards[:config.MinShares])
+	if r.Status != 0 || len(r.RootToken) == 0 {
+		t.Fatal("leader not unsealed:", r.Message)
+	}
+	root := r.RootToken
+	// each follower is unsealed on its own, once the storage initialized by the leader is replicated
+	for _, f := range followers {
+		f := f
+		waitFor(t, "initialized "+f.id, func() bool {
+			code, _ := health(t, f)
+			return code != http.StatusNotImplemented
+		})
+		waitFor(t, "unsealed "+f.id, func() bool {
+			if r := unseal(t, f, shards[1:config.MinShares+1]); r.Status == 0 {
+				return true
+			}
+			call(t, http.MethodPost, f.address+"/v1/sys/unseal/reset", "", nil)
+			return false
+		})
+		if code, _ := health(t, f); code != http.StatusTooManyRequests {
+			t.Fatal("unsealed follower is not a standby:", f.id, code)
+		}
+	}
+
+	// writes sent to a follower are forwarded to the leader
+	user := map[string]interface{}{"username": "alice", "password": "correct horse battery", "policy_names": []string{"readers"}}
+	if code, r := call(t, http.MethodPost, followers[0].address+"/v1/auth/userpass/users", root, user); code != http.StatusOK {
+		t.Fatal("create user on follower:", code, r.Message)
+	}
+	login := new(struct {
+		Token string `json:"token"`
+	})
+	waitFor(t, "login on "+followers[1].id, func() bool {
+		code, r := call(t, http.MethodPost, followers[1].address+"/v1/auth/userpass/login", "",
+			map[string]string{"username": "alice", "password": "correct horse battery"})
+		return code == http.StatusOK && json.Unmarshal(r.Result, login) == nil
+	})
+	// and replicated to every node, which reads locally
+	for _, n := range nodes {
+		n := n
+		waitFor(t, "token replicated to "+n.id, func() bool {
+			code, _ := call(t, http.MethodGet, n.address+"/v1/auth/token/lookup-self", login.Token, nil)
+			return code == http.StatusOK
+		})
+	}
+}
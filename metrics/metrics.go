@@ -0,0 +1,116 @@
+// Prometheus metrics of the server, served at /metrics
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	Namespace = "nekoq"
+
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	// results of unlock attempts
+	UnsealUnlocked = "unlocked"
+	UnsealPending  = "pending"  // more shards are needed
+	UnsealRejected = "rejected" // too many shards fed
+	UnsealFailed   = "failed"   // the shards do not combine to the master key
+)
+
+// Registry holds the metrics of nekoq-security, and the go and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	UnsealAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "unseal_attempts_total",
+		Help:      "Key shards fed to unlock the master key, by result.",
+	}, []string{"result"})
+
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Http requests by route and status code.",
+	}, []string{"method", "route", "code"})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of http requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	Rotations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "pg",
+		Name:      "rotations_total",
+		Help:      "Credential rotations by instance and result.",
+	}, []string{"instance", "result"})
+
+	ConnectivityChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "pg",
+		Name:      "connectivity_checks_total",
+		Help:      "Connections made to check credentials, by database address and result.",
+	}, []string{"address", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UnsealAttempts,
+		Requests,
+		RequestDuration,
+		Rotations,
+		ConnectivityChecks,
+	)
+}
+
+// Result is the result label of an operation which returned err
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// Middleware counts requests by route pattern, so path parameters do not make new series
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		Requests.WithLabelValues(method, route, strconv.Itoa(ctx.Writer.Status())).Inc()
+		RequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Serve registers GET /metrics behind the handlers, e.g. the check of the token
+func Serve(e *gin.Engine, handlers ...gin.HandlerFunc) {
+	h := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	e.GET("/metrics", append(handlers, func(ctx *gin.Context) {
+		h.ServeHTTP(ctx.Writer, ctx.Request)
+	})...)
+}
+
+// ListenAndServe serves /metrics on a listener of its own, without token and while sealed
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(Middleware())
+	e.GET("/v1/pg/instances/:id", func(ctx *gin.Context) {
+		ctx.Status(http.StatusNotFound)
+	})
+	Serve(e)
+	for _, p := range []string{"/v1/pg/instances/a", "/v1/pg/instances/b", "/nowhere"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	if v := testutil.ToFloat64(Requests.WithLabelValues("GET", "/v1/pg/instances/:id", "404")); v != 2 {
+		t.Fatal(v)
+	}
+	if v := testutil.ToFloat64(Requests.WithLabelValues("GET", "unmatched", "404")); v != 1 {
+		t.Fatal(v)
+	}
+
+	Rotations.WithLabelValues("db1", Result(errors.New("unreachable"))).Inc()
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `nekoq_pg_rotations_total{instance="db1",result="failure"} 1`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
@@ -1,3 +1,13 @@
 package main
 
-import _ "goimport.moetang.info/nekoq-security/provider/pg"
+import (
+	_ "goimport.moetang.info/nekoq-security/auth"
+	_ "goimport.moetang.info/nekoq-security/auth/acl"
+	_ "goimport.moetang.info/nekoq-security/auth/approle"
+	_ "goimport.moetang.info/nekoq-security/auth/jwt"
+	_ "goimport.moetang.info/nekoq-security/auth/userpass"
+	_ "goimport.moetang.info/nekoq-security/lease"
+	_ "goimport.moetang.info/nekoq-security/provider/pg"
+	_ "goimport.moetang.info/nekoq-security/pwgen"
+	_ "goimport.moetang.info/nekoq-security/wrapping"
+)
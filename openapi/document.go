@@ -0,0 +1,155 @@
+// OpenAPI description of the web api, generated from the operations registered by the modules
+package openapi
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Version = "3.0.3"
+
+	TokenHeader = "X-NekoQ-Token"
+)
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Deprecated  bool    `json:"deprecated,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type OperationObject struct {
+	OperationId string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security"`
+}
+
+type SecurityScheme struct {
+	Type string `json:"type"`
+	In   string `json:"in"`
+	Name string `json:"name"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+type Document struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       Info                                   `json:"info"`
+	Paths      map[string]map[string]*OperationObject `json:"paths"`
+	Components Components                             `json:"components"`
+}
+
+type registered struct {
+	path   string
+	method string
+	op     *OperationObject
+}
+
+var (
+	registry   []*registered
+	schemas    = make(map[string]*Schema)
+	refs       = make(map[string]*Schema)
+	registryMu sync.Mutex
+)
+
+func init() {
+	RegisterSchema("Error", Object(map[string]*Schema{
+		"status":     Integer().Describe("1, or -1 when the request can be retried later"),
+		"code":       String().Describe("stable error code, e.g. not_found or validation_failed"),
+		"message":    String(),
+		"request_id": String(),
+		"details":    Map(Any()),
+	}).Require("status", "code", "message"))
+}
+
+// RegisterSchema adds a named schema to the components, to be referred to by RefTo(name)
+func RegisterSchema(name string, s *Schema) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	schemas[name] = s
+	refs["#/components/schemas/"+name] = s
+}
+
+func register(path, method string, op *OperationObject) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, &registered{path: path, method: method, op: op})
+}
+
+var ginParamPattern = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// openAPIPath converts gin path parameters, /instances/:id to /instances/{id}
+func openAPIPath(p string) string {
+	return ginParamPattern.ReplaceAllString(p, "{$1}")
+}
+
+// Generate builds the document from all registered operations
+func Generate() *Document {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	d := &Document{
+		OpenAPI: Version,
+		Info: Info{
+			Title:       "nekoq-security",
+			Description: "Routes outside of /v1 are deprecated aliases.",
+			Version:     "1",
+		},
+		Paths: make(map[string]map[string]*OperationObject),
+		Components: Components{
+			Schemas: schemas,
+			SecuritySchemes: map[string]*SecurityScheme{
+				"token": {Type: "apiKey", In: "header", Name: TokenHeader},
+			},
+		},
+	}
+	for _, r := range registry {
+		p := openAPIPath(r.path)
+		if d.Paths[p] == nil {
+			d.Paths[p] = make(map[string]*OperationObject)
+		}
+		d.Paths[p][strings.ToLower(r.method)] = r.op
+	}
+	return d
+}
+
+// ServeDocument serves the document at /v1/openapi.json, without token and while sealed
+func ServeDocument(e *gin.Engine) {
+	e.GET("/v1/openapi.json", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, Generate())
+	})
+}
@@ -0,0 +1,120 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader([]byte(s)))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	RegisterSchema("TestTag", String().OneOf("a", "b"))
+	s := Object(map[string]*Schema{
+		"name":  String().Match("^[a-z]+$"),
+		"port":  Integer().Range(1, 65535),
+		"tags":  Array(RefTo("TestTag")).NonEmpty(),
+		"users": Map(Object(map[string]*Schema{"db": String().NonEmpty()}).Require("db")),
+	}).Require("name")
+
+	cases := map[string]string{
+		`{"name": "abc", "port": 5432, "tags": ["a"], "users": {"u": {"db": "x"}}, "extra": 1}`: "",
+		`{"name": null}`:                      "name",
+		`{"port": 1}`:                         "name",
+		`{"name": "ABC"}`:                     "name",
+		`{"name": "abc", "port": 0}`:          "port",
+		`{"name": "abc", "port": 1.5}`:        "port",
+		`{"name": "abc", "port": "1"}`:        "port",
+		`{"name": "abc", "tags": []}`:         "tags",
+		`{"name": "abc", "tags": ["c"]}`:      "tags.0",
+		`{"name": "abc", "users": {"u": {}}}`: "users.u.db",
+		`{"name": "abc", "users": {"u": 1}}`:  "users.u",
+		`["abc"]`:                             "",
+	}
+	for body, field := range cases {
+		err := s.Validate(decode(t, body), refs)
+		if body == `["abc"]` {
+			if err == nil {
+				t.Fatal("array accepted as object")
+			}
+			continue
+		}
+		if len(field) == 0 {
+			if err != nil {
+				t.Fatal(body, err)
+			}
+			continue
+		}
+		ve, ok := err.(*ValidationError)
+		if !ok || ve.Field != field {
+			t.Fatal(body, err)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	g := NewGroup(e, "test", "/test")
+	called := 0
+	g.Handle(&Operation{Method: http.MethodPost, Path: "/items/:id", Legacy: "/old/item/:id", Id: "putTestItem",
+		PathParams: map[string]*Schema{"id": String().Match("^[0-9]+$")},
+		Query:      []*Parameter{{Name: "force", Schema: Boolean()}},
+		Body:       Object(map[string]*Schema{"n": Integer()}).Require("n")},
+		func(ctx *gin.Context) {
+			called++
+			ctx.JSON(http.StatusOK, gin.H{"status": 0})
+		})
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body))))
+		return w
+	}
+	if w := do("/v1/test/items/1?force=true", `{"n": 1}`); w.Code != http.StatusOK || len(w.Header().Get("Deprecation")) > 0 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w := do("/old/item/7", `{"n": 1}`)
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" ||
+		w.Header().Get("Link") != `</v1/test/items/7>; rel="successor-version"` {
+		t.Fatal(w.Code, w.Header())
+	}
+	for _, c := range [][2]string{
+		{"/v1/test/items/x", `{"n": 1}`},
+		{"/v1/test/items/1?force=maybe", `{"n": 1}`},
+		{"/v1/test/items/1", `{"n": "1"}`},
+		{"/v1/test/items/1", ``},
+		{"/old/item/1", `{`},
+	} {
+		if w := do(c[0], c[1]); w.Code != http.StatusBadRequest {
+			t.Fatal(c, w.Code, w.Body.String())
+		}
+	}
+	if called != 2 {
+		t.Fatal(called)
+	}
+
+	d := Generate()
+	if d.Paths["/v1/test/items/{id}"]["post"].OperationId != "putTestItem" {
+		t.Fatal(d.Paths)
+	}
+	legacy := d.Paths["/old/item/{id}"]["post"]
+	if !legacy.Deprecated || legacy.OperationId != "putTestItemDeprecated" {
+		t.Fatal(legacy)
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatal(err)
+	}
+}
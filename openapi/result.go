@@ -0,0 +1,70 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResultRecorder holds the response of the next handlers back, so a middleware can replace its result
+type ResultRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Record makes the next handlers write to the recorder, until Stop
+func Record(ctx *gin.Context) *ResultRecorder {
+	r := &ResultRecorder{ResponseWriter: ctx.Writer}
+	ctx.Writer = r
+	return r
+}
+
+// Stop restores the writer of the request
+func (r *ResultRecorder) Stop(ctx *gin.Context) {
+	ctx.Writer = r.ResponseWriter
+}
+
+func (r *ResultRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *ResultRecorder) WriteString(s string) (int, error) {
+	return r.body.WriteString(s)
+}
+
+func (r *ResultRecorder) WriteHeaderNow() {
+}
+
+func (r *ResultRecorder) Flush() {
+}
+
+func (r *ResultRecorder) Written() bool {
+	return r.body.Len() > 0 || r.ResponseWriter.Written()
+}
+
+// Result returns the result of a successful response, false for errors and responses without result
+func (r *ResultRecorder) Result() (json.RawMessage, bool) {
+	return resultOf(r.Status(), r.body.Bytes())
+}
+
+// Send writes the recorded response as it is
+func (r *ResultRecorder) Send() error {
+	_, err := r.ResponseWriter.Write(r.body.Bytes())
+	return err
+}
+
+func resultOf(status int, body []byte) (json.RawMessage, bool) {
+	if status != http.StatusOK {
+		return nil, false
+	}
+	var r struct {
+		Status int             `json:"status"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil || r.Status != 0 || len(r.Result) == 0 {
+		return nil, false
+	}
+	return r.Result, true
+}
@@ -0,0 +1,22 @@
+package openapi
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResultOf(t *testing.T) {
+	r, ok := resultOf(http.StatusOK, []byte(`{"status":0,"result":{"lease_id":"pg/db1/x"}}`))
+	if !ok || string(r) != `{"lease_id":"pg/db1/x"}` {
+		t.Fatal(string(r))
+	}
+	for status, body := range map[int]string{
+		http.StatusOK:        `{"status":0,"message":"success"}`,
+		http.StatusNotFound:  `{"status":1,"code":"not_found","message":"instance not found"}`,
+		http.StatusForbidden: `not json`,
+	} {
+		if _, ok := resultOf(status, []byte(body)); ok {
+			t.Error(status, body)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+
+	"github.com/gin-gonic/gin"
+)
+
+const V1Prefix = "/v1"
+
+// Operation describes a route, its parameters and its json body
+type Operation struct {
+	Method string
+	Path   string // under the prefix of the group, gin syntax
+	// full path of the deprecated alias, served with the same method
+	Legacy  string
+	Id      string
+	Summary string
+	// no token required
+	Public bool
+	// schemas of path parameters, strings of any value by default
+	PathParams map[string]*Schema
+	Query      []*Parameter
+	Body       *Schema
+	// requests without a body are allowed, e.g. when every field has a default
+	BodyOptional bool
+	// schema of the result field of the response
+	Result *Schema
+}
+
+// Group registers the operations of a module under /v1 and their deprecated aliases
+type Group struct {
+	tag    string
+	prefix string
+	v1     *gin.RouterGroup
+	legacy *gin.RouterGroup
+}
+
+// NewGroup serves operations under /v1<prefix>. The middlewares apply to their legacy paths too.
+func NewGroup(e *gin.Engine, tag, prefix string, middlewares ...gin.HandlerFunc) *Group {
+	return &Group{
+		tag:    tag,
+		prefix: V1Prefix + prefix,
+		v1:     e.Group(V1Prefix+prefix, middlewares...),
+		legacy: e.Group("", middlewares...),
+	}
+}
+
+// Handle registers the operation. The request is validated against its schemas right before the last handler,
+// after authentication.
+func (g *Group) Handle(op *Operation, handlers ...gin.HandlerFunc) {
+	params := op.parameters()
+	chain := make([]gin.HandlerFunc, 0, len(handlers)+1)
+	chain = append(chain, handlers[:len(handlers)-1]...)
+	chain = append(chain, validator(op, params))
+	chain = append(chain, handlers[len(handlers)-1])
+
+	successor := g.prefix + op.Path
+	g.v1.Handle(op.Method, op.Path, chain...)
+	register(successor, op.Method, g.describe(op, op.Id, params, false))
+
+	if len(op.Legacy) > 0 {
+		g.legacy.Handle(op.Method, op.Legacy, append([]gin.HandlerFunc{Deprecated(successor)}, chain...)...)
+		register(op.Legacy, op.Method, g.describe(op, op.Id+"Deprecated", params, true))
+	}
+}
+
+// Deprecated marks the responses of a legacy route, pointing at its /v1 successor
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		target := successor
+		for _, p := range ctx.Params {
+			target = strings.Replace(target, ":"+p.Key, p.Value, 1)
+		}
+		ctx.Header("Deprecation", "true")
+		ctx.Header("Link", "<"+target+`>; rel="successor-version"`)
+		ctx.Next()
+	}
+}
+
+// DescribeDeprecated documents a legacy route registered outside of a group, e.g. with another method
+func DescribeDeprecated(method, path string, op *Operation) {
+	g := &Group{}
+	register(path, method, g.describe(op, op.Id+"Deprecated", op.parameters(), true))
+}
+
+func (op *Operation) parameters() []*Parameter {
+	var params []*Parameter
+	for _, m := range ginParamPattern.FindAllStringSubmatch(op.Path, -1) {
+		s := op.PathParams[m[1]]
+		if s == nil {
+			s = String()
+		}
+		params = append(params, &Parameter{Name: m[1], In: "path", Required: true, Schema: s})
+	}
+	for _, q := range op.Query {
+		q.In = "query"
+		params = append(params, q)
+	}
+	return params
+}
+
+func envelope(result *Schema) *Schema {
+	s := Object(map[string]*Schema{
+		"status":  Integer().Describe("0"),
+		"message": String(),
+	}).Require("status")
+	if result != nil {
+		s.Properties["result"] = result
+	}
+	return s
+}
+
+func jsonContent(s *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: s}}
+}
+
+func (g *Group) describe(op *Operation, id string, params []*Parameter, deprecated bool) *OperationObject {
+	o := &OperationObject{
+		OperationId: id,
+		Summary:     op.Summary,
+		Deprecated:  deprecated,
+		Parameters:  params,
+		Responses: map[string]*Response{
+			"200":     {Description: "success", Content: jsonContent(envelope(op.Result))},
+			"default": {Description: "error", Content: jsonContent(RefTo("Error"))},
+		},
+		Security: []map[string][]string{{"token": {}}},
+	}
+	if len(g.tag) > 0 {
+		o.Tags = []string{g.tag}
+	}
+	if op.Public {
+		o.Security = []map[string][]string{}
+	}
+	if op.Body != nil {
+		o.RequestBody = &RequestBody{Required: !op.BodyOptional, Content: jsonContent(op.Body)}
+	}
+	return o
+}
+
+func validationFailed(ctx *gin.Context, field, message string) {
+	apierr.Abort(ctx, apierr.InvalidField(field, field+": "+message))
+}
+
+// validator rejects requests not matching the parameters and body of the operation
+func validator(op *Operation, params []*Parameter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		for _, p := range params {
+			var v string
+			var present bool
+			if p.In == "path" {
+				v, present = ctx.Param(p.Name), true
+			} else {
+				v, present = ctx.GetQuery(p.Name)
+			}
+			if !present {
+				if p.Required {
+					validationFailed(ctx, p.Name, "is required")
+					return
+				}
+				continue
+			}
+			if err := p.Schema.Validate(parameterValue(p.Schema, v), refs); err != nil {
+				if ve, ok := err.(*ValidationError); ok {
+					validationFailed(ctx, p.Name, ve.Message)
+					return
+				}
+				apierr.Abort(ctx, apierr.Internal(err))
+				return
+			}
+		}
+		if op.Body == nil {
+			ctx.Next()
+			return
+		}
+
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			apierr.Abort(ctx, apierr.Validation("cannot read request body"))
+			return
+		}
+		ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if len(bytes.TrimSpace(body)) == 0 {
+			if !op.BodyOptional {
+				apierr.Abort(ctx, apierr.Validation("request body is required"))
+				return
+			}
+			ctx.Next()
+			return
+		}
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			apierr.Abort(ctx, apierr.Validation("request body is not valid json"))
+			return
+		}
+		if err := op.Body.Validate(v, refs); err != nil {
+			if ve, ok := err.(*ValidationError); ok {
+				apierr.Abort(ctx, apierr.InvalidField(ve.Field, ve.Error()))
+				return
+			}
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// parameterValue converts a path or query string to the json value its schema expects
+func parameterValue(s *Schema, v string) interface{} {
+	switch s.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return json.Number(v)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
@@ -0,0 +1,277 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Schema is the subset of the OpenAPI 3.0 schema object used by the api, and checked by Validate
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *int64             `json:"minimum,omitempty"`
+	Maximum              *int64             `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MinProperties        *int               `json:"minProperties,omitempty"`
+}
+
+func String() *Schema {
+	return &Schema{Type: "string"}
+}
+
+func Integer() *Schema {
+	return &Schema{Type: "integer", Format: "int64"}
+}
+
+func Boolean() *Schema {
+	return &Schema{Type: "boolean"}
+}
+
+func Array(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+// Object is an object with the given properties. Unknown properties are allowed.
+func Object(properties map[string]*Schema) *Schema {
+	return &Schema{Type: "object", Properties: properties}
+}
+
+// Map is an object with any keys and values of the given schema
+func Map(values *Schema) *Schema {
+	return &Schema{Type: "object", AdditionalProperties: values}
+}
+
+// Any accepts every value
+func Any() *Schema {
+	return &Schema{}
+}
+
+// RefTo refers to a schema of the components of the document
+func RefTo(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func (s *Schema) Describe(d string) *Schema {
+	s.Description = d
+	return s
+}
+
+func (s *Schema) Require(names ...string) *Schema {
+	s.Required = append(s.Required, names...)
+	return s
+}
+
+func (s *Schema) OneOf(values ...string) *Schema {
+	s.Enum = values
+	return s
+}
+
+func (s *Schema) Match(pattern string) *Schema {
+	// panics on registration rather than on the first request
+	compiled(pattern)
+	s.Pattern = pattern
+	return s
+}
+
+func (s *Schema) Len(min, max int) *Schema {
+	if min > 0 {
+		s.MinLength = &min
+	}
+	if max > 0 {
+		s.MaxLength = &max
+	}
+	return s
+}
+
+func (s *Schema) Range(min, max int64) *Schema {
+	s.Minimum = &min
+	s.Maximum = &max
+	return s
+}
+
+func (s *Schema) Min(min int64) *Schema {
+	s.Minimum = &min
+	return s
+}
+
+func (s *Schema) NonEmpty() *Schema {
+	one := 1
+	switch s.Type {
+	case "array":
+		s.MinItems = &one
+	case "object":
+		s.MinProperties = &one
+	default:
+		s.MinLength = &one
+	}
+	return s
+}
+
+// ValidationError is the first violation found, Field is the json path of the value, e.g. address_list.m1.port
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Field) == 0 {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+var (
+	patternCache   = make(map[string]*regexp.Regexp)
+	patternCacheMu sync.Mutex
+)
+
+func compiled(pattern string) *regexp.Regexp {
+	patternCacheMu.Lock()
+	defer patternCacheMu.Unlock()
+	r, ok := patternCache[pattern]
+	if !ok {
+		r = regexp.MustCompile(pattern)
+		patternCache[pattern] = r
+	}
+	return r
+}
+
+// Validate checks a value decoded by encoding/json with UseNumber. refs resolves $ref.
+func (s *Schema) Validate(v interface{}, refs map[string]*Schema) error {
+	return s.validate("", v, refs)
+}
+
+func join(path, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+func fail(path, format string, args ...interface{}) error {
+	return &ValidationError{Field: path, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Schema) validate(path string, v interface{}, refs map[string]*Schema) error {
+	if len(s.Ref) > 0 {
+		r, ok := refs[s.Ref]
+		if !ok {
+			return fmt.Errorf("unknown schema %s", s.Ref)
+		}
+		return r.validate(path, v, refs)
+	}
+	if v == nil {
+		// null is treated as absent, as encoding/json does
+		return nil
+	}
+	switch s.Type {
+	case "":
+		return nil
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail(path, "must be a string")
+		}
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			if *s.MinLength == 1 {
+				return fail(path, "must not be empty")
+			}
+			return fail(path, "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail(path, "must be at most %d characters", *s.MaxLength)
+		}
+		if len(s.Pattern) > 0 && !compiled(s.Pattern).MatchString(str) {
+			return fail(path, "must match %s", s.Pattern)
+		}
+		if len(s.Enum) > 0 {
+			for _, e := range s.Enum {
+				if e == str {
+					return nil
+				}
+			}
+			return fail(path, "must be one of %v", s.Enum)
+		}
+	case "integer":
+		num, ok := v.(json.Number)
+		if !ok {
+			return fail(path, "must be an integer")
+		}
+		i, err := strconv.ParseInt(string(num), 10, 64)
+		if err != nil {
+			return fail(path, "must be an integer")
+		}
+		if s.Minimum != nil && i < *s.Minimum {
+			return fail(path, "must be at least %d", *s.Minimum)
+		}
+		if s.Maximum != nil && i > *s.Maximum {
+			return fail(path, "must be at most %d", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail(path, "must be a boolean")
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fail(path, "must be an array")
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			return fail(path, "must have at least %d items", *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				if err := s.Items.validate(join(path, strconv.Itoa(i)), item, refs); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fail(path, "must be an object")
+		}
+		if s.MinProperties != nil && len(obj) < *s.MinProperties {
+			return fail(path, "must have at least %d entries", *s.MinProperties)
+		}
+		for _, name := range s.Required {
+			if value, ok := obj[name]; !ok || value == nil {
+				return fail(join(path, name), "is required")
+			}
+		}
+		// sorted so the reported violation is stable
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps, ok := s.Properties[k]
+			if !ok {
+				ps = s.AdditionalProperties
+			}
+			if ps == nil {
+				continue
+			}
+			if err := ps.validate(join(path, k), obj[k], refs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
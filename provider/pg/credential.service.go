@@ -1,52 +1,128 @@
 package pg
 
 import (
-	"log"
 	"net/http"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/auth/acl"
+	"goimport.moetang.info/nekoq-security/lease"
+	"goimport.moetang.info/nekoq-security/logging"
 
 	"github.com/gin-gonic/gin"
 )
 
 type PasswordResponse struct {
-	AddressList map[string]struct {
-		HostName string `json:"host_name"`
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		Role     string `json:"role"`
-		UserMap  map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`             // current password
-			OldPassword        string `json:"old_password"`         // old password
-			PendingNewPassword string `json:"pending_new_password"` // new password
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		} `json:"user_map"`
-	} `json:"address_list"`
+	AddressList   map[string]PostgresAddress `json:"address_list"`
+	LeaseId       string                     `json:"lease_id,omitempty"`
+	LeaseDuration int64                      `json:"lease_duration,omitempty"` // seconds
+	Renewable     bool                       `json:"renewable,omitempty"`
 }
 
+// LeaseQueryName asks for a lease of static credentials, one time users and checked out users always have one
+const LeaseQueryName = "lease"
+
 func GetCredentialById(ctx *gin.Context) {
 	instId := ctx.Param("id")
 
-	inst, exist, err := CheckExist(MakeAvailableInstanceNameKey(instId))
+	inst, exist, err := CheckExist(ctx.Request.Context(), MakeAvailableInstanceNameKey(instId))
 	if err != nil {
-		log.Println("[ERROR] CheckExist error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("CheckExist error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 	if !exist {
-		log.Println("[ERROR] instance not exists.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "instance not exists",
-		})
+		logging.FromContext(ctx).Error("instance not exists", logging.Err(err))
+		apierr.Abort(ctx, apierr.NotFound("instance", instId))
+		return
+	}
+
+	if inst.isOneTimeUser() {
+		getOneTimeUser(ctx, inst)
+		return
+	}
+	if inst.isLibrary() {
+		apierr.Abort(ctx, apierr.Validation("users of a Library instance are checked out"))
 		return
 	}
 
+	if len(inst.AddressList) == 0 && !authorize(ctx, acl.OperationViewCredential, inst, "") {
+		return
+	}
+	// only addresses whose role the token can view credentials of
 	pr := new(PasswordResponse)
-	pr.AddressList = inst.AddressList
+	pr.AddressList = make(map[string]PostgresAddress)
+	for k, v := range inst.AddressList {
+		ok, err := allowed(ctx, acl.OperationViewCredential, inst, v.Role)
+		if err != nil {
+			logging.FromContext(ctx).Error("authorize error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		if ok {
+			pr.AddressList[k] = v
+		}
+	}
+	if len(pr.AddressList) == 0 && len(inst.AddressList) > 0 {
+		apierr.Abort(ctx, apierr.Forbidden())
+		return
+	}
+
+	if ctx.Query(LeaseQueryName) == "true" && !issueLease(ctx, inst, pr) {
+		return
+	}
+	logging.FromContext(ctx).Info("credentials read")
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": pr,
+	})
+}
+
+// issueLease adds a lease to pr, the passwords are rotated at the latest once the last lease ended
+func issueLease(ctx *gin.Context, inst *PostgresInstance, pr *PasswordResponse) bool {
+	l := &lease.Lease{
+		Data:      map[string]string{"instance": inst.InstanceName},
+		Accessor:  auth.CurrentToken(ctx).Accessor,
+		Renewable: true,
+	}
+	ttl, maxTTL := inst.leaseTTLs()
+	if err := lease.Issue(ctx.Request.Context(), leasePrefix(inst.InstanceName), l, ttl, maxTTL); err != nil {
+		logging.FromContext(ctx).Error("issue lease error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return false
+	}
+	pr.LeaseId = l.Id
+	pr.LeaseDuration = l.Duration(time.Now())
+	pr.Renewable = l.Renewable
+	for _, v := range pr.AddressList {
+		for un, u := range v.UserMap {
+			u.PasswordExpireAt = int(l.ExpireAt)
+			v.UserMap[un] = u
+		}
+	}
+	logging.Annotate(ctx, logging.F("lease_id", l.Id))
+	return true
+}
+
+// getOneTimeUser creates a role on the admin address, whose credentials the token must be able to view
+func getOneTimeUser(ctx *gin.Context, inst *PostgresInstance) {
+	admin, err := inst.adminConnection()
+	if err != nil {
+		logging.FromContext(ctx).Error("adminConnection error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	if !authorize(ctx, acl.OperationViewCredential, inst, admin.role) {
+		return
+	}
+	pr, err := issueOneTimeUser(ctx.Request.Context(), inst, admin, auth.CurrentToken(ctx).Accessor)
+	if err != nil {
+		logging.FromContext(ctx).Error("issueOneTimeUser error", logging.Err(err))
+		apierr.Abort(ctx, err)
+		return
+	}
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"status": 0,
@@ -57,33 +133,35 @@ func GetCredentialById(ctx *gin.Context) {
 func RotateCredentialById(ctx *gin.Context) {
 	instId := ctx.Param("id")
 
-	inst, exist, err := CheckExist(MakeAvailableInstanceNameKey(instId))
+	inst, exist, err := CheckExist(ctx.Request.Context(), MakeAvailableInstanceNameKey(instId))
 	if err != nil {
-		log.Println("[ERROR] CheckExist error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("CheckExist error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 	if !exist {
-		log.Println("[ERROR] instance not exists.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "instance not exists",
-		})
+		logging.FromContext(ctx).Error("instance not exists", logging.Err(err))
+		apierr.Abort(ctx, apierr.NotFound("instance", instId))
 		return
 	}
 
-	err = RotateInstancePassword(inst)
+	// rotation changes the credentials of every address
+	if len(inst.AddressList) == 0 && !authorize(ctx, acl.OperationRotate, inst, "") {
+		return
+	}
+	for _, v := range inst.AddressList {
+		if !authorize(ctx, acl.OperationRotate, inst, v.Role) {
+			return
+		}
+	}
+
+	err = RotateInstancePassword(ctx.Request.Context(), inst)
 	if err != nil {
-		log.Println("[ERROR] RotateInstancePassword error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("RotateInstancePassword error", logging.Err(err))
+		apierr.Abort(ctx, err)
 		return
 	}
+	publish(EventRotated, inst)
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"status":  0,
@@ -0,0 +1,220 @@
+package pg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/lease"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/pwgen"
+	"goimport.moetang.info/nekoq-security/tracing"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+)
+
+const (
+	CredentialPolicyDefault     = "Default"
+	CredentialPolicyOneTimeUser = "OneTimeUser" // a new role for every credential read, dropped when its lease ends
+
+	// time format of {{expiration}}, accepted by VALID UNTIL
+	expirationLayout = "2006-01-02 15:04:05-07:00"
+)
+
+var (
+	defaultCreationStatements = []string{
+		`CREATE ROLE "{{name}}" WITH LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}'`,
+	}
+	defaultRevocationStatements = []string{
+		`DROP ROLE IF EXISTS "{{name}}"`,
+	}
+)
+
+// adminConnection is the user of the instance which creates and drops one time users
+type adminConnection struct {
+	addressKey string
+	host       string
+	port       int
+	role       string
+	user       string
+	password   string
+	database   string
+}
+
+func (p *PostgresInstance) isOneTimeUser() bool {
+	return p.InstanceCredentialPolicy.Type == CredentialPolicyOneTimeUser
+}
+
+// validateCredentialPolicy checks the policy type, and that the admin user of one time users exists
+func (p *PostgresInstance) validateCredentialPolicy() error {
+	policy := p.InstanceCredentialPolicy
+	switch policy.Type {
+	case "", CredentialPolicyDefault, CredentialPolicyLibrary:
+		return nil
+	case CredentialPolicyOneTimeUser:
+	default:
+		return apierr.InvalidField("instance_credential_policy.type", "unknown credential policy")
+	}
+	if _, err := p.adminConnection(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *PostgresInstance) adminConnection() (*adminConnection, error) {
+	policy := p.InstanceCredentialPolicy
+	a, ok := p.AddressList[policy.AdminAddress]
+	if !ok {
+		return nil, apierr.InvalidField("instance_credential_policy.admin_address", "admin address not in address_list")
+	}
+	u, ok := a.UserMap[policy.AdminUser]
+	if !ok {
+		return nil, apierr.InvalidField("instance_credential_policy.admin_user", "admin user not in user_map of the admin address")
+	}
+	return &adminConnection{
+		addressKey: policy.AdminAddress,
+		host:       a.Host,
+		port:       a.Port,
+		role:       a.Role,
+		user:       u.UserName,
+		password:   u.Password,
+		database:   u.Database,
+	}, nil
+}
+
+func (p *PostgresInstance) creationStatements() []string {
+	if s := p.InstanceCredentialPolicy.CreationStatements; len(s) > 0 {
+		return s
+	}
+	return defaultCreationStatements
+}
+
+func (p *PostgresInstance) revocationStatements() []string {
+	if s := p.InstanceCredentialPolicy.RevocationStatements; len(s) > 0 {
+		return s
+	}
+	return defaultRevocationStatements
+}
+
+// oneTimeUserName is unique and needs no quoting: nq_<unix time>_<random hex>
+func oneTimeUserName(now time.Time) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "nq_" + strconv.FormatInt(now.Unix(), 10) + "_" + hex.EncodeToString(b), nil
+}
+
+// renderStatement replaces {{name}}, {{password}} and {{expiration}} of a statement template
+func renderStatement(tpl string, vars map[string]string) string {
+	for k, v := range vars {
+		tpl = strings.ReplaceAll(tpl, "{{"+k+"}}", v)
+	}
+	return tpl
+}
+
+// execStatements runs the statements in one transaction as the admin user
+func execStatements(ctx context.Context, admin *adminConnection, statements []string, vars map[string]string) error {
+	conn, err := connect(ctx, admin.host, admin.port, admin.user, admin.password, admin.database)
+	if err != nil {
+		return err
+	}
+	defer closeConn(conn)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, v := range statements {
+		// statements carry passwords, only the operation is traced
+		operation := ""
+		if f := strings.Fields(v); len(f) > 0 {
+			operation = strings.ToUpper(f[0])
+		}
+		_, span := tracing.Start(ctx, "pg.exec", append(connAttributes(admin.host, admin.port, admin.user, admin.database), semconv.DBOperationKey.String(operation))...)
+		_, err := tx.Exec(ctx, renderStatement(v, vars))
+		tracing.End(span, err)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// issueOneTimeUser creates a role valid until the max ttl of its lease. The lease is stored first,
+// so a role never outlives the lease which drops it.
+func issueOneTimeUser(ctx context.Context, inst *PostgresInstance, admin *adminConnection, accessor string) (*PasswordResponse, error) {
+	now := time.Now()
+	name, err := oneTimeUserName(now)
+	if err != nil {
+		return nil, err
+	}
+	password, err := pwgen.Generate(ctx, inst.InstanceCredentialPolicy.PasswordPolicy, "")
+	if err != nil {
+		return nil, err
+	}
+	l := &lease.Lease{
+		Data:      map[string]string{"instance": inst.InstanceName, "user": name},
+		Accessor:  accessor,
+		Renewable: true,
+	}
+	ttl, maxTTL := inst.leaseTTLs()
+	if err := lease.Issue(ctx, leasePrefix(inst.InstanceName), l, ttl, maxTTL); err != nil {
+		return nil, err
+	}
+
+	err = execStatements(ctx, admin, inst.creationStatements(), map[string]string{
+		"name":       name,
+		"password":   password,
+		"expiration": time.Unix(l.MaxExpireAt, 0).UTC().Format(expirationLayout),
+	})
+	if err != nil {
+		if err := lease.Revoke(ctx, l); err != nil {
+			logging.FromContext(ctx).Error("revoke lease error", logging.Err(err))
+		}
+		return nil, apierr.UnreachableDatabase(address(admin.host, admin.port), err)
+	}
+
+	pr := new(PasswordResponse)
+	a := inst.AddressList[admin.addressKey]
+	a.UserMap = map[string]PostgresUser{
+		name: {UserName: name, Password: password, PasswordExpireAt: int(l.ExpireAt), Database: admin.database},
+	}
+	pr.AddressList = map[string]PostgresAddress{admin.addressKey: a}
+	pr.LeaseId = l.Id
+	pr.LeaseDuration = l.Duration(now)
+	pr.Renewable = l.Renewable
+	logging.FromContext(ctx).Info("one time user created", logging.F("lease_id", l.Id), logging.F("user", name))
+	return pr, nil
+}
+
+// dropOneTimeUser runs the revocation statements of the instance, also after it was deleted
+func dropOneTimeUser(ctx context.Context, instanceName, name string) error {
+	inst, exist, err := CheckExist(ctx, MakeAvailableInstanceNameKey(instanceName))
+	if err != nil {
+		return err
+	}
+	if !exist {
+		inst, exist, err = CheckExist(ctx, MakeDeletedInstanceNameKey(instanceName))
+		if err != nil {
+			return err
+		}
+	}
+	if !exist {
+		logging.FromContext(ctx).Warn("instance of one time user not found, role is not dropped", logging.F("instance", instanceName), logging.F("user", name))
+		return nil
+	}
+	admin, err := inst.adminConnection()
+	if err != nil {
+		return err
+	}
+	if err := execStatements(ctx, admin, inst.revocationStatements(), map[string]string{"name": name}); err != nil {
+		return apierr.UnreachableDatabase(address(admin.host, admin.port), err)
+	}
+	logging.FromContext(ctx).Info("one time user dropped", logging.F("instance", instanceName), logging.F("user", name))
+	return nil
+}
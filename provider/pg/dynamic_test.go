@@ -0,0 +1,52 @@
+package pg
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+)
+
+func TestRenderStatement(t *testing.T) {
+	s := renderStatement(defaultCreationStatements[0], map[string]string{
+		"name":       "nq_1_ab",
+		"password":   "p",
+		"expiration": time.Unix(0, 0).UTC().Format(expirationLayout),
+	})
+	if s != `CREATE ROLE "nq_1_ab" WITH LOGIN PASSWORD 'p' VALID UNTIL '1970-01-01 00:00:00+00:00'` {
+		t.Fatal(s)
+	}
+}
+
+func TestOneTimeUserName(t *testing.T) {
+	a, _ := oneTimeUserName(time.Unix(1792413768, 0))
+	b, _ := oneTimeUserName(time.Unix(1792413768, 0))
+	if a == b || !regexp.MustCompile(`^nq_1792413768_[0-9a-f]{16}$`).MatchString(a) {
+		t.Fatal(a, b)
+	}
+}
+
+func TestValidateCredentialPolicy(t *testing.T) {
+	cases := map[string]apierr.Code{
+		`{"instance_credential_policy":{"type":""}}`:                                                 "",
+		`{"instance_credential_policy":{"type":"Unknown"}}`:                                          apierr.CodeValidationFailed,
+		`{"instance_credential_policy":{"type":"Library"}}`:                                          "",
+		`{"instance_credential_policy":{"type":"OneTimeUser","admin_address":"m","admin_user":"u"}}`: apierr.CodeValidationFailed,
+		`{"address_list":{"m":{"host":"db","port":5432,"user_map":{"u":{"user_name":"admin"}}}},
+			"instance_credential_policy":{"type":"OneTimeUser","admin_address":"m","admin_user":"x"}}`: apierr.CodeValidationFailed,
+		`{"address_list":{"m":{"host":"db","port":5432,"user_map":{"u":{"user_name":"admin"}}}},
+			"instance_credential_policy":{"type":"OneTimeUser","admin_address":"m","admin_user":"u"}}`: "",
+	}
+	for body, expected := range cases {
+		inst := new(PostgresInstance)
+		if err := json.Unmarshal([]byte(body), inst); err != nil {
+			t.Fatal(err)
+		}
+		err := inst.validateCredentialPolicy()
+		if (err == nil && expected != "") || (err != nil && apierr.CodeOf(err) != expected) {
+			t.Error(body, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package pg
+
+import (
+	"sync"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/auth/acl"
+	"goimport.moetang.info/nekoq-security/logging"
+)
+
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	EventRotated = "rotated"
+
+	// events kept for a subscriber which does not keep up, it is closed beyond that
+	subscriberBuffer = 64
+)
+
+// CredentialEvent tells that the credentials of an instance changed. It carries no secret,
+// subscribers read the new credentials with the usual credential view.
+type CredentialEvent struct {
+	Instance string            `json:"instance"`
+	Type     string            `json:"type"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Time     int64             `json:"time"`
+}
+
+// VisibleTo returns true when the token can read the metadata of the instance of the event
+func (e *CredentialEvent) VisibleTo(t *auth.Token) (bool, error) {
+	return acl.Authorize(t, &acl.Request{
+		Operation: acl.OperationViewMetadata,
+		Resource:  resourcePrefix + e.Instance,
+		Instance:  e.Instance,
+		Labels:    e.Labels,
+	})
+}
+
+var (
+	subscribers   = make(map[chan *CredentialEvent]struct{})
+	subscribersMu sync.Mutex
+)
+
+// Subscribe returns the events of this node from now on. Events are published by the process making
+// the change and are not replicated, so in cluster mode only the leader has them. The channel is closed by cancel, or when the
+// subscriber falls behind, in which case it should subscribe again and re-read what it watches.
+func Subscribe() (<-chan *CredentialEvent, func()) {
+	ch := make(chan *CredentialEvent, subscriberBuffer)
+	subscribersMu.Lock()
+	subscribers[ch] = struct{}{}
+	subscribersMu.Unlock()
+	return ch, func() {
+		subscribersMu.Lock()
+		defer subscribersMu.Unlock()
+		if _, ok := subscribers[ch]; ok {
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func publish(eventType string, inst *PostgresInstance) {
+	e := &CredentialEvent{
+		Instance: inst.InstanceName,
+		Type:     eventType,
+		Labels:   inst.Labels,
+		Time:     time.Now().Unix(),
+	}
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			logging.Warn("credential event subscriber falls behind, closed")
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
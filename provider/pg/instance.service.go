@@ -1,15 +1,22 @@
 package pg
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"log"
 	"net/http"
+	"time"
 
 	"goimport.moetang.info/nekoq-security/alg/aesutils"
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth/acl"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/lease"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/pwgen"
+	"goimport.moetang.info/nekoq-security/tracing"
 
 	"github.com/gin-gonic/gin"
-	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -20,32 +27,35 @@ var (
 // list all instances
 func ListAllInstances(ctx *gin.Context) {
 	var r = make(map[string][]byte)
-	err := container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
-		cursor := bucket.Cursor()
-		for k, v := cursor.Seek(availableInstancePrefix); k != nil && bytes.HasPrefix(k, availableInstancePrefix); k, v = cursor.Next() {
+	err := container.ViewWithinBucketContext(ctx.Request.Context(), namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(availableInstancePrefix, func(k, v []byte) error {
 			r[string(k)] = v
-		}
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
-		log.Println("[ERROR] List all instances error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "list all instances error",
-		})
+		logging.FromContext(ctx).Error("List all instances error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 	var result = make(map[string]*PostgresInstance)
 	for k, v := range r {
-		inst, err := DecAndUnmarshallInstance(v)
+		inst, err := DecAndUnmarshallInstance(ctx.Request.Context(), v)
 		if err != nil {
-			log.Println("[ERROR] decrypt instance error.", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"status":  1,
-				"message": "list all instances error",
-			})
+			logging.FromContext(ctx).Error("decrypt instance error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
 			return
 		}
+		// only instances the token can list
+		ok, err := allowed(ctx, acl.OperationList, inst, "")
+		if err != nil {
+			logging.FromContext(ctx).Error("authorize error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		if !ok {
+			continue
+		}
 		desensitization(inst)
 		result[k] = inst
 	}
@@ -61,83 +71,81 @@ func ListAllInstances(ctx *gin.Context) {
 func CreateInstance(ctx *gin.Context) {
 	inst := new(PostgresInstance)
 	if err := ctx.ShouldBindJSON(inst); err != nil {
-		log.Println("[ERROR] bind json error.", err)
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"status":  1,
-			"message": "parameter error",
-		})
+		logging.FromContext(ctx).Error("bind json error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
 		return
 	}
 
-	//check parameter
-	checkInstParameter(inst)
+	logging.Annotate(ctx, logging.F("instance", inst.InstanceName))
+
+	// the body is validated against createInstanceSchema before the handler
+	if !authorize(ctx, acl.OperationCreate, inst, "") {
+		return
+	}
+	if err := inst.validateCredentialPolicy(); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	if err := inst.validatePasswordPolicies(); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	if err := inst.validateRotationPolicy(); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
 
-	_, exist, err := CheckExist(MakeAvailableInstanceNameKey(inst.InstanceName))
+	_, exist, err := CheckExist(ctx.Request.Context(), MakeAvailableInstanceNameKey(inst.InstanceName))
 	if err != nil {
-		log.Println("[ERROR] CheckExist error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("CheckExist error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 	if exist {
-		log.Println("[ERROR] instance exists.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "instance exists",
-		})
+		logging.FromContext(ctx).Error("instance exists", logging.Err(err))
+		apierr.Abort(ctx, apierr.Conflict("instance", inst.InstanceName))
 		return
 	}
 
-	if err := CheckConnectivityBefore(inst); err != nil {
-		log.Println("[ERROR] CheckConnectivityBefore error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "cannot connect database error",
-		})
+	if err := CheckConnectivityBefore(ctx.Request.Context(), inst); err != nil {
+		logging.FromContext(ctx).Error("CheckConnectivityBefore error", logging.Err(err))
+		apierr.Abort(ctx, err)
 		return
 	}
 
-	b, err := MarshallAndEncInstance(inst)
+	b, err := MarshallAndEncInstance(ctx.Request.Context(), inst)
 	if err != nil {
-		log.Println("[ERROR] MarshallAndEncInstance error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("MarshallAndEncInstance error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 
-	err = container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
-		return bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b)
+	err = container.DoTxWithinBucketContext(ctx.Request.Context(), namespace, func(bucket *config.Bucket) error {
+		if err := bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b); err != nil {
+			return err
+		}
+		return putPasswordsSetAt(bucket, inst.InstanceName, time.Now())
 	})
 	if err != nil {
-		log.Println("[ERROR] save error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("save error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 
+	logging.FromContext(ctx).Info("instance created")
+	publish(EventCreated, inst)
+
 	ctx.JSON(http.StatusOK, gin.H{
 		"status":  0,
 		"message": "success",
 	})
 }
 
-func checkInstParameter(inst *PostgresInstance) {
-}
-
-func checkInstParameterWithoutCredential(inst *PostgresInstance) {
-}
-
 // get instance by id
 func GetInstanceById(ctx *gin.Context) {
 	instId := ctx.Param("id")
 	var r []byte
-	err := container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	err := container.ViewWithinBucketContext(ctx.Request.Context(), namespace, func(bucket *config.Bucket) error {
 		oldKey := MakeAvailableInstanceNameKey(instId)
 		v := bucket.Get(oldKey)
 		if v != nil {
@@ -146,30 +154,25 @@ func GetInstanceById(ctx *gin.Context) {
 		return nil
 	})
 	if err != nil {
-		log.Println("[ERROR] get instance error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "get instance error",
-		})
+		logging.FromContext(ctx).Error("get instance error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 
 	if len(r) == 0 {
-		log.Println("[ERROR] get instance error.", err)
-		ctx.JSON(http.StatusNotFound, gin.H{
-			"status":  1,
-			"message": "not found",
-		})
+		logging.FromContext(ctx).Error("get instance error", logging.Err(err))
+		apierr.Abort(ctx, apierr.NotFound("instance", instId))
 		return
 	}
 
-	inst, err := DecAndUnmarshallInstance(r)
+	inst, err := DecAndUnmarshallInstance(ctx.Request.Context(), r)
 	if err != nil {
-		log.Println("[ERROR] DecAndUnmarshallInstance error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "get instance error",
-		})
+		logging.FromContext(ctx).Error("DecAndUnmarshallInstance error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+
+	if !authorize(ctx, acl.OperationViewMetadata, inst, "") {
 		return
 	}
 
@@ -188,23 +191,9 @@ func desensitization(inst *PostgresInstance) {
 	addrList := inst.AddressList
 	for i, v := range addrList {
 		um := v.UserMap
-		newUm := make(map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`
-			OldPassword        string `json:"old_password"`
-			PendingNewPassword string `json:"pending_new_password"`
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		})
+		newUm := make(map[string]PostgresUser)
 		for k, v := range um {
-			newUm[k] = struct {
-				UserName           string `json:"user_name"`
-				Password           string `json:"password"`
-				OldPassword        string `json:"old_password"`
-				PendingNewPassword string `json:"pending_new_password"`
-				PasswordExpireAt   int    `json:"password_expire_at"`
-				Database           string `json:"database"`
-			}{UserName: v.UserName, Password: "", OldPassword: "", PendingNewPassword: "", PasswordExpireAt: v.PasswordExpireAt, Database: v.Database}
+			newUm[k] = v.withoutPasswords()
 		}
 		v.UserMap = newUm
 		addrList[i] = v
@@ -215,7 +204,20 @@ func desensitization(inst *PostgresInstance) {
 // delete an instance
 func DeleteInstanceById(ctx *gin.Context) {
 	instId := ctx.Param("id")
-	err := container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	origInst, exist, err := CheckExist(ctx.Request.Context(), MakeAvailableInstanceNameKey(instId))
+	if err != nil {
+		logging.FromContext(ctx).Error("CheckExist error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	if !exist {
+		origInst = &PostgresInstance{InstanceName: instId}
+	}
+	if !authorize(ctx, acl.OperationDelete, origInst, "") {
+		return
+	}
+
+	err = container.DoTxWithinBucketContext(ctx.Request.Context(), namespace, func(bucket *config.Bucket) error {
 		oldKey := MakeAvailableInstanceNameKey(instId)
 		v := bucket.Get(oldKey)
 		if v != nil {
@@ -227,18 +229,31 @@ func DeleteInstanceById(ctx *gin.Context) {
 			if err != nil {
 				return err
 			}
+			err = bucket.Delete(makePasswordsSetAtKey(instId))
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 	if err != nil {
-		log.Println("[ERROR] delete instance error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "delete instance error",
-		})
+		logging.FromContext(ctx).Error("delete instance error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 
+	logging.FromContext(ctx).Info("instance deleted")
+	// one time users are dropped with the deleted record, leases of static users just end
+	if _, err := lease.RevokePrefix(ctx.Request.Context(), leasePrefix(instId)); err != nil {
+		logging.FromContext(ctx).Error("revoke leases error", logging.Err(err))
+	}
+	if err := pwgen.ForgetHistory(ctx.Request.Context(), resourcePrefix+instId+"/"); err != nil {
+		logging.FromContext(ctx).Error("forget password history error", logging.Err(err))
+	}
+	if exist {
+		publish(EventDeleted, origInst)
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{
 		"status":  0,
 		"message": "success",
@@ -251,32 +266,25 @@ func UpdateInstanceById(ctx *gin.Context) {
 
 	inst := new(PostgresInstance)
 	if err := ctx.ShouldBindJSON(inst); err != nil {
-		log.Println("[ERROR] bind json error.", err)
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"status":  1,
-			"message": "parameter error",
-		})
+		logging.FromContext(ctx).Error("bind json error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
 		return
 	}
-	//check parameter
-	checkInstParameterWithoutCredential(inst)
+	// the body is validated against updateInstanceSchema before the handler
 	inst.InstanceName = instId
 
-	origInst, exist, err := CheckExist(MakeAvailableInstanceNameKey(instId))
+	// the passwords are read within the lock of rotations, so none is overwritten by the update
+	origInst := &PostgresInstance{InstanceName: instId}
+	unlock, err := lockInstance(ctx.Request.Context(), origInst)
 	if err != nil {
-		log.Println("[ERROR] CheckExist error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("lockInstance error", logging.Err(err))
+		apierr.Abort(ctx, err)
 		return
 	}
-	if !exist {
-		log.Println("[ERROR] not exist error.", err)
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"status":  1,
-			"message": "instance does not exist",
-		})
+	defer unlock()
+
+	// both the current and the updated instance must be in scope, so labels cannot move it out of reach
+	if !authorize(ctx, acl.OperationUpdate, origInst, "") || !authorize(ctx, acl.OperationUpdate, inst, "") {
 		return
 	}
 
@@ -287,58 +295,71 @@ func UpdateInstanceById(ctx *gin.Context) {
 			inst.AddressList[k] = v
 		}
 	}
+	if inst.RotationPolicy != origInst.RotationPolicy {
+		inst.unscheduleRotations()
+	}
+	if err := inst.validateCredentialPolicy(); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	if err := inst.validatePasswordPolicies(); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
+	if err := inst.validateRotationPolicy(); err != nil {
+		apierr.Abort(ctx, err)
+		return
+	}
 
-	if err := CheckConnectivityBefore(inst); err != nil {
-		log.Println("[ERROR] CheckConnectivityBefore error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "cannot connect database error",
-		})
+	if err := CheckConnectivityBefore(ctx.Request.Context(), inst); err != nil {
+		logging.FromContext(ctx).Error("CheckConnectivityBefore error", logging.Err(err))
+		apierr.Abort(ctx, err)
 		return
 	}
 
-	b, err := MarshallAndEncInstance(inst)
+	b, err := MarshallAndEncInstance(ctx.Request.Context(), inst)
 	if err != nil {
-		log.Println("[ERROR] MarshallAndEncInstance error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("MarshallAndEncInstance error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 
-	err = container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	err = container.DoTxWithinBucketContext(ctx.Request.Context(), namespace, func(bucket *config.Bucket) error {
 		return bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b)
 	})
 	if err != nil {
-		log.Println("[ERROR] save error.", err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"status":  1,
-			"message": "internal error",
-		})
+		logging.FromContext(ctx).Error("save error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
 		return
 	}
 
+	logging.FromContext(ctx).Info("instance updated")
+	publish(EventUpdated, inst)
+
 	ctx.JSON(http.StatusOK, gin.H{
 		"status":  0,
 		"message": "success",
 	})
 }
 
-func MarshallAndEncInstance(instance *PostgresInstance) ([]byte, error) {
+func MarshallAndEncInstance(ctx context.Context, instance *PostgresInstance) ([]byte, error) {
 	b, err := json.Marshal(instance)
 	if err != nil {
 		return nil, err
 	}
+	_, span := tracing.Start(ctx, "crypto.encrypt", attribute.Int("crypto.bytes", len(b)))
 	encb, err := aesutils.Encrypt(b, container.MasterKey)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
 	return encb, nil
 }
 
-func DecAndUnmarshallInstance(b []byte) (*PostgresInstance, error) {
+func DecAndUnmarshallInstance(ctx context.Context, b []byte) (*PostgresInstance, error) {
+	_, span := tracing.Start(ctx, "crypto.decrypt", attribute.Int("crypto.bytes", len(b)))
 	decb, err := aesutils.Decrypt(b, container.MasterKey)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
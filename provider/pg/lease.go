@@ -0,0 +1,61 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/lease"
+	"goimport.moetang.info/nekoq-security/logging"
+)
+
+// credential reads issue leases of this kind, under pg/<instance>/
+const leaseKind = "pg"
+
+func leasePrefix(instanceName string) string {
+	return leaseKind + "/" + instanceName + "/"
+}
+
+// leaseTTLs of the credential policy of the instance, 0 for the defaults
+func (p *PostgresInstance) leaseTTLs() (time.Duration, time.Duration) {
+	policy := p.InstanceCredentialPolicy
+	return time.Duration(policy.LeaseTTL) * time.Second, time.Duration(policy.LeaseMaxTTL) * time.Second
+}
+
+// expireLease drops the one time user of the lease, rotates the password of a checked out user, or rotates the passwords of the instance once
+// its last lease ended, so credentials outlive no lease while clients holding other leases keep working
+func expireLease(ctx context.Context, l *lease.Lease) error {
+	name := l.Data["instance"]
+	if user := l.Data["user"]; len(user) > 0 {
+		return dropOneTimeUser(ctx, name, user)
+	}
+	if user := l.Data["checked_out"]; len(user) > 0 {
+		return checkIn(ctx, name, l.Data["address"], user)
+	}
+	leases, err := lease.List(leasePrefix(name))
+	if err != nil {
+		return err
+	}
+	for _, v := range leases {
+		if v.Id != l.Id {
+			return nil
+		}
+	}
+
+	inst, exist, err := CheckExist(ctx, MakeAvailableInstanceNameKey(name))
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return nil
+	}
+	if err := RotateInstancePassword(ctx, inst); err != nil {
+		return err
+	}
+	publish(EventRotated, inst)
+	logging.FromContext(ctx).Info("passwords rotated after the last lease ended", logging.F("instance", name))
+	return nil
+}
+
+func init() {
+	lease.RegisterExpiry(leaseKind, expireLease)
+}
@@ -0,0 +1,215 @@
+package pg
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/auth/acl"
+	"goimport.moetang.info/nekoq-security/lease"
+	"goimport.moetang.info/nekoq-security/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CredentialPolicyLibrary shares the users of the instance one holder at a time, by check-out and check-in
+const CredentialPolicyLibrary = "Library"
+
+// serializes the choice of a free user, check-outs are writes served by the leader
+var libraryLock sync.Mutex
+
+func (p *PostgresInstance) isLibrary() bool {
+	return p.InstanceCredentialPolicy.Type == CredentialPolicyLibrary
+}
+
+type checkOutRequest struct {
+	TTL int64 `json:"ttl"` // seconds
+}
+
+type checkInRequest struct {
+	LeaseId string `json:"lease_id"`
+}
+
+// checkedOut returns the address and user keys of the users held by leases, ended leases included
+// until the password is rotated
+func checkedOut(instanceName string) (map[string]bool, error) {
+	leases, err := lease.List(leasePrefix(instanceName))
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]bool)
+	for _, l := range leases {
+		if u := l.Data["checked_out"]; len(u) > 0 {
+			r[l.Data["address"]+"/"+u] = true
+		}
+	}
+	return r, nil
+}
+
+// freeUser returns the first user, by address and user key, of the addresses which is not taken
+func freeUser(inst *PostgresInstance, addresses []string, taken map[string]bool) (string, string) {
+	sort.Strings(addresses)
+	for _, k := range addresses {
+		var users []string
+		for u := range inst.AddressList[k].UserMap {
+			users = append(users, u)
+		}
+		sort.Strings(users)
+		for _, u := range users {
+			if !taken[k+"/"+u] {
+				return k, u
+			}
+		}
+	}
+	return "", ""
+}
+
+// CheckOutUser hands out a free user of an address the token can view credentials of, until check-in
+// or the end of the lease
+func CheckOutUser(ctx *gin.Context) {
+	instId := ctx.Param("id")
+	req := new(checkOutRequest)
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(req); err != nil {
+			apierr.Abort(ctx, apierr.Validation("parameter error"))
+			return
+		}
+	}
+
+	// a scheduled rotation holds the lock too, the passwords are read after it
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+	inst, exist, err := CheckExist(ctx.Request.Context(), MakeAvailableInstanceNameKey(instId))
+	if err != nil {
+		logging.FromContext(ctx).Error("CheckExist error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	if !exist {
+		apierr.Abort(ctx, apierr.NotFound("instance", instId))
+		return
+	}
+	if !inst.isLibrary() {
+		apierr.Abort(ctx, apierr.Validation("credential policy of the instance is not Library"))
+		return
+	}
+
+	taken, err := checkedOut(inst.InstanceName)
+	if err != nil {
+		logging.FromContext(ctx).Error("checkedOut error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	var viewable []string
+	for k, a := range inst.AddressList {
+		ok, err := allowed(ctx, acl.OperationViewCredential, inst, a.Role)
+		if err != nil {
+			logging.FromContext(ctx).Error("authorize error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		if ok {
+			viewable = append(viewable, k)
+		}
+	}
+	if len(viewable) == 0 {
+		apierr.Abort(ctx, apierr.Forbidden())
+		return
+	}
+	addressKey, userKey := freeUser(inst, viewable, taken)
+	if len(userKey) == 0 {
+		apierr.Abort(ctx, apierr.New(apierr.CodeConflict, "every user of the instance is checked out"))
+		return
+	}
+
+	l := &lease.Lease{
+		Data:      map[string]string{"instance": inst.InstanceName, "address": addressKey, "checked_out": userKey},
+		Accessor:  auth.CurrentToken(ctx).Accessor,
+		Renewable: true,
+	}
+	ttl, maxTTL := inst.leaseTTLs()
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	if err := lease.Issue(ctx.Request.Context(), leasePrefix(inst.InstanceName), l, ttl, maxTTL); err != nil {
+		logging.FromContext(ctx).Error("issue lease error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+
+	pr := new(PasswordResponse)
+	a := inst.AddressList[addressKey]
+	u := a.UserMap[userKey]
+	u.PasswordExpireAt = int(l.ExpireAt)
+	a.UserMap = map[string]PostgresUser{userKey: u}
+	pr.AddressList = map[string]PostgresAddress{addressKey: a}
+	pr.LeaseId = l.Id
+	pr.LeaseDuration = l.Duration(time.Now())
+	pr.Renewable = l.Renewable
+	logging.FromContext(ctx).Info("user checked out", logging.F("lease_id", l.Id), logging.F("address", addressKey), logging.F("user", userKey))
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": pr,
+	})
+}
+
+// CheckInUser ends the lease of a check-out, rotating the password of the user before it is handed out again
+func CheckInUser(ctx *gin.Context) {
+	instId := ctx.Param("id")
+	req := new(checkInRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	l, err := lease.Lookup(req.LeaseId)
+	if err != nil && err != lease.ErrLeaseNotFound {
+		logging.FromContext(ctx).Error("lookup lease error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	// leases of other tokens and instances are not disclosed
+	if err == lease.ErrLeaseNotFound || !strings.HasPrefix(l.Id, leasePrefix(instId)) || len(l.Data["checked_out"]) == 0 ||
+		!lease.CanManage(auth.CurrentToken(ctx), l) {
+		apierr.Abort(ctx, apierr.NotFound("lease", req.LeaseId))
+		return
+	}
+	logging.Annotate(ctx, logging.F("lease_id", l.Id))
+
+	if err := lease.End(ctx.Request.Context(), l); err != nil {
+		// the lease is revoked, the rotation is retried
+		apierr.Abort(ctx, err)
+		return
+	}
+	logging.FromContext(ctx).Info("user checked in", logging.F("address", l.Data["address"]), logging.F("user", l.Data["checked_out"]))
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+// checkIn rotates the password of a user at the end of its check-out, so the holder cannot use it any more
+func checkIn(ctx context.Context, instanceName, addressKey, userKey string) error {
+	inst, exist, err := CheckExist(ctx, MakeAvailableInstanceNameKey(instanceName))
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return nil
+	}
+	if _, ok := inst.AddressList[addressKey].UserMap[userKey]; !ok {
+		return nil
+	}
+	if err := RotateUserPassword(ctx, inst, addressKey, userKey); err != nil {
+		return err
+	}
+	publish(EventRotated, inst)
+	logging.FromContext(ctx).Info("password of checked in user rotated", logging.F("instance", instanceName), logging.F("address", addressKey), logging.F("user", userKey))
+	return nil
+}
@@ -0,0 +1,34 @@
+package pg
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFreeUser(t *testing.T) {
+	inst := new(PostgresInstance)
+	err := json.Unmarshal([]byte(`{"address_list":{
+		"b":{"host":"db2","port":5432,"user_map":{"u1":{"user_name":"app1"}}},
+		"a":{"host":"db1","port":5432,"user_map":{"u2":{"user_name":"app2"},"u1":{"user_name":"app1"}}}}}`), inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		addresses []string
+		taken     map[string]bool
+		address   string
+		user      string
+	}{
+		{[]string{"b", "a"}, nil, "a", "u1"},
+		{[]string{"a", "b"}, map[string]bool{"a/u1": true}, "a", "u2"},
+		{[]string{"a", "b"}, map[string]bool{"a/u1": true, "a/u2": true}, "b", "u1"},
+		{[]string{"a"}, map[string]bool{"a/u1": true, "a/u2": true}, "", ""},
+		{[]string{"b"}, map[string]bool{"a/u1": true}, "b", "u1"},
+	}
+	for i, c := range cases {
+		a, u := freeUser(inst, c.addresses, c.taken)
+		if a != c.address || u != c.user {
+			t.Fatal(i, a, u)
+		}
+	}
+}
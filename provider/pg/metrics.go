@@ -0,0 +1,91 @@
+package pg
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// time the passwords of an instance were last set, by creation or rotation, in unix seconds
+var passwordsSetAtPrefix = []byte("pg.rotated.")
+
+func makePasswordsSetAtKey(instanceName string) []byte {
+	return append(append([]byte{}, passwordsSetAtPrefix...), []byte(instanceName)...)
+}
+
+func putPasswordsSetAt(bucket *config.Bucket, instanceName string, t time.Time) error {
+	return bucket.Put(makePasswordsSetAtKey(instanceName), []byte(strconv.FormatInt(t.Unix(), 10)))
+}
+
+func markPasswordsSet(ctx context.Context, instanceName string) error {
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return putPasswordsSetAt(bucket, instanceName, time.Now())
+	})
+}
+
+// passwordAgeCollector reports the age of the password of every user on scrape, nothing while sealed
+type passwordAgeCollector struct {
+	age *prometheus.Desc
+}
+
+func (p *passwordAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.age
+}
+
+func (p *passwordAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	if container == nil || !config.IsUnsealed() {
+		return
+	}
+	now := time.Now().Unix()
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		// users not rotated since rotated_at was introduced count from the last rotation of the instance
+		setAt := make(map[string]int64)
+		err := bucket.ForEachWithPrefix(passwordsSetAtPrefix, func(k, v []byte) error {
+			t, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			setAt[strings.TrimPrefix(string(k), string(passwordsSetAtPrefix))] = t
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return bucket.ForEachWithPrefix(availableInstancePrefix, func(k, v []byte) error {
+			inst, err := DecAndUnmarshallInstance(context.Background(), v)
+			if err != nil {
+				return err
+			}
+			for address, a := range inst.AddressList {
+				for user, u := range a.UserMap {
+					last := int64(u.RotatedAt)
+					if last == 0 {
+						last = setAt[inst.InstanceName]
+					}
+					if last == 0 {
+						continue
+					}
+					ch <- prometheus.MustNewConstMetric(p.age, prometheus.GaugeValue, float64(now-last), inst.InstanceName, address, user)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		logging.Error("collect password age error", logging.Err(err))
+	}
+}
+
+func init() {
+	metrics.Registry.MustRegister(&passwordAgeCollector{
+		age: prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "pg", "password_age_seconds"),
+			"Seconds since the password of the user was set by creation or rotation.", []string{"instance", "address", "user"}, nil),
+	})
+}
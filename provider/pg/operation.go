@@ -4,30 +4,89 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"net"
+	"strconv"
 	"time"
 
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+	"goimport.moetang.info/nekoq-security/pwgen"
+	"goimport.moetang.info/nekoq-security/tracing"
+
 	"github.com/jackc/pgx/v4"
-	uuid "github.com/satori/go.uuid"
-	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 )
 
-func RotateInstancePassword(inst *PostgresInstance) error {
-	newAddressList := make(map[string]struct {
-		HostName string `json:"host_name"`
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		Role     string `json:"role"`
-		UserMap  map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`             // current password
-			OldPassword        string `json:"old_password"`         // old password
-			PendingNewPassword string `json:"pending_new_password"` // new password
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		} `json:"user_map"`
+// RotateInstancePassword rotates the passwords of every user of the instance and records the result.
+// Checked out users of a library are left to their check-in, their holders keep working.
+func RotateInstancePassword(ctx context.Context, inst *PostgresInstance) error {
+	// a check-out in between would hand out the password being rotated
+	if inst.isLibrary() {
+		libraryLock.Lock()
+		defer libraryLock.Unlock()
+	}
+	unlock, err := lockInstance(ctx, inst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	selected := allUsers
+	taken := make(map[string]bool)
+	if inst.isLibrary() {
+		if taken, err = checkedOut(inst.InstanceName); err != nil {
+			return err
+		}
+		selected = func(addressKey, userKey string) bool {
+			return !taken[addressKey+"/"+userKey]
+		}
+	}
+	ctx, span := tracing.Start(ctx, "pg.rotate", attribute.String("pg.instance", inst.InstanceName))
+	err = rotateInstancePassword(ctx, inst, selected)
+	tracing.End(span, err)
+	metrics.Rotations.WithLabelValues(inst.InstanceName, metrics.Result(err)).Inc()
+	if err != nil {
+		return err
+	}
+	if len(taken) > 0 {
+		return nil
+	}
+	if err := markPasswordsSet(ctx, inst.InstanceName); err != nil {
+		// the rotation is done, only the password age is off
+		logging.FromContext(ctx).Error("markPasswordsSet error", logging.Err(err))
+	}
+	return nil
+}
+
+// RotateUserPassword rotates the password of one user of an address, the others are left as they are
+func RotateUserPassword(ctx context.Context, inst *PostgresInstance, addressKey, userKey string) error {
+	unlock, err := lockInstance(ctx, inst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ctx, span := tracing.Start(ctx, "pg.rotate", attribute.String("pg.instance", inst.InstanceName),
+		attribute.String("pg.address", addressKey), attribute.String("pg.user", userKey))
+	err = rotateInstancePassword(ctx, inst, func(a, u string) bool {
+		return a == addressKey && u == userKey
 	})
+	tracing.End(span, err)
+	metrics.Rotations.WithLabelValues(inst.InstanceName, metrics.Result(err)).Inc()
+	return err
+}
+
+// userFilter selects the users to rotate by address and user_map key
+type userFilter func(addressKey, userKey string) bool
+
+func allUsers(addressKey, userKey string) bool {
+	return true
+}
+
+// rotateInstancePassword rotates the selected users, the caller holds the lock of the instance
+func rotateInstancePassword(ctx context.Context, inst *PostgresInstance, selected userFilter) error {
+	newAddressList := make(map[string]PostgresAddress)
 	// copy new
 	for k, v := range inst.AddressList {
 		newAddressList[k] = v
@@ -38,22 +97,18 @@ func RotateInstancePassword(inst *PostgresInstance) error {
 		host := v.Host
 		port := v.Port
 		// copy new
-		newUserList := make(map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`             // current password
-			OldPassword        string `json:"old_password"`         // old password
-			PendingNewPassword string `json:"pending_new_password"` // new password
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		})
+		newUserList := make(map[string]PostgresUser)
 		for kk, vv := range v.UserMap {
 			newUserList[kk] = vv
 		}
-		// check and update all user
+		// check and update all selected users
 		for kk, vv := range v.UserMap {
-			newVV, err := checkAndUpdateUser(host, port, vv)
+			if !selected(k, kk) {
+				continue
+			}
+			newVV, err := checkAndUpdateUser(ctx, host, port, vv)
 			if err != nil {
-				return err
+				return apierr.UnreachableDatabase(address(host, port), err)
 			}
 			newUserList[kk] = newVV
 		}
@@ -65,38 +120,32 @@ func RotateInstancePassword(inst *PostgresInstance) error {
 	inst.AddressList = newAddressList
 
 	// 2. update old, current, new passwords if needed
-	b, err := MarshallAndEncInstance(inst)
+	b, err := MarshallAndEncInstance(ctx, inst)
 	if err != nil {
-		log.Println("[ERROR] MarshallAndEncInstance error.", err)
+		logging.FromContext(ctx).Error("MarshallAndEncInstance error", logging.Err(err))
 		return err
 	}
-	err = container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
 		return bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b)
 	})
 	if err != nil {
-		log.Println("[ERROR] save error.", err)
+		logging.FromContext(ctx).Error("save error", logging.Err(err))
 		return err
 	}
 
 	// 3. update new password in storage
 	for k, v := range inst.AddressList {
-		host := v.Host
-		port := v.Port
 		// copy new
-		newUserList := make(map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`             // current password
-			OldPassword        string `json:"old_password"`         // old password
-			PendingNewPassword string `json:"pending_new_password"` // new password
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		})
+		newUserList := make(map[string]PostgresUser)
 		for kk, vv := range v.UserMap {
 			newUserList[kk] = vv
 		}
-		// check and update all user
+		// check and update all selected users
 		for kk, vv := range v.UserMap {
-			newVV, err := generateNewPassword(host, port, vv)
+			if !selected(k, kk) {
+				continue
+			}
+			newVV, err := generateNewPassword(ctx, inst, k, kk, vv)
 			if err != nil {
 				return err
 			}
@@ -108,45 +157,46 @@ func RotateInstancePassword(inst *PostgresInstance) error {
 		newAddressList[k] = newV
 	}
 	inst.AddressList = newAddressList
-	b, err = MarshallAndEncInstance(inst)
+	b, err = MarshallAndEncInstance(ctx, inst)
 	if err != nil {
-		log.Println("[ERROR] MarshallAndEncInstance error.", err)
+		logging.FromContext(ctx).Error("MarshallAndEncInstance error", logging.Err(err))
 		return err
 	}
-	err = container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
 		return bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b)
 	})
 	if err != nil {
-		log.Println("[ERROR] save error.", err)
+		logging.FromContext(ctx).Error("save error", logging.Err(err))
 		return err
 	}
 
 	// 4. update db password
-	err = updatePgInstPassword(inst)
+	err = updatePgInstPassword(ctx, inst, selected)
 	if err != nil {
-		log.Println("[ERROR] updatePgInstPassword error.", err)
+		logging.FromContext(ctx).Error("updatePgInstPassword error", logging.Err(err))
 		return err
 	}
 
-	// 5. update old, current, new passwords
+	// 5. update old, current, new passwords, and the next rotation
+	now := time.Now()
 	for k, v := range inst.AddressList {
 		// copy new
-		newUserList := make(map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`             // current password
-			OldPassword        string `json:"old_password"`         // old password
-			PendingNewPassword string `json:"pending_new_password"` // new password
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		})
+		newUserList := make(map[string]PostgresUser)
 		for kk, vv := range v.UserMap {
 			newUserList[kk] = vv
 		}
-		// check and update all user
+		// check and update all selected users
 		for kk, vv := range v.UserMap {
+			if !selected(k, kk) {
+				continue
+			}
 			newVV := vv
 			newVV.Password = newVV.PendingNewPassword
 			newVV.PendingNewPassword = ""
+			newVV.RotatedAt = int(now.Unix())
+			if inst.rotationScheduled() {
+				newVV.PasswordExpireAt = inst.scheduleRotation(now)
+			}
 			newUserList[kk] = newVV
 		}
 
@@ -155,112 +205,120 @@ func RotateInstancePassword(inst *PostgresInstance) error {
 		newAddressList[k] = newV
 	}
 	inst.AddressList = newAddressList
-	b, err = MarshallAndEncInstance(inst)
+	b, err = MarshallAndEncInstance(ctx, inst)
 	if err != nil {
-		log.Println("[ERROR] MarshallAndEncInstance error.", err)
+		logging.FromContext(ctx).Error("MarshallAndEncInstance error", logging.Err(err))
 		return err
 	}
-	err = container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
 		return bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b)
 	})
 	if err != nil {
-		log.Println("[ERROR] save error.", err)
+		logging.FromContext(ctx).Error("save error", logging.Err(err))
 		return err
 	}
 
 	return nil
 }
 
-func updatePgInstPassword(inst *PostgresInstance) error {
-	for _, v := range inst.AddressList {
-		for _, vv := range v.UserMap {
-			err := updatePassword(v.Host, v.Port, vv.UserName, vv.Password, vv.PendingNewPassword, vv.Database)
+func updatePgInstPassword(ctx context.Context, inst *PostgresInstance, selected userFilter) error {
+	for k, v := range inst.AddressList {
+		for kk, vv := range v.UserMap {
+			if !selected(k, kk) {
+				continue
+			}
+			err := updatePassword(ctx, v.Host, v.Port, vv.UserName, vv.Password, vv.PendingNewPassword, vv.Database)
 			if err != nil {
-				return err
+				return apierr.UnreachableDatabase(address(v.Host, v.Port), err)
 			}
 		}
 	}
 	return nil
 }
 
-func updatePassword(host string, port int, name string, password string, newPassword string, database string) error {
-	tctx, cfn := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cfn()
-	conn, err := pgx.Connect(tctx, fmt.Sprint("host=", host, " port=", port, " connect_timeout=10 user=", name, " password=", password, " database=", database))
+func updatePassword(ctx context.Context, host string, port int, name string, password string, newPassword string, database string) error {
+	conn, err := connect(ctx, host, port, name, password, database)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		cctx, ccfn := context.WithTimeout(context.Background(), 10*time.Second)
-		defer ccfn()
-		conn.Close(cctx)
-	}()
-	_, err = conn.Exec(context.Background(), "ALTER USER "+name+" WITH PASSWORD '"+newPassword+"'")
+	defer closeConn(conn)
+	// the statement carries the password, only the operation is traced
+	_, span := tracing.Start(ctx, "pg.exec", append(connAttributes(host, port, name, database), semconv.DBOperationKey.String("ALTER USER"))...)
+	_, err = conn.Exec(ctx, "ALTER USER "+name+" WITH PASSWORD '"+newPassword+"'")
+	tracing.End(span, err)
 	return err
 }
 
-func generateNewPassword(host string, port int, vv struct {
-	UserName           string `json:"user_name"`
-	Password           string `json:"password"`
-	OldPassword        string `json:"old_password"`
-	PendingNewPassword string `json:"pending_new_password"`
-	PasswordExpireAt   int    `json:"password_expire_at"`
-	Database           string `json:"database"`
-}) (struct {
-	UserName           string `json:"user_name"`
-	Password           string `json:"password"`             // current password
-	OldPassword        string `json:"old_password"`         // old password
-	PendingNewPassword string `json:"pending_new_password"` // new password
-	PasswordExpireAt   int    `json:"password_expire_at"`
-	Database           string `json:"database"`
-}, error) {
+// generateNewPassword makes the pending password of the user, of its password policy or of the instance.
+// It is none of the current and old passwords, nor of the history of the policy.
+func generateNewPassword(ctx context.Context, inst *PostgresInstance, addressKey, userKey string, vv PostgresUser) (PostgresUser, error) {
 	newVV := vv
-	newVV.PendingNewPassword = strings.ReplaceAll(uuid.NewV4().String(), "-", "")
+	policy := vv.PasswordPolicy
+	if len(policy) == 0 {
+		policy = inst.InstanceCredentialPolicy.PasswordPolicy
+	}
+	password, err := pwgen.Generate(ctx, policy, passwordScope(inst.InstanceName, addressKey, userKey), vv.Password, vv.OldPassword)
+	if err != nil {
+		return newVV, err
+	}
+	newVV.PendingNewPassword = password
 	return newVV, nil
 }
 
-func checkAndUpdateUser(host string, port int, vv struct {
-	UserName           string `json:"user_name"`
-	Password           string `json:"password"`
-	OldPassword        string `json:"old_password"`
-	PendingNewPassword string `json:"pending_new_password"`
-	PasswordExpireAt   int    `json:"password_expire_at"`
-	Database           string `json:"database"`
-}) (struct {
-	UserName           string `json:"user_name"`
-	Password           string `json:"password"`             // current password
-	OldPassword        string `json:"old_password"`         // old password
-	PendingNewPassword string `json:"pending_new_password"` // new password
-	PasswordExpireAt   int    `json:"password_expire_at"`
-	Database           string `json:"database"`
-}, error) {
+// validatePasswordPolicies checks that the password policies of the instance and of its users exist
+func (p *PostgresInstance) validatePasswordPolicies() error {
+	check := func(field, name string) error {
+		if len(name) == 0 {
+			return nil
+		}
+		_, err := pwgen.LoadPolicy(name)
+		if err == pwgen.ErrPolicyNotFound {
+			return apierr.InvalidField(field, "password policy not found: "+name)
+		}
+		if err != nil {
+			return apierr.Internal(err)
+		}
+		return nil
+	}
+	if err := check("instance_credential_policy.password_policy", p.InstanceCredentialPolicy.PasswordPolicy); err != nil {
+		return err
+	}
+	for k, v := range p.AddressList {
+		for kk, vv := range v.UserMap {
+			if err := check("address_list."+k+".user_map."+kk+".password_policy", vv.PasswordPolicy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// passwordScope keeps the password history of a user, under the prefix of the instance
+func passwordScope(instanceName, addressKey, userKey string) string {
+	return resourcePrefix + instanceName + "/" + addressKey + "/" + userKey
+}
+
+func checkAndUpdateUser(ctx context.Context, host string, port int, vv PostgresUser) (PostgresUser, error) {
 	newVV := vv
-	if err := CheckConnectivity(host, port, vv.UserName, vv.Password, vv.Database); err == nil {
+	if err := CheckConnectivity(ctx, host, port, vv.UserName, vv.Password, vv.Database); err == nil {
 		return newVV, nil
 	}
-	if err := CheckConnectivity(host, port, vv.UserName, vv.OldPassword, vv.Database); err == nil {
+	if err := CheckConnectivity(ctx, host, port, vv.UserName, vv.OldPassword, vv.Database); err == nil {
 		newVV.Password = vv.OldPassword
 		return newVV, nil
 	}
-	if err := CheckConnectivity(host, port, vv.UserName, vv.PendingNewPassword, vv.Database); err == nil {
+	if err := CheckConnectivity(ctx, host, port, vv.UserName, vv.PendingNewPassword, vv.Database); err == nil {
 		newVV.Password = vv.PendingNewPassword
 		newVV.PendingNewPassword = ""
 		return newVV, nil
 	}
-	return struct {
-		UserName           string `json:"user_name"`
-		Password           string `json:"password"`
-		OldPassword        string `json:"old_password"`
-		PendingNewPassword string `json:"pending_new_password"`
-		PasswordExpireAt   int    `json:"password_expire_at"`
-		Database           string `json:"database"`
-	}{UserName: "", Password: "", OldPassword: "", PendingNewPassword: "", PasswordExpireAt: 0, Database: ""}, errors.New("check user failed.")
+	return PostgresUser{}, errors.New("check user failed.")
 }
 
-func CheckExist(id []byte) (*PostgresInstance, bool, error) {
+func CheckExist(ctx context.Context, id []byte) (*PostgresInstance, bool, error) {
 	var result = false
 	var bb []byte
-	err := container.DoTxWithinBucket(namespace, func(bucket *bbolt.Bucket) error {
+	err := container.ViewWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
 		b := bucket.Get(id)
 		if len(b) == 0 {
 			result = false
@@ -276,34 +334,43 @@ func CheckExist(id []byte) (*PostgresInstance, bool, error) {
 	if !result {
 		return nil, false, nil
 	}
-	inst, err := DecAndUnmarshallInstance(bb)
+	inst, err := DecAndUnmarshallInstance(ctx, bb)
 	return inst, result, err
 }
 
-func CheckConnectivityBefore(inst *PostgresInstance) error {
+func CheckConnectivityBefore(ctx context.Context, inst *PostgresInstance) error {
 	for _, v := range inst.AddressList {
 		for u, t := range v.UserMap {
-			if err := CheckConnectivity(v.Host, v.Port, u, t.Password, t.Database); err != nil {
-				return err
+			if err := CheckConnectivity(ctx, v.Host, v.Port, u, t.Password, t.Database); err != nil {
+				return apierr.UnreachableDatabase(address(v.Host, v.Port), err)
 			}
 		}
 	}
 	return nil
 }
 
-func CheckConnectivity(host string, port int, user string, password string, database string) error {
-	tctx, cfn := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cfn()
-	conn, err := pgx.Connect(tctx, fmt.Sprint("host=", host, " port=", port, " connect_timeout=10 user=", user, " password=", password, " database=", database))
+func CheckConnectivity(ctx context.Context, host string, port int, user string, password string, database string) error {
+	ctx, span := tracing.Start(ctx, "pg.check_connectivity", connAttributes(host, port, user, database)...)
+	err := checkConnectivity(ctx, host, port, user, password, database)
+	tracing.End(span, err)
+	metrics.ConnectivityChecks.WithLabelValues(address(host, port), metrics.Result(err)).Inc()
+	return err
+}
+
+func checkConnectivity(ctx context.Context, host string, port int, user string, password string, database string) error {
+	conn, err := connect(ctx, host, port, user, password, database)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		cctx, ccfn := context.WithTimeout(context.Background(), 10*time.Second)
-		defer ccfn()
-		conn.Close(cctx)
-	}()
-	rows, err := conn.Query(context.Background(), "select 1")
+	defer closeConn(conn)
+	_, span := tracing.Start(ctx, "pg.query", append(connAttributes(host, port, user, database), semconv.DBStatementKey.String("select 1"))...)
+	err = selectOne(ctx, conn)
+	tracing.End(span, err)
+	return err
+}
+
+func selectOne(ctx context.Context, conn *pgx.Conn) error {
+	rows, err := conn.Query(ctx, "select 1")
 	if err != nil {
 		return err
 	}
@@ -315,6 +382,37 @@ func CheckConnectivity(host string, port int, user string, password string, data
 	}
 }
 
+func connAttributes(host string, port int, user string, database string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.DBSystemPostgreSQL,
+		semconv.NetPeerNameKey.String(host),
+		semconv.NetPeerPortKey.Int(port),
+		semconv.DBUserKey.String(user),
+		semconv.DBNameKey.String(database),
+	}
+}
+
+// connect opens a connection within 10 seconds, traced as pg.connect
+func connect(ctx context.Context, host string, port int, user string, password string, database string) (*pgx.Conn, error) {
+	tctx, cfn := context.WithTimeout(ctx, 10*time.Second)
+	defer cfn()
+	tctx, span := tracing.Start(tctx, "pg.connect", connAttributes(host, port, user, database)...)
+	logging.FromContext(ctx).Debug("connect to database", logging.F("address", address(host, port)), logging.F("user", user), logging.F("database", database))
+	conn, err := pgx.Connect(tctx, fmt.Sprint("host=", host, " port=", port, " connect_timeout=10 user=", user, " password=", password, " database=", database))
+	tracing.End(span, err)
+	return conn, err
+}
+
+func closeConn(conn *pgx.Conn) {
+	cctx, ccfn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ccfn()
+	conn.Close(cctx)
+}
+
+func address(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 func MakeAvailableInstanceNameKey(instanceName string) []byte {
 	return append(append([]byte{}, availableInstancePrefix...), []byte(instanceName)...)
 }
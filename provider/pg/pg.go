@@ -3,7 +3,13 @@ package pg
 import (
 	"net/http"
 
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/auth/acl"
 	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+	"goimport.moetang.info/nekoq-security/wrapping"
 
 	scaffold "github.com/moetang/webapp-scaffold"
 
@@ -13,6 +19,8 @@ import (
 const (
 	moduleName = "postgres"
 	namespace  = "database.postgres"
+
+	resourcePrefix = "pg/"
 )
 
 var container *config.NekoQSecurityContainer
@@ -22,40 +30,86 @@ type pgModuleType struct {
 
 func (p pgModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
 	container = c
+	startScheduler.Do(func() {
+		go HealthCheckJob()
+	})
 	return nil
 }
 
 func (p pgModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
-	g := scaffold.GetGin().Group("/module/database/postgres")
-	// get instances
-	g.GET("/instances", wrapUnlock(ListAllInstances))
-	// create instance
-	g.POST("/instance", wrapUnlock(CreateInstance))
-	// get instance
-	g.GET("/instance/:id", wrapUnlock(GetInstanceById))
-	// delete instance
-	g.DELETE("/instance/:id", wrapUnlock(DeleteInstanceById))
-	// update instance, without replacing existing address
-	g.PUT("/instance/:id", wrapUnlock(UpdateInstanceById))
-
-	// 1. get credential
-	g.GET("/instance_credential/view/:id", wrapUnlock(GetCredentialById))
-	// 2. rotate credential
-	g.POST("/instance_credential/rotate/:id", wrapUnlock(RotateCredentialById))
+	g := openapi.NewGroup(scaffold.GetGin(), "postgres", "/pg", config.RequireUnsealed(), logInstance)
+	// every handler asks the acl evaluator before acting, see authorize
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/instances", Legacy: "/module/database/postgres/instances", Id: "listPgInstances",
+		Summary: "instances the token can list, by storage key", Result: openapi.Map(openapi.RefTo("PgInstance"))},
+		auth.Authenticated(), ListAllInstances)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/instances", Legacy: "/module/database/postgres/instance", Id: "createPgInstance",
+		Summary: "create an instance, every user must be able to connect", Body: createInstanceSchema},
+		auth.Authenticated(), CreateInstance)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/instances/:id", Legacy: "/module/database/postgres/instance/:id", Id: "getPgInstance",
+		Summary: "read an instance without passwords", PathParams: instanceIdParam, Result: openapi.RefTo("PgInstance")},
+		auth.Authenticated(), GetInstanceById)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/instances/:id", Legacy: "/module/database/postgres/instance/:id", Id: "deletePgInstance",
+		Summary: "delete an instance", PathParams: instanceIdParam},
+		auth.Authenticated(), DeleteInstanceById)
+	g.Handle(&openapi.Operation{Method: http.MethodPut, Path: "/instances/:id", Legacy: "/module/database/postgres/instance/:id", Id: "updatePgInstance",
+		Summary: "update an instance, without replacing existing addresses", PathParams: instanceIdParam, Body: updateInstanceSchema},
+		auth.Authenticated(), UpdateInstanceById)
+
+	credentials := &openapi.Operation{Method: http.MethodGet, Path: "/instances/:id/credentials", Legacy: "/module/database/postgres/instance_credential/view/:id", Id: "getPgCredentials",
+		Summary: "passwords of the addresses the token can view, with lease=true under a new lease. With an encryption key, the jwe of the result, " +
+			"with wrap_ttl, the wrap_info of the result instead",
+		PathParams: instanceIdParam, Query: credentialQuery, Result: credentialSchema}
+	// encrypted before it is wrapped, the wrapped response is the jwe
+	g.Handle(credentials, auth.Authenticated(), wrapping.Wrappable(), auth.EncryptedResponse(), GetCredentialById)
+	// reads may issue leases, which only the leader can write
+	config.RegisterLeaderRead(openapi.V1Prefix+"/pg"+credentials.Path, credentials.Legacy)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/instances/:id/credentials/rotate", Legacy: "/module/database/postgres/instance_credential/rotate/:id", Id: "rotatePgCredentials",
+		Summary: "rotate the passwords of every user of the instance", PathParams: instanceIdParam},
+		auth.Authenticated(), RotateCredentialById)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/instances/:id/check-out", Id: "checkOutPgUser",
+		Summary: "check out a free user of a Library instance, under a new lease. With an encryption key, the jwe of the result, " +
+			"with wrap_ttl, the wrap_info of the result instead",
+		PathParams: instanceIdParam, Query: wrapping.Query, Body: checkOutSchema, BodyOptional: true, Result: credentialSchema},
+		auth.Authenticated(), wrapping.Wrappable(), auth.EncryptedResponse(), CheckOutUser)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/instances/:id/check-in", Id: "checkInPgUser",
+		Summary: "check in a user, its password is rotated", PathParams: instanceIdParam, Body: checkInSchema},
+		auth.Authenticated(), CheckInUser)
 
 	return nil
 }
 
-func wrapUnlock(fn func(ctx *gin.Context)) func(ctx *gin.Context) {
-	return func(ctx *gin.Context) {
-		if !container.MasterUnlock {
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"status":  -1,
-				"message": "nekoq-security is not unlocked",
-			})
-		}
-		fn(ctx)
+// logInstance adds the instance of the path to the logger of the request
+func logInstance(ctx *gin.Context) {
+	if id := ctx.Param("id"); len(id) > 0 {
+		logging.Annotate(ctx, logging.F("instance", id))
+	}
+}
+
+// allowed asks the acl evaluator whether the token of the request can do op on the instance,
+// or on one of its addresses when addressRole is not empty
+func allowed(ctx *gin.Context, op string, inst *PostgresInstance, addressRole string) (bool, error) {
+	return acl.Authorize(auth.CurrentToken(ctx), &acl.Request{
+		Operation:   op,
+		Resource:    resourcePrefix + inst.InstanceName,
+		Instance:    inst.InstanceName,
+		Labels:      inst.Labels,
+		AddressRole: addressRole,
+	})
+}
+
+// authorize writes the error response and returns false if the operation is not allowed
+func authorize(ctx *gin.Context, op string, inst *PostgresInstance, addressRole string) bool {
+	ok, err := allowed(ctx, op, inst, addressRole)
+	if err != nil {
+		logging.FromContext(ctx).Error("authorize error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return false
 	}
+	if !ok {
+		apierr.Abort(ctx, apierr.Forbidden())
+		return false
+	}
+	return true
 }
 
 var pgModule config.Module = pgModuleType{}
@@ -64,27 +118,64 @@ func init() {
 	config.RegisterModuleNamespace(moduleName, namespace, pgModule)
 }
 
+// PostgresUser is a user of an address, with its passwords while a rotation is in progress
+type PostgresUser struct {
+	UserName           string `json:"user_name"`
+	Password           string `json:"password"`             // current password
+	OldPassword        string `json:"old_password"`         // old password
+	PendingNewPassword string `json:"pending_new_password"` // new password
+	PasswordExpireAt   int    `json:"password_expire_at"`
+	Database           string `json:"database"`
+	PasswordPolicy     string `json:"password_policy"` // name, the policy of the instance when empty
+	RotatedAt          int    `json:"rotated_at"`      // unix time of the last rotation
+}
+
+// withoutPasswords returns the user for the views of the metadata
+func (u PostgresUser) withoutPasswords() PostgresUser {
+	u.Password = ""
+	u.OldPassword = ""
+	u.PendingNewPassword = ""
+	return u
+}
+
+// PostgresAddress is a server of an instance and the users managed on it, by key
+type PostgresAddress struct {
+	HostName string                  `json:"host_name"`
+	Host     string                  `json:"host"`
+	Port     int                     `json:"port"`
+	Role     string                  `json:"role"`
+	UserMap  map[string]PostgresUser `json:"user_map"`
+}
+
 type PostgresInstance struct {
-	InstanceName string `json:"instance_name"`
-	Description  string `json:"description"`
-	AddressList  map[string]struct {
-		HostName string `json:"host_name"`
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		Role     string `json:"role"`
-		UserMap  map[string]struct {
-			UserName           string `json:"user_name"`
-			Password           string `json:"password"`             // current password
-			OldPassword        string `json:"old_password"`         // old password
-			PendingNewPassword string `json:"pending_new_password"` // new password
-			PasswordExpireAt   int    `json:"password_expire_at"`
-			Database           string `json:"database"`
-		} `json:"user_map"`
-	} `json:"address_list"`
-	Status struct {
+	InstanceName string                     `json:"instance_name"`
+	Description  string                     `json:"description"`
+	Labels       map[string]string          `json:"labels"`
+	AddressList  map[string]PostgresAddress `json:"address_list"`
+	Status       struct {
 		OnlineHealth string `json:"online_health"`
 	} `json:"status"`
 	InstanceCredentialPolicy struct {
-		Type string `json:"type"` // e.g. Default, OneTimeUser
+		Type        string `json:"type"`          // Default, OneTimeUser or Library
+		LeaseTTL    int64  `json:"lease_ttl"`     // seconds, of the leases of credential reads
+		LeaseMaxTTL int64  `json:"lease_max_ttl"` // seconds, renewals included
+		// OneTimeUser: the user of an address which runs the statements
+		AdminAddress         string   `json:"admin_address"`
+		AdminUser            string   `json:"admin_user"`
+		CreationStatements   []string `json:"creation_statements"`   // templates of {{name}}, {{password}}, {{expiration}}
+		RevocationStatements []string `json:"revocation_statements"` // templates of {{name}}
+		PasswordPolicy       string   `json:"password_policy"`       // name, of the default password policy when empty
 	} `json:"instance_credential_policy"`
+	// rotations of the users by the scheduler, none without interval or cron
+	RotationPolicy struct {
+		Interval int64  `json:"interval"` // seconds between the rotations of a user
+		Cron     string `json:"cron"`     // instead of interval: minute hour day-of-month month day-of-week
+		// rotations only start within the window, 15:04 of the time zone, overnight when end is before start
+		MaintenanceWindow struct {
+			Start string `json:"start"`
+			End   string `json:"end"`
+		} `json:"maintenance_window"`
+		Jitter   int64  `json:"jitter"`    // seconds, rotations are delayed by at random up to
+		TimeZone string `json:"time_zone"` // of cron and the window, UTC when empty
+	} `json:"rotation_policy"`
 }
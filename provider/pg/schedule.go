@@ -1,6 +1,321 @@
 package pg
 
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"sync"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/alg/cron"
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/metrics"
+	"goimport.moetang.info/nekoq-security/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// interval of the scans for due rotations, the granularity of cron expressions
+	scheduleInterval = time.Minute
+	// rotations more often than this would hardly let clients read the passwords
+	minRotationInterval = time.Hour
+
+	windowLayout = "15:04"
+)
+
+var startScheduler sync.Once
+
+var (
+	instanceLocksMu sync.Mutex
+	instanceLocks   = make(map[string]*sync.Mutex)
+)
+
+// lockInstance serializes the rotations of the instance, and reads it again once locked since a rotation
+// holding the lock changed its passwords. The caller unlocks when it returns no error.
+func lockInstance(ctx context.Context, inst *PostgresInstance) (func(), error) {
+	instanceLocksMu.Lock()
+	l, ok := instanceLocks[inst.InstanceName]
+	if !ok {
+		l = new(sync.Mutex)
+		instanceLocks[inst.InstanceName] = l
+	}
+	instanceLocksMu.Unlock()
+
+	l.Lock()
+	cur, exist, err := CheckExist(ctx, MakeAvailableInstanceNameKey(inst.InstanceName))
+	if err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	if !exist {
+		l.Unlock()
+		return nil, apierr.NotFound("instance", inst.InstanceName)
+	}
+	*inst = *cur
+	return l.Unlock, nil
+}
+
+func (p *PostgresInstance) rotationScheduled() bool {
+	policy := p.RotationPolicy
+	return policy.Interval > 0 || len(policy.Cron) > 0
+}
+
+func (p *PostgresInstance) hasMaintenanceWindow() bool {
+	return len(p.RotationPolicy.MaintenanceWindow.Start) > 0
+}
+
+// validateRotationPolicy checks the policy can schedule rotations
+func (p *PostgresInstance) validateRotationPolicy() error {
+	policy := p.RotationPolicy
+	if _, err := time.LoadLocation(policy.TimeZone); err != nil {
+		return apierr.InvalidField("rotation_policy.time_zone", "unknown time zone")
+	}
+	if policy.Interval > 0 && len(policy.Cron) > 0 {
+		return apierr.InvalidField("rotation_policy.cron", "either interval or cron")
+	}
+	if policy.Interval < 0 || (policy.Interval > 0 && time.Duration(policy.Interval)*time.Second < minRotationInterval) {
+		return apierr.InvalidField("rotation_policy.interval", "interval must be at least 3600 seconds")
+	}
+	if len(policy.Cron) > 0 {
+		s, err := cron.Parse(policy.Cron)
+		if err != nil {
+			return apierr.InvalidField("rotation_policy.cron", "invalid cron expression: "+err.Error())
+		}
+		if _, err := s.Next(time.Now()); err != nil {
+			return apierr.InvalidField("rotation_policy.cron", "invalid cron expression: "+err.Error())
+		}
+	}
+	if policy.Jitter < 0 {
+		return apierr.InvalidField("rotation_policy.jitter", "jitter cannot be negative")
+	}
+	w := policy.MaintenanceWindow
+	if len(w.Start) == 0 && len(w.End) == 0 {
+		return nil
+	}
+	start, err1 := time.Parse(windowLayout, w.Start)
+	end, err2 := time.Parse(windowLayout, w.End)
+	if err1 != nil || err2 != nil {
+		return apierr.InvalidField("rotation_policy.maintenance_window", "start and end must be HH:MM")
+	}
+	if start.Equal(end) {
+		return apierr.InvalidField("rotation_policy.maintenance_window", "start and end cannot be the same")
+	}
+	return nil
+}
+
+func (p *PostgresInstance) rotationLocation() *time.Location {
+	loc, err := time.LoadLocation(p.RotationPolicy.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// minutes of the day, of a valid window
+func windowMinutes(v string) int {
+	t, _ := time.Parse(windowLayout, v)
+	return t.Hour()*60 + t.Minute()
+}
+
+func (p *PostgresInstance) inMaintenanceWindow(t time.Time) bool {
+	if !p.hasMaintenanceWindow() {
+		return true
+	}
+	t = t.In(p.rotationLocation())
+	m := t.Hour()*60 + t.Minute()
+	start, end := windowMinutes(p.RotationPolicy.MaintenanceWindow.Start), windowMinutes(p.RotationPolicy.MaintenanceWindow.End)
+	if start < end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+// nextMaintenanceWindow returns t within the window, or the next start of the window
+func (p *PostgresInstance) nextMaintenanceWindow(t time.Time) time.Time {
+	if p.inMaintenanceWindow(t) {
+		return t
+	}
+	t = t.In(p.rotationLocation())
+	start := windowMinutes(p.RotationPolicy.MaintenanceWindow.Start)
+	y, m, d := t.Date()
+	next := time.Date(y, m, d, start/60, start%60, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(y, m, d+1, start/60, start%60, 0, 0, t.Location())
+	}
+	return next
+}
+
+// nextRotation returns when the password set at last is due, delayed by jitter and moved into the maintenance window
+func (p *PostgresInstance) nextRotation(last time.Time, jitter time.Duration) (time.Time, error) {
+	policy := p.RotationPolicy
+	var next time.Time
+	if len(policy.Cron) > 0 {
+		s, err := cron.Parse(policy.Cron)
+		if err != nil {
+			return next, err
+		}
+		if next, err = s.Next(last.In(p.rotationLocation())); err != nil {
+			return next, err
+		}
+	} else {
+		next = last.Add(time.Duration(policy.Interval) * time.Second)
+	}
+	return p.nextMaintenanceWindow(next.Add(jitter)), nil
+}
+
+func (p *PostgresInstance) randomJitter() time.Duration {
+	if p.RotationPolicy.Jitter <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(p.RotationPolicy.Jitter))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n.Int64()) * time.Second
+}
+
+// scheduleRotation returns the password_expire_at of a password set at last, 0 without a rotation policy
+func (p *PostgresInstance) scheduleRotation(last time.Time) int {
+	if !p.rotationScheduled() {
+		return 0
+	}
+	next, err := p.nextRotation(last, p.randomJitter())
+	if err != nil {
+		logging.Error("schedule rotation error", logging.F("instance", p.InstanceName), logging.Err(err))
+		return 0
+	}
+	return int(next.Unix())
+}
+
+// unscheduleRotations lets the scheduler compute the rotations of every user again, after the policy changed
+func (p *PostgresInstance) unscheduleRotations() {
+	for _, v := range p.AddressList {
+		for kk, vv := range v.UserMap {
+			vv.PasswordExpireAt = 0
+			v.UserMap[kk] = vv
+		}
+	}
+}
+
+// HealthCheckJob rotates the passwords of the users which are due by the rotation policies of their instances.
+// Like the lease manager it runs on the leader once unsealed, so the rotations missed meanwhile are done then.
 func HealthCheckJob() {
-	//TODO 1. check health
-	//TODO 2. update password
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !config.IsUnsealed() || !container.IsLeader() {
+			continue
+		}
+		if err := rotateDue(time.Now()); err != nil {
+			logging.Error("scheduled rotations error", logging.Err(err))
+		}
+	}
+}
+
+func rotateDue(now time.Time) error {
+	var instances []*PostgresInstance
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(availableInstancePrefix, func(k, v []byte) error {
+			inst, err := DecAndUnmarshallInstance(context.Background(), v)
+			if err != nil {
+				return err
+			}
+			if inst.rotationScheduled() {
+				instances = append(instances, inst)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, inst := range instances {
+		ctx := logging.WithContext(context.Background(), logging.F("instance", inst.InstanceName))
+		if err := rotateDueUsers(ctx, inst, now); err != nil {
+			logging.FromContext(ctx).Error("scheduled rotation error", logging.Err(err))
+		}
+	}
+	return nil
+}
+
+// rotateDueUsers schedules the users without a rotation time, and rotates the users which are due
+// within the maintenance window. Checked out users are rotated by their check-in.
+func rotateDueUsers(ctx context.Context, inst *PostgresInstance, now time.Time) error {
+	// a check-out in between would hand out the password being rotated
+	if inst.isLibrary() {
+		libraryLock.Lock()
+		defer libraryLock.Unlock()
+	}
+	unlock, err := lockInstance(ctx, inst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !inst.rotationScheduled() {
+		return nil
+	}
+	taken := make(map[string]bool)
+	if inst.isLibrary() {
+		if taken, err = checkedOut(inst.InstanceName); err != nil {
+			return err
+		}
+	}
+
+	due := make(map[string]bool)
+	scheduled := false
+	total := 0
+	for k, v := range inst.AddressList {
+		for kk, vv := range v.UserMap {
+			total++
+			if vv.PasswordExpireAt == 0 {
+				last := now
+				if vv.RotatedAt > 0 {
+					last = time.Unix(int64(vv.RotatedAt), 0)
+				}
+				vv.PasswordExpireAt = inst.scheduleRotation(last)
+				v.UserMap[kk] = vv
+				scheduled = true
+				continue
+			}
+			if !taken[k+"/"+kk] && int64(vv.PasswordExpireAt) <= now.Unix() {
+				due[k+"/"+kk] = true
+			}
+		}
+	}
+	if scheduled {
+		b, err := MarshallAndEncInstance(ctx, inst)
+		if err != nil {
+			return err
+		}
+		err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+			return bucket.Put(MakeAvailableInstanceNameKey(inst.InstanceName), b)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(due) == 0 || !inst.inMaintenanceWindow(now) {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "pg.rotate", attribute.String("pg.instance", inst.InstanceName))
+	err = rotateInstancePassword(ctx, inst, func(addressKey, userKey string) bool {
+		return due[addressKey+"/"+userKey]
+	})
+	tracing.End(span, err)
+	metrics.Rotations.WithLabelValues(inst.InstanceName, metrics.Result(err)).Inc()
+	if err != nil {
+		return err
+	}
+	if len(due) == total {
+		if err := markPasswordsSet(ctx, inst.InstanceName); err != nil {
+			logging.FromContext(ctx).Error("markPasswordsSet error", logging.Err(err))
+		}
+	}
+	publish(EventRotated, inst)
+	logging.FromContext(ctx).Info("scheduled rotation done", logging.F("users", len(due)))
+	return nil
 }
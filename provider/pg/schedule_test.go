@@ -0,0 +1,92 @@
+package pg
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+)
+
+func instanceOf(t *testing.T, body string) *PostgresInstance {
+	inst := new(PostgresInstance)
+	if err := json.Unmarshal([]byte(body), inst); err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+func TestValidateRotationPolicy(t *testing.T) {
+	cases := map[string]apierr.Code{
+		`{}`:                                                                "",
+		`{"rotation_policy":{"interval":86400}}`:                            "",
+		`{"rotation_policy":{"interval":60}}`:                               apierr.CodeValidationFailed,
+		`{"rotation_policy":{"cron":"0 3 * * 0"}}`:                          "",
+		`{"rotation_policy":{"cron":"0 3 * *"}}`:                            apierr.CodeValidationFailed,
+		`{"rotation_policy":{"cron":"0 0 31 2 *"}}`:                         apierr.CodeValidationFailed,
+		`{"rotation_policy":{"interval":86400,"cron":"0 3 * * 0"}}`:         apierr.CodeValidationFailed,
+		`{"rotation_policy":{"interval":86400,"jitter":-1}}`:                apierr.CodeValidationFailed,
+		`{"rotation_policy":{"interval":86400,"time_zone":"Mars/Olympus"}}`: apierr.CodeValidationFailed,
+		`{"rotation_policy":{"interval":86400,"maintenance_window":{"start":"22:00","end":"02:00"}}}`: "",
+		`{"rotation_policy":{"interval":86400,"maintenance_window":{"start":"22:00"}}}`:               apierr.CodeValidationFailed,
+		`{"rotation_policy":{"interval":86400,"maintenance_window":{"start":"22:00","end":"22:00"}}}`: apierr.CodeValidationFailed,
+	}
+	for body, expected := range cases {
+		err := instanceOf(t, body).validateRotationPolicy()
+		if (err == nil && expected != "") || (err != nil && apierr.CodeOf(err) != expected) {
+			t.Error(body, err)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	inst := instanceOf(t, `{"rotation_policy":{"interval":86400,"time_zone":"UTC",
+		"maintenance_window":{"start":"22:00","end":"02:00"}}}`)
+	day := func(h, m int) time.Time {
+		return time.Date(2026, 10, 19, h, m, 0, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		t, next time.Time
+	}{
+		{day(23, 0), day(23, 0)},
+		{day(1, 59), day(1, 59)},
+		{day(2, 0), day(22, 0)},
+		{day(12, 0), day(22, 0)},
+		{day(22, 0), day(22, 0)},
+	} {
+		if next := inst.nextMaintenanceWindow(c.t); !next.Equal(c.next) {
+			t.Error(c.t, next)
+		}
+	}
+
+	inst = instanceOf(t, `{"rotation_policy":{"interval":86400,"maintenance_window":{"start":"02:00","end":"04:00"}}}`)
+	if next := inst.nextMaintenanceWindow(day(5, 0)); !next.Equal(time.Date(2026, 10, 20, 2, 0, 0, 0, time.UTC)) {
+		t.Error(next)
+	}
+}
+
+func TestNextRotation(t *testing.T) {
+	last := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)
+	for body, expected := range map[string]time.Time{
+		`{"rotation_policy":{"interval":86400}}`:                                                      time.Date(2026, 10, 20, 10, 30, 0, 0, time.UTC),
+		`{"rotation_policy":{"cron":"0 3 * * *"}}`:                                                    time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC),
+		`{"rotation_policy":{"cron":"0 3 * * *","time_zone":"Asia/Shanghai"}}`:                        time.Date(2026, 10, 19, 19, 0, 0, 0, time.UTC),
+		`{"rotation_policy":{"interval":86400,"maintenance_window":{"start":"01:00","end":"05:00"}}}`: time.Date(2026, 10, 21, 1, 0, 0, 0, time.UTC),
+	} {
+		inst := instanceOf(t, body)
+		if err := inst.validateRotationPolicy(); err != nil {
+			t.Fatal(body, err)
+		}
+		next, err := inst.nextRotation(last, 0)
+		if err != nil || !next.Equal(expected) {
+			t.Error(body, next, err)
+		}
+	}
+
+	// the jitter delays the rotation, which still starts within the window
+	inst := instanceOf(t, `{"rotation_policy":{"interval":86400,"maintenance_window":{"start":"10:00","end":"11:00"}}}`)
+	next, err := inst.nextRotation(last, 2*time.Hour)
+	if err != nil || !next.Equal(time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC)) {
+		t.Error(next, err)
+	}
+}
@@ -0,0 +1,97 @@
+package pg
+
+import (
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/openapi"
+	"goimport.moetang.info/nekoq-security/wrapping"
+)
+
+const (
+	instanceNamePattern = "^[A-Za-z0-9_.-]+$"
+	windowPattern       = "^(([01][0-9]|2[0-3]):[0-5][0-9])?$"
+)
+
+func userSchema(withPasswords bool) *openapi.Schema {
+	s := openapi.Object(map[string]*openapi.Schema{
+		"user_name":          openapi.String().NonEmpty(),
+		"password_expire_at": openapi.Integer(),
+		"database":           openapi.String().NonEmpty(),
+		"password_policy":    openapi.String().Describe("name, the password policy of the instance when empty"),
+		"rotated_at":         openapi.Integer().Describe("unix time of the last rotation"),
+	})
+	if withPasswords {
+		s.Properties["password"] = openapi.String().Describe("current password")
+		s.Properties["old_password"] = openapi.String()
+		s.Properties["pending_new_password"] = openapi.String()
+	}
+	return s
+}
+
+func addressSchema(withPasswords bool) *openapi.Schema {
+	return openapi.Object(map[string]*openapi.Schema{
+		"host_name": openapi.String(),
+		"host":      openapi.String().NonEmpty(),
+		"port":      openapi.Integer().Range(1, 65535),
+		"role":      openapi.String().Describe("e.g. master or replica"),
+		"user_map":  openapi.Map(userSchema(withPasswords)),
+	}).Require("host", "port")
+}
+
+func instanceSchema(withPasswords bool) *openapi.Schema {
+	return openapi.Object(map[string]*openapi.Schema{
+		"instance_name": openapi.String().Match(instanceNamePattern),
+		"description":   openapi.String(),
+		"labels":        openapi.Map(openapi.String()),
+		"address_list":  openapi.Map(addressSchema(withPasswords)),
+		"status": openapi.Object(map[string]*openapi.Schema{
+			"online_health": openapi.String(),
+		}),
+		"instance_credential_policy": openapi.Object(map[string]*openapi.Schema{
+			"type":          openapi.String().Describe("Default, OneTimeUser for a new role on every credential read, or Library for users checked out one holder at a time"),
+			"lease_ttl":     auth.TTLSchema(),
+			"lease_max_ttl": auth.TTLSchema(),
+			"admin_address": openapi.String().Describe("OneTimeUser: key of the address_list entry the roles are created on"),
+			"admin_user":    openapi.String().Describe("OneTimeUser: key of the user_map entry which creates and drops the roles"),
+			"creation_statements": openapi.Array(openapi.String().NonEmpty()).
+				Describe("run in one transaction, {{name}}, {{password}} and {{expiration}} are replaced"),
+			"revocation_statements": openapi.Array(openapi.String().NonEmpty()).
+				Describe("run in one transaction when the lease ends, {{name}} is replaced"),
+			"password_policy": openapi.String().Describe("name, the default password policy when empty"),
+		}),
+		"rotation_policy": openapi.Object(map[string]*openapi.Schema{
+			"interval": openapi.Integer().Min(0).Describe("seconds between the rotations of a user, at least 3600"),
+			"cron":     openapi.String().Describe("instead of interval: minute hour day-of-month month day-of-week"),
+			"maintenance_window": openapi.Object(map[string]*openapi.Schema{
+				"start": openapi.String().Match(windowPattern),
+				"end":   openapi.String().Match(windowPattern),
+			}).Describe("rotations only start within the window, overnight when end is before start"),
+			"jitter":    openapi.Integer().Min(0).Describe("seconds, rotations are delayed by at random up to"),
+			"time_zone": openapi.String().Describe("of cron and the window, e.g. Europe/Berlin, UTC when empty"),
+		}),
+	})
+}
+
+func init() {
+	openapi.RegisterSchema("PgInstance", instanceSchema(false).Describe("instance without passwords"))
+}
+
+var (
+	createInstanceSchema = instanceSchema(true).Require("instance_name")
+	// the name is taken from the path
+	updateInstanceSchema = instanceSchema(true)
+	credentialSchema     = openapi.Object(map[string]*openapi.Schema{
+		"address_list":   openapi.Map(addressSchema(true)),
+		"lease_id":       openapi.String(),
+		"lease_duration": openapi.Integer().Describe("seconds left"),
+		"renewable":      openapi.Boolean(),
+	})
+	checkOutSchema = openapi.Object(map[string]*openapi.Schema{
+		"ttl": auth.TTLSchema(),
+	})
+	checkInSchema = openapi.Object(map[string]*openapi.Schema{
+		"lease_id": openapi.String().NonEmpty(),
+	}).Require("lease_id")
+	instanceIdParam = map[string]*openapi.Schema{"id": openapi.String().Match(instanceNamePattern)}
+	credentialQuery = append([]*openapi.Parameter{{Name: LeaseQueryName, Description: "issue a lease, the passwords are rotated once the last lease ended",
+		Schema: openapi.Boolean()}}, wrapping.Query...)
+)
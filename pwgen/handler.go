@@ -0,0 +1,124 @@
+package pwgen
+
+import (
+	"net/http"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+func initRoutes(e *gin.Engine) {
+	g := openapi.NewGroup(e, "password policy", "/sys/password-policies", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "", Id: "listPasswordPolicies",
+		Summary: "list password policies", Result: openapi.Array(openapi.RefTo("PasswordPolicy"))},
+		auth.RequireManager(), ListPolicies)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "", Id: "putPasswordPolicy",
+		Summary: "create or replace a password policy", Body: openapi.RefTo("PasswordPolicy")},
+		auth.RequireManager(), PutPolicy)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/:name", Id: "getPasswordPolicy",
+		Summary: "read a password policy, the built-in one for default unless it is replaced", PathParams: policyNameParam,
+		Result: openapi.RefTo("PasswordPolicy")},
+		auth.RequireManager(), GetPolicy)
+	g.Handle(&openapi.Operation{Method: http.MethodDelete, Path: "/:name", Id: "deletePasswordPolicy",
+		Summary: "delete a password policy", PathParams: policyNameParam},
+		auth.RequireManager(), DeletePolicy)
+	g.Handle(&openapi.Operation{Method: http.MethodGet, Path: "/:name/generate", Id: "generatePassword",
+		Summary: "generate a password of the policy, without history", PathParams: policyNameParam,
+		Result: openapi.Object(map[string]*openapi.Schema{"password": openapi.String()})},
+		auth.Authenticated(), GeneratePassword)
+}
+
+func ListPolicies(ctx *gin.Context) {
+	policies, err := listPolicies()
+	if err != nil {
+		logging.FromContext(ctx).Error("listPolicies error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": policies,
+	})
+}
+
+func PutPolicy(ctx *gin.Context) {
+	p := new(Policy)
+	if err := ctx.ShouldBindJSON(p); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	if err := p.Validate(); err != nil {
+		apierr.Abort(ctx, apierr.InvalidField("policy", "invalid password policy: "+err.Error()))
+		return
+	}
+	if err := savePolicy(ctx.Request.Context(), p); err != nil {
+		logging.FromContext(ctx).Error("savePolicy error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+// loadPolicy writes the error response and returns nil when the policy cannot be loaded
+func loadPolicy(ctx *gin.Context) *Policy {
+	p, err := LoadPolicy(ctx.Param("name"))
+	if err == ErrPolicyNotFound {
+		apierr.Abort(ctx, apierr.NotFound("password policy", ctx.Param("name")))
+		return nil
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("LoadPolicy error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return nil
+	}
+	return p
+}
+
+func GetPolicy(ctx *gin.Context) {
+	p := loadPolicy(ctx)
+	if p == nil {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": p,
+	})
+}
+
+func DeletePolicy(ctx *gin.Context) {
+	if err := deletePolicy(ctx.Request.Context(), ctx.Param("name")); err != nil {
+		logging.FromContext(ctx).Error("deletePolicy error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":  0,
+		"message": "success",
+	})
+}
+
+// GeneratePassword is for trying a policy out, the password is not used anywhere
+func GeneratePassword(ctx *gin.Context) {
+	p := loadPolicy(ctx)
+	if p == nil {
+		return
+	}
+	password, err := p.Generate()
+	if err != nil {
+		logging.FromContext(ctx).Error("generate password error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": gin.H{"password": password},
+	})
+}
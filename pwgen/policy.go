@@ -0,0 +1,204 @@
+package pwgen
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const (
+	ModeCharacters = "characters"
+	ModeDiceware   = "diceware"
+
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+
+	// passwords are written into connection strings and sql literals as they are
+	forbiddenChars = " \t\r\n'\"\\"
+	ambiguousChars = "0Oo1lI|"
+)
+
+var classChars = map[string]string{
+	ClassLower:  "abcdefghijklmnopqrstuvwxyz",
+	ClassUpper:  "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	ClassDigit:  "0123456789",
+	ClassSymbol: "!#$%&()*+,-./:;<=>?@[]^_{|}~",
+}
+
+// DefaultPolicy makes 32 letters and digits, of every class
+var DefaultPolicy = Policy{
+	Name:   DefaultPolicyName,
+	Length: 32,
+	Classes: []CharClass{
+		{Class: ClassLower, Min: 1},
+		{Class: ClassUpper, Min: 1},
+		{Class: ClassDigit, Min: 1},
+	},
+}
+
+// EFF large wordlist, https://www.eff.org/dice, under CC BY 3.0 US
+//
+//go:embed eff_large_wordlist.txt
+var wordlist string
+
+var words = strings.Fields(wordlist)
+
+// CharClass is a class of characters a password is made of, with the minimum count of them
+type CharClass struct {
+	Class string `json:"class"`           // lower, upper, digit or symbol
+	Chars string `json:"chars,omitempty"` // instead of the characters of the class
+	Min   int    `json:"min"`
+}
+
+// Policy of the passwords generated for rotations and new users
+type Policy struct {
+	Name string `json:"name"`
+	Mode string `json:"mode,omitempty"` // characters by default, or diceware
+	// characters
+	Length           int         `json:"length,omitempty"`
+	Classes          []CharClass `json:"classes,omitempty"`
+	ExcludeAmbiguous bool        `json:"exclude_ambiguous,omitempty"` // of 0Oo1lI|
+	Exclude          string      `json:"exclude,omitempty"`
+	// diceware
+	Words     int    `json:"words,omitempty"`
+	Separator string `json:"separator,omitempty"` // - by default
+	// passwords of a user which are not generated again
+	History int `json:"history,omitempty"`
+}
+
+func (p *Policy) excluded(c rune) bool {
+	return strings.ContainsRune(forbiddenChars, c) || strings.ContainsRune(p.Exclude, c) ||
+		(p.ExcludeAmbiguous && strings.ContainsRune(ambiguousChars, c))
+}
+
+// alphabet of the class, without the excluded characters
+func (p *Policy) alphabet(c CharClass) []rune {
+	chars := c.Chars
+	if len(chars) == 0 {
+		chars = classChars[c.Class]
+	}
+	var r []rune
+	seen := make(map[rune]bool)
+	for _, v := range chars {
+		if !p.excluded(v) && !seen[v] {
+			seen[v] = true
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func (p *Policy) separator() string {
+	if len(p.Separator) == 0 {
+		return "-"
+	}
+	return p.Separator
+}
+
+// Validate returns the reason the policy cannot generate passwords
+func (p *Policy) Validate() error {
+	if p.History < 0 || p.History > 100 {
+		return errors.New("history must be between 0 and 100")
+	}
+	switch p.Mode {
+	case ModeDiceware:
+		if p.Words < 4 || p.Words > 20 {
+			return errors.New("words must be between 4 and 20")
+		}
+		if strings.ContainsAny(p.Separator, forbiddenChars) {
+			return errors.New("separator cannot contain whitespaces, quotes or backslashes")
+		}
+		return nil
+	case "", ModeCharacters:
+	default:
+		return errors.New("unknown mode")
+	}
+	if p.Length < 8 || p.Length > 256 {
+		return errors.New("length must be between 8 and 256")
+	}
+	if len(p.Classes) == 0 {
+		return errors.New("at least one class is required")
+	}
+	total := 0
+	for _, c := range p.Classes {
+		if _, ok := classChars[c.Class]; !ok && len(c.Chars) == 0 {
+			return errors.New("unknown class: " + c.Class)
+		}
+		if strings.ContainsAny(c.Chars, forbiddenChars) {
+			return errors.New("chars cannot contain whitespaces, quotes or backslashes")
+		}
+		if c.Min < 0 {
+			return errors.New("min cannot be negative")
+		}
+		if len(p.alphabet(c)) == 0 {
+			return errors.New("every character of class " + c.Class + " is excluded")
+		}
+		total += c.Min
+	}
+	if total > p.Length {
+		return errors.New("the min counts of the classes exceed the length")
+	}
+	return nil
+}
+
+func randomInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64()), nil
+}
+
+// Generate makes a password of the policy, which must be valid
+func (p *Policy) Generate() (string, error) {
+	if p.Mode == ModeDiceware {
+		r := make([]string, p.Words)
+		for i := range r {
+			n, err := randomInt(len(words))
+			if err != nil {
+				return "", err
+			}
+			r[i] = words[n]
+		}
+		return strings.Join(r, p.separator()), nil
+	}
+
+	// the min counts of every class, then any character of the classes, shuffled
+	var r, all []rune
+	seen := make(map[rune]bool)
+	for _, c := range p.Classes {
+		a := p.alphabet(c)
+		for _, v := range a {
+			if !seen[v] {
+				seen[v] = true
+				all = append(all, v)
+			}
+		}
+		for i := 0; i < c.Min; i++ {
+			n, err := randomInt(len(a))
+			if err != nil {
+				return "", err
+			}
+			r = append(r, a[n])
+		}
+	}
+	for len(r) < p.Length {
+		n, err := randomInt(len(all))
+		if err != nil {
+			return "", err
+		}
+		r = append(r, all[n])
+	}
+	for i := len(r) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r), nil
+}
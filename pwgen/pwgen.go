@@ -0,0 +1,258 @@
+// named password policies, the generation of passwords from them and the history of generated passwords
+package pwgen
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+
+	"goimport.moetang.info/nekoq-security/config"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+)
+
+const (
+	moduleName = "password_policy"
+	namespace  = "sys.password_policy"
+
+	// DefaultPolicyName is used when no policy is referred to. Without a stored policy of that name, it is
+	// DefaultPolicy.
+	DefaultPolicyName = "default"
+
+	// a history hit of a random password means a weak policy, retrying forever would hang the rotation
+	maxAttempts = 10
+)
+
+var (
+	ErrPolicyNotFound = errors.New("password policy not found")
+	ErrHistoryFull    = errors.New("no password outside of the history, the policy is too weak")
+)
+
+var (
+	policyKeyPrefix  = []byte("policy.")
+	historyKeyPrefix = []byte("history.")
+)
+
+var container *config.NekoQSecurityContainer
+
+type pwgenModuleType struct {
+}
+
+func (p pwgenModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	return nil
+}
+
+func (p pwgenModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	initRoutes(scaffold.GetGin())
+	return nil
+}
+
+var pwgenModule config.Module = pwgenModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, pwgenModule)
+}
+
+func makePolicyKey(name string) []byte {
+	return append(append([]byte{}, policyKeyPrefix...), []byte(name)...)
+}
+
+func makeHistoryKey(scope string) []byte {
+	return append(append([]byte{}, historyKeyPrefix...), []byte(scope)...)
+}
+
+func decryptPolicy(b []byte) (*Policy, error) {
+	p := new(Policy)
+	if err := container.OpenJSON(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPolicy returns the named policy, or the default policy for an empty name
+func LoadPolicy(name string) (*Policy, error) {
+	if len(name) == 0 {
+		name = DefaultPolicyName
+	}
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makePolicyKey(name))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		if name == DefaultPolicyName {
+			p := DefaultPolicy
+			return &p, nil
+		}
+		return nil, ErrPolicyNotFound
+	}
+	return decryptPolicy(b)
+}
+
+func listPolicies() ([]*Policy, error) {
+	var r []*Policy
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		return bucket.ForEachWithPrefix(policyKeyPrefix, func(k, v []byte) error {
+			p, err := decryptPolicy(v)
+			if err != nil {
+				return err
+			}
+			r = append(r, p)
+			return nil
+		})
+	})
+	return r, err
+}
+
+func savePolicy(ctx context.Context, p *Policy) error {
+	b, err := container.SealJSON(p)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makePolicyKey(p.Name), b)
+	})
+}
+
+func deletePolicy(ctx context.Context, name string) error {
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return bucket.Delete(makePolicyKey(name))
+	})
+}
+
+// historyEntry is a salted hash of a generated password
+type historyEntry struct {
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+}
+
+func hashPassword(salt []byte, password string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newHistoryEntry(password string) (historyEntry, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return historyEntry{}, err
+	}
+	return historyEntry{Salt: hex.EncodeToString(salt), Hash: hashPassword(salt, password)}, nil
+}
+
+func (e historyEntry) matches(password string) bool {
+	salt, err := hex.DecodeString(e.Salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPassword(salt, password)), []byte(e.Hash)) == 1
+}
+
+func loadHistory(scope string) ([]historyEntry, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makeHistoryKey(scope))
+		return nil
+	})
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	var r []historyEntry
+	if err := container.OpenJSON(b, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func saveHistory(ctx context.Context, scope string, history []historyEntry) error {
+	b, err := container.SealJSON(history)
+	if err != nil {
+		return err
+	}
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makeHistoryKey(scope), b)
+	})
+}
+
+// ForgetHistory deletes the history of the scopes starting with prefix, e.g. of a deleted instance
+func ForgetHistory(ctx context.Context, prefix string) error {
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		var keys [][]byte
+		err := bucket.ForEachWithPrefix(makeHistoryKey(prefix), func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Generate returns a password of the named policy, of the default policy when name is empty.
+// With a scope, e.g. pg/db1/master/app, the password is none of previous nor of the last passwords
+// of the scope kept by the history of the policy, and it is added to the history.
+func Generate(ctx context.Context, name, scope string, previous ...string) (string, error) {
+	p, err := LoadPolicy(name)
+	if err != nil {
+		return "", err
+	}
+	var history []historyEntry
+	if len(scope) > 0 && p.History > 0 {
+		if history, err = loadHistory(scope); err != nil {
+			return "", err
+		}
+	}
+	for i := 0; i < maxAttempts; i++ {
+		password, err := p.Generate()
+		if err != nil {
+			return "", err
+		}
+		if used(password, previous, history) {
+			continue
+		}
+		if len(scope) == 0 || p.History == 0 {
+			return password, nil
+		}
+		e, err := newHistoryEntry(password)
+		if err != nil {
+			return "", err
+		}
+		history = append(history, e)
+		if len(history) > p.History {
+			history = history[len(history)-p.History:]
+		}
+		if err := saveHistory(ctx, scope, history); err != nil {
+			return "", err
+		}
+		return password, nil
+	}
+	return "", ErrHistoryFull
+}
+
+func used(password string, previous []string, history []historyEntry) bool {
+	for _, v := range previous {
+		if v == password {
+			return true
+		}
+	}
+	for _, e := range history {
+		if e.matches(password) {
+			return true
+		}
+	}
+	return false
+}
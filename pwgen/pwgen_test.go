@@ -0,0 +1,98 @@
+package pwgen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWordlist(t *testing.T) {
+	if len(words) != 7776 {
+		t.Fatal("wordlist length:", len(words))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := map[string]struct {
+		policy Policy
+		valid  bool
+	}{
+		"default":       {DefaultPolicy, true},
+		"short":         {Policy{Length: 7, Classes: []CharClass{{Class: ClassLower}}}, false},
+		"no class":      {Policy{Length: 16}, false},
+		"unknown class": {Policy{Length: 16, Classes: []CharClass{{Class: "emoji"}}}, false},
+		"custom chars":  {Policy{Length: 16, Classes: []CharClass{{Class: "hex", Chars: "0123456789abcdef"}}}, true},
+		"quote chars":   {Policy{Length: 16, Classes: []CharClass{{Class: "q", Chars: "ab'"}}}, false},
+		"mins exceed":   {Policy{Length: 8, Classes: []CharClass{{Class: ClassLower, Min: 5}, {Class: ClassDigit, Min: 4}}}, false},
+		"all excluded":  {Policy{Length: 8, Classes: []CharClass{{Class: "x", Chars: "01"}}, ExcludeAmbiguous: true}, false},
+		"diceware":      {Policy{Mode: ModeDiceware, Words: 6}, true},
+		"few words":     {Policy{Mode: ModeDiceware, Words: 3}, false},
+		"space sep":     {Policy{Mode: ModeDiceware, Words: 6, Separator: " "}, false},
+		"history":       {Policy{Mode: ModeDiceware, Words: 6, History: 101}, false},
+		"unknown mode":  {Policy{Mode: "pin", Length: 8}, false},
+	}
+	for name, c := range cases {
+		err := c.policy.Validate()
+		if (err == nil) != c.valid {
+			t.Error(name, err)
+		}
+	}
+}
+
+func TestGenerateCharacters(t *testing.T) {
+	p := Policy{Length: 12, ExcludeAmbiguous: true, Exclude: "abc", Classes: []CharClass{
+		{Class: ClassLower, Min: 3},
+		{Class: ClassUpper, Min: 3},
+		{Class: ClassDigit, Min: 3},
+		{Class: ClassSymbol, Min: 3},
+	}}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		password, err := p.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(password) != p.Length {
+			t.Fatal("length:", password)
+		}
+		if strings.ContainsAny(password, forbiddenChars+ambiguousChars+p.Exclude) {
+			t.Fatal("excluded character:", password)
+		}
+		for _, c := range p.Classes {
+			n := 0
+			for _, v := range password {
+				if strings.ContainsRune(classChars[c.Class], v) {
+					n++
+				}
+			}
+			if n != c.Min {
+				t.Fatal("class", c.Class, "of", password)
+			}
+		}
+	}
+}
+
+func TestGenerateDiceware(t *testing.T) {
+	p := Policy{Mode: ModeDiceware, Words: 5, Separator: "."}
+	password, err := p.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.Split(password, ".")) != 5 {
+		t.Fatal(password)
+	}
+}
+
+func TestUsed(t *testing.T) {
+	e, err := newHistoryEntry("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.matches("p1") || e.matches("p2") {
+		t.Fatal("matches")
+	}
+	if !used("p0", []string{"p0"}, nil) || !used("p1", nil, []historyEntry{e}) || used("p2", []string{"p0"}, []historyEntry{e}) {
+		t.Fatal("used")
+	}
+}
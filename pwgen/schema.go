@@ -0,0 +1,28 @@
+package pwgen
+
+import (
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+const policyNamePattern = "^[A-Za-z0-9_.-]+$"
+
+func init() {
+	openapi.RegisterSchema("PasswordPolicy", openapi.Object(map[string]*openapi.Schema{
+		"name": openapi.String().Match(policyNamePattern),
+		"mode": openapi.String().OneOf(ModeCharacters, ModeDiceware),
+		"length": openapi.Integer().Range(8, 256).
+			Describe("characters: whitespaces, quotes and backslashes are never generated"),
+		"classes": openapi.Array(openapi.Object(map[string]*openapi.Schema{
+			"class": openapi.String().Describe("lower, upper, digit, symbol, or the name of chars"),
+			"chars": openapi.String().Describe("instead of the characters of the class"),
+			"min":   openapi.Integer().Min(0),
+		}).Require("class")),
+		"exclude_ambiguous": openapi.Boolean().Describe("characters: without 0Oo1lI|"),
+		"exclude":           openapi.String().Describe("characters: never generated"),
+		"words":             openapi.Integer().Range(4, 20).Describe("diceware: count of words of the EFF large wordlist"),
+		"separator":         openapi.String().Describe("diceware: between the words, - by default"),
+		"history":           openapi.Integer().Range(0, 100).Describe("last passwords of a user which are not generated again"),
+	}).Require("name"))
+}
+
+var policyNameParam = map[string]*openapi.Schema{"name": openapi.String().Match(policyNamePattern)}
@@ -0,0 +1,140 @@
+// OpenTelemetry tracing of requests, storage transactions, encryption and database calls
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+
+	instrumentationName = "goimport.moetang.info/nekoq-security"
+)
+
+type Config struct {
+	Exporter    string  `toml:"exporter"`     // none, stdout or otlp
+	Endpoint    string  `toml:"endpoint"`     // otlp grpc collector, localhost:4317 when empty
+	Insecure    bool    `toml:"insecure"`     // plain text connection to the collector
+	SampleRatio float64 `toml:"sample_ratio"` // of the traces started here, 1 when 0
+}
+
+func (tc *Config) Validate() error {
+	switch tc.Exporter {
+	case "":
+		tc.Exporter = ExporterNone
+	case ExporterNone, ExporterStdout, ExporterOTLP:
+	default:
+		return errors.New("unknown tracing exporter")
+	}
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		return errors.New("tracing sample_ratio must be between 0 and 1")
+	}
+	if tc.SampleRatio == 0 {
+		tc.SampleRatio = 1
+	}
+	return nil
+}
+
+// Init installs the global tracer provider. Spans are dropped without exporter.
+func Init(tc *Config) error {
+	var exporter sdktrace.SpanExporter
+	switch tc.Exporter {
+	case ExporterStdout:
+		e, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return err
+		}
+		exporter = e
+	case ExporterOTLP:
+		var opts []otlptracegrpc.Option
+		if len(tc.Endpoint) > 0 {
+			opts = append(opts, otlptracegrpc.WithEndpoint(tc.Endpoint))
+		}
+		if tc.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		// connects in the background, spans are dropped while the collector is unreachable
+		e, err := otlptracegrpc.New(context.Background(), opts...)
+		if err != nil {
+			return err
+		}
+		exporter = e
+	default:
+		return nil
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tc.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("nekoq-security"))),
+	))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return nil
+}
+
+// Start starts a span, child of the span of ctx if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, marking it failed when err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Middleware starts the span of the request, continuing the trace of the traceparent header.
+// Handlers find it in the context of the request.
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		parent := otel.GetTextMapPropagator().Extract(ctx.Request.Context(), propagation.HeaderCarrier(ctx.Request.Header))
+		route := ctx.FullPath()
+		if len(route) == 0 {
+			route = "unmatched"
+		}
+		spanCtx, span := otel.Tracer(instrumentationName).Start(parent, ctx.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(ctx.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(ctx.Request.URL.Path),
+				attribute.String("nekoq.request_id", apierr.RequestIdOf(ctx)),
+			))
+		ctx.Request = ctx.Request.WithContext(spanCtx)
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+// Inject adds the traceparent of ctx to the headers of an outgoing request
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
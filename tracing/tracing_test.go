@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.Use(Middleware())
+	e.GET("/v1/pg/instances/:id", func(ctx *gin.Context) {
+		_, span := Start(ctx.Request.Context(), "storage.tx")
+		End(span, nil)
+		ctx.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/pg/instances/db1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatal(len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.Name() != "GET /v1/pg/instances/:id" || child.Name() != "storage.tx" {
+		t.Fatal(server.Name(), child.Name())
+	}
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatal(server.SpanContext().TraceID())
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" || child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Fatal(server.Parent(), child.Parent())
+	}
+}
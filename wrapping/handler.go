@@ -0,0 +1,167 @@
+package wrapping
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/apierr"
+	"goimport.moetang.info/nekoq-security/auth"
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/logging"
+	"goimport.moetang.info/nekoq-security/openapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TTLQueryName asks for a wrapped response, valid for that many seconds
+const TTLQueryName = "wrap_ttl"
+
+func initRoutes(e *gin.Engine) {
+	// the wrapping token is the credential of these routes
+	g := openapi.NewGroup(e, "wrapping", "/wrapping", config.RequireUnsealed())
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/unwrap", Id: "unwrap", Public: true,
+		Summary: "the result of the wrapped response, once", Body: tokenSchema},
+		UnwrapHandler)
+	g.Handle(&openapi.Operation{Method: http.MethodPost, Path: "/lookup", Id: "lookupWrapping", Public: true,
+		Summary: "where and when the response was wrapped, without unwrapping it", Body: tokenSchema, Result: openapi.RefTo("WrapInfo")},
+		LookupHandler)
+}
+
+type tokenRequest struct {
+	Token string `json:"token"`
+}
+
+// WrapInfo is the result of a wrapped response
+type WrapInfo struct {
+	Token        string `json:"token,omitempty"`
+	LeaseId      string `json:"lease_id"`
+	TTL          int64  `json:"ttl"` // seconds left
+	CreationTime int64  `json:"creation_time"`
+	CreationPath string `json:"creation_path"`
+	ExpireAt     int64  `json:"expire_at"`
+	UnwrappedAt  int64  `json:"unwrapped_at,omitempty"`
+}
+
+func infoOf(e *Entry, now time.Time) *WrapInfo {
+	ttl := e.ExpireAt - now.Unix()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return &WrapInfo{
+		LeaseId:      e.LeaseId,
+		TTL:          ttl,
+		CreationTime: e.CreationTime,
+		CreationPath: e.CreationPath,
+		ExpireAt:     e.ExpireAt,
+		UnwrappedAt:  e.UnwrappedAt,
+	}
+}
+
+// ttlOf parses the wrap_ttl query, false when absent or invalid
+func ttlOf(v string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || time.Duration(n)*time.Second > MaxTTL {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Wrappable wraps the result of the handler when the request has a wrap_ttl. Errors are sent as they are.
+// It goes after authentication, the lease of the wrapping token is issued to the token of the request.
+func Wrappable() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ttl, ok := ttlOf(ctx.Query(TTLQueryName))
+		if !ok {
+			// invalid values are rejected by the validator
+			ctx.Next()
+			return
+		}
+		r := openapi.Record(ctx)
+		ctx.Next()
+		r.Stop(ctx)
+
+		result, ok := r.Result()
+		if !ok {
+			if err := r.Send(); err != nil {
+				logging.FromContext(ctx).Error("write response error", logging.Err(err))
+			}
+			return
+		}
+		accessor := ""
+		if t := auth.CurrentToken(ctx); t != nil {
+			accessor = t.Accessor
+		}
+		token, e, err := Wrap(ctx.Request.Context(), accessor, ctx.Request.URL.Path, result, ttl)
+		if err != nil {
+			logging.FromContext(ctx).Error("wrap response error", logging.Err(err))
+			apierr.Abort(ctx, apierr.Internal(err))
+			return
+		}
+		info := infoOf(e, time.Now())
+		info.Token = token
+		logging.FromContext(ctx).Info("response wrapped", logging.F("lease_id", e.LeaseId))
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"status": 0,
+			"result": gin.H{"wrap_info": info},
+		})
+	}
+}
+
+func UnwrapHandler(ctx *gin.Context) {
+	req := new(tokenRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	e, err := Unwrap(ctx.Request.Context(), req.Token, config.RemoteIP(ctx.Request))
+	switch err {
+	case nil:
+	case ErrTokenNotFound, ErrTokenExpired:
+		apierr.Abort(ctx, apierr.New(apierr.CodeNotFound, err.Error()))
+		return
+	case ErrAlreadyUnwrapped:
+		// the token was used by someone else, or is replayed. The first unwrap goes to the audit log
+		// as the cause, and is not disclosed.
+		logging.FromContext(ctx).Warn("wrapping token unwrapped twice", logging.F("lease_id", e.LeaseId),
+			logging.F("creation_path", e.CreationPath), logging.F("unwrapped_by", e.UnwrappedBy))
+		apierr.Abort(ctx, apierr.Wrap(apierr.CodeConflict, err.Error(),
+			fmt.Errorf("lease %s unwrapped at %d by %s", e.LeaseId, e.UnwrappedAt, e.UnwrappedBy)))
+		return
+	default:
+		logging.FromContext(ctx).Error("unwrap error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+	logging.FromContext(ctx).Info("response unwrapped", logging.F("lease_id", e.LeaseId))
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": e.Response,
+	})
+}
+
+func LookupHandler(ctx *gin.Context) {
+	req := new(tokenRequest)
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		apierr.Abort(ctx, apierr.Validation("parameter error"))
+		return
+	}
+	e, err := Lookup(req.Token)
+	if err == ErrTokenNotFound {
+		apierr.Abort(ctx, apierr.New(apierr.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("lookup wrapping token error", logging.Err(err))
+		apierr.Abort(ctx, apierr.Internal(err))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": 0,
+		"result": infoOf(e, time.Now()),
+	})
+}
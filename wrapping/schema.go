@@ -0,0 +1,26 @@
+package wrapping
+
+import (
+	"goimport.moetang.info/nekoq-security/openapi"
+)
+
+func init() {
+	openapi.RegisterSchema("WrapInfo", openapi.Object(map[string]*openapi.Schema{
+		"token":         openapi.String().Describe("single use, only in the wrapped response"),
+		"lease_id":      openapi.String().Describe("revoking the lease destroys the wrapped response"),
+		"ttl":           openapi.Integer().Describe("seconds left"),
+		"creation_time": openapi.Integer(),
+		"creation_path": openapi.String(),
+		"expire_at":     openapi.Integer(),
+		"unwrapped_at":  openapi.Integer(),
+	}))
+}
+
+var (
+	// Query of the operations whose result can be wrapped
+	Query = []*openapi.Parameter{{Name: TTLQueryName, Description: "wrap the result for that many seconds",
+		Schema: openapi.Integer().Range(1, int64(MaxTTL.Seconds()))}}
+	tokenSchema = openapi.Object(map[string]*openapi.Schema{
+		"token": openapi.String().NonEmpty(),
+	}).Require("token")
+)
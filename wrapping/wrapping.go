@@ -0,0 +1,206 @@
+// Response wrapping: a credential response is stored behind a single use token, unwrapped by its final consumer
+package wrapping
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+	"goimport.moetang.info/nekoq-security/lease"
+
+	scaffold "github.com/moetang/webapp-scaffold"
+)
+
+const (
+	moduleName = "wrapping"
+	namespace  = "sys.wrapping"
+
+	// wrapped responses are held by leases of this kind, whose data is the hash of the token
+	leaseKind = "wrapping"
+
+	tokenPrefix = "nqw."
+
+	MaxTTL = time.Hour
+)
+
+var (
+	ErrTokenNotFound    = errors.New("wrapping token not found")
+	ErrTokenExpired     = errors.New("wrapping token expired")
+	ErrAlreadyUnwrapped = errors.New("wrapping token already unwrapped")
+)
+
+var wrapKeyPrefix = []byte("wrap.")
+
+var container *config.NekoQSecurityContainer
+
+type wrappingModuleType struct {
+}
+
+func (w wrappingModuleType) SetupConfig(c *config.NekoQSecurityContainer) error {
+	container = c
+	return nil
+}
+
+func (w wrappingModuleType) InitWebScaffold(scaffold *scaffold.WebappScaffold) error {
+	initRoutes(scaffold.GetGin())
+	return nil
+}
+
+var wrappingModule config.Module = wrappingModuleType{}
+
+func init() {
+	config.RegisterModuleNamespace(moduleName, namespace, wrappingModule)
+	lease.RegisterExpiry(leaseKind, expireLease)
+}
+
+// Entry is a wrapped response. After the unwrap it is kept without the response until its lease ends,
+// so a second unwrap is told apart from an unknown token.
+type Entry struct {
+	LeaseId      string          `json:"lease_id"`
+	CreationPath string          `json:"creation_path"`
+	CreationTime int64           `json:"creation_time"`
+	ExpireAt     int64           `json:"expire_at"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	UnwrappedAt  int64           `json:"unwrapped_at,omitempty"`
+	UnwrappedBy  string          `json:"unwrapped_by,omitempty"` // remote address of the unwrap
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func makeWrapKey(hash string) []byte {
+	return append(append([]byte{}, wrapKeyPrefix...), []byte(hash)...)
+}
+
+func marshallAndEncEntry(e *Entry) ([]byte, error) {
+	return container.SealJSON(e)
+}
+
+func decAndUnmarshallEntry(b []byte) (*Entry, error) {
+	e := new(Entry)
+	if err := container.OpenJSON(b, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Wrap stores the response for ttl under a new token, which is only returned here. The lease is issued
+// to accessor, which can revoke it before the unwrap.
+func Wrap(ctx context.Context, accessor, path string, response []byte, ttl time.Duration) (string, *Entry, error) {
+	if ttl <= 0 || ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	hash := hashToken(token)
+	l := &lease.Lease{Data: map[string]string{"hash": hash}, Accessor: accessor}
+	if err := lease.Issue(ctx, leaseKind+"/", l, ttl, ttl); err != nil {
+		return "", nil, err
+	}
+	e := &Entry{
+		LeaseId:      l.Id,
+		CreationPath: path,
+		CreationTime: l.IssuedAt,
+		ExpireAt:     l.ExpireAt,
+		Response:     response,
+	}
+	b, err := marshallAndEncEntry(e)
+	if err != nil {
+		return "", nil, err
+	}
+	err = container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return bucket.Put(makeWrapKey(hash), b)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, e, nil
+}
+
+// Lookup returns the entry of the token without its response, and without using the token up
+func Lookup(token string) (*Entry, error) {
+	var b []byte
+	err := container.ViewWithinBucket(namespace, func(bucket *config.Bucket) error {
+		b = bucket.Get(makeWrapKey(hashToken(token)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrTokenNotFound
+	}
+	e, err := decAndUnmarshallEntry(b)
+	if err != nil {
+		return nil, err
+	}
+	e.Response = nil
+	return e, nil
+}
+
+// Unwrap returns the entry with its response once. Later calls return ErrAlreadyUnwrapped with the entry
+// of the first unwrap.
+func Unwrap(ctx context.Context, token, remoteAddr string) (*Entry, error) {
+	var e *Entry
+	var result error
+	err := container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		key := makeWrapKey(hashToken(token))
+		b := bucket.Get(key)
+		if len(b) == 0 {
+			result = ErrTokenNotFound
+			return nil
+		}
+		var err error
+		e, err = decAndUnmarshallEntry(b)
+		if err != nil {
+			return err
+		}
+		if e.UnwrappedAt > 0 {
+			result = ErrAlreadyUnwrapped
+			return nil
+		}
+		now := time.Now().Unix()
+		if now >= e.ExpireAt {
+			result = ErrTokenExpired
+			return nil
+		}
+		used := *e
+		used.Response = nil
+		used.UnwrappedAt = now
+		used.UnwrappedBy = remoteAddr
+		enc, err := marshallAndEncEntry(&used)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, enc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, result
+}
+
+// expireLease deletes the wrapped response, unwrapped or not
+func expireLease(ctx context.Context, l *lease.Lease) error {
+	return container.DoTxWithinBucketContext(ctx, namespace, func(bucket *config.Bucket) error {
+		return bucket.Delete(makeWrapKey(l.Data["hash"]))
+	})
+}
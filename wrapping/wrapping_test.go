@@ -0,0 +1,69 @@
+package wrapping
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"goimport.moetang.info/nekoq-security/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTTLOf(t *testing.T) {
+	cases := map[string]time.Duration{
+		"60":   time.Minute,
+		"3600": time.Hour,
+		"3601": 0,
+		"0":    0,
+		"-1":   0,
+		"1m":   0,
+		"":     0,
+	}
+	for v, expected := range cases {
+		ttl, ok := ttlOf(v)
+		if ttl != expected || ok != (expected > 0) {
+			t.Error(v, ttl, ok)
+		}
+	}
+}
+
+func TestUnwrapRecordsPeerAddress(t *testing.T) {
+	c, err := config.OpenTestConfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.POST("/unwrap", UnwrapHandler)
+
+	token, _, err := Wrap(context.Background(), "accessor", "/v1/pg/instances/db1/credentials", []byte(`{"a":1}`), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrap := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/unwrap", strings.NewReader(`{"token":"`+token+`"}`))
+		req.RemoteAddr = "203.0.113.5:4000"
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := unwrap(); code != http.StatusOK {
+		t.Fatal("unwrap failed:", code)
+	}
+	if code := unwrap(); code != http.StatusConflict {
+		t.Fatal("second unwrap:", code)
+	}
+	entry, err := Lookup(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.UnwrappedBy != "203.0.113.5" || len(entry.Response) > 0 {
+		t.Fatal(entry.UnwrappedBy)
+	}
+}